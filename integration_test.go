@@ -1,6 +1,9 @@
 package main
 
 import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -169,48 +172,8 @@ func TestIntegration(t *testing.T) {
 
 	// 7. Scenario: Running from Store Directory (Headless)
 	t.Log("--- Scenario 5: Headless Operations (From Store) ---")
-	// cd storeDir
-	// Run snapshots - needs --store .
-	// Note: since we use project name, snapshots list might need handling?
-	// `BackupRoots` lists `StoreSnapshots/ProjectName` IF `b.ProjectName` set.
-	// If we run `backup-cli --store .`, `b.ProjectName` is empty (no config).
-	// So `BackupRoots` lists `StoreSnapshots/*.
-	// Wait, internal structure: `StoreSnapshots` contains "integration-test-proj/" directory.
-	// `BackupRoots` iterates `StoreSnapshots`.
-	// Does it recursively find snapshots?
-	// `backup.go`:
-	// ```
-	// 	searchDir := b.StoreSnapshots
-	// 	if b.ProjectName != "" {
-	// 		searchDir = filepath.Join(...)
-	// 	}
-	// 	files, err := os.ReadDir(searchDir)
-	// ```
-	// If ProjectName is empty, it reads `StoreSnapshots`.
-	// It sees "integration-test-proj" directory.
-	// `NewBackupRoot(b, .../integration-test-proj)` -> fails time parsing.
-	// Result: `snapshots` command lists nothing or warns.
-	// Manual verification: "Warning: skipped invalid backup head integration-test-proj".
-	// This means headless listing of named projects behaves poorly if name not provided via config/flag.
-	// But we removed the flag.
-	// So user MUST use config? BUT config is in source.
-	// Use case: Admin going into store to inspect.
-	// They don't have project name easily?
-	// Maybe `BackupRoots` should look into subdirs if it sees directories?
-	// Or we accept this limitation: headless requires pointing to projectsubdir?
-	// Or `backup-cli --store ./snapshots/integration-test-proj` ? (using store root as the project snapshot root).
-	// `StoreRoot` expects `data` and `snapshots` inside.
-
-	// Let's test the limitation/behavior as is.
-	// Actually, `FindBackupRoot` supports "proj/timestamp".
-	// But `snapshots` command calls `BackupRoots()` which lists `searchDir`.
-	// If we want to list snapshots for a project headless:
-	// We can't currently without config.
-	// We might need to add back `--name` flag later?
-	// OR: `backup-cli` should maybe auto-discover projects?
-	// Let's stick to what we have:
-	// Try `restore` with explicit project path "integration-test-proj/<snap2>".
-
+	// Without a project (see Scenario 55 for --project), snapshots are
+	// named with their project: "proj/timestamp".
 	targetRestore := filepath.Join(tempDir, "restore_from_store")
 	fullSnapID := projectName + "/" + snapshot2
 
@@ -290,21 +253,12 @@ func TestIntegration(t *testing.T) {
 
 	// 10. Scenario: Integrity Check (Corrupted)
 	t.Log("--- Scenario 10: Integrity Check (Corrupted) ---")
-	// Find a blob to delete
-	// We know blobs are in store/data/xx/xxxxxxxx...
-	// Let's find one.
-	dataPath := filepath.Join(storeDir, "data")
-	foundBlob := ""
-	filepath.Walk(dataPath, func(path string, info os.FileInfo, err error) error {
-		if !info.IsDir() && strings.HasSuffix(path, ".gz") {
-			foundBlob = path
-			return filepath.SkipAll
-		}
-		return nil
-	})
-
-	if foundBlob == "" {
-		t.Fatal("No blobs found to corrupt")
+	// Pick the content blob of file1.txt: a file, so that the shallow check
+	// does not read it, unlike a directory listing
+	file1Hash := fmt.Sprintf("%x", md5.Sum([]byte("v1-content1")))
+	foundBlob := filepath.Join(storeDir, "data", file1Hash[:2], file1Hash+".gz")
+	if _, err := os.Stat(foundBlob); err != nil {
+		t.Fatalf("No blob of file1.txt to corrupt: %v", err)
 	}
 
 	// Move blob to backup location to restore later? No need, just basic test.
@@ -359,7 +313,7 @@ func TestIntegration(t *testing.T) {
 	if strings.Contains(out, "Store integrity check passed") {
 		t.Error("Deep check passed despite corruption")
 	}
-	if !strings.Contains(out, "corrupted blob") && !strings.Contains(out, "gzip error") && !strings.Contains(out, "hash mismatch") {
+	if !strings.Contains(out, "corrupted blob") && !strings.Contains(out, "decoding error") && !strings.Contains(out, "hash mismatch") {
 		t.Errorf("Deep check didn't report corruption. Got: %s", out)
 	}
 
@@ -407,7 +361,14 @@ func TestIntegration(t *testing.T) {
 	// Create a backup from yesterday
 	yesterday := time.Now().Add(-25 * time.Hour)
 	tStamp := yesterday.Format("060102-150405")
-	os.WriteFile(filepath.Join(proj2Dir, tStamp), []byte("dummyhash"), 0644)
+	// Point it at an existing tree: prune refuses to run while a snapshot
+	// references a missing directory listing
+	projHeads, _ := os.ReadDir(filepath.Join(storeDir, "snapshots", "integration-test-proj"))
+	if len(projHeads) == 0 {
+		t.Fatal("Expected snapshots of integration-test-proj")
+	}
+	existingHead, _ := os.ReadFile(filepath.Join(storeDir, "snapshots", "integration-test-proj", projHeads[0].Name()))
+	os.WriteFile(filepath.Join(proj2Dir, tStamp), existingHead, 0644)
 
 	out = run(storeDir, "status")
 	if !strings.Contains(out, "older-project") {
@@ -580,8 +541,8 @@ func TestIntegration(t *testing.T) {
 	configContentStr = fmt.Sprintf("store = \"%s\"\nname = \"ignore-test\"\n", filepath.ToSlash(ignoreStoreDir))
 	os.WriteFile(filepath.Join(ignoreDir, ".backup", "config.toml"), []byte(configContentStr), 0644)
 
-	// Run Backup
-	cmd = exec.Command(binPath, "backup")
+	// Run Backup, listing the archived files
+	cmd = exec.Command(binPath, "--verbose", "backup")
 	// Let's run from dir
 	cmd.Dir = ignoreDir
 	outBytes, err = cmd.CombinedOutput()
@@ -1078,6 +1039,873 @@ func TestIntegration(t *testing.T) {
 		t.Errorf("Expected invalid store error, got: %s", string(outBytes))
 	}
 
+	// 30. Scenario: SHA-256 Store
+	t.Log("--- Scenario 30: SHA-256 Store ---")
+	shaStore := filepath.Join(tempDir, "sha_store")
+	shaSrc := filepath.Join(tempDir, "sha_src")
+	run(tempDir, "init-store", "--hash", "sha256", shaStore)
+	run(tempDir, "init", "--store", shaStore, "--project", "sha-proj", shaSrc)
+	os.MkdirAll(filepath.Join(shaSrc, "dir with space"), 0755)
+	os.WriteFile(filepath.Join(shaSrc, "dir with space", "a file.txt"), []byte("sha content"), 0644)
+
+	out = run(shaSrc, "create")
+	shaSnap := parseSnapshotID(t, out)
+	head, err := os.ReadFile(filepath.Join(shaStore, "snapshots", "sha-proj", shaSnap))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(strings.TrimSpace(string(head))); got != 64 {
+		t.Errorf("Expected 64 char sha256 head hash, got %d", got)
+	}
+	out = run(shaSrc, "check", "--deep")
+	if !strings.Contains(out, "Store integrity check passed") {
+		t.Errorf("Deep check failed on sha256 store: %s", out)
+	}
+	shaRestore := filepath.Join(tempDir, "sha_restore")
+	run(shaSrc, "restore", shaSnap, ".", shaRestore)
+	if content, err := os.ReadFile(filepath.Join(shaRestore, "dir with space", "a file.txt")); err != nil || string(content) != "sha content" {
+		t.Errorf("Restore from sha256 store failed: %v %q", err, content)
+	}
+
+	// 31. Scenario: Restore Modification Times
+	t.Log("--- Scenario 31: Restore Modification Times ---")
+	oldTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.Local)
+	timesDir := filepath.Join(shaSrc, "times")
+	os.MkdirAll(timesDir, 0755)
+	timesFile := filepath.Join(timesDir, "old.txt")
+	os.WriteFile(timesFile, []byte("old"), 0644)
+	os.Chtimes(timesFile, oldTime, oldTime)
+	os.Chtimes(timesDir, oldTime, oldTime)
+
+	out = run(shaSrc, "create")
+	timesSnap := parseSnapshotID(t, out)
+
+	timesRestore := filepath.Join(tempDir, "times_restore")
+	run(shaSrc, "restore", "--preserve-times", timesSnap, "times", timesRestore)
+	for _, p := range []string{timesRestore, filepath.Join(timesRestore, "old.txt")} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Errorf("Restored path missing: %v", err)
+		} else if !info.ModTime().Equal(oldTime) {
+			t.Errorf("Modification time of %s not restored: got %v, want %v", p, info.ModTime(), oldTime)
+		}
+	}
+
+	// Without the flag restored content gets the current time
+	plainRestore := filepath.Join(tempDir, "times_restore_plain")
+	run(shaSrc, "restore", timesSnap, "times", plainRestore)
+	if info, err := os.Stat(filepath.Join(plainRestore, "old.txt")); err != nil || info.ModTime().Equal(oldTime) {
+		t.Errorf("Plain restore should not preserve modification times")
+	}
+
+	// 32. Scenario: JSON Output
+	t.Log("--- Scenario 32: JSON Output ---")
+	var snapList []struct {
+		Project   string `json:"project"`
+		Timestamp string `json:"timestamp"`
+		Hash      string `json:"hash"`
+	}
+	out = run(shaSrc, "--json", "list")
+	if err := json.Unmarshal([]byte(out), &snapList); err != nil {
+		t.Fatalf("list --json is not valid JSON: %v\n%s", err, out)
+	}
+	if len(snapList) != 2 || snapList[1].Project != "sha-proj" || snapList[1].Timestamp != timesSnap || len(snapList[1].Hash) != 64 {
+		t.Errorf("Unexpected list --json output: %+v", snapList)
+	}
+
+	os.WriteFile(filepath.Join(shaSrc, "new.txt"), []byte("new"), 0644)
+	var statusReport struct {
+		Files    int            `json:"files"`
+		Counters map[string]int `json:"counters"`
+		Entries  []struct {
+			Status string `json:"status"`
+			Path   string `json:"path"`
+		} `json:"entries"`
+	}
+	out = run(shaSrc, "--json", "status")
+	if err := json.Unmarshal([]byte(out), &statusReport); err != nil {
+		t.Fatalf("status --json is not valid JSON: %v\n%s", err, out)
+	}
+	foundNew := false
+	for _, e := range statusReport.Entries {
+		if e.Path == "new.txt" && e.Status == "N" {
+			foundNew = true
+		}
+	}
+	if !foundNew || statusReport.Counters["N"] != 1 {
+		t.Errorf("status --json missing new file: %s", out)
+	}
+	os.Remove(filepath.Join(shaSrc, "new.txt"))
+
+	var projects []struct {
+		Name       string `json:"name"`
+		AgeSeconds int64  `json:"ageSeconds"`
+	}
+	out = run(shaStore, "--json", "status")
+	if err := json.Unmarshal([]byte(out), &projects); err != nil {
+		t.Fatalf("headless status --json is not valid JSON: %v\n%s", err, out)
+	}
+	if len(projects) != 1 || projects[0].Name != "sha-proj" {
+		t.Errorf("Unexpected headless status --json output: %s", out)
+	}
+
+	// 33. Scenario: Forget by Retention Policy
+	t.Log("--- Scenario 33: Forget by Retention Policy ---")
+	headContent, err := os.ReadFile(filepath.Join(shaStore, "snapshots", "sha-proj", timesSnap))
+	if err != nil {
+		t.Fatalf("Failed to read snapshot head: %v", err)
+	}
+	forgetDir := filepath.Join(shaStore, "snapshots", "forget-proj")
+	os.MkdirAll(forgetDir, 0755)
+	for _, name := range []string{"250101-120000", "250115-120000", "250201-090000", "250201-100000"} {
+		os.WriteFile(filepath.Join(forgetDir, name), headContent, 0644)
+	}
+
+	out = run(shaStore, "forget", "--project", "forget-proj", "--keep-daily", "1", "--keep-monthly", "2", "--dry-run")
+	if !strings.Contains(out, "[dry-run] Would remove forget-proj/250201-090000") || !strings.Contains(out, "[dry-run] Would remove forget-proj/250101-120000") {
+		t.Errorf("forget --dry-run did not list removals: %s", out)
+	}
+	if !strings.Contains(out, "forget-proj/250201-100000 (daily, monthly)") || !strings.Contains(out, "forget-proj/250115-120000 (monthly)") {
+		t.Errorf("forget --dry-run did not list kept snapshots with reasons: %s", out)
+	}
+	if _, err := os.Stat(filepath.Join(forgetDir, "250101-120000")); err != nil {
+		t.Errorf("forget --dry-run removed a snapshot")
+	}
+
+	out = run(shaStore, "forget", "--project", "forget-proj", "--keep-daily", "1", "--keep-monthly", "2")
+	for name, keep := range map[string]bool{"250101-120000": false, "250115-120000": true, "250201-090000": false, "250201-100000": true} {
+		_, err := os.Stat(filepath.Join(forgetDir, name))
+		if keep && err != nil {
+			t.Errorf("forget removed kept snapshot %s", name)
+		}
+		if !keep && !os.IsNotExist(err) {
+			t.Errorf("forget did not remove snapshot %s", name)
+		}
+	}
+	if !strings.Contains(out, "Pruned") {
+		t.Errorf("forget did not prune: %s", out)
+	}
+	if _, err := os.Stat(filepath.Join(shaStore, "snapshots", "sha-proj", timesSnap)); err != nil {
+		t.Errorf("forget touched another project")
+	}
+	cmd = exec.Command(binPath, "forget", "forget-proj/250201-100000")
+	cmd.Dir = shaStore
+	outBytes, err = cmd.CombinedOutput()
+	out = string(outBytes)
+	if err == nil || !strings.Contains(out, "use 'backup remove forget-proj/250201-100000'") {
+		t.Errorf("forget with a snapshot argument should point to remove: %v %s", err, out)
+	}
+	if _, err := os.Stat(filepath.Join(forgetDir, "250201-100000")); err != nil {
+		t.Errorf("forget with a snapshot argument removed a snapshot")
+	}
+
+	// 34. Scenario: Leftover Partial Files
+	t.Log("--- Scenario 34: Leftover Partial Files ---")
+	partialFile := filepath.Join(shaStore, "data", "00", "leftover.gz.partial")
+	os.MkdirAll(filepath.Dir(partialFile), 0755)
+	os.WriteFile(partialFile, []byte("interrupted"), 0644)
+	out = run(shaSrc, "check")
+	if !strings.Contains(out, "Warning: leftover partial file") || !strings.Contains(out, "Store integrity check passed") {
+		t.Errorf("check did not warn about partial file: %s", out)
+	}
+	out = run(shaSrc, "check", "--clean-partials")
+	if !strings.Contains(out, "Removed 1 leftover partial files") || strings.Contains(out, "Warning: leftover partial file") {
+		t.Errorf("check --clean-partials did not remove partial file: %s", out)
+	}
+	if _, err := os.Stat(partialFile); !os.IsNotExist(err) {
+		t.Errorf("Partial file still exists after check --clean-partials")
+	}
+
+	// 35. Scenario: Dry-Run Restore
+	t.Log("--- Scenario 35: Dry-Run Restore ---")
+	dryRestore := filepath.Join(tempDir, "dry_restore")
+	os.MkdirAll(dryRestore, 0755)
+	os.WriteFile(filepath.Join(dryRestore, "old.txt"), []byte("keep me"), 0644)
+	out = run(shaSrc, "restore", "--dry-run", timesSnap, "times", dryRestore)
+	if !strings.Contains(out, "Would restore "+filepath.Join(dryRestore, "old.txt")+" (exists)") {
+		t.Errorf("restore --dry-run did not flag existing file: %s", out)
+	}
+	if !strings.Contains(out, "2 paths, 2 already exist") {
+		t.Errorf("restore --dry-run summary wrong: %s", out)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dryRestore, "old.txt")); string(content) != "keep me" {
+		t.Errorf("restore --dry-run overwrote a file")
+	}
+
+	// 36. Scenario: Restore Refuses to Overwrite Without --force
+	t.Log("--- Scenario 36: Restore Refuses to Overwrite Without --force ---")
+	cmd = exec.Command(binPath, "restore", timesSnap, "times", dryRestore)
+	cmd.Dir = shaSrc
+	outBytes, err = cmd.CombinedOutput()
+	if err == nil {
+		t.Errorf("restore over existing files should fail without --force: %s", outBytes)
+	}
+	if !strings.Contains(string(outBytes), filepath.Join(dryRestore, "old.txt")) {
+		t.Errorf("restore did not list the conflicting path: %s", outBytes)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dryRestore, "old.txt")); string(content) != "keep me" {
+		t.Errorf("restore without --force overwrote a file")
+	}
+	run(shaSrc, "restore", "--force", timesSnap, "times", dryRestore)
+	if content, _ := os.ReadFile(filepath.Join(dryRestore, "old.txt")); string(content) != "old" {
+		t.Errorf("restore --force did not overwrite the file, got %q", content)
+	}
+
+	// 37. Scenario: Cat a File From a Snapshot
+	t.Log("--- Scenario 37: Cat a File From a Snapshot ---")
+	out = run(shaSrc, "cat", timesSnap, "times/old.txt")
+	if out != "old" {
+		t.Errorf("cat printed %q, expected %q", out, "old")
+	}
+	cmd = exec.Command(binPath, "cat", timesSnap, "times")
+	cmd.Dir = shaSrc
+	outBytes, err = cmd.CombinedOutput()
+	if err == nil || !strings.Contains(string(outBytes), "is a directory") {
+		t.Errorf("cat of a directory should fail: %s", outBytes)
+	}
+
+	// 38. Scenario: Empty Directories Round-Trip
+	t.Log("--- Scenario 38: Empty Directories Round-Trip ---")
+	os.MkdirAll(filepath.Join(shaSrc, "emptydir", "nested"), 0755)
+	out = run(shaSrc, "create")
+	emptySnap := parseSnapshotID(t, out)
+	out = run(shaSrc, "tree", emptySnap)
+	if !strings.Contains(out, "emptydir/") || !strings.Contains(out, "nested/") {
+		t.Errorf("tree does not show empty directories: %s", out)
+	}
+	out = run(shaSrc, "status")
+	if !strings.Contains(out, ". emptydir/") {
+		t.Errorf("status does not show empty directory as archived: %s", out)
+	}
+	emptyRestore := filepath.Join(tempDir, "empty_restore")
+	run(shaSrc, "restore", emptySnap, "emptydir", emptyRestore)
+	if info, err := os.Stat(filepath.Join(emptyRestore, "nested")); err != nil || !info.IsDir() {
+		t.Errorf("Empty directory was not restored: %v", err)
+	}
+
+	// 39. Scenario: Store Lock
+	t.Log("--- Scenario 39: Store Lock ---")
+	lockFile := filepath.Join(shaStore, ".backup", "lock")
+	os.WriteFile(lockFile, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644)
+	cmd = exec.Command(binPath, "create")
+	cmd.Dir = shaSrc
+	outBytes, err = cmd.CombinedOutput()
+	if err == nil || !strings.Contains(string(outBytes), fmt.Sprintf("store is locked by PID %d", os.Getpid())) {
+		t.Errorf("create should fail while the store is locked: %s", outBytes)
+	}
+	run(shaSrc, "list")
+	run(shaSrc, "status")
+	os.Remove(lockFile)
+	run(shaSrc, "create")
+	if _, err := os.Stat(lockFile); !os.IsNotExist(err) {
+		t.Errorf("create did not release the store lock: %v", err)
+	}
+
+	// 40. Scenario: Verify a Single Snapshot
+	t.Log("--- Scenario 40: Verify a Single Snapshot ---")
+	out = run(shaSrc, "verify-snapshot", "--deep", emptySnap)
+	if !strings.Contains(out, "Snapshot integrity check passed.") {
+		t.Errorf("verify-snapshot did not pass: %s", out)
+	}
+
+	// 41. Scenario: List Snapshot Sizes
+	t.Log("--- Scenario 41: List Snapshot Sizes ---")
+	out = run(shaSrc, "list", "--sizes")
+	if !strings.Contains(out, "B, ") || !strings.Contains(out, " files") {
+		t.Errorf("list --sizes does not show sizes: %s", out)
+	}
+	out = run(shaSrc, "--bytes", "list", "--sizes")
+	if !strings.Contains(out, " bytes, ") {
+		t.Errorf("list --sizes --bytes does not show plain byte counts: %s", out)
+	}
+	if _, err := os.Stat(filepath.Join(shaStore, ".backup", "size-cache")); err != nil {
+		t.Errorf("list --sizes did not write the size cache: %v", err)
+	}
+
+	// 42. Scenario: Export a Snapshot to Tar
+	t.Log("--- Scenario 42: Export a Snapshot to Tar ---")
+	tarPath := filepath.Join(tempDir, "export.tar.gz")
+	run(shaSrc, "export", timesSnap, tarPath)
+	if info, err := os.Stat(tarPath); err != nil || info.Size() == 0 {
+		t.Errorf("export did not write %s: %v", tarPath, err)
+	}
+
+	// 43. Scenario: Import a Tar Archive as a Snapshot
+	t.Log("--- Scenario 43: Import a Tar Archive as a Snapshot ---")
+	out = run(shaSrc, "import", "--project", "imported", tarPath)
+	importedSnap := parseSnapshotID(t, out)
+	out = run(shaSrc, "verify-snapshot", "--deep", "imported/"+importedSnap)
+	if !strings.Contains(out, "Snapshot integrity check passed.") {
+		t.Errorf("verify-snapshot of the imported snapshot did not pass: %s", out)
+	}
+	importedRestore := filepath.Join(tempDir, "imported_restore")
+	run(shaSrc, "restore", "imported/"+importedSnap, "times", importedRestore)
+	if content, err := os.ReadFile(filepath.Join(importedRestore, "old.txt")); err != nil || string(content) != "old" {
+		t.Errorf("Restore from the imported snapshot failed: %v %q", err, content)
+	}
+
+	// 44. Scenario: Repair Blobs From a Second Store
+	t.Log("--- Scenario 44: Repair Blobs From a Second Store ---")
+	mirrorStore := filepath.Join(tempDir, "mirror_store")
+	run(tempDir, "init-store", "--hash", "sha256", "--compression", "zstd", mirrorStore)
+	run(tempDir, "--store", mirrorStore, "import", "--project", "imported", tarPath)
+	oldHash := fmt.Sprintf("%x", sha256.Sum256([]byte("old")))
+	oldBlob := filepath.Join(shaStore, "data", oldHash[:2], oldHash+".gz")
+	if err := os.Remove(oldBlob); err != nil {
+		t.Fatal(err)
+	}
+	cmd = exec.Command(binPath, "check")
+	cmd.Dir = shaSrc
+	if outBytes, err := cmd.CombinedOutput(); err == nil || !strings.Contains(string(outBytes), "missing blob") {
+		t.Errorf("Expected check to report the missing blob: %s", outBytes)
+	}
+	// Combined with --clean-partials, the store lock is taken once
+	partial := filepath.Join(shaStore, "data", oldHash[:2], oldHash+".gz.1234.partial")
+	os.WriteFile(partial, []byte("partial"), 0644)
+	out = run(shaSrc, "check", "--deep", "--repair", "--clean-partials", "--from", mirrorStore)
+	if !strings.Contains(out, "Healed 1 blobs.") || !strings.Contains(out, "Store integrity check passed.") {
+		t.Errorf("check --repair did not heal the store: %s", out)
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("check --repair --clean-partials left the partial file: %v", err)
+	}
+
+	t.Log("--- Scenario 45: Snapshot Messages and Log ---")
+	os.WriteFile(filepath.Join(shaSrc, "note.txt"), []byte("note"), 0644)
+	run(shaSrc, "create", "-m", "add a note")
+	out = run(shaSrc, "log")
+	if !strings.Contains(out, "    add a note") || !strings.Contains(out, "Author: ") {
+		t.Errorf("log does not show the snapshot message: %s", out)
+	}
+	if strings.Index(out, "add a note") > strings.Index(out, timesSnap) {
+		t.Errorf("log is not newest first: %s", out)
+	}
+	out = run(shaSrc, "--json", "log")
+	if !strings.Contains(out, `"message": "add a note"`) {
+		t.Errorf("log --json does not include the message: %s", out)
+	}
+
+	t.Log("--- Scenario 46: Store Statistics ---")
+	out = run(shaSrc, "stats", "--top", "3")
+	if !strings.Contains(out, "Blobs:") || !strings.Contains(out, "imported") || !strings.Contains(out, "Most referenced blobs:") {
+		t.Errorf("stats output incomplete: %s", out)
+	}
+	out = run(shaSrc, "--json", "stats")
+	if !strings.Contains(out, `"reachable_blobs"`) {
+		t.Errorf("stats --json output incomplete: %s", out)
+	}
+	cmd = exec.Command(binPath, "stats", "--top", "-1")
+	cmd.Dir = shaSrc
+	if out, err := cmd.CombinedOutput(); err == nil || !strings.Contains(string(out), "--top must not be negative") {
+		t.Errorf("Expected stats to refuse a negative --top: %v %s", err, out)
+	}
+
+	t.Log("--- Scenario 47: Status Against an Older Snapshot ---")
+	out = run(shaSrc, "status", timesSnap)
+	if !strings.Contains(out, "Comparing with backup") || !strings.Contains(out, "n note.txt") {
+		t.Errorf("status against %s should show note.txt as new: %s", timesSnap, out)
+	}
+	out = run(shaSrc, "status")
+	if !strings.Contains(out, ". note.txt") {
+		t.Errorf("status against the latest snapshot should show note.txt as archived: %s", out)
+	}
+
+	t.Log("--- Scenario 48: Status Reports Deleted Files ---")
+	os.Remove(filepath.Join(shaSrc, "note.txt"))
+	out = run(shaSrc, "status")
+	if !strings.Contains(out, "D note.txt") {
+		t.Errorf("status should report the deleted note.txt: %s", out)
+	}
+
+	t.Log("--- Scenario 49: Store With Custom Sharding ---")
+	shardStore := filepath.Join(tempDir, "shard_store")
+	run(tempDir, "init-store", "--shard-width", "3", "--shard-depth", "2", shardStore)
+	run(tempDir, "--store", shardStore, "import", "--project", "imported", tarPath)
+	if blobs, _ := filepath.Glob(filepath.Join(shardStore, "data", "???", "???", "*.gz")); len(blobs) == 0 {
+		t.Error("Expected blobs two levels below data/")
+	}
+	out = run(tempDir, "--store", shardStore, "check", "--deep")
+	if !strings.Contains(out, "Store integrity check passed.") {
+		t.Errorf("check failed on a sharded store: %s", out)
+	}
+
+	t.Log("--- Scenario 50: Check Exit Codes ---")
+	checkExitCode := func() int {
+		cmd := exec.Command(binPath, "--store", shardStore, "check")
+		cmd.Dir = tempDir
+		err := cmd.Run()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return 0
+	}
+	orphanHash := fmt.Sprintf("%x", md5.Sum([]byte("orphan")))
+	orphanDir := filepath.Join(shardStore, "data", orphanHash[:3], orphanHash[3:6])
+	os.MkdirAll(orphanDir, 0755)
+	os.WriteFile(filepath.Join(orphanDir, orphanHash+".gz"), []byte("orphan"), 0644)
+	if code := checkExitCode(); code != 3 {
+		t.Errorf("Expected exit code 3 for unreferenced blobs only, got %d", code)
+	}
+	if blobs, _ := filepath.Glob(filepath.Join(shardStore, "data", "???", "???", "*.gz")); len(blobs) > 1 {
+		for _, blob := range blobs {
+			if !strings.Contains(blob, orphanHash) {
+				os.Remove(blob)
+				break
+			}
+		}
+	}
+	if code := checkExitCode(); code != 2 {
+		t.Errorf("Expected exit code 2 for a missing blob, got %d", code)
+	}
+
+	t.Log("--- Scenario 51: Remove Snapshots by Age ---")
+	out = run(shaSrc, "remove", "--older-than", "1d", "--dry-run")
+	if !strings.Contains(out, "No snapshots match the age filter.") {
+		t.Errorf("Expected no snapshot older than a day: %s", out)
+	}
+	out = run(shaSrc, "remove", "--newer-than", "1h", "--dry-run")
+	if !strings.Contains(out, "[dry-run] Would remove snapshot "+timesSnap) {
+		t.Errorf("Expected recent snapshots to be selected: %s", out)
+	}
+	if strings.Contains(out, "imported/") {
+		t.Errorf("Expected only snapshots of the current project: %s", out)
+	}
+
+	t.Log("--- Scenario 52: Find Files in Snapshots ---")
+	out = run(shaSrc, "find", "old.txt")
+	if !strings.Contains(out, ":times/old.txt") {
+		t.Errorf("find did not report times/old.txt: %s", out)
+	}
+	if n := strings.Count(out, "old.txt"); n != 1 {
+		t.Errorf("Expected the unchanged old.txt to be listed once, got %d: %s", n, out)
+	}
+	out = run(shaSrc, "find", "--latest", "*.txt")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	for _, line := range lines {
+		if snap := strings.SplitN(line, ":", 2)[0]; snap != strings.SplitN(lines[0], ":", 2)[0] {
+			t.Errorf("find --latest searched more than one snapshot: %s", out)
+			break
+		}
+	}
+
+	t.Log("--- Scenario 53: Locate a Blob by Hash ---")
+	out = run(shaSrc, "--json", "find", "old.txt")
+	var found []struct {
+		Hash string `json:"hash"`
+	}
+	if err := json.Unmarshal([]byte(out), &found); err != nil || len(found) != 1 {
+		t.Fatalf("Failed to parse find output (%v): %s", err, out)
+	}
+	out = run(shaSrc, "locate-hash", found[0].Hash)
+	if n := strings.Count(out, ":times/old.txt"); n < 2 {
+		t.Errorf("Expected old.txt to be located in every snapshot containing it, got %d: %s", n, out)
+	}
+	cmd = exec.Command(binPath, "locate-hash", "nothex")
+	cmd.Dir = shaSrc
+	if out, err := cmd.CombinedOutput(); err == nil || !strings.Contains(string(out), "invalid hash") {
+		t.Errorf("Expected locate-hash to reject an invalid hash: %s", out)
+	}
+
+	t.Log("--- Scenario 54: Sampled Deep Check ---")
+	out = run(shaStore, "check", "--sample", "50%", "--seed", "3")
+	if !strings.Contains(out, "(sample 50%, seed 3)") || !strings.Contains(out, "Store integrity check passed.") {
+		t.Errorf("Unexpected check --sample output: %s", out)
+	}
+	cmd = exec.Command(binPath, "check", "--sample", "0%")
+	cmd.Dir = shaStore
+	if out, err := cmd.CombinedOutput(); err == nil || !strings.Contains(string(out), "invalid percentage") {
+		t.Errorf("Expected check --sample 0%% to fail: %s", out)
+	}
+
+	t.Log("--- Scenario 55: Headless Project Selection ---")
+	out = run(storeDir, "--store", storeDir, "--project", projectName, "list")
+	if !strings.Contains(out, snapshot2) || strings.Contains(out, projectName+"/") {
+		t.Errorf("Expected list --project to show bare timestamps: %s", out)
+	}
+	targetRestore = filepath.Join(tempDir, "restore_from_store_project")
+	run(storeDir, "--store", storeDir, "--project", projectName, "restore", snapshot2, targetRestore)
+	if _, err := os.Stat(filepath.Join(targetRestore, "sub/file3.txt")); err != nil {
+		t.Errorf("Headless restore with --project failed: %v", err)
+	}
+	cmd = exec.Command(binPath, "--project", "other", "list")
+	cmd.Dir = srcDir
+	if out, err := cmd.CombinedOutput(); err == nil || !strings.Contains(string(out), "only applies when running from a store") {
+		t.Errorf("Expected --project to be rejected in a source directory: %s", out)
+	}
+
+	t.Log("--- Scenario 56: Rename a Project ---")
+	out = run(srcDir, "rename-project", "--dry-run", projectName, "renamed-proj")
+	if !strings.Contains(out, "[dry-run] Would rename project") {
+		t.Errorf("Unexpected dry-run output: %s", out)
+	}
+	run(srcDir, "rename-project", projectName, "renamed-proj")
+	if data, _ := os.ReadFile(filepath.Join(srcDir, ".backup", "config.toml")); !strings.Contains(string(data), `name = "renamed-proj"`) {
+		t.Errorf("config.toml was not updated: %s", data)
+	}
+	if out = run(srcDir, "list"); !strings.Contains(out, snapshot2) {
+		t.Errorf("Snapshots missing after rename: %s", out)
+	}
+	run(srcDir, "rename-project", "renamed-proj", projectName)
+	run(storeDir, "--store", storeDir, "rename-project", projectName, "renamed-proj")
+	if _, err := os.Stat(filepath.Join(storeDir, "snapshots", "renamed-proj", snapshot2)); err != nil {
+		t.Errorf("Renaming from the store failed: %v", err)
+	}
+	run(storeDir, "--store", storeDir, "rename-project", "renamed-proj", projectName)
+	if data, _ := os.ReadFile(filepath.Join(srcDir, ".backup", "config.toml")); !strings.Contains(string(data), `name = "`+projectName+`"`) {
+		t.Errorf("config.toml was not restored: %s", data)
+	}
+
+	t.Log("--- Scenario 57: Copy a Snapshot to Another Store ---")
+	offsiteStore := filepath.Join(tempDir, "offsite_store")
+	run(tempDir, "init-store", "--compression", "zstd", offsiteStore)
+	out = run(srcDir, "copy", "--dry-run", "--to", offsiteStore, snapshot2)
+	if !strings.Contains(out, "[dry-run] Would copy") {
+		t.Errorf("Unexpected copy --dry-run output: %s", out)
+	}
+	run(srcDir, "copy", "--to", offsiteStore, snapshot2)
+	out = run(offsiteStore, "list")
+	if !strings.Contains(out, projectName+"/"+snapshot2) || strings.Count(out, projectName+"/") != 1 {
+		t.Errorf("Expected only the copied snapshot in the offsite store: %s", out)
+	}
+	run(offsiteStore, "check", "--deep")
+	targetRestore = filepath.Join(tempDir, "restore_from_offsite")
+	run(offsiteStore, "restore", projectName+"/"+snapshot2, targetRestore)
+	if _, err := os.Stat(filepath.Join(targetRestore, "sub/file3.txt")); err != nil {
+		t.Errorf("Restore from the copied snapshot failed: %v", err)
+	}
+
+	t.Log("--- Scenario 58: Encrypted Store ---")
+	encryptedStore := filepath.Join(tempDir, "encrypted_store")
+	os.Setenv("BACKUP_PASSPHRASE", "correct horse")
+	run(tempDir, "init-store", "--encrypt", encryptedStore)
+	run(srcDir, "copy", "--to", encryptedStore, snapshot2)
+	run(encryptedStore, "check", "--deep")
+	targetRestore = filepath.Join(tempDir, "restore_from_encrypted")
+	run(encryptedStore, "restore", projectName+"/"+snapshot2, targetRestore)
+	if content, err := os.ReadFile(filepath.Join(targetRestore, "sub/file3.txt")); err != nil || string(content) != "v2-content3" {
+		t.Errorf("Restore from the encrypted store failed: %q, %v", content, err)
+	}
+	os.Setenv("BACKUP_PASSPHRASE", "wrong")
+	cmd = exec.Command(binPath, "list")
+	cmd.Dir = encryptedStore
+	if out, err := cmd.CombinedOutput(); err == nil || !strings.Contains(string(out), "wrong passphrase") {
+		t.Errorf("Expected a wrong passphrase to be refused: %v\n%s", err, out)
+	}
+	os.Unsetenv("BACKUP_PASSPHRASE")
+
+	t.Log("--- Scenario 59: Hash Cache Info ---")
+	out = run(srcDir, "create")
+	if !strings.Contains(out, "Hash cache:") || !strings.Contains(out, "hit ratio") {
+		t.Errorf("Expected hash cache counts in the backup summary: %s", out)
+	}
+	out = run(srcDir, "cache-info")
+	if !strings.Contains(out, "Entries:") || !strings.Contains(out, "Last backup:") || !strings.Contains(out, "hit ratio") {
+		t.Errorf("Unexpected cache-info output: %s", out)
+	}
+
+	t.Log("--- Scenario 60: Unlock ---")
+	lockFile = filepath.Join(storeDir, ".backup", "lock")
+	out = run(srcDir, "unlock")
+	if !strings.Contains(out, "Store is not locked.") {
+		t.Errorf("Unexpected unlock output without a lock: %s", out)
+	}
+	// A lock of this (running) process is only broken when confirmed
+	os.WriteFile(lockFile, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644)
+	cmd = exec.Command(binPath, "unlock")
+	cmd.Dir = srcDir
+	if out, err := cmd.CombinedOutput(); err == nil || !strings.Contains(string(out), "which is still running") {
+		t.Errorf("Expected unlock to refuse a live lock without confirmation: %v\n%s", err, out)
+	}
+	if _, err := os.Stat(lockFile); err != nil {
+		t.Errorf("Expected the live lock to be kept: %v", err)
+	}
+	run(srcDir, "unlock", "--force")
+	if _, err := os.Stat(lockFile); !os.IsNotExist(err) {
+		t.Errorf("unlock --force did not remove the lock: %v", err)
+	}
+	os.WriteFile(lockFile, []byte("999999999\n"), 0644)
+	out = run(srcDir, "unlock")
+	if !strings.Contains(out, "Removed the store lock held by PID 999999999") {
+		t.Errorf("Expected the stale lock to be removed: %s", out)
+	}
+
+	t.Log("--- Scenario 61: Project Directory as Store ---")
+	projectDir := filepath.Join(storeDir, "snapshots", projectName)
+	out = run(projectDir, "list")
+	if !strings.Contains(out, snapshot2) || strings.Contains(out, "self-backup") {
+		t.Errorf("Expected the listing scoped to %s: %s", projectName, out)
+	}
+	out = run(tempDir, "--store", projectDir, "list")
+	if !strings.Contains(out, snapshot2) || strings.Contains(out, "self-backup") {
+		t.Errorf("Expected --store with a project directory to list its snapshots: %s", out)
+	}
+	if _, err := os.Stat(filepath.Join(projectDir, ".backup")); !os.IsNotExist(err) {
+		t.Errorf("Expected no store config in the project directory: %v", err)
+	}
+
+	t.Log("--- Scenario 62: Quiet and Verbose Output ---")
+	os.WriteFile(filepath.Join(srcDir, "logged.txt"), []byte("logged"), 0644)
+	out = run(srcDir, "--verbose", "create")
+	if !strings.Contains(out, "Archiving: logged.txt") {
+		t.Errorf("Expected --verbose to list archived files: %s", out)
+	}
+	os.WriteFile(filepath.Join(srcDir, "logged.txt"), []byte("logged again"), 0644)
+	out = run(srcDir, "--quiet", "create")
+	if strings.Contains(out, "Starting backup") || strings.Contains(out, "Archiving") || !strings.Contains(out, "Backup Summary:") {
+		t.Errorf("Expected --quiet to print only the summary: %s", out)
+	}
+	out = run(srcDir, "create")
+	if strings.Contains(out, "Archiving") || !strings.Contains(out, "Starting backup") {
+		t.Errorf("Expected progress but no archived files by default: %s", out)
+	}
+
+	t.Log("--- Scenario 63: List Order and Limit ---")
+	out = run(srcDir, "list")
+	all := strings.Split(strings.TrimSpace(out), "\n")
+	all = all[:len(all)-1] // Count line
+	out = run(srcDir, "list", "--limit", "2")
+	lines = strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 3 || lines[0] != all[len(all)-2] || lines[1] != all[len(all)-1] ||
+		lines[2] != fmt.Sprintf("2 of %d snapshots shown", len(all)) {
+		t.Errorf("Expected the newest 2 of %d snapshots: %s", len(all), out)
+	}
+	out = run(srcDir, "list", "--reverse", "--limit", "1")
+	if !strings.HasPrefix(out, all[len(all)-1]+"\n") {
+		t.Errorf("Expected the newest snapshot first: %s", out)
+	}
+	if out = run(srcDir, "list", "--project", projectName); len(strings.Split(strings.TrimSpace(out), "\n")) != len(all)+1 {
+		t.Errorf("Expected all snapshots of %s: %s", projectName, out)
+	}
+	out = run(srcDir, "list", "--project", "no-such-project")
+	if !strings.Contains(out, "0 snapshots found") {
+		t.Errorf("Expected no snapshots of an unknown project: %s", out)
+	}
+
+	t.Log("--- Scenario 64: Snapshot Tags ---")
+	tagged := strings.Fields(all[0])[0]
+	out = run(srcDir, "tag", tagged, "release", "keep")
+	if !strings.Contains(out, "tags: keep, release") {
+		t.Errorf("Unexpected tag output: %s", out)
+	}
+	run(srcDir, "tag", "--remove", tagged, "keep")
+	out = run(srcDir, "list", "--tag", "release")
+	if lines = strings.Split(strings.TrimSpace(out), "\n"); len(lines) != 2 ||
+		!strings.HasPrefix(lines[0], tagged+" ") || !strings.HasSuffix(lines[0], " [release]") {
+		t.Errorf("Expected only the tagged snapshot: %s", out)
+	}
+	if out = run(srcDir, "log"); !strings.Contains(out, "Tags:   release") {
+		t.Errorf("Expected log to show the tags: %s", out)
+	}
+	out = run(srcDir, "remove", "--dry-run", "--tag", "release")
+	if !strings.Contains(out, "Would remove snapshot") || !strings.Contains(out, tagged) || strings.Count(out, "Would remove snapshot") != 1 {
+		t.Errorf("Expected remove --tag to select the tagged snapshot: %s", out)
+	}
+	out = run(srcDir, "forget", "--dry-run", "--keep-daily", "1", "--keep-tag", "release")
+	if !strings.Contains(out, "keep    "+tagged+" (tag release)") {
+		t.Errorf("Expected forget to keep the tagged snapshot: %s", out)
+	}
+	cmd = exec.Command(binPath, "tag", tagged, "bad,tag")
+	cmd.Dir = srcDir
+	if out, err := cmd.CombinedOutput(); err == nil {
+		t.Errorf("Expected an invalid tag to be rejected: %s", out)
+	}
+
+	t.Log("--- Scenario 65: Long Tree Listing ---")
+	out = run(srcDir, "tree", "--long", snapshot1)
+	var fileLine, dirLine string
+	for _, line := range strings.Split(out, "\n") {
+		switch {
+		case strings.HasSuffix(line, " file1.txt"):
+			fileLine = line
+		case strings.HasSuffix(line, " sub/"):
+			dirLine = line
+		}
+	}
+	if f := strings.Fields(fileLine); len(f) < 4 || f[0] != "file" || len(f[len(f)-2]) <= 7 {
+		t.Errorf("Expected a file row with type, size and full hash: %s", out)
+	}
+	if f := strings.Fields(dirLine); len(f) != 4 || f[0] != "dir" || f[1] != "-" {
+		t.Errorf("Expected a directory row without size: %s", out)
+	}
+
+	t.Log("--- Scenario 66: Restore to Stdout ---")
+	if _, err := exec.LookPath("tar"); err == nil && runtime.GOOS != "windows" {
+		stdoutRestore := filepath.Join(tempDir, "stdout_restore")
+		os.MkdirAll(stdoutRestore, 0755)
+		cmd = exec.Command("sh", "-c", fmt.Sprintf("%q restore --to-stdout %s sub | tar -x -C %q", binPath, snapshot1, stdoutRestore))
+		cmd.Dir = srcDir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Errorf("restore --to-stdout | tar -x failed: %v\n%s", err, out)
+		}
+		if _, err := os.Stat(filepath.Join(stdoutRestore, "sub", "file2.txt")); err != nil {
+			t.Errorf("Expected sub/file2.txt extracted from the stream: %v", err)
+		}
+	}
+	cmd = exec.Command(binPath, "restore", "--to-stdout", "--dry-run", snapshot1)
+	cmd.Dir = srcDir
+	if out, err := cmd.CombinedOutput(); err == nil || !strings.Contains(string(out), "cannot be combined with --to-stdout") {
+		t.Errorf("Expected --dry-run with --to-stdout to be rejected: %s", out)
+	}
+
+	t.Log("--- Scenario 67: Short Status ---")
+	run(srcDir, "create")
+	if out = run(srcDir, "status", "--short"); out != "" {
+		t.Errorf("Expected no short status output for an unchanged tree: %q", out)
+	}
+	os.WriteFile(filepath.Join(srcDir, "short.txt"), []byte("short"), 0644)
+	if out = run(srcDir, "status", "-s"); out != "N short.txt\n" {
+		t.Errorf("Expected only the new file: %q", out)
+	}
+	os.Remove(filepath.Join(srcDir, "short.txt"))
+
+	t.Log("--- Scenario 68: Config Get and Set ---")
+	if out = run(srcDir, "config", "get", "name"); out != projectName+"\n" {
+		t.Errorf("Expected config get name to print %s: %q", projectName, out)
+	}
+	if out = run(srcDir, "config", "path"); out != filepath.Join(srcDir, ".backup", "config.toml")+"\n" {
+		t.Errorf("Unexpected config path: %q", out)
+	}
+	run(srcDir, "config", "set", "chunk_threshold", "64MiB")
+	if out = run(srcDir, "config", "list"); !strings.Contains(out, "chunk_threshold = 64MiB") {
+		t.Errorf("Expected the new setting in config list: %s", out)
+	}
+	cmd = exec.Command(binPath, "config", "set", "chunk_threshold", "huge")
+	cmd.Dir = srcDir
+	if out, err := cmd.CombinedOutput(); err == nil {
+		t.Errorf("Expected an invalid size to be refused: %s", out)
+	}
+	if out = run(storeDir, "config", "get", "store"); out != ".\n" {
+		t.Errorf("Expected the store.toml setting from the store: %q", out)
+	}
+
+	t.Log("--- Scenario 69: Snapshot Growth ---")
+	out = run(srcDir, "snapshots", "--stat", "--limit", "2")
+	if lines = strings.Split(strings.TrimSpace(out), "\n"); len(lines) != 3 {
+		t.Fatalf("Expected two snapshots and a summary: %s", out)
+	}
+	for _, line := range lines[:2] {
+		if !strings.Contains(line, " new blobs, ") || !strings.HasSuffix(line, " added") {
+			t.Errorf("Expected the growth of the snapshot: %q", line)
+		}
+	}
+
+	t.Log("--- Scenario 70: Restore with --path and --dest ---")
+	pathRestore := filepath.Join(tempDir, "restore_path_flag")
+	run(storeDir, "restore", "--path", "sub/file3.txt", "--dest", pathRestore, projectName+"/"+snapshot2)
+	if _, err := os.Stat(pathRestore); err != nil {
+		t.Errorf("Expected --path and --dest to restore a single file from the store: %v", err)
+	}
+	// With --path, a single argument is the destination, also from the source
+	pathRestore = filepath.Join(tempDir, "restore_path_arg")
+	run(srcDir, "restore", "--path", "sub", snapshot2, pathRestore)
+	if _, err := os.Stat(filepath.Join(pathRestore, "file3.txt")); err != nil {
+		t.Errorf("Expected --path with a destination argument to restore sub: %v", err)
+	}
+	cmd = exec.Command(binPath, "restore", "--path", "sub", "--dest", pathRestore, snapshot2, "extra")
+	cmd.Dir = srcDir
+	if out, err := cmd.CombinedOutput(); err == nil {
+		t.Errorf("Expected an extra argument to be refused: %s", out)
+	}
+
+	t.Log("--- Scenario 71: Verify Snapshot Heads ---")
+	badHead := filepath.Join(storeDir, "snapshots", projectName, "260101-000000")
+	if err := os.WriteFile(badHead, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd = exec.Command(binPath, "list", "--verify-heads")
+	cmd.Dir = srcDir
+	if out, err := cmd.CombinedOutput(); err == nil || !strings.Contains(string(out), projectName+"/260101-000000: snapshot file is empty") {
+		t.Errorf("Expected the empty head to be reported: %v %s", err, out)
+	}
+	if out = run(srcDir, "list", "--verify-heads", "--fix"); !strings.Contains(out, "Removed "+projectName+"/260101-000000") {
+		t.Errorf("Expected the empty head to be removed: %s", out)
+	}
+	if _, err := os.Stat(badHead); !os.IsNotExist(err) {
+		t.Error("Expected the empty head file to be gone")
+	}
+	if out = run(srcDir, "list", "--verify-heads"); !strings.Contains(out, "All snapshot heads are valid.") {
+		t.Errorf("Expected no invalid heads after --fix: %s", out)
+	}
+
+	t.Log("--- Scenario 72: Pre and Post Backup Hooks ---")
+	if runtime.GOOS != "windows" {
+		hookSrc := filepath.Join(tempDir, "hook_src")
+		if err := os.MkdirAll(hookSrc, 0755); err != nil {
+			t.Fatal(err)
+		}
+		run(tempDir, "init", "--store", storeDir, "--project", "hook-proj", hookSrc)
+		hookConfig := filepath.Join(hookSrc, ".backup", "config.toml")
+		base, _ := os.ReadFile(hookConfig)
+		hooks := "pre_backup = \"echo dumping && echo db > dump.sql\"\npost_backup = \"echo $BACKUP_STATUS > ../hook_status\"\n"
+		os.WriteFile(hookConfig, append(base, hooks...), 0644)
+		if out = run(hookSrc, "create"); !strings.Contains(out, "pre_backup: dumping") {
+			t.Errorf("Expected the pre_backup output: %s", out)
+		}
+		if out = run(hookSrc, "tree"); !strings.Contains(out, "dump.sql") {
+			t.Errorf("Expected the file of the pre_backup hook to be backed up: %s", out)
+		}
+		if data, _ := os.ReadFile(filepath.Join(tempDir, "hook_status")); string(data) != "success\n" {
+			t.Errorf("Expected the post_backup hook to run after the backup, got %q", data)
+		}
+		os.WriteFile(hookConfig, append(base, "pre_backup = \"echo no database >&2; exit 1\"\n"...), 0644)
+		cmd = exec.Command(binPath, "create")
+		cmd.Dir = hookSrc
+		if out, err := cmd.CombinedOutput(); err == nil || !strings.Contains(string(out), "pre_backup: no database") {
+			t.Errorf("Expected a failing pre_backup hook to abort the backup: %v %s", err, out)
+		}
+	}
+
+	t.Log("--- Scenario 73: Dry-run Backup Lists Changes ---")
+	os.WriteFile(filepath.Join(srcDir, "dry_run_new.txt"), []byte("dry run"), 0644)
+	out = run(srcDir, "create", "--dry-run")
+	if !strings.Contains(out, "Changes since backup") || !strings.Contains(out, "N dry_run_new.txt") {
+		t.Errorf("Expected create --dry-run to list the new file: %s", out)
+	}
+	if strings.Contains(out, "Would save file") {
+		t.Errorf("Expected no per-blob lines without --verbose: %s", out)
+	}
+	os.Remove(filepath.Join(srcDir, "dry_run_new.txt"))
+
+	t.Log("--- Scenario 74: Tilde and Environment Variables in Arguments ---")
+	// The arguments do not pass through a shell, so the tool expands them
+	if out = run(tempDir, "--store", "~/backup_integration_tilde_test", "list"); !strings.Contains(out, "tilde-proj") {
+		t.Errorf("Expected --store with ~ to open the store: %s", out)
+	}
+	t.Setenv("BACKUP_INTEGRATION_DIR", tempDir)
+	run(storeDir, "restore", projectName+"/"+snapshot2, "$BACKUP_INTEGRATION_DIR/restore_env")
+	if _, err := os.Stat(filepath.Join(tempDir, "restore_env", "file1.txt")); err != nil {
+		t.Errorf("Expected restore to expand the destination: %v", err)
+	}
+	cmd = exec.Command(binPath, "restore", "--dest", "$BACKUP_INTEGRATION_UNSET/out", projectName+"/"+snapshot2)
+	cmd.Dir = storeDir
+	if out, err := cmd.CombinedOutput(); err == nil || !strings.Contains(string(out), "BACKUP_INTEGRATION_UNSET is not set") {
+		t.Errorf("Expected an unset variable to be reported: %v %s", err, out)
+	}
+
+	t.Log("--- Scenario 75: Check Snapshot Heads Only ---")
+	// The empty head of scenario 15 is reported
+	cmd = exec.Command(binPath, "check", "--snapshots-only")
+	cmd.Dir = storeDir
+	if out, err := cmd.CombinedOutput(); err == nil || !strings.Contains(string(out), "251219-000000") {
+		t.Errorf("Expected check --snapshots-only to report the empty head: %v %s", err, out)
+	}
+	os.Remove(emptySnapPath)
+	out = run(storeDir, "check", "--snapshots-only")
+	if !strings.Contains(out, "Snapshot check passed") {
+		t.Errorf("Expected check --snapshots-only to pass: %s", out)
+	}
+	invalidHead := filepath.Join(storeDir, "snapshots", projectName, "991231-235959")
+	os.WriteFile(invalidHead, []byte("not a hash\n"), 0644)
+	cmd = exec.Command(binPath, "check", "--snapshots-only")
+	cmd.Dir = storeDir
+	if out, err := cmd.CombinedOutput(); err == nil || !strings.Contains(string(out), "991231-235959") {
+		t.Errorf("Expected check --snapshots-only to report the invalid head: %v %s", err, out)
+	}
+	os.Remove(invalidHead)
+
 	// Cleanup tilde test dir from home
 	os.RemoveAll(tildeStoreDir)
 }
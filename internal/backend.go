@@ -0,0 +1,198 @@
+package internal
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Backend opens the parts of stores kept at URLs of one scheme. A store at
+// a URL has the layout of a local store: blobs in data/, snapshot heads in
+// snapshots/ and its configuration in .backup/store.toml.
+type Backend interface {
+	// OpenBlobstore returns the blobs kept at u for the store s, laid out
+	// as s.ShardWidth, s.ShardDepth and s.Codec.Ext describe.
+	OpenBlobstore(s *Store, u *url.URL) (Blobstore, error)
+	OpenRefStore(u *url.URL) (RefStore, error)
+	// OpenStateFiles returns the state files of the store kept in the
+	// directory u, its .backup directory.
+	OpenStateFiles(u *url.URL) (StateFiles, error)
+	// ReadFile returns the content of the file at u. A missing file is
+	// reported with an error matching fs.ErrNotExist.
+	ReadFile(u *url.URL) ([]byte, error)
+}
+
+var (
+	backendsMu sync.Mutex
+	backends   = map[string]Backend{}
+)
+
+// RegisterBackend makes backend available for store URLs of scheme, as
+// given to --store, the store setting of config.toml, and the data and
+// snapshots settings of store.toml. It is meant to be called from init
+// functions and panics if the scheme is registered twice. Programs outside
+// this module use RegisterBackend of pkg/backup.
+func RegisterBackend(scheme string, backend Backend) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	scheme = strings.ToLower(scheme)
+	if _, ok := backends[scheme]; ok {
+		panic("backup: backend registered twice for scheme " + scheme)
+	}
+	backends[scheme] = backend
+}
+
+// Backends returns the registered URL schemes.
+func Backends() []string {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	schemes := make([]string, 0, len(backends))
+	for scheme := range backends {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// IsStoreURL reports whether store names a URL (scheme://…) rather than a
+// local path.
+func IsStoreURL(store string) bool {
+	i := strings.Index(store, "://")
+	if i < 2 { // Leaves room for Windows drive letters
+		return false
+	}
+	for _, c := range store[:i] {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '+' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupBackend parses rawURL and returns the backend of its scheme.
+func lookupBackend(rawURL string) (Backend, *url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid store URL %q: %w", rawURL, err)
+	}
+	backendsMu.Lock()
+	backend, ok := backends[strings.ToLower(u.Scheme)]
+	backendsMu.Unlock()
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported store URL %q (supported schemes: %s)", rawURL, strings.Join(Backends(), ", "))
+	}
+	return backend, u, nil
+}
+
+// StoreName returns the store's URL, or its directory for local stores.
+func (b *Backup) StoreName() string {
+	if b.StoreURL != "" {
+		return b.StoreURL
+	}
+	return b.StoreRoot
+}
+
+// joinURL returns u with elem appended to its path.
+func joinURL(u *url.URL, elem ...string) *url.URL {
+	joined := *u
+	joined.Path = path.Join(append([]string{u.Path}, elem...)...)
+	return &joined
+}
+
+// openStoreURL sets b up for the store at b.StoreURL. Its configuration,
+// lock and record of unreferenced blobs are kept at the URL; caches and
+// the other state of this host are kept in a directory of the user's cache
+// (see storeStateDir), which becomes b.StoreRoot.
+func (b *Backup) openStoreURL() error {
+	backend, u, err := lookupBackend(b.StoreURL)
+	if err != nil {
+		return err
+	}
+	data, err := backend.ReadFile(joinURL(u, ".backup", "store.toml"))
+	if err != nil {
+		return fmt.Errorf("not a backup store: %s: %w", b.StoreURL, err)
+	}
+	b.StoreConfig = &StoreConfig{}
+	if _, err := toml.Decode(string(data), b.StoreConfig); err != nil {
+		return fmt.Errorf("failed to load store config from %s: %v", b.StoreURL, err)
+	}
+	if b.State, err = backend.OpenStateFiles(joinURL(u, ".backup")); err != nil {
+		return err
+	}
+
+	if b.StoreRoot, err = storeStateDir(u); err != nil {
+		return err
+	}
+	b.StoreData = filepath.Join(b.StoreRoot, "data")
+	b.StoreSnapshots = filepath.Join(b.StoreRoot, "snapshots")
+	for _, dir := range []string{b.StoreData, b.StoreSnapshots, filepath.Join(b.StoreRoot, ".backup")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storeStateDir returns the local directory for the caches and the other
+// state of this host for the store at u.
+func storeStateDir(u *url.URL) (string, error) {
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, u.Scheme+"_"+u.Host+u.Path)
+	return filepath.Join(cache, "backup", "stores", name), nil
+}
+
+// openBlobstore returns the blobs kept at rawURL for the store s.
+func openBlobstore(s *Store, rawURL string) (Blobstore, error) {
+	backend, u, err := lookupBackend(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return backend.OpenBlobstore(s, u)
+}
+
+// openRefStore returns the snapshot heads kept at rawURL.
+func openRefStore(rawURL string) (RefStore, error) {
+	backend, u, err := lookupBackend(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return backend.OpenRefStore(u)
+}
+
+// fileBackend keeps stores in local directories, for file:///path URLs.
+type fileBackend struct{}
+
+func init() {
+	RegisterBackend("file", fileBackend{})
+}
+
+func (fileBackend) OpenBlobstore(s *Store, u *url.URL) (Blobstore, error) {
+	return &localBlobstore{s: s, dir: filepath.FromSlash(u.Path)}, nil
+}
+
+func (fileBackend) OpenRefStore(u *url.URL) (RefStore, error) {
+	return &localRefStore{dir: filepath.FromSlash(u.Path)}, nil
+}
+
+func (fileBackend) OpenStateFiles(u *url.URL) (StateFiles, error) {
+	return &localStateFiles{localRefStore{dir: filepath.FromSlash(u.Path)}}, nil
+}
+
+func (fileBackend) ReadFile(u *url.URL) ([]byte, error) {
+	return os.ReadFile(filepath.FromSlash(u.Path))
+}
@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// countingBackend is a third-party style backend keeping stores in local
+// directories and counting the blob stores it opens.
+type countingBackend struct {
+	opened *int
+}
+
+var countingOpened int
+
+func init() {
+	RegisterBackend("counting", countingBackend{opened: &countingOpened})
+}
+
+func (c countingBackend) OpenBlobstore(s *Store, u *url.URL) (Blobstore, error) {
+	*c.opened++
+	return fileBackend{}.OpenBlobstore(s, u)
+}
+
+func (c countingBackend) OpenRefStore(u *url.URL) (RefStore, error) {
+	return fileBackend{}.OpenRefStore(u)
+}
+
+func (c countingBackend) OpenStateFiles(u *url.URL) (StateFiles, error) {
+	return fileBackend{}.OpenStateFiles(u)
+}
+
+func (c countingBackend) ReadFile(u *url.URL) ([]byte, error) {
+	return fileBackend{}.ReadFile(u)
+}
+
+func TestIsStoreURL(t *testing.T) {
+	for store, want := range map[string]bool{
+		"sftp://host/path":  true,
+		"file:///tmp/store": true,
+		"s3+v2://bucket":    true,
+		"/tmp/store":        false,
+		"store":             false,
+		"~/store":           false,
+		`C:\store`:          false,
+		"c://store":         false,
+		"my store://x":      false,
+	} {
+		if got := IsStoreURL(store); got != want {
+			t.Errorf("IsStoreURL(%q) = %v, want %v", store, got, want)
+		}
+	}
+}
+
+func TestNewBackup_StoreURL(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	storeDir := t.TempDir()
+	if _, err := NewBackup(t.TempDir(), storeDir, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(storeDir, ".backup", "store.toml"), []byte("store = \".\"\ncompression = \"zstd\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A source directory whose config names the store by URL
+	src := t.TempDir()
+	storeURL := "counting://" + filepath.ToSlash(storeDir)
+	if err := os.MkdirAll(filepath.Join(src, ".backup"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	config := "store = \"" + storeURL + "\"\nname = \"proj\"\n"
+	if err := os.WriteFile(filepath.Join(src, ".backup", "config.toml"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opened := countingOpened
+	b, err := NewBackup(src, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if countingOpened != opened+1 {
+		t.Errorf("Expected the registered backend to open the blobs")
+	}
+	if b.StoreURL != storeURL || b.StoreName() != storeURL {
+		t.Errorf("Expected store URL %s, got %s (%s)", storeURL, b.StoreURL, b.StoreName())
+	}
+	if b.Store.Codec.Name != "zstd" {
+		t.Errorf("Expected the store config to be read from the URL, got codec %s", b.Store.Codec.Name)
+	}
+	if strings.HasPrefix(b.StoreRoot, storeDir) {
+		t.Errorf("Expected the local state outside of the store, got %s", b.StoreRoot)
+	}
+	if err := b.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	// The lock is kept in the store, where other hosts see it
+	if _, err := os.Stat(filepath.Join(storeDir, ".backup", "lock")); err != nil {
+		t.Errorf("Expected the lock in the store: %v", err)
+	}
+	other, err := OpenStore(storeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Lock(); err == nil || !strings.Contains(err.Error(), "store is locked") {
+		t.Errorf("Expected the store to be locked, got %v", err)
+	}
+	root, _, err := b.CreateSnapshot()
+	b.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(storeDir, "snapshots", "proj", root.Timestamp())); err != nil {
+		t.Errorf("Expected the head in the store: %v", err)
+	}
+	if all, _ := b.GetAllBlobs(); len(all) != 2 {
+		t.Errorf("Expected 2 blobs, got %d", len(all))
+	}
+
+	// The same store opened by path sees the snapshot
+	local, err := OpenStore(storeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local.ProjectName = "proj"
+	if _, err := local.FindBackupRoot(root.Timestamp()); err != nil {
+		t.Error(err)
+	}
+	if errs := local.Verify(true); len(errs) != 0 {
+		t.Errorf("Unexpected verify errors: %v", errs)
+	}
+
+	if _, err := NewBackup(t.TempDir(), "unknown://host/store", false); err == nil || !strings.Contains(err.Error(), "supported schemes") {
+		t.Errorf("Expected an unsupported scheme error, got %v", err)
+	}
+	if _, err := OpenStore("file://" + filepath.ToSlash(t.TempDir())); err == nil {
+		t.Error("Expected a directory without store.toml to be refused")
+	}
+}
@@ -1,10 +1,17 @@
 package internal
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
+	"log/slog"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 type Backup struct {
@@ -12,26 +19,89 @@ type Backup struct {
 	CurrentWorkingDir string
 	BackupConfigDir   string
 	StoreRoot         string
+	StoreURL          string // URL of a store kept by a Backend; StoreRoot then holds its local state
 	ProjectName       string
 	StoreData         string
 	StoreSnapshots    string
 	Config            *Config
+	StoreConfig       *StoreConfig
 	Store             *Store
+	Refs              RefStore   // Snapshot heads; nil means the snapshots directory
+	State             StateFiles // Lock and prune record shared by all hosts; nil means StoreRoot/.backup
 	HashCache         *HashCache
 	DryRun            bool
 	ShowIgnored       bool
+	JSON              bool
+	MaxFileSize       int64 // Files larger than this are skipped; 0 means no limit
+	Jobs              int   // Number of files hashed and saved concurrently; <= 1 is serial
+	ChunkThreshold    int64 // Files at least this large are stored in chunks; 0 disables chunking
+	ChunkCache        *HashCache
+	GlobalIgnore      *IgnoreMatcher // Patterns from config's global_ignore and exclude, applied below every ignore file
+	CommandLineIgnore *IgnoreMatcher // Patterns from --exclude/--include, applied before every ignore file
+	Includes          []string       // Extra source roots from config's includes, backed up as subdirectories of Top
+	Message           string         // Recorded in the metadata of snapshots made by CreateSnapshot
+	Strict            bool           // Abort the backup on files that cannot be read instead of skipping them
 	Stats             BackupStats
+	Failed            []FailedFile // Files skipped by the last backup because they could not be read
+	failedMu          sync.Mutex
+	Logger            *slog.Logger // Receives progress messages and warnings; nil logs to the console at info level
+	locked            bool         // Whether this process holds the store lock
 }
 
+// BackupStats counts the work done by a backup. Counters are updated with
+// sync/atomic so entries can be saved concurrently.
 type BackupStats struct {
-	FilesTotal    int
-	FilesArchived int
-	FilesIgnored  int
-	DirsTotal     int
-	DirsArchived  int
-	DirsIgnored   int
+	FilesTotal    int64
+	FilesArchived int64
+	FilesIgnored  int64
+	DirsTotal     int64
+	DirsArchived  int64
+	DirsIgnored   int64
 	BytesArchived int64
 	BytesTotal    int64
+	// Content that was already in the store. Files count whole files whose
+	// blob existed; bytes also include existing chunks of chunked files.
+	FilesDeduplicated int64
+	BytesDeduplicated int64
+	// Files that could not be read and were left out (see Backup.Strict)
+	FilesFailed int64
+}
+
+// Load returns a copy of s, reading each counter atomically, so it can be
+// taken while entries are being saved.
+func (s *BackupStats) Load() BackupStats {
+	return BackupStats{
+		FilesTotal:        atomic.LoadInt64(&s.FilesTotal),
+		FilesArchived:     atomic.LoadInt64(&s.FilesArchived),
+		FilesIgnored:      atomic.LoadInt64(&s.FilesIgnored),
+		DirsTotal:         atomic.LoadInt64(&s.DirsTotal),
+		DirsArchived:      atomic.LoadInt64(&s.DirsArchived),
+		DirsIgnored:       atomic.LoadInt64(&s.DirsIgnored),
+		BytesArchived:     atomic.LoadInt64(&s.BytesArchived),
+		BytesTotal:        atomic.LoadInt64(&s.BytesTotal),
+		FilesDeduplicated: atomic.LoadInt64(&s.FilesDeduplicated),
+		BytesDeduplicated: atomic.LoadInt64(&s.BytesDeduplicated),
+		FilesFailed:       atomic.LoadInt64(&s.FilesFailed),
+	}
+}
+
+// FailedFile is a file left out of a backup because it could not be read.
+type FailedFile struct {
+	Path string
+	Err  error
+}
+
+// fail records a file that could not be read. It returns err if b.Strict
+// is set, so the backup aborts, and nil otherwise.
+func (b *Backup) fail(path string, err error) error {
+	if b.Strict {
+		return err
+	}
+	atomic.AddInt64(&b.Stats.FilesFailed, 1)
+	b.failedMu.Lock()
+	b.Failed = append(b.Failed, FailedFile{Path: path, Err: err})
+	b.failedMu.Unlock()
+	return nil
 }
 
 func NewBackup(startDir, storeDir string, assumeYes bool) (*Backup, error) {
@@ -39,22 +109,32 @@ func NewBackup(startDir, storeDir string, assumeYes bool) (*Backup, error) {
 	var err error
 
 	// 1. Determine StoreRoot if provided explicitly
-	if storeDir != "" {
+	if IsStoreURL(storeDir) {
+		b.StoreURL = storeDir
+	} else if storeDir != "" {
 		expanded, err := ExpandPath(storeDir)
 		if err != nil {
 			return nil, err
 		}
-		b.StoreRoot, err = filepath.Abs(expanded)
+		b.StoreRoot, err = CanonicalPath(expanded)
 		if err != nil {
 			return nil, err
 		}
+		// A project directory under snapshots/ opens its store, scoped
+		// to the project
+		if !fileExists(filepath.Join(b.StoreRoot, ".backup", "store.toml")) {
+			if root, project := storeProject(b.StoreRoot); root != "" {
+				b.StoreRoot, b.ProjectName = root, project
+			}
+		}
 	}
 
-	// 2. Determine potential source directory
+	// 2. Determine potential source directory. Paths are canonical, so the
+	// relative paths between the source, the working directory and the
+	// store do not depend on the symlinks used to reach them.
 	var cwd string
 	if startDir != "" {
-		cwd, err = filepath.Abs(startDir)
-		if err != nil {
+		if cwd, err = ExpandPath(startDir); err != nil {
 			return nil, err
 		}
 	} else {
@@ -63,6 +143,9 @@ func NewBackup(startDir, storeDir string, assumeYes bool) (*Backup, error) {
 			return nil, err
 		}
 	}
+	if cwd, err = CanonicalPath(cwd); err != nil {
+		return nil, err
+	}
 
 	// 3. Look for .backup configuration in tree
 	top := lookupTop(cwd)
@@ -74,6 +157,9 @@ func NewBackup(startDir, storeDir string, assumeYes bool) (*Backup, error) {
 			b.StoreRoot = top
 			// Ensure we treat this as headless/store mode (Empty Top) so restore requires destination
 			b.Top = ""
+			if _, project := storeProject(cwd); project != "" {
+				b.ProjectName = project
+			}
 		} else {
 			// Check for config.toml (Source Mode)
 			configPath := filepath.Join(top, ".backup", "config.toml")
@@ -90,20 +176,20 @@ func NewBackup(startDir, storeDir string, assumeYes bool) (*Backup, error) {
 				}
 
 				// If store not explicitly provided, look in config
-				if b.StoreRoot == "" {
+				if b.StoreRoot == "" && b.StoreURL == "" {
 					backupStoreSetting := b.Config.Store
-					if backupStoreSetting != "" {
+					if IsStoreURL(backupStoreSetting) {
+						b.StoreURL = backupStoreSetting
+					} else if backupStoreSetting != "" {
 						expanded, err := ExpandPath(backupStoreSetting)
 						if err != nil {
 							return nil, err
 						}
-						if filepath.IsAbs(expanded) {
-							b.StoreRoot = expanded
-						} else {
-							b.StoreRoot = filepath.Join(top, expanded)
+						// Relative to the source root, which holds .backup/config.toml
+						if !filepath.IsAbs(expanded) {
+							expanded = filepath.Join(top, expanded)
 						}
-						// Canonize path
-						b.StoreRoot, err = filepath.Abs(b.StoreRoot)
+						b.StoreRoot, err = CanonicalPath(expanded)
 						if err != nil {
 							return nil, err
 						}
@@ -114,12 +200,41 @@ func NewBackup(startDir, storeDir string, assumeYes bool) (*Backup, error) {
 				if b.Config.Name != "" {
 					b.ProjectName = b.Config.Name
 				}
+
+				if b.Config.MaxFileSize != "" {
+					b.MaxFileSize, err = ParseSize(b.Config.MaxFileSize)
+					if err != nil {
+						return nil, fmt.Errorf("invalid max_file_size in %s: %w", configPath, err)
+					}
+				}
+
+				if b.Config.ChunkThreshold != "" {
+					b.ChunkThreshold, err = ParseSize(b.Config.ChunkThreshold)
+					if err != nil {
+						return nil, fmt.Errorf("invalid chunk_threshold in %s: %w", configPath, err)
+					}
+				}
+
+				if b.Config.GlobalIgnore != "" {
+					b.GlobalIgnore, err = b.loadGlobalIgnore(top, b.Config.GlobalIgnore)
+					if err != nil {
+						return nil, fmt.Errorf("invalid global_ignore in %s: %w", configPath, err)
+					}
+				}
+				b.addConfigExcludes(top, b.Config.Exclude)
+
+				if len(b.Config.Includes) > 0 {
+					b.Includes, err = resolveIncludes(top, b.Config.Includes)
+					if err != nil {
+						return nil, fmt.Errorf("invalid includes in %s: %w", configPath, err)
+					}
+				}
 			}
 		}
 	}
 
 	// 4. Auto-detect store if not specified (Legacy detection or implicit current dir)
-	if b.StoreRoot == "" {
+	if b.StoreRoot == "" && b.StoreURL == "" {
 		// Check if current directory looks like a store (data/ and snapshots/ exist)
 		// This is a fallback if store.toml is missing but structure matches
 		dataDir := filepath.Join(cwd, "data")
@@ -138,7 +253,7 @@ func NewBackup(startDir, storeDir string, assumeYes bool) (*Backup, error) {
 	}
 
 	// 5. Validation
-	if b.StoreRoot == "" {
+	if b.StoreRoot == "" && b.StoreURL == "" {
 		return nil, fmt.Errorf("no backup configuration found\n\n" +
 			"To get started:\n" +
 			"  • Initialize a new backup store:  backup init-store <path>\n" +
@@ -147,26 +262,85 @@ func NewBackup(startDir, storeDir string, assumeYes bool) (*Backup, error) {
 			"Run 'backup --help' for more information.")
 	}
 
+	storeTomlPath := b.StoreURL
+	if b.StoreURL != "" {
+		err = b.openStoreURL()
+	} else {
+		storeTomlPath, err = b.openStoreDir(assumeYes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := LookupHashFunc(b.StoreConfig.Hash); err != nil {
+		return nil, fmt.Errorf("invalid store config %s: %w", storeTomlPath, err)
+	}
+	if _, err := LookupCodec(b.StoreConfig.Compression); err != nil {
+		return nil, fmt.Errorf("invalid store config %s: %w", storeTomlPath, err)
+	}
+	if _, _, err := b.StoreConfig.Shards(); err != nil {
+		return nil, fmt.Errorf("invalid store config %s: %w", storeTomlPath, err)
+	}
+	if _, _, err := b.StoreConfig.IORetry(); err != nil {
+		return nil, fmt.Errorf("invalid store config %s: %w", storeTomlPath, err)
+	}
+	if _, err := b.StoreConfig.KeepUnreferenced(); err != nil {
+		return nil, fmt.Errorf("invalid store config %s: %w", storeTomlPath, err)
+	}
+
+	if b.Top == "" && b.ProjectName == "" {
+		b.ProjectName = b.StoreConfig.DefaultProject
+	}
+
+	b.Store = NewStore(b)
+	if err := b.setupStore(); err != nil {
+		return nil, err
+	}
+
+	// Hash cache logic needs Top?
+	// If Top is missing (store-only mode), we might not have a place for hash-cache or config-based hash-cache.
+	// For now, only initialize HashCache if Top is present.
+	if b.Top != "" {
+		b.HashCache, err = NewHashCache(b.Top, filepath.Join(b.BackupConfigDir, "hash-cache"), b.Store.HashFunc)
+		if err != nil {
+			return nil, err
+		}
+		b.HashCache.Paranoid = b.Config != nil && b.Config.ParanoidCache
+		b.HashCache.b = b
+		// Chunk manifest hashes are cached separately from content hashes
+		b.ChunkCache, err = NewHashCache(b.Top, filepath.Join(b.BackupConfigDir, "chunk-cache"), b.Store.HashFunc)
+		if err != nil {
+			return nil, err
+		}
+		b.ChunkCache.b = b
+	}
+
+	return b, nil
+}
+
+// openStoreDir sets b up for the local store at b.StoreRoot, creating its
+// directories and, once confirmed, its store.toml. It returns the path of
+// store.toml.
+func (b *Backup) openStoreDir(assumeYes bool) (string, error) {
 	info, err := os.Stat(b.StoreRoot)
 	if err != nil || !info.IsDir() {
-		return nil, fmt.Errorf("backup store is not a directory: %s", b.StoreRoot)
+		return "", fmt.Errorf("backup store is not a directory: %s", b.StoreRoot)
 	}
 
 	// 6. Initialize Store structure
 	b.StoreData = filepath.Join(b.StoreRoot, "data")
 	if err := os.MkdirAll(b.StoreData, 0755); err != nil {
-		return nil, err
+		return "", err
 	}
 
 	b.StoreSnapshots = filepath.Join(b.StoreRoot, "snapshots")
 	if err := os.MkdirAll(b.StoreSnapshots, 0755); err != nil {
-		return nil, err
+		return "", err
 	}
 
 	// Ensure .backup directory exists in store
 	storeBackupDir := filepath.Join(b.StoreRoot, ".backup")
 	if err := os.MkdirAll(storeBackupDir, 0755); err != nil {
-		return nil, err
+		return "", err
 	}
 
 	// Ensure store.toml exists
@@ -177,84 +351,76 @@ func NewBackup(startDir, storeDir string, assumeYes bool) (*Backup, error) {
 			// Check if interactive
 			fileInfo, _ := os.Stdin.Stat()
 			if (fileInfo.Mode() & os.ModeCharDevice) == 0 {
-				return nil, fmt.Errorf("store configuration missing in %s and running non-interactively; use --yes to create", b.StoreRoot)
+				return "", fmt.Errorf("store configuration missing in %s and running non-interactively; use --yes to create", b.StoreRoot)
 			}
 
 			fmt.Printf("Store configuration missing in %s. Create store.toml? [y/N] ", b.StoreRoot)
 			var response string
 			fmt.Scanln(&response) // Simple scan
 			if response != "y" && response != "Y" && response != "yes" {
-				return nil, fmt.Errorf("store initialization aborted by user")
+				return "", fmt.Errorf("store initialization aborted by user")
 			}
 		}
 
 		if err := os.WriteFile(storeTomlPath, []byte("store = \".\"\n"), 0644); err != nil {
-			fmt.Fprintf(os.Stderr, "Warning: Failed to create store.toml: %v\n", err)
+			b.warnf("Failed to create store.toml: %v", err)
 		}
 	}
 
-	// Hash cache logic needs Top?
-	// If Top is missing (store-only mode), we might not have a place for hash-cache or config-based hash-cache.
-	// For now, only initialize HashCache if Top is present.
-	if b.Top != "" {
-		b.HashCache, err = NewHashCache(b.Top, filepath.Join(b.BackupConfigDir, "hash-cache"))
+	// Load store configuration (hash algorithm etc.)
+	b.StoreConfig = &StoreConfig{}
+	if _, err := os.Stat(storeTomlPath); err == nil {
+		b.StoreConfig, err = LoadStoreConfig(storeTomlPath)
 		if err != nil {
-			return nil, err
+			return "", fmt.Errorf("failed to load store config from %s: %v", storeTomlPath, err)
 		}
 	}
-
-	b.Store = NewStore(b)
-
-	return b, nil
+	return storeTomlPath, nil
 }
 
-func (b *Backup) BackupRoots() ([]*BackupRoot, error) {
-	var roots []*BackupRoot
-
-	searchDir := b.StoreSnapshots
-	if b.ProjectName != "" {
-		searchDir = filepath.Join(b.StoreSnapshots, b.ProjectName)
-		if _, err := os.Stat(searchDir); os.IsNotExist(err) {
-			return []*BackupRoot{}, nil
+// setupStore sets up the blob encryption and opens the blobs and snapshot
+// heads of a store at a URL, or the locations named by store.toml.
+func (b *Backup) setupStore() error {
+	var err error
+	name, data, snapshots := b.StoreRoot, b.StoreConfig.Data, b.StoreConfig.Snapshots
+	if b.StoreURL != "" {
+		name = b.StoreURL
+		base := strings.TrimSuffix(b.StoreURL, "/")
+		if data == "" {
+			data = base + "/data"
 		}
-		// List files in specific project dir
-		files, err := os.ReadDir(searchDir)
-		if err != nil {
-			return nil, err
+		if snapshots == "" {
+			snapshots = base + "/snapshots"
 		}
-		for _, f := range files {
-			if f.IsDir() {
-				continue
-			}
-			root, err := NewBackupRoot(b, filepath.Join(searchDir, f.Name()))
-			if err != nil { // Skip invalid
-				continue
-			}
-			roots = append(roots, root)
+	}
+	if err := b.Store.openEncryption(b.StoreConfig, name); err != nil {
+		return err
+	}
+	if data != "" {
+		if b.Store.Blobs, err = openBlobstore(b.Store, data); err != nil {
+			return err
 		}
-	} else {
-		// ProjectName empty -> Search all subdirectories
-		params, err := os.ReadDir(searchDir)
-		if err == nil {
-			for _, p := range params {
-				if p.IsDir() {
-					projectDir := filepath.Join(searchDir, p.Name())
-					files, err := os.ReadDir(projectDir)
-					if err == nil {
-						for _, f := range files {
-							if f.IsDir() {
-								continue
-							}
-							root, err := NewBackupRoot(b, filepath.Join(projectDir, f.Name()))
-							if err == nil {
-								roots = append(roots, root)
-							}
-						}
-					}
-				}
-			}
+	}
+	if snapshots != "" {
+		if b.Refs, err = openRefStore(snapshots); err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+func (b *Backup) BackupRoots() ([]*BackupRoot, error) {
+	if b.ProjectName == "" {
+		// ProjectName empty -> Search all projects
+		return b.AllBackupRoots()
+	}
+	roots, err := b.projectRoots(b.ProjectName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []*BackupRoot{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
 	sort.Sort(BackupRoots(roots))
 	return roots, nil
 }
@@ -263,31 +429,21 @@ func (b *Backup) BackupRoots() ([]*BackupRoot, error) {
 // ignoring the current project context.
 func (b *Backup) AllBackupRoots() ([]*BackupRoot, error) {
 	var roots []*BackupRoot
-	searchDir := b.StoreSnapshots
 
-	// Search all subdirectories
-	params, err := os.ReadDir(searchDir)
+	// Search all projects
+	projects, err := b.refs().List("")
 	if err != nil {
-		if os.IsNotExist(err) {
+		if errors.Is(err, fs.ErrNotExist) {
 			return []*BackupRoot{}, nil
 		}
 		return nil, err
 	}
 
-	for _, p := range params {
+	for _, p := range projects {
 		if p.IsDir() {
-			projectDir := filepath.Join(searchDir, p.Name())
-			files, err := os.ReadDir(projectDir)
+			found, err := b.projectRoots(p.Name())
 			if err == nil {
-				for _, f := range files {
-					if f.IsDir() {
-						continue
-					}
-					root, err := NewBackupRoot(b, filepath.Join(projectDir, f.Name()))
-					if err == nil {
-						roots = append(roots, root)
-					}
-				}
+				roots = append(roots, found...)
 			}
 		}
 	}
@@ -295,6 +451,26 @@ func (b *Backup) AllBackupRoots() ([]*BackupRoot, error) {
 	return roots, nil
 }
 
+// projectRoots returns the snapshots of project, skipping invalid heads.
+func (b *Backup) projectRoots(project string) ([]*BackupRoot, error) {
+	files, err := b.refs().List(project)
+	if err != nil {
+		return nil, err
+	}
+	var roots []*BackupRoot
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		root, err := b.backupRoot(path.Join(project, f.Name()))
+		if err != nil { // Skip invalid
+			continue
+		}
+		roots = append(roots, root)
+	}
+	return roots, nil
+}
+
 func (b *Backup) LatestBackupRoot() (*BackupRoot, error) {
 	roots, err := b.BackupRoots()
 	if err != nil {
@@ -307,29 +483,138 @@ func (b *Backup) LatestBackupRoot() (*BackupRoot, error) {
 }
 
 func (b *Backup) FindBackupRoot(name string) (*BackupRoot, error) {
-	path := ""
-	// If name contains separators, assume it's relative path from snapshots root (e.g "proj/timestamp")
-	// Or absolute path? Let's check if it exists relative to StoreSnapshots first if "clean".
-
+	// If name contains separators, assume it's relative to the snapshots root (e.g "proj/timestamp")
+	ref := filepath.ToSlash(filepath.Clean(name))
+	if ref == "." || ref == ".." || strings.HasPrefix(ref, "../") || path.IsAbs(ref) {
+		return nil, fmt.Errorf("invalid snapshot name %q", name)
+	}
 	// If project name is set and name is just timestamp
-	if b.ProjectName != "" && filepath.Base(name) == name {
-		path = filepath.Join(b.StoreSnapshots, b.ProjectName, name)
-	} else {
-		// Try direct from snapshots root
-		path = filepath.Join(b.StoreSnapshots, name)
+	if b.ProjectName != "" && !strings.Contains(ref, "/") {
+		ref = path.Join(b.ProjectName, ref)
 	}
-
-	if _, err := os.Stat(path); err != nil {
+	if _, err := b.refs().Read(ref); err != nil {
 		return nil, err
 	}
-	return NewBackupRoot(b, path)
+	return b.backupRoot(ref)
 }
 
 func (b *Backup) BackupDirectory(hash, name string) *BackupDirectory {
 
 	// For now new instance is fine as long as it's stateless representation of that hash.
 	// The content loading is inside BackupDirectory.
-	return NewBackupDirectory(b, hash, name)
+	return NewBackupDirectory(b, hash, name, EntryAttrs{})
+}
+
+// SetCommandLineIgnores sets ad-hoc exclude and include patterns, relative
+// to the top directory. They take precedence over ignore files, and
+// includes take precedence over excludes.
+func (b *Backup) SetCommandLineIgnores(excludes, includes []string) {
+	if len(excludes) == 0 && len(includes) == 0 {
+		b.CommandLineIgnore = nil
+		return
+	}
+	m := NewIgnoreMatcher(b.Top, nil)
+	for _, p := range excludes {
+		m.AddPattern(p, "command-line")
+	}
+	for _, p := range includes {
+		m.AddPattern("!"+strings.TrimPrefix(p, "!"), "command-line")
+	}
+	b.CommandLineIgnore = m
+}
+
+// loadGlobalIgnore loads the global ignore file named in config.toml. Its
+// patterns apply relative to top, and ignore files in the tree can negate
+// them. A missing file only produces a warning.
+func (b *Backup) loadGlobalIgnore(top, setting string) (*IgnoreMatcher, error) {
+	path, err := ExpandPath(setting)
+	if err != nil {
+		return nil, err
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(top, path)
+	}
+	m := NewIgnoreMatcher(top, nil)
+	if err := m.loadFile(path, setting); err != nil {
+		if os.IsNotExist(err) {
+			b.warnf("global ignore file %s not found", path)
+			return m, nil
+		}
+		return nil, err
+	}
+	return m, nil
+}
+
+// addConfigExcludes adds the exclude patterns of config.toml to the global
+// ignore matcher, after the patterns of the global ignore file so that they
+// override those. Ignore files in the tree still override both.
+func (b *Backup) addConfigExcludes(top string, excludes []string) {
+	for _, p := range excludes {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		if b.GlobalIgnore == nil {
+			b.GlobalIgnore = NewIgnoreMatcher(top, nil)
+		}
+		b.GlobalIgnore.AddPattern(p, "config.toml")
+	}
+}
+
+// resolveIncludes turns the includes of config.toml into absolute paths.
+// Relative paths are taken relative to top. Each include must be a
+// directory, and their base names, under which they appear in snapshots,
+// must be distinct.
+func resolveIncludes(top string, settings []string) ([]string, error) {
+	var includes []string
+	names := make(map[string]string)
+	for _, setting := range settings {
+		path, err := ExpandPath(setting)
+		if err != nil {
+			return nil, err
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(top, path)
+		}
+		path = filepath.Clean(path)
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", setting)
+		}
+		name := filepath.Base(path)
+		if name == ".backup" || name == string(filepath.Separator) {
+			return nil, fmt.Errorf("%s cannot be included", setting)
+		}
+		if other, ok := names[name]; ok {
+			return nil, fmt.Errorf("%s and %s would both be stored as %s", other, setting, name)
+		}
+		names[name] = setting
+		includes = append(includes, path)
+	}
+	return includes, nil
+}
+
+// storeProject returns the root of the local store and the project when dir
+// is the snapshot directory of a project, e.g. /store/snapshots/proj.
+func storeProject(dir string) (root, project string) {
+	top := lookupTop(dir)
+	if top == "" || !fileExists(filepath.Join(top, ".backup", "store.toml")) {
+		return "", ""
+	}
+	rel, err := filepath.Rel(top, dir)
+	if err != nil {
+		return "", ""
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if len(parts) != 2 || parts[0] != "snapshots" {
+		return "", ""
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return "", ""
+	}
+	return top, parts[1]
 }
 
 func lookupTop(current string) string {
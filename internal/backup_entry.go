@@ -1,101 +1,422 @@
 package internal
 
 import (
-	"bufio"
-	"compress/gzip"
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
 )
 
+// RestoreOptions controls how entries are written back to disk.
+type RestoreOptions struct {
+	// PreserveTimes sets the recorded modification times on restored
+	// files and directories.
+	PreserveTimes bool
+	// Force overwrites existing files and symlinks. Without it, restoring
+	// over an existing non-directory path fails.
+	Force bool
+	// PreservePerms sets the recorded permission bits on restored files
+	// and directories.
+	PreservePerms bool
+	// PreserveOwner sets the recorded owner and group on restored files
+	// and directories. Backup.Restore clears it with a warning when the
+	// process cannot change owners.
+	PreserveOwner bool
+	// DryRun lists the paths Backup.Restore would write without writing
+	// anything.
+	DryRun bool
+	// Filter selects the paths restored below the restored entry; nil
+	// restores everything. See NewRestoreFilter.
+	Filter *RestoreFilter
+	// StripComponents drops this many leading components from the paths
+	// below the restored entry, like tar --strip-components. Entries with
+	// no more components than that are not restored. Used by
+	// Backup.Restore.
+	StripComponents int
+	// CaseInsensitive restores to a filesystem that does not distinguish
+	// names differing only in case. Sibling entries whose names collide
+	// there are refused, or with Force restored under a "~N" suffix.
+	// Backup.Restore sets it when it detects such a destination.
+	CaseInsensitive bool
+	// Verify reads every restored file back and compares its content with
+	// the hashes in the store, failing on the first mismatch.
+	Verify bool
+	// ContinueOnError restores everything it can when entries fail to
+	// restore, e.g. because their blobs are missing, and returns a
+	// RestoreFailedError listing them at the end. Used by Backup.Restore.
+	ContinueOnError bool
+
+	// hardlinks maps hardlink IDs to the first path restored for them.
+	hardlinks map[string]string
+	// rel is the path of the entry being restored in the snapshot, for
+	// Filter.
+	rel string
+	// failed collects the entries that failed with ContinueOnError.
+	failed *[]FailedFile
+	// dirs holds the listing hashes of the directories above the entry
+	// being restored, to detect cycles; see enter.
+	dirs []string
+}
+
+// maxTreeDepth bounds how deeply nested directories are walked on save and
+// restore. Path length limits keep real trees far from it, so only a
+// damaged or crafted tree reaches it.
+const maxTreeDepth = 4096
+
+// enter returns the options for restoring the entries of d, which is
+// restored as opts.rel. It refuses a d that is nested deeper than
+// maxTreeDepth, or that lists itself or a directory above it: such a
+// listing cannot come from a backup and would be restored forever.
+func (opts RestoreOptions) enter(d *BackupDirectory) (RestoreOptions, error) {
+	if slices.Contains(opts.dirs, d.Hash()) {
+		return opts, fmt.Errorf("directory %s contains itself (listing %s): the snapshot is damaged", restoreName(opts.rel), d.Hash())
+	}
+	if len(opts.dirs) >= maxTreeDepth {
+		return opts, fmt.Errorf("directory %s is nested more than %d levels deep", restoreName(opts.rel), maxTreeDepth)
+	}
+	// Copy, so sibling directories do not share the backing array
+	opts.dirs = append(slices.Clip(opts.dirs), d.Hash())
+	return opts, nil
+}
+
+// fail records that dest could not be restored when failures are
+// collected, and returns err otherwise.
+func (opts RestoreOptions) fail(dest string, err error) error {
+	if opts.failed == nil {
+		return err
+	}
+	*opts.failed = append(*opts.failed, FailedFile{Path: dest, Err: err})
+	return nil
+}
+
+// restoreName names the entry at rel in errors.
+func restoreName(rel string) string {
+	if rel == "" {
+		return "/"
+	}
+	return rel
+}
+
 type BackupEntry interface {
 	Hash() string
 	Name() string
-	Restore(dest string) error
+	Attrs() EntryAttrs
+	Restore(dest string, opts RestoreOptions) error
 }
 
 type BaseBackupEntry struct {
-	b    *Backup
-	hash string
-	name string
+	b     *Backup
+	hash  string
+	name  string
+	attrs EntryAttrs
 }
 
-func (e *BaseBackupEntry) Hash() string { return e.hash }
-func (e *BaseBackupEntry) Name() string { return e.name }
+func (e *BaseBackupEntry) Hash() string      { return e.hash }
+func (e *BaseBackupEntry) Name() string      { return e.name }
+func (e *BaseBackupEntry) Attrs() EntryAttrs { return e.attrs }
 
-func (e *BaseBackupEntry) Restore(dest string) error {
+func (e *BaseBackupEntry) Restore(dest string, opts RestoreOptions) error {
 	return fmt.Errorf("not implemented")
 }
 
+// checkOverwrite fails if dest exists and opts does not allow replacing it.
+func checkOverwrite(dest string, opts RestoreOptions) error {
+	if opts.Force {
+		return nil
+	}
+	if _, err := os.Lstat(dest); err == nil {
+		return fmt.Errorf("%s already exists (use --force to overwrite)", dest)
+	}
+	return nil
+}
+
+// restoreMeta applies the recorded extended attributes, and the permissions
+// and modification time as far as requested, to dest.
+func (e *BaseBackupEntry) restoreMeta(dest string, opts RestoreOptions) error {
+	// Changing the owner clears setuid bits and file capabilities, so it
+	// comes first
+	if opts.PreserveOwner {
+		e.restoreOwner(dest)
+	}
+	// Before the permissions, which may make dest read-only
+	e.restoreXattrs(dest)
+	if opts.PreservePerms && e.attrs.Mode != 0 {
+		if err := os.Chmod(dest, e.attrs.Mode); err != nil {
+			return fmt.Errorf("failed to set permissions on %s: %w", dest, err)
+		}
+	}
+	return e.restoreTimes(dest, opts)
+}
+
+// restoreTimes applies the recorded modification time to dest if requested.
+func (e *BaseBackupEntry) restoreTimes(dest string, opts RestoreOptions) error {
+	if !opts.PreserveTimes || e.attrs.ModTime.IsZero() {
+		return nil
+	}
+	if err := os.Chtimes(dest, e.attrs.ModTime, e.attrs.ModTime); err != nil {
+		return fmt.Errorf("failed to set modification time on %s: %w", dest, err)
+	}
+	return nil
+}
+
 type BackupFile struct {
 	BaseBackupEntry
+	// chunked files reference a chunk manifest instead of their content.
+	chunked bool
 }
 
-func NewBackupFile(b *Backup, hash, name string) *BackupFile {
-	return &BackupFile{BaseBackupEntry{b: b, hash: hash, name: name}}
+func NewBackupFile(b *Backup, hash, name string, attrs EntryAttrs) *BackupFile {
+	return &BackupFile{BaseBackupEntry: BaseBackupEntry{b: b, hash: hash, name: name, attrs: attrs}}
 }
 
-func (f *BackupFile) Restore(dest string) error {
-	storePath := f.b.Store.DataStore(f.hash)
-	src, err := os.Open(storePath)
-	if err != nil {
-		return fmt.Errorf("failed to open store file: %w", err)
+// NewBackupChunkedFile returns a file whose hash is that of its chunk manifest.
+func NewBackupChunkedFile(b *Backup, hash, name string, attrs EntryAttrs) *BackupFile {
+	f := NewBackupFile(b, hash, name, attrs)
+	f.chunked = true
+	return f
+}
+
+func (f *BackupFile) Restore(dest string, opts RestoreOptions) error {
+	if err := checkOverwrite(dest, opts); err != nil {
+		return err
+	}
+
+	if first, ok := opts.hardlinks[f.attrs.Hardlink]; ok && f.attrs.Hardlink != "" {
+		if err := relink(first, dest); err == nil {
+			return nil
+		}
+		// Fall back to a copy, e.g. when dest is on another file system
 	}
-	defer src.Close()
 
-	gz, err := gzip.NewReader(src)
+	chunks, err := f.chunks()
 	if err != nil {
-		return fmt.Errorf("failed to create gzip reader: %w", err)
+		return err
 	}
-	defer gz.Close()
 
 	// Ensure destination directory exists
 	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
 		return fmt.Errorf("failed to create destination dir: %w", err)
 	}
 
-	out, err := os.Create(dest)
+	// Replace a symlink instead of writing through it
+	if info, err := os.Lstat(dest); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if err := os.Remove(dest); err != nil {
+			return fmt.Errorf("failed to remove existing symlink: %w", err)
+		}
+	}
+
+	var out *os.File
+	err = f.b.Store.retry(func() (err error) {
+		out, err = os.Create(dest)
+		return err
+	})
 	if err != nil {
 		return fmt.Errorf("failed to create destination file: %w", err)
 	}
 	defer out.Close()
 
-	if _, err := io.Copy(out, gz); err != nil {
-		return fmt.Errorf("failed to copy content: %w", err)
+	if err := f.copyChunks(out, chunks); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to close destination file: %w", err)
+	}
+	if opts.Verify {
+		if err := f.verify(dest, chunks); err != nil {
+			return err
+		}
+	}
+
+	if f.attrs.Hardlink != "" && opts.hardlinks != nil {
+		if _, ok := opts.hardlinks[f.attrs.Hardlink]; !ok {
+			opts.hardlinks[f.attrs.Hardlink] = dest
+		}
 	}
 
+	return f.restoreMeta(dest, opts)
+}
+
+// verify reads the restored file at path and checks its content against
+// the hash of the blob, or of each chunk for a chunked file.
+func (f *BackupFile) verify(path string, chunks []chunkRef) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to verify %s: %w", path, err)
+	}
+	defer in.Close()
+	for i, c := range chunks {
+		r := io.Reader(in)
+		if f.chunked {
+			r = io.LimitReader(in, c.Size)
+		}
+		hash, err := f.b.Store.HashReader(r)
+		if err != nil {
+			return fmt.Errorf("failed to verify %s: %w", path, err)
+		}
+		if hash != c.Hash {
+			if f.chunked {
+				return fmt.Errorf("verification of %s failed: chunk %d has hash %s, expected %s", path, i+1, hash, c.Hash)
+			}
+			return fmt.Errorf("verification of %s failed: hash %s, expected %s", path, hash, c.Hash)
+		}
+	}
+	if f.chunked {
+		if n, _ := in.Read(make([]byte, 1)); n > 0 {
+			return fmt.Errorf("verification of %s failed: file is longer than its chunks", path)
+		}
+	}
 	return nil
 }
 
-type BackupLink struct {
-	BaseBackupEntry
+// relink replaces dest with a hardlink to existing.
+func relink(existing, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(dest); err == nil {
+		if err := os.Remove(dest); err != nil {
+			return err
+		}
+	}
+	return os.Link(existing, dest)
 }
 
-func NewBackupLink(b *Backup, hash, name string) *BackupLink {
-	return &BackupLink{BaseBackupEntry{b: b, hash: hash, name: name}}
+// WriteContent writes the file's content to w.
+func (f *BackupFile) WriteContent(w io.Writer) error {
+	chunks, err := f.chunks()
+	if err != nil {
+		return err
+	}
+	return f.copyChunks(w, chunks)
 }
 
-func (l *BackupLink) Restore(dest string) error {
-	storePath := l.b.Store.DataStore(l.hash)
-	src, err := os.Open(storePath)
+// Open returns a reader for the file's content.
+func (f *BackupFile) Open() (io.ReadCloser, error) {
+	chunks, err := f.chunks()
 	if err != nil {
-		return fmt.Errorf("failed to open store file: %w", err)
+		return nil, err
 	}
-	defer src.Close()
+	return &chunkReader{s: f.b.Store, chunks: chunks}, nil
+}
 
-	gz, err := gzip.NewReader(src)
+// Size returns the length of the file's content: the size recorded in the
+// listing, or for listings without one, the size in the manifest of chunked
+// files and the length of the decompressed blob of other files.
+func (f *BackupFile) Size() (int64, error) {
+	if f.attrs.Size > 0 {
+		return f.attrs.Size, nil
+	}
+	if f.chunked {
+		chunks, err := f.chunks()
+		if err != nil {
+			return 0, err
+		}
+		var size int64
+		for _, c := range chunks {
+			size += c.Size
+		}
+		return size, nil
+	}
+	r, err := f.Open()
 	if err != nil {
-		return fmt.Errorf("failed to create gzip reader: %w", err)
+		return 0, err
 	}
-	defer gz.Close()
+	defer r.Close()
+	return io.Copy(io.Discard, r)
+}
 
-	// Read target path
-	content, err := io.ReadAll(gz)
+// chunks returns the blobs holding the file's content, checking that a
+// whole file blob exists before anything is written.
+func (f *BackupFile) chunks() ([]chunkRef, error) {
+	if f.chunked {
+		return f.b.Store.readManifest(f.hash)
+	}
+	if _, err := f.b.Store.Blobs.Size(f.hash); err != nil {
+		return nil, fmt.Errorf("failed to open store file: %w", err)
+	}
+	return []chunkRef{{Hash: f.hash}}, nil
+}
+
+func (f *BackupFile) copyChunks(w io.Writer, chunks []chunkRef) error {
+	for _, c := range chunks {
+		if err := f.b.Store.copyBlob(w, c.Hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunkReader reads the content of a list of blobs in sequence.
+type chunkReader struct {
+	s      *Store
+	chunks []chunkRef
+	r      io.ReadCloser
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if c.r == nil {
+			if len(c.chunks) == 0 {
+				return 0, io.EOF
+			}
+			r, err := c.s.openBlob(c.chunks[0].Hash)
+			if err != nil {
+				return 0, fmt.Errorf("failed to open store file: %w", err)
+			}
+			c.r = r
+			c.chunks = c.chunks[1:]
+		}
+		n, err := c.r.Read(p)
+		if err == io.EOF {
+			c.Close()
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *chunkReader) Close() error {
+	if c.r == nil {
+		return nil
+	}
+	err := c.r.Close()
+	c.r = nil
+	return err
+}
+
+type BackupLink struct {
+	BaseBackupEntry
+}
+
+func NewBackupLink(b *Backup, hash, name string, attrs EntryAttrs) *BackupLink {
+	return &BackupLink{BaseBackupEntry{b: b, hash: hash, name: name, attrs: attrs}}
+}
+
+// Target returns the path the symlink points to.
+func (l *BackupLink) Target() (string, error) {
+	var sb strings.Builder
+	if err := l.b.Store.copyBlob(&sb, l.hash); err != nil {
+		return "", fmt.Errorf("failed to read link target: %w", err)
+	}
+	return sb.String(), nil
+}
+
+func (l *BackupLink) Restore(dest string, opts RestoreOptions) error {
+	if err := checkOverwrite(dest, opts); err != nil {
+		return err
+	}
+
+	target, err := l.Target()
 	if err != nil {
-		return fmt.Errorf("failed to read link target: %w", err)
+		return err
 	}
-	target := string(content)
 
 	// Ensure destination directory exists
 	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
@@ -121,75 +442,293 @@ type BackupDirectory struct {
 	entries map[string]BackupEntry
 }
 
-func NewBackupDirectory(b *Backup, hash, name string) *BackupDirectory {
-	return &BackupDirectory{BaseBackupEntry: BaseBackupEntry{b: b, hash: hash, name: name}}
+func NewBackupDirectory(b *Backup, hash, name string, attrs EntryAttrs) *BackupDirectory {
+	return &BackupDirectory{BaseBackupEntry: BaseBackupEntry{b: b, hash: hash, name: name, attrs: attrs}}
 }
 
-func (d *BackupDirectory) Restore(dest string) error {
+func (d *BackupDirectory) Restore(dest string, opts RestoreOptions) error {
+	// Hardlinks are re-created among the files of one restore
+	if opts.hardlinks == nil {
+		opts.hardlinks = make(map[string]string)
+	}
+	inner, err := opts.enter(d)
+	if err != nil {
+		return err
+	}
+
 	entries, err := d.Entries()
 	if err != nil {
 		return err
 	}
 
-	if err := os.MkdirAll(dest, 0755); err != nil {
-		return fmt.Errorf("failed to create directory %s: %w", dest, err)
+	// A directory the filter does not select is only created for the
+	// entries below it that it does select
+	selected := opts.Filter.includes(opts.rel, true)
+	if selected {
+		// Existing directories are merged into; anything else is in the way
+		if info, err := os.Lstat(dest); err == nil && !info.IsDir() {
+			if err := checkOverwrite(dest, opts); err != nil {
+				return err
+			}
+			if err := os.Remove(dest); err != nil {
+				return fmt.Errorf("failed to remove existing file: %w", err)
+			}
+		}
+
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			return fmt.Errorf("failed to create directory %s: %w", dest, err)
+		}
 	}
 
+	destNames, err := restoreNames(entries, opts)
+	if err != nil {
+		return err
+	}
+	// Children are restored in the order of the listing, so that a restore
+	// and its failures are reproducible
+	for _, name := range sortedEntryNames(entries) {
+		entry := entries[name]
+		childOpts := inner
+		childOpts.rel = path.Join(opts.rel, name)
+		if !opts.Filter.restores(entry, childOpts.rel) {
+			continue
+		}
+		childDest := filepath.Join(dest, destNames[name])
+		if err := entry.Restore(childDest, childOpts); err != nil {
+			if err := opts.fail(childDest, err); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !selected {
+		if _, err := os.Lstat(dest); err != nil {
+			return nil // Nothing below was selected
+		}
+	}
+	// Set directory times and permissions last so writing children neither
+	// bumps the time nor is blocked by a read-only directory
+	return d.restoreMeta(dest, opts)
+}
+
+// restoreNames returns the names the entries of a directory selected by
+// opts.Filter are restored under: their own, except for names that collide
+// on a case-insensitive destination. Those are an error, or with Force
+// every name after the first in name order gets a "~N" suffix before its
+// extension.
+func restoreNames(entries map[string]BackupEntry, opts RestoreOptions) (map[string]string, error) {
+	names := make(map[string]string, len(entries))
+	var selected []string
 	for name, entry := range entries {
-		childDest := filepath.Join(dest, name)
-		if err := entry.Restore(childDest); err != nil {
-			return err
+		if opts.Filter.restores(entry, path.Join(opts.rel, name)) {
+			names[name] = name
+			selected = append(selected, name)
 		}
 	}
-	return nil
+	if !opts.CaseInsensitive {
+		return names, nil
+	}
+	sort.Strings(selected)
+	used := make(map[string]string, len(selected)) // Folded name to name
+	for _, name := range selected {
+		folded := strings.ToLower(name)
+		if _, ok := used[folded]; !ok {
+			used[folded] = name
+			continue
+		}
+		if !opts.Force {
+			return nil, fmt.Errorf("%s and %s differ only in case and would overwrite each other on a case-insensitive filesystem (use --force to restore %s under another name)",
+				path.Join(opts.rel, used[folded]), path.Join(opts.rel, name), name)
+		}
+		ext := path.Ext(name)
+		for n := 2; ; n++ {
+			renamed := fmt.Sprintf("%s~%d%s", strings.TrimSuffix(name, ext), n, ext)
+			if _, ok := used[strings.ToLower(renamed)]; !ok && entries[renamed] == nil {
+				used[strings.ToLower(renamed)] = renamed
+				names[name] = renamed
+				break
+			}
+		}
+	}
+	return names, nil
 }
 
-func (d *BackupDirectory) Entries() (map[string]BackupEntry, error) {
-	if d.entries != nil {
-		return d.entries, nil
+// backupEntryType returns the EntryType of the source entry e was saved from.
+func backupEntryType(e BackupEntry) EntryType {
+	switch e := e.(type) {
+	case *BackupDirectory:
+		return EntryTypeDirectory
+	case *BackupLink:
+		return EntryTypeLink
+	case *BackupFile:
+		if e.chunked {
+			return EntryTypeChunkedFile
+		}
 	}
+	return EntryTypeFile
+}
 
-	d.entries = make(map[string]BackupEntry)
+// sortedEntryNames returns the names of entries in the order entrySorter
+// gives their listing: by type (files before directories), hash and name.
+func sortedEntryNames(entries map[string]BackupEntry) []string {
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		ei, ej := entries[names[i]], entries[names[j]]
+		if ti, tj := backupEntryType(ei), backupEntryType(ej); ti != tj {
+			return ti < tj
+		}
+		if ei.Hash() != ej.Hash() {
+			return ei.Hash() < ej.Hash()
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
 
-	// Read GZiped content
-	storePath := d.b.Store.DataStore(d.hash)
-	f, err := os.Open(storePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open store file %s: %v", storePath, err)
+func (d *BackupDirectory) Entries() (map[string]BackupEntry, error) {
+	if d.entries != nil {
+		return d.entries, nil
 	}
-	defer f.Close()
 
-	gz, err := gzip.NewReader(f)
+	// Read compressed content
+	gz, err := d.b.Store.openBlob(d.hash)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to open store file %s: %v", d.b.Store.blobLocation(d.hash), err)
 	}
 	defer gz.Close()
 
-	scanner := bufio.NewScanner(gz)
+	// Entries are only kept once the whole listing was read, so a failed
+	// read fails again instead of looking empty
+	entries := make(map[string]BackupEntry)
+	scanner := newListingScanner(gz)
 	for scanner.Scan() {
-		line := scanner.Text()
-		// Format: T hash name
-		// T is 1 char, then space (index 1), hash is 32 chars (index 2-34), space (index 34), name (index 35+)
-		if len(line) < 36 || line[1] != ' ' || line[34] != ' ' {
-			fmt.Fprintf(os.Stderr, "Warning: invalid directory entry: %s\n", line)
+		l, err := scanner.Entry()
+		if err != nil {
+			d.b.warnf("invalid directory entry: %s", scanner.Text())
 			continue
 		}
 
-		typeChar := line[0]
-		hash := line[2:34]
-		name := line[35:]
-
-		switch typeChar {
+		switch l.Type {
 		case 'D':
-			d.entries[name] = NewBackupDirectory(d.b, hash, name)
+			entries[l.Name] = NewBackupDirectory(d.b, l.Hash, l.Name, l.Attrs)
 		case 'F':
-			d.entries[name] = NewBackupFile(d.b, hash, name)
+			entries[l.Name] = NewBackupFile(d.b, l.Hash, l.Name, l.Attrs)
+		case 'C':
+			entries[l.Name] = NewBackupChunkedFile(d.b, l.Hash, l.Name, l.Attrs)
 		case 'L':
-			d.entries[name] = NewBackupLink(d.b, hash, name)
+			entries[l.Name] = NewBackupLink(d.b, l.Hash, l.Name, l.Attrs)
 		default:
-			fmt.Fprintf(os.Stderr, "Warning: unknown entry type: %c\n", typeChar)
+			d.b.warnf("unknown entry type: %c", l.Type)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	d.entries = entries
+	return entries, nil
+}
+
+// RestoreTarget is a destination path written when restoring an entry.
+type RestoreTarget struct {
+	Path  string
+	Entry BackupEntry
+	// Exists reports whether something is already present at Path.
+	Exists bool
+}
+
+// RestoreTargets lists, in path order, every destination path that restoring
+// entry to dest would write. Only directory listings are read from the store.
+func RestoreTargets(entry BackupEntry, dest string) ([]RestoreTarget, error) {
+	return restoreTargets(entry, dest, RestoreOptions{})
+}
+
+// restoreTargets lists the destination paths of restoring entry to dest
+// with the Filter of opts.
+func restoreTargets(entry BackupEntry, dest string, opts RestoreOptions) ([]RestoreTarget, error) {
+	var targets []RestoreTarget
+	err := collectRestoreTargets(entry, dest, opts, &targets)
+	return targets, err
+}
+
+// RestoreConflicts returns the existing paths that restoring entry to dest
+// would overwrite. Existing directories are merged into and are only a
+// conflict when the entry restored there is not a directory.
+func RestoreConflicts(entry BackupEntry, dest string) ([]string, error) {
+	return restoreConflicts(entry, dest, RestoreOptions{})
+}
+
+func restoreConflicts(entry BackupEntry, dest string, opts RestoreOptions) ([]string, error) {
+	targets, err := restoreTargets(entry, dest, opts)
+	if err != nil {
+		return nil, err
+	}
+	var conflicts []string
+	for _, t := range targets {
+		if !t.Exists {
+			continue
 		}
+		_, restoreDir := t.Entry.(*BackupDirectory)
+		if info, err := os.Lstat(t.Path); err == nil && restoreDir && info.IsDir() {
+			continue
+		}
+		conflicts = append(conflicts, t.Path)
 	}
+	return conflicts, nil
+}
+
+func collectRestoreTargets(entry BackupEntry, dest string, opts RestoreOptions, targets *[]RestoreTarget) error {
+	_, err := os.Lstat(dest)
+	target := RestoreTarget{Path: dest, Entry: entry, Exists: err == nil}
 
-	return d.entries, scanner.Err()
+	dir, ok := entry.(*BackupDirectory)
+	if !ok {
+		*targets = append(*targets, target)
+		return nil
+	}
+	inner, err := opts.enter(dir)
+	if err != nil {
+		return err
+	}
+	entries, err := dir.Entries()
+	if err != nil {
+		if opts.ContinueOnError {
+			// Restore reports the directory when it fails to read it
+			*targets = append(*targets, target)
+			return nil
+		}
+		return err
+	}
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	destNames, err := restoreNames(entries, opts)
+	if err != nil {
+		return err
+	}
+
+	// Like Restore, a directory the filter does not select is only listed
+	// for the entries below it that it selects
+	var below []RestoreTarget
+	for _, name := range names {
+		childOpts := inner
+		childOpts.rel = path.Join(opts.rel, name)
+		if !opts.Filter.restores(entries[name], childOpts.rel) {
+			continue
+		}
+		if err := collectRestoreTargets(entries[name], filepath.Join(dest, destNames[name]), childOpts, &below); err != nil {
+			return err
+		}
+	}
+	if len(below) > 0 || opts.Filter.includes(opts.rel, true) {
+		*targets = append(*targets, target)
+		*targets = append(*targets, below...)
+	}
+	return nil
 }
@@ -0,0 +1,471 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRestoreTargets(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "a.txt", "a")
+	writeTestFile(t, b, "sub/b.txt", "b")
+	root := snapshotTestBackup(t, b, "260101-100000")
+
+	top, err := root.TopDirectory()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dest, "a.txt"), []byte("existing"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	targets, err := RestoreTargets(top, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		path   string
+		exists bool
+	}{
+		{dest, true},
+		{filepath.Join(dest, "a.txt"), true},
+		{filepath.Join(dest, "sub"), false},
+		{filepath.Join(dest, "sub", "b.txt"), false},
+	}
+	if len(targets) != len(expected) {
+		t.Fatalf("Expected %d targets, got %+v", len(expected), targets)
+	}
+	for i, e := range expected {
+		if targets[i].Path != e.path || targets[i].Exists != e.exists {
+			t.Errorf("Target %d: expected %s (exists=%v), got %s (exists=%v)", i, e.path, e.exists, targets[i].Path, targets[i].Exists)
+		}
+	}
+
+	// Nothing may be written
+	if _, err := os.Stat(filepath.Join(dest, "sub")); !os.IsNotExist(err) {
+		t.Errorf("RestoreTargets created files")
+	}
+}
+
+func TestRestore_Force(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "a.txt", "new")
+	writeTestFile(t, b, "sub/b.txt", "b")
+	root := snapshotTestBackup(t, b, "260101-100000")
+
+	top, err := root.TopDirectory()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := t.TempDir()
+	existing := filepath.Join(dest, "a.txt")
+	if err := os.WriteFile(existing, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conflicts, err := RestoreConflicts(top, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 1 || conflicts[0] != existing {
+		t.Errorf("Expected conflict %s, got %v", existing, conflicts)
+	}
+
+	if err := top.Restore(dest, RestoreOptions{}); err == nil {
+		t.Error("Expected restore over an existing file to fail without Force")
+	}
+	if content, _ := os.ReadFile(existing); string(content) != "old" {
+		t.Errorf("Existing file was overwritten without Force: %q", content)
+	}
+
+	if err := top.Restore(dest, RestoreOptions{Force: true}); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(existing); string(content) != "new" {
+		t.Errorf("Expected Force to overwrite the file, got %q", content)
+	}
+}
+
+func TestBackupFile_WriteContent(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "sub/a.txt", "hello")
+	root := snapshotTestBackup(t, b, "260101-100000")
+
+	entry, err := root.Locate("sub/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, ok := entry.(*BackupFile)
+	if !ok {
+		t.Fatalf("Expected a file, got %T", entry)
+	}
+	var buf bytes.Buffer
+	if err := f.WriteContent(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "hello" {
+		t.Errorf("Expected %q, got %q", "hello", buf.String())
+	}
+}
+
+func TestBackupFile_SizeWithoutRecordedSize(t *testing.T) {
+	b := newTestBackup(t)
+	hash := b.Store.HashBytes([]byte("old listing"))
+	if _, err := b.Store.saveBlob(hash, []byte("old listing")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Listings written before sizes were recorded have no size attribute
+	f := NewBackupFile(b, hash, "old.txt", EntryAttrs{})
+	if size, err := f.Size(); err != nil || size != int64(len("old listing")) {
+		t.Errorf("Expected the size of the content, got %d, %v", size, err)
+	}
+	f = NewBackupFile(b, hash, "new.txt", EntryAttrs{Size: 42})
+	if size, err := f.Size(); err != nil || size != 42 {
+		t.Errorf("Expected the recorded size, got %d, %v", size, err)
+	}
+}
+
+func TestBackupFile_OpenAndSize(t *testing.T) {
+	b := newTestBackup(t)
+	b.ChunkThreshold = 1 << 20
+	big := randomData(3, 3<<20)
+	writeTestFile(t, b, "big.bin", string(big))
+	writeTestFile(t, b, "small.txt", "small")
+	if err := os.Symlink("small.txt", filepath.Join(b.Top, "link")); err != nil {
+		t.Fatal(err)
+	}
+	root := snapshotTestBackup(t, b, "260101-100000")
+	top, err := root.TopDirectory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := top.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string][]byte{"big.bin": big, "small.txt": []byte("small")} {
+		f := entries[name].(*BackupFile)
+		size, err := f.Size()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != int64(len(want)) {
+			t.Errorf("%s: expected size %d, got %d", name, len(want), size)
+		}
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: content read through Open differs", name)
+		}
+	}
+
+	target, err := entries["link"].(*BackupLink).Target()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "small.txt" {
+		t.Errorf("Expected link target small.txt, got %q", target)
+	}
+}
+
+func TestEmptyDirectory_RoundTrip(t *testing.T) {
+	b := newTestBackup(t)
+	b.MaxFileSize = 10
+	writeTestFile(t, b, "full/a.txt", "a")
+	// A directory whose only file is skipped is stored as an empty directory
+	writeTestFile(t, b, "skipped/large.bin", "larger than ten bytes")
+	if err := os.MkdirAll(filepath.Join(b.Top, "empty", "nested"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	root := snapshotTestBackup(t, b, "260101-100000")
+
+	for _, p := range []string{"empty", "empty/nested", "skipped"} {
+		entry, err := root.Locate(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir, ok := entry.(*BackupDirectory)
+		if !ok {
+			t.Fatalf("Expected %s to be a directory in the snapshot, got %T", p, entry)
+		}
+		entries, err := dir.Entries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p != "empty" && len(entries) != 0 {
+			t.Errorf("Expected %s to be empty, got %d entries", p, len(entries))
+		}
+	}
+
+	top, err := root.TopDirectory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(t.TempDir(), "restore")
+	if err := top.Restore(dest, RestoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"empty", "empty/nested", "skipped"} {
+		info, err := os.Stat(filepath.Join(dest, filepath.FromSlash(p)))
+		if err != nil || !info.IsDir() {
+			t.Errorf("Expected %s to be restored as a directory: %v", p, err)
+		}
+	}
+
+	if errs := b.Verify(true); len(errs) != 0 {
+		t.Errorf("Expected no verify errors, got %v", errs)
+	}
+}
+
+func TestRestore_Hardlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hardlinks are restored as copies on Windows")
+	}
+	b := newTestBackup(t)
+	writeTestFile(t, b, "a.txt", "shared")
+	writeTestFile(t, b, "single.txt", "shared")
+	if err := os.MkdirAll(filepath.Join(b.Top, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(b.Top, "a.txt"), filepath.Join(b.Top, "sub", "b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	root := snapshotTestBackup(t, b, "260101-100000")
+
+	a, err := root.Locate("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	linked, err := root.Locate("sub/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	single, err := root.Locate("single.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Attrs().Hardlink == "" || a.Attrs().Hardlink != linked.Attrs().Hardlink {
+		t.Fatalf("Expected a shared hardlink ID, got %q and %q", a.Attrs().Hardlink, linked.Attrs().Hardlink)
+	}
+	if single.Attrs().Hardlink != "" {
+		t.Errorf("Expected no hardlink ID for a single link, got %q", single.Attrs().Hardlink)
+	}
+
+	top, err := root.TopDirectory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(t.TempDir(), "restore")
+	if err := top.Restore(dest, RestoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	stat := func(rel string) os.FileInfo {
+		info, err := os.Stat(filepath.Join(dest, filepath.FromSlash(rel)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+	if !os.SameFile(stat("a.txt"), stat("sub/b.txt")) {
+		t.Error("Expected a.txt and sub/b.txt to be restored as hardlinks")
+	}
+	if os.SameFile(stat("a.txt"), stat("single.txt")) {
+		t.Error("Files with equal content must not be linked")
+	}
+
+	// Listings record link groups, not inodes: the same tree linked again
+	// through another inode gets the same hash
+	if a.Attrs().Hardlink != linkGroupID(0) {
+		t.Errorf("Expected the first link group, got %q", a.Attrs().Hardlink)
+	}
+	mtime := a.Attrs().ModTime
+	subInfo, err := os.Stat(filepath.Join(b.Top, "sub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, b, "a.txt.new", "shared")
+	if err := os.Rename(filepath.Join(b.Top, "a.txt.new"), filepath.Join(b.Top, "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(b.Top, "sub", "b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(b.Top, "a.txt"), filepath.Join(b.Top, "sub", "b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	for name, mt := range map[string]time.Time{"a.txt": mtime, "sub": subInfo.ModTime()} {
+		if err := os.Chtimes(filepath.Join(b.Top, name), mt, mt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	again := snapshotTestBackup(t, b, "260101-110000")
+	first, _ := root.Hash()
+	second, _ := again.Hash()
+	if first != second {
+		t.Errorf("Expected the relinked tree to have the same hash, got %s and %s", first, second)
+	}
+}
+
+func TestSymlinks_RoundTrip(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require privileges on Windows")
+	}
+	b := newTestBackup(t)
+	writeTestFile(t, b, "realdir/inside.txt", "inside")
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("outside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"absolute": outside,
+		"dangling": "does/not/exist",
+		"dirlink":  "realdir",
+		"escaping": "../../somewhere",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(b.Top, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := snapshotTestBackup(t, b, "260101-100000")
+
+	top, err := root.TopDirectory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := top.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, target := range links {
+		l, ok := entries[name].(*BackupLink)
+		if !ok {
+			t.Fatalf("Expected %s to be stored as a link, got %T", name, entries[name])
+		}
+		got, err := l.Target()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != target {
+			t.Errorf("%s: expected target %q, got %q", name, target, got)
+		}
+	}
+	// Links are not followed: the outside file was never archived
+	if _, err := os.Stat(b.Store.DataStore(b.Store.HashBytes([]byte("outside")))); !os.IsNotExist(err) {
+		t.Error("Content behind an absolute link was archived")
+	}
+
+	if errs := b.Verify(true); len(errs) != 0 {
+		t.Errorf("Expected no verify errors, got %v", errs)
+	}
+
+	dest := filepath.Join(t.TempDir(), "restore")
+	if err := top.Restore(dest, RestoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for name, target := range links {
+		info, err := os.Lstat(filepath.Join(dest, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("%s was not restored as a symlink", name)
+			continue
+		}
+		if got, _ := os.Readlink(filepath.Join(dest, name)); got != target {
+			t.Errorf("%s: restored target %q, want %q", name, got, target)
+		}
+	}
+	if content, err := os.ReadFile(filepath.Join(dest, "dirlink", "inside.txt")); err != nil || string(content) != "inside" {
+		t.Errorf("Restored directory link does not resolve: %q, %v", content, err)
+	}
+
+	report := NewStatusReport()
+	if err := b.runStatus(root, NewDirectoryEntry(b, b.Top, nil), top, report, false); err != nil {
+		t.Fatal(err)
+	}
+	if report.Links != len(links) || report.Files != 1 {
+		t.Errorf("Expected %d links and 1 file, got %d links and %d files", len(links), report.Links, report.Files)
+	}
+	for _, e := range report.Entries {
+		if target, ok := links[e.Path]; ok && (e.Link != target || e.Status != StatusArchived) {
+			t.Errorf("Unexpected status entry for link %s", e)
+		}
+	}
+}
+
+func TestRestore_Order(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "a.txt", "first file")
+	writeTestFile(t, b, "z.txt", "second file")
+	writeTestFile(t, b, "sub/b.txt", "nested")
+	if runtime.GOOS != "windows" {
+		if err := os.Symlink("z.txt", filepath.Join(b.Top, "link")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := snapshotTestBackup(t, b, "260101-100000")
+	top, err := root.TopDirectory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := top.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Files by hash, then directories, then links, as in the listing
+	files := []string{"a.txt", "z.txt"}
+	if b.Store.HashBytes([]byte("second file")) < b.Store.HashBytes([]byte("first file")) {
+		files = []string{"z.txt", "a.txt"}
+	}
+	want := append(files, "sub")
+	if runtime.GOOS != "windows" {
+		want = append(want, "link")
+	}
+	if got := sortedEntryNames(entries); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("Expected restore order %v, got %v", want, got)
+	}
+
+	// With both files missing, every restore fails on the same one
+	for _, content := range []string{"first file", "second file"} {
+		if err := os.Remove(b.Store.DataStore(b.Store.HashBytes([]byte(content)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var first string
+	for i := 0; i < 10; i++ {
+		err := top.Restore(filepath.Join(t.TempDir(), "restore"), RestoreOptions{})
+		if err == nil {
+			t.Fatal("Expected the restore to fail")
+		}
+		if i == 0 {
+			first = err.Error()
+		} else if err.Error() != first {
+			t.Fatalf("Restore failed differently: %v, then %v", first, err)
+		}
+	}
+	if !strings.Contains(first, entries[files[0]].Hash()) {
+		t.Errorf("Expected the restore to fail on %s first, got %v", files[0], first)
+	}
+}
@@ -4,7 +4,11 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestNewBackup_WithSourceDir(t *testing.T) {
@@ -37,16 +41,93 @@ func TestNewBackup_WithSourceDir(t *testing.T) {
 		t.Fatalf("NewBackup failed: %v", err)
 	}
 
-	if b.Top != tempDir {
-		t.Errorf("Expected Top to be %s, got %s", tempDir, b.Top)
+	// Paths are canonical (e.g. /private/var rather than /var on macOS)
+	canonicalDir, err := filepath.EvalSymlinks(tempDir)
+	if err != nil {
+		t.Fatal(err)
 	}
-	/*
-	   // StoreRoot path resolution might vary (symlinks on mac /var vs /private/var), so we might check if it ends with "store"
-	   // or resolve eval symlinks.
-	   // For simplicity let's check base name.
-	*/
-	if filepath.Base(b.StoreRoot) != "store" {
-		t.Errorf("Expected StoreRoot to end with 'store', got %s", b.StoreRoot)
+	if b.Top != canonicalDir {
+		t.Errorf("Expected Top to be %s, got %s", canonicalDir, b.Top)
+	}
+	if want := filepath.Join(canonicalDir, "store"); b.StoreRoot != want {
+		t.Errorf("Expected StoreRoot to be %s, got %s", want, b.StoreRoot)
+	}
+}
+
+func TestNewBackup_SymlinkedStore(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Symlinks need privileges on Windows")
+	}
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	links := t.TempDir()
+	realStore, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	realSrc, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := filepath.Join(links, "store")
+	src := filepath.Join(links, "src")
+	if err := os.Symlink(realStore, store); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(realSrc, src); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewBackup(t.TempDir(), store, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(src, ".backup"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// The store is named through the link
+	config := "store = \"" + filepath.ToSlash(store) + "\"\nname = \"proj\"\n"
+	if err := os.WriteFile(filepath.Join(src, ".backup", "config.toml"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "sub", "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewBackup(filepath.Join(src, "sub"), "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.StoreRoot != realStore || b.Top != realSrc || b.CurrentWorkingDir != filepath.Join(realSrc, "sub") {
+		t.Fatalf("Expected canonical paths, got store %s, top %s, cwd %s", b.StoreRoot, b.Top, b.CurrentWorkingDir)
+	}
+	if err := b.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	root, _, err := b.CreateSnapshot()
+	b.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry, _ := root.Locate("sub/a.txt"); entry == nil {
+		t.Error("Expected sub/a.txt in the snapshot")
+	}
+	// Status locates the working directory below the top in the snapshot
+	b.JSON = true
+	if err := b.Status(root.Timestamp(), false, false); err != nil {
+		t.Errorf("Status failed: %v", err)
+	}
+
+	// The same store through the link or directly
+	other, err := OpenStore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.StoreRoot != b.StoreRoot {
+		t.Errorf("Expected the store opened through the link to be %s, got %s", b.StoreRoot, other.StoreRoot)
+	}
+	if direct, err := NewBackup(realSrc, "", false); err != nil || direct.StoreRoot != b.StoreRoot || direct.Top != b.Top {
+		t.Errorf("Expected the same paths without links, got %v (%v)", direct, err)
 	}
 }
 
@@ -149,6 +230,90 @@ func TestNewBackup_InStoreDir(t *testing.T) {
 	}
 }
 
+func TestNewBackup_DefaultProject(t *testing.T) {
+	tempDir := t.TempDir()
+	store := filepath.Join(tempDir, "store")
+	src := filepath.Join(tempDir, "src")
+	for _, dir := range []string{filepath.Join(store, ".backup"), filepath.Join(src, ".backup")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(store, ".backup", "store.toml"), []byte("default_project = \"laptop\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, ".backup", "config.toml"), []byte("store = \"../store\"\nname = \"desktop\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewBackup(store, "", true)
+	if err != nil {
+		t.Fatalf("NewBackup failed: %v", err)
+	}
+	if b.ProjectName != "laptop" {
+		t.Errorf("Expected the headless project to be laptop, got %q", b.ProjectName)
+	}
+
+	// A source directory keeps its own project
+	b, err = NewBackup(src, "", true)
+	if err != nil {
+		t.Fatalf("NewBackup failed: %v", err)
+	}
+	if b.ProjectName != "desktop" {
+		t.Errorf("Expected the source project to be desktop, got %q", b.ProjectName)
+	}
+}
+
+func TestNewBackup_ProjectDirectory(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	store, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewBackup(t.TempDir(), store, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(store, ".backup", "store.toml"), []byte("default_project = \"laptop\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, project := range []string{"laptop", "desktop"} {
+		if err := os.MkdirAll(filepath.Join(store, "snapshots", project), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	projectDir := filepath.Join(store, "snapshots", "desktop")
+
+	// Given as --store, the project directory opens its store
+	b, err := NewBackup(t.TempDir(), projectDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.StoreRoot != store || b.ProjectName != "desktop" {
+		t.Errorf("Expected store %s scoped to desktop, got %s scoped to %q", store, b.StoreRoot, b.ProjectName)
+	}
+	if _, err := os.Stat(filepath.Join(projectDir, ".backup")); !os.IsNotExist(err) {
+		t.Errorf("Expected no store config in the project directory")
+	}
+
+	// Run from the project directory
+	b, err = NewBackup(projectDir, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.StoreRoot != store || b.ProjectName != "desktop" {
+		t.Errorf("Expected store %s scoped to desktop, got %s scoped to %q", store, b.StoreRoot, b.ProjectName)
+	}
+
+	// Other directories of the store keep the default project
+	b, err = NewBackup(filepath.Join(store, "snapshots"), "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.ProjectName != "laptop" {
+		t.Errorf("Expected the default project laptop, got %q", b.ProjectName)
+	}
+}
+
 func TestNewBackup_NonInteractive_Failure(t *testing.T) {
 	tempStore, err := os.MkdirTemp("", "backup_test_store_ni")
 	if err != nil {
@@ -184,3 +349,333 @@ func TestNewBackup_NonInteractive_Failure(t *testing.T) {
 		t.Errorf("Unexpected error message: %v", err)
 	}
 }
+
+func TestSnapshotName_RoundTrip(t *testing.T) {
+	for _, name := range []string{"260101-100000", "260101-100000-1", "260101-100000-12"} {
+		ts, seq, err := ParseSnapshotName(name)
+		if err != nil {
+			t.Fatalf("ParseSnapshotName(%q): %v", name, err)
+		}
+		if got := SnapshotName(ts, seq); got != name {
+			t.Errorf("SnapshotName round trip: got %q, want %q", got, name)
+		}
+	}
+	for _, name := range []string{"260101-10000", "260101-100000-0", "260101-100000-", "260101-100000-01", "260101-100000x1", "latest"} {
+		if _, _, err := ParseSnapshotName(name); err == nil {
+			t.Errorf("Expected ParseSnapshotName(%q) to fail", name)
+		}
+	}
+}
+
+func TestWriteSnapshotHead_SameSecond(t *testing.T) {
+	b := newTestBackup(t)
+	dir := filepath.Join(b.StoreSnapshots, b.ProjectName)
+	now := time.Date(2026, 1, 1, 10, 0, 0, 0, time.Local)
+	var names []string
+	for i := 0; i < 12; i++ {
+		name, err := b.WriteSnapshotHead(b.ProjectName, now, fmt.Sprintf("hash%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	if names[0] != "260101-100000" || names[1] != "260101-100000-1" || names[11] != "260101-100000-11" {
+		t.Errorf("Unexpected snapshot names %v", names)
+	}
+	if _, err := b.WriteSnapshotHead(b.ProjectName, now.Add(time.Second), "later"); err != nil {
+		t.Fatal(err)
+	}
+	// Heads are renamed into place; no partial files are left behind
+	if files, _ := os.ReadDir(dir); len(files) != 13 {
+		t.Errorf("Expected 13 files in the snapshot dir, got %d", len(files))
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, names[3])); string(content) != "hash3\n" {
+		t.Errorf("Unexpected head content %q", content)
+	}
+
+	roots, err := b.BackupRoots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 13 {
+		t.Fatalf("Expected 13 snapshots, got %d", len(roots))
+	}
+	// Counter suffixes sort numerically, before the next second
+	for i, name := range names {
+		if roots[i].Timestamp() != name {
+			t.Errorf("Snapshot %d: got %s, want %s", i, roots[i].Timestamp(), name)
+		}
+	}
+	if roots[12].Timestamp() != "260101-100001" {
+		t.Errorf("Expected latest snapshot 260101-100001, got %s", roots[12].Timestamp())
+	}
+}
+
+func TestNewBackup_GlobalIgnore(t *testing.T) {
+	tempDir := t.TempDir()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	if err := os.WriteFile(filepath.Join(home, "ignore"), []byte("*.swp\n.DS_Store\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(tempDir, ".backup"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(tempDir, "store"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	config := "store = \"store\"\nglobal_ignore = \"~/ignore\"\n"
+	if err := os.WriteFile(filepath.Join(tempDir, ".backup", "config.toml"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Ignore the store and negate one global pattern locally
+	if err := os.WriteFile(filepath.Join(tempDir, ".backupignore"), []byte("store/\n!keep.swp\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.txt", "a.swp", "keep.swp", "sub/.DS_Store"} {
+		path := filepath.Join(tempDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := NewBackup(tempDir, "", true)
+	if err != nil {
+		t.Fatalf("NewBackup failed: %v", err)
+	}
+	if b.GlobalIgnore == nil {
+		t.Fatal("Expected global ignore patterns to be loaded")
+	}
+
+	top := NewDirectoryEntry(b, b.Top, nil)
+	ignored, err := top.Ignored()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reasons := make(map[string]string)
+	for _, ie := range ignored {
+		reasons[ie.Name] = ie.ReasonText()
+	}
+	if reasons["a.swp"] != "Ignored by ~/ignore: *.swp" {
+		t.Errorf("Expected a.swp to be ignored by the global file, got %q", reasons["a.swp"])
+	}
+	if _, ok := reasons["keep.swp"]; ok {
+		t.Error("Expected keep.swp to be re-included by the local ignore file")
+	}
+
+	sub := NewDirectoryEntry(b, filepath.Join(b.Top, "sub"), top.matcher)
+	ignored, err = sub.Ignored()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ignored) != 1 || ignored[0].Name != ".DS_Store" {
+		t.Errorf("Expected sub/.DS_Store to be ignored, got %v", ignored)
+	}
+}
+
+func TestNewBackup_ConfigExclude(t *testing.T) {
+	tempDir := t.TempDir()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	if err := os.WriteFile(filepath.Join(home, "ignore"), []byte("*.swp\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(tempDir, ".backup"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(tempDir, "store"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	config := "store = \"store\"\nglobal_ignore = \"~/ignore\"\nexclude = [\"store/\", \"*.tmp\", \"build/\", \"!keep.swp\"]\n"
+	if err := os.WriteFile(filepath.Join(tempDir, ".backup", "config.toml"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The root ignore file overrides the config
+	if err := os.WriteFile(filepath.Join(tempDir, ".backupignore"), []byte("!important.tmp\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.txt", "a.tmp", "important.tmp", "a.swp", "keep.swp", "build/out.o"} {
+		path := filepath.Join(tempDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := NewBackup(tempDir, "", true)
+	if err != nil {
+		t.Fatalf("NewBackup failed: %v", err)
+	}
+	top := NewDirectoryEntry(b, b.Top, nil)
+	ignored, err := top.Ignored()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reasons := make(map[string]string)
+	for _, ie := range ignored {
+		reasons[ie.Name] = ie.ReasonText()
+	}
+	for name, want := range map[string]string{
+		"a.tmp": "Ignored by config.toml: *.tmp",
+		"build": "Ignored by config.toml: build/",
+		"a.swp": "Ignored by ~/ignore: *.swp",
+	} {
+		if reasons[name] != want {
+			t.Errorf("Expected %s to be %q, got %q", name, want, reasons[name])
+		}
+	}
+	for _, name := range []string{"a.txt", "important.tmp", "keep.swp"} {
+		if _, ok := reasons[name]; ok {
+			t.Errorf("Expected %s not to be ignored", name)
+		}
+	}
+}
+
+func TestBackup_InvalidHeads(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "a.txt", "a")
+	root := snapshotTestBackup(t, b, "260101-100000")
+	if err := b.WriteSnapshotMeta(root.Ref, NewSnapshotMeta("")); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Dir(root.BackupHead)
+	for name, content := range map[string]string{
+		"260101-110000":              "",
+		"260101-110000.meta":         "",
+		"260101-130000":              "not a hash",
+		"notes.txt":                  "hello",
+		"260101-120000.1234.partial": "",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A head that cannot be read
+	if err := os.Symlink("missing", filepath.Join(dir, "260101-140000")); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid, err := b.InvalidHeads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var refs []string
+	for _, h := range invalid {
+		if h.Damaged {
+			refs = append(refs, h.Ref)
+		} else if h.Ref != root.Project()+"/260101-140000" {
+			t.Errorf("Expected only the unreadable head not to count as damaged, got %v", h)
+		}
+	}
+	want := []string{root.Project() + "/260101-110000", root.Project() + "/260101-130000", root.Project() + "/notes.txt"}
+	if !slices.Equal(refs, want) || len(invalid) != 4 {
+		t.Fatalf("Expected damaged heads %v and an unreadable one, got %v", want, invalid)
+	}
+	if err := os.Remove(filepath.Join(dir, "260101-140000")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ref := range refs {
+		if err := b.RemoveHead(ref); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "260101-110000.meta")); !os.IsNotExist(err) {
+		t.Error("Expected the sidecar of a removed head to be removed")
+	}
+	if invalid, err := b.InvalidHeads(); err != nil || len(invalid) != 0 {
+		t.Errorf("Expected no invalid heads after removing them, got %v %v", invalid, err)
+	}
+	if roots, err := b.BackupRoots(); err != nil || len(roots) != 1 || roots[0].Meta == nil {
+		t.Errorf("Expected the valid snapshot and its metadata to be kept, got %v %v", roots, err)
+	}
+}
+
+func TestNewBackup_Includes(t *testing.T) {
+	tempDir := t.TempDir()
+	src := filepath.Join(tempDir, "src")
+	shared := filepath.Join(tempDir, "shared")
+	for _, name := range []string{"src/a.dat", "src/b.txt", "shared/c.dat", "shared/d.log", "shared/sub/e.txt"} {
+		path := filepath.Join(tempDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(src, ".backup"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(tempDir, "store"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	config := "store = \"../store\"\nincludes = [\"../shared\"]\n"
+	if err := os.WriteFile(filepath.Join(src, ".backup", "config.toml"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Each root only applies its own ignore file
+	if err := os.WriteFile(filepath.Join(src, ".backupignore"), []byte("*.dat\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(shared, ".backupignore"), []byte("*.log\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewBackup(src, "", true)
+	if err != nil {
+		t.Fatalf("NewBackup failed: %v", err)
+	}
+	if len(b.Includes) != 1 || b.Includes[0] != shared {
+		t.Fatalf("Expected includes [%s], got %v", shared, b.Includes)
+	}
+
+	root, _, err := b.CreateSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"b.txt", "shared/c.dat", "shared/sub/e.txt"} {
+		if e, err := root.Locate(p); err != nil || e == nil {
+			t.Errorf("Expected %s in the snapshot: %v", p, err)
+		}
+	}
+	for _, p := range []string{"a.dat", "shared/d.log"} {
+		if e, _ := root.Locate(p); e != nil {
+			t.Errorf("Expected %s to be ignored", p)
+		}
+	}
+
+	// An include cannot take the name of an entry of the source tree
+	if err := os.Mkdir(filepath.Join(src, "shared"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDirectoryEntry(b, b.Top, nil).Hash(); err == nil || !strings.Contains(err.Error(), "conflicts") {
+		t.Errorf("Expected a conflict error, got %v", err)
+	}
+}
+
+func TestResolveIncludes_Invalid(t *testing.T) {
+	top := t.TempDir()
+	for _, dir := range []string{"a/x", "b/x"} {
+		if err := os.MkdirAll(filepath.Join(top, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := resolveIncludes(top, []string{"a/x", "b/x"}); err == nil {
+		t.Error("Expected an error for includes with the same name")
+	}
+	if _, err := resolveIncludes(top, []string{"missing"}); err == nil {
+		t.Error("Expected an error for a missing include")
+	}
+	if _, err := os.Create(filepath.Join(top, "plain")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resolveIncludes(top, []string{"plain"}); err == nil {
+		t.Error("Expected an error for an include that is not a directory")
+	}
+}
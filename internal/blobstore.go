@@ -0,0 +1,240 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Blobstore holds the blobs of a store, keyed by hash. Blobs are passed in
+// their stored form; the Store compresses and decompresses them. Missing
+// blobs are reported with errors matching fs.ErrNotExist.
+type Blobstore interface {
+	Has(hash string) (bool, error)
+	// Size returns the stored size of a blob.
+	Size(hash string) (int64, error)
+	Get(hash string) (io.ReadCloser, error)
+	// Put stores the blob read from r, replacing an existing one. The blob
+	// only becomes visible once it is complete.
+	Put(hash string, r io.Reader) error
+	Delete(hash string) error
+	List() ([]string, error)
+}
+
+// localBlobstore keeps the blobs in a local directory, the store's data
+// directory unless store.toml names another one.
+type localBlobstore struct {
+	s   *Store
+	dir string
+}
+
+func (l *localBlobstore) path(hash string) (string, error) {
+	p := l.s.blobPath(l.dir, hash)
+	if p == "" {
+		return "", fmt.Errorf("invalid hash %q", hash)
+	}
+	return p, nil
+}
+
+func (l *localBlobstore) Has(hash string) (bool, error) {
+	_, err := l.Size(hash)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (l *localBlobstore) Size(hash string) (int64, error) {
+	p, err := l.path(hash)
+	if err != nil {
+		return 0, err
+	}
+	var info os.FileInfo
+	err = l.s.retry(func() (err error) {
+		info, err = os.Stat(p)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (l *localBlobstore) Get(hash string) (io.ReadCloser, error) {
+	p, err := l.path(hash)
+	if err != nil {
+		return nil, err
+	}
+	var f *os.File
+	err = l.s.retry(func() (err error) {
+		f, err = os.Open(p)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Put writes the blob to a partial file next to its path and renames it
+// into place.
+func (l *localBlobstore) Put(hash string, r io.Reader) error {
+	p, err := l.path(hash)
+	if err != nil {
+		return err
+	}
+	var out *os.File
+	err = l.s.retry(func() (err error) {
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		out, err = createPartial(p)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, r)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	return l.s.retryMove(func() error { return os.Rename(out.Name(), p) }, func() bool { return moved(out.Name(), p) })
+}
+
+// moved reports whether a rename of src to dest took effect: src is gone
+// and dest exists.
+func moved(src, dest string) bool {
+	if _, err := os.Lstat(src); !os.IsNotExist(err) {
+		return false
+	}
+	_, err := os.Lstat(dest)
+	return err == nil
+}
+
+// putFile moves the local file at path into place as the blob hash.
+func (l *localBlobstore) putFile(hash, path string) error {
+	p, err := l.path(hash)
+	if err != nil {
+		return err
+	}
+	return l.s.retryMove(func() error {
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		return os.Rename(path, p)
+	}, func() bool { return moved(path, p) })
+}
+
+func (l *localBlobstore) Delete(hash string) error {
+	p, err := l.path(hash)
+	if err != nil {
+		return err
+	}
+	return l.s.retryMove(func() error { return os.Remove(p) }, func() bool { return true })
+}
+
+// List returns the hashes of the blobs in the data directory. A missing
+// data directory holds no blobs.
+func (l *localBlobstore) List() ([]string, error) {
+	var hashes []string
+	_, depth := l.s.shards()
+	err := l.s.collectBlobs(l.dir, nil, depth, func(dir string) ([]fs.FileInfo, error) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		infos := make([]fs.FileInfo, 0, len(entries))
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil {
+				continue // Removed since it was listed
+			}
+			infos = append(infos, info)
+		}
+		return infos, nil
+	}, filepath.Join, &hashes)
+	if errors.Is(err, fs.ErrNotExist) {
+		return hashes, nil
+	}
+	return hashes, err
+}
+
+// collectBlobs appends the hashes of the blobs below dir, which is reached
+// through the shard directories shards and has depth levels of
+// subdirectories left, to hashes. Blob stores pass their way of reading and
+// joining directories.
+func (s *Store) collectBlobs(dir string, shards []string, depth int, readDir func(string) ([]fs.FileInfo, error), join func(...string) string, hashes *[]string) error {
+	entries, err := readDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if depth > 0 {
+			if e.IsDir() {
+				if err := s.collectBlobs(join(dir, e.Name()), append(shards, e.Name()), depth-1, readDir, join, hashes); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if e.IsDir() {
+			continue
+		}
+		// Skips .partial files and anything else that is not a blob, and
+		// misfiled blobs, which cannot be read by their hash
+		if hash, ok := s.blobName(e.Name()); ok && s.inShard(hash, shards) {
+			*hashes = append(*hashes, hash)
+		}
+	}
+	return nil
+}
+
+// blobReader closes the stored blob along with the reader decompressing it.
+type blobReader struct {
+	io.ReadCloser
+	blob io.Closer
+}
+
+func (r *blobReader) Close() error {
+	err := r.ReadCloser.Close()
+	if cerr := r.blob.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// openBlob returns the uncompressed content of the blob hash.
+func (s *Store) openBlob(hash string) (io.ReadCloser, error) {
+	f, err := s.Blobs.Get(hash)
+	if err != nil {
+		return nil, err
+	}
+	r, err := s.newReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &blobReader{ReadCloser: r, blob: f}, nil
+}
+
+// hasBlob reports whether the blob hash is in the store.
+func (s *Store) hasBlob(hash string) bool {
+	ok, _ := s.Blobs.Has(hash)
+	return ok
+}
+
+// blobLocation describes where the blob hash is stored, for messages: its
+// path in a local store.
+func (s *Store) blobLocation(hash string) string {
+	if l, ok := s.Blobs.(*localBlobstore); ok {
+		return s.blobPath(l.dir, hash)
+	}
+	return hash
+}
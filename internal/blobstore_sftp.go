@@ -0,0 +1,293 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpBlobstore keeps the blobs in a directory of an SFTP server, with the
+// same layout as the data directory of a local store.
+type sftpBlobstore struct {
+	client *sftp.Client
+	root   string
+	s      *Store
+}
+
+func newSFTPBlobstore(s *Store, client *sftp.Client, root string) *sftpBlobstore {
+	return &sftpBlobstore{client: client, root: root, s: s}
+}
+
+func (r *sftpBlobstore) path(hash string) (string, error) {
+	name, err := r.s.BlobName(hash)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(r.root, name), nil
+}
+
+func (r *sftpBlobstore) Has(hash string) (bool, error) {
+	_, err := r.Size(hash)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (r *sftpBlobstore) Size(hash string) (int64, error) {
+	p, err := r.path(hash)
+	if err != nil {
+		return 0, err
+	}
+	var info os.FileInfo
+	err = r.s.retry(func() (err error) {
+		info, err = r.client.Stat(p)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (r *sftpBlobstore) Get(hash string) (io.ReadCloser, error) {
+	p, err := r.path(hash)
+	if err != nil {
+		return nil, err
+	}
+	var f *sftp.File
+	err = r.s.retry(func() (err error) {
+		f, err = r.client.Open(p)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Put uploads the blob to a partial file next to its path and renames it
+// into place. Servers without the posix-rename extension refuse to rename
+// over an existing file, which then already holds the same content.
+func (r *sftpBlobstore) Put(hash string, src io.Reader) error {
+	p, err := r.path(hash)
+	if err != nil {
+		return err
+	}
+	temp, err := sftpUpload(r.s, r.client, p, src)
+	if err != nil {
+		return err
+	}
+	moved := func() bool {
+		if _, err := r.client.Lstat(temp); !errors.Is(err, fs.ErrNotExist) {
+			return false
+		}
+		_, err := r.client.Lstat(p)
+		return err == nil
+	}
+	if err := r.s.retryMove(func() error { return r.client.PosixRename(temp, p) }, moved); err == nil {
+		return nil
+	}
+	if err := r.s.retryMove(func() error { return r.client.Rename(temp, p) }, moved); err != nil {
+		r.client.Remove(temp)
+		if ok, _ := r.Has(hash); ok {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// sftpUpload writes src to a new partial file next to dest, creating the
+// directory of dest, and returns its name. Creating the file is retried as
+// the store s sets; a nil s does not retry.
+func sftpUpload(s *Store, client *sftp.Client, dest string, src io.Reader) (string, error) {
+	var suffix [8]byte
+	if _, err := rand.Read(suffix[:]); err != nil {
+		return "", err
+	}
+	temp := dest + "." + hex.EncodeToString(suffix[:]) + ".partial"
+	var out *sftp.File
+	err := s.retry(func() (err error) {
+		if err := client.MkdirAll(path.Dir(dest)); err != nil {
+			return err
+		}
+		out, err = client.Create(temp)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(out, src)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		client.Remove(temp)
+		return "", err
+	}
+	return temp, nil
+}
+
+func (r *sftpBlobstore) Delete(hash string) error {
+	p, err := r.path(hash)
+	if err != nil {
+		return err
+	}
+	return r.s.retryMove(func() error { return r.client.Remove(p) }, func() bool { return true })
+}
+
+// List returns the hashes of the blobs below the remote directory. A
+// missing directory holds no blobs.
+func (r *sftpBlobstore) List() ([]string, error) {
+	var hashes []string
+	_, depth := r.s.shards()
+	err := r.s.collectBlobs(r.root, nil, depth, r.client.ReadDir, path.Join, &hashes)
+	if errors.Is(err, fs.ErrNotExist) {
+		return hashes, nil
+	}
+	return hashes, err
+}
+
+// sftpBackend keeps stores on SFTP servers, for
+// sftp://[user@]host[:port]/path URLs. The server's host key must be listed
+// in ~/.ssh/known_hosts. Authentication uses the password of the URL if
+// any, the SSH agent and the default private keys in ~/.ssh. Connections
+// are shared by the URLs of the same user and server.
+type sftpBackend struct {
+	mu      sync.Mutex
+	clients map[string]*sftp.Client
+}
+
+func init() {
+	RegisterBackend("sftp", &sftpBackend{clients: make(map[string]*sftp.Client)})
+}
+
+func (sb *sftpBackend) OpenBlobstore(s *Store, u *url.URL) (Blobstore, error) {
+	client, err := sb.dial(u)
+	if err != nil {
+		return nil, err
+	}
+	return newSFTPBlobstore(s, client, u.Path), nil
+}
+
+func (sb *sftpBackend) OpenRefStore(u *url.URL) (RefStore, error) {
+	client, err := sb.dial(u)
+	if err != nil {
+		return nil, err
+	}
+	return &sftpRefStore{client: client, root: u.Path}, nil
+}
+
+func (sb *sftpBackend) OpenStateFiles(u *url.URL) (StateFiles, error) {
+	client, err := sb.dial(u)
+	if err != nil {
+		return nil, err
+	}
+	return &sftpStateFiles{sftpRefStore{client: client, root: u.Path}}, nil
+}
+
+func (sb *sftpBackend) ReadFile(u *url.URL) ([]byte, error) {
+	client, err := sb.dial(u)
+	if err != nil {
+		return nil, err
+	}
+	f, err := client.Open(u.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// dial returns the client connected to the server of u.
+func (sb *sftpBackend) dial(u *url.URL) (*sftp.Client, error) {
+	if u.Hostname() == "" || u.Path == "" {
+		return nil, fmt.Errorf("invalid location %q: expected sftp://[user@]host[:port]/path", u.Redacted())
+	}
+	name := u.User.Username()
+	if name == "" {
+		current, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		name = current.Username
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	key := name + "@" + addr
+	if client, ok := sb.clients[key]; ok {
+		return client, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	hostKeys, err := knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot check the host key of %s: %w", u.Host, err)
+	}
+	config := &ssh.ClientConfig{
+		User:            name,
+		Auth:            sshAuthMethods(u, home),
+		HostKeyCallback: hostKeys,
+	}
+	conn, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to %s: %w", addr, err)
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("cannot start sftp on %s: %w", addr, err)
+	}
+	sb.clients[key] = client
+	return client, nil
+}
+
+func sshAuthMethods(u *url.URL, home string) []ssh.AuthMethod {
+	var methods []ssh.AuthMethod
+	if password, ok := u.User.Password(); ok {
+		methods = append(methods, ssh.Password(password))
+	}
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+	var signers []ssh.Signer
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		key, err := os.ReadFile(filepath.Join(home, ".ssh", name))
+		if err != nil {
+			continue
+		}
+		// Keys with a passphrase are left to the agent
+		if signer, err := ssh.ParsePrivateKey(key); err == nil {
+			signers = append(signers, signer)
+		}
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	return methods
+}
@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+// newTestSFTPBackup returns a test backup whose blobs are kept by an
+// in-memory SFTP server.
+func newTestSFTPBackup(t *testing.T) (*Backup, *sftp.Client) {
+	t.Helper()
+	b := newTestBackup(t)
+	serverConn, clientConn := net.Pipe()
+	server := sftp.NewRequestServer(serverConn, sftp.InMemHandler())
+	go server.Serve()
+	client, err := sftp.NewClientPipe(clientConn, clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	b.Store.Blobs = newSFTPBlobstore(b.Store, client, "/backup/data")
+	return b, client
+}
+
+func TestSFTPBlobstore(t *testing.T) {
+	b, client := newTestSFTPBackup(t)
+	b.ChunkThreshold = 1 << 20
+	writeTestFile(t, b, "a.txt", "a")
+	writeTestFile(t, b, "sub/b.txt", "b")
+	writeTestFile(t, b, "big.bin", string(randomData(7, 2<<20)))
+	first := snapshotTestBackup(t, b, "260101-100000")
+
+	all, err := b.GetAllBlobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) < 5 {
+		t.Fatalf("Expected the blobs on the server, got %v", all)
+	}
+	if entries, _ := os.ReadDir(b.StoreData); len(entries) != 0 {
+		t.Errorf("Expected no local blobs, got %d entries", len(entries))
+	}
+	for hash := range all {
+		if _, err := client.Stat("/backup/data/" + hash[:2] + "/" + hash + b.Store.codec().Ext); err != nil {
+			t.Errorf("Blob not in the sharded layout: %v", err)
+		}
+	}
+	if errs := b.Verify(true); len(errs) != 0 {
+		t.Errorf("Unexpected verify errors: %v", errs)
+	}
+
+	dest := filepath.Join(t.TempDir(), "restore")
+	if err := b.Restore(first.Timestamp(), "", dest, RestoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dest, "sub", "b.txt")); string(got) != "b" {
+		t.Errorf("Restored sub/b.txt = %q", got)
+	}
+
+	// Dropping the snapshot leaves every blob unreferenced
+	if err := os.Remove(first.BackupHead); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := b.Prune(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.BlobsRemoved != len(all) {
+		t.Errorf("Expected %d blobs to be pruned, got %d", len(all), stats.BlobsRemoved)
+	}
+	if left, _ := b.GetAllBlobs(); len(left) != 0 {
+		t.Errorf("Expected no blobs left, got %v", left)
+	}
+
+	// A missing blob is reported like in a local store
+	writeTestFile(t, b, "c.txt", "c")
+	second := snapshotTestBackup(t, b, "260102-100000")
+	top, err := second.TopDirectory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := top.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Store.Blobs.Delete(entries["c.txt"].Hash()); err != nil {
+		t.Fatal(err)
+	}
+	errs := b.Verify(false)
+	if len(errs) != 1 {
+		t.Fatalf("Expected one verify error, got %v", errs)
+	}
+	if _, ok := errs[0].(*MissingBlobError); !ok {
+		t.Errorf("Expected a MissingBlobError, got %T: %v", errs[0], errs[0])
+	}
+}
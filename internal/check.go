@@ -2,20 +2,195 @@ package internal
 
 import (
 	"bufio"
-	"compress/gzip"
-	"crypto/md5"
+	"errors"
 	"fmt"
-	"io"
+	"io/fs"
+	"math"
+	"math/rand"
 	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
 )
 
+// MissingBlobError reports a blob that is referenced but not in the store.
+// Kind names what the blob holds when it is known, e.g. "directory listing".
+type MissingBlobError struct {
+	Hash string
+	Kind string
+	Path string
+}
+
+func (e *MissingBlobError) Error() string {
+	kind := e.Kind
+	if kind == "" {
+		kind = "blob"
+	}
+	if e.Path != "" {
+		return fmt.Sprintf("missing %s: %s (path: %s)", kind, e.Hash, e.Path)
+	}
+	return fmt.Sprintf("missing %s: %s", kind, e.Hash)
+}
+
+// CorruptBlobError reports a blob that is empty (Err is nil) or whose
+// content does not match its hash.
+type CorruptBlobError struct {
+	Hash string
+	Err  error
+}
+
+func (e *CorruptBlobError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("empty blob: %s", e.Hash)
+	}
+	return fmt.Sprintf("corrupted blob %s: %v", e.Hash, e.Err)
+}
+
+func (e *CorruptBlobError) Unwrap() error { return e.Err }
+
+// UnreferencedBlobError reports a blob that no snapshot references. Such
+// blobs waste space but do not affect integrity; prune removes them.
+type UnreferencedBlobError struct {
+	Hash string
+}
+
+func (e *UnreferencedBlobError) Error() string {
+	return fmt.Sprintf("unreferenced blob: %s", e.Hash)
+}
+
+// TypeMismatchError reports a blob referenced as a directory that does not
+// hold a directory listing (Err tells why), or a blob referenced both as a
+// directory and as file content (Err is nil). Content that merely looks like
+// a listing is a valid file, so file blobs are only reported in the second
+// case.
+type TypeMismatchError struct {
+	Hash string
+	Err  error
+}
+
+func (e *TypeMismatchError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("type mismatch: %s is referenced both as a directory and as a file", e.Hash)
+	}
+	return fmt.Sprintf("type mismatch: %s is referenced as a directory but is not a directory listing: %v", e.Hash, e.Err)
+}
+
+func (e *TypeMismatchError) Unwrap() error { return e.Err }
+
+// MisfiledBlobError reports a blob file that is not in the shard
+// directories of its hash, so it cannot be read by its hash.
+type MisfiledBlobError struct {
+	Hash string
+	Path string
+}
+
+func (e *MisfiledBlobError) Error() string {
+	return fmt.Sprintf("misfiled blob %s: %s", e.Hash, e.Path)
+}
+
 // Verify checks the integrity of the backup store.
-// If deep is true, it verifies the content hash of every blob.
-// It returns a list of errors found (missing files, corrupted content).
+// If deep is true, it verifies the content hash of every blob, referenced or
+// not, using up to b.Jobs concurrent workers.
+// It returns a list of errors found: *MissingBlobError, *CorruptBlobError,
+// *TypeMismatchError, *MisfiledBlobError and *UnreferencedBlobError for
+// individual blobs, plain errors otherwise.
 func (b *Backup) Verify(deep bool) []error {
+	errs := b.verifyRoots(deep)
+
+	// Unreferenced blobs
+	unreferenced, err := b.FindUnreferenced()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("unreferenced blob detection failed: %w", err))
+	} else if len(unreferenced) > 0 {
+		// Unreferenced blobs are a cleanliness issue rather than damage;
+		// their type lets callers tell them apart
+		for _, o := range unreferenced {
+			errs = append(errs, &UnreferencedBlobError{Hash: o})
+		}
+		// A blob whose content does not match its name is damage even
+		// if nothing references it
+		if deep {
+			errs = append(errs, b.hashBlobs(unreferenced)...)
+		}
+	}
+
+	misfiled, err := b.Store.FindMisfiled()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("misfiled blob detection failed: %w", err))
+	}
+	for _, p := range misfiled {
+		hash, _ := b.Store.blobName(filepath.Base(p))
+		errs = append(errs, &MisfiledBlobError{Hash: hash, Path: p})
+	}
+
+	// Leftovers of interrupted writes do not affect integrity, so they are
+	// reported as warnings only.
+	partials, err := b.Store.FindPartials()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("partial file detection failed: %w", err))
+	}
+	for _, p := range partials {
+		b.warnf("leftover partial file %s (remove with check --clean-partials)", p)
+	}
+
+	// Check hash cache if present
+	if b.HashCache != nil {
+		if err := b.HashCache.Verify(); err != nil {
+			errs = append(errs, fmt.Errorf("hash cache verification failed: %w", err))
+		}
+	}
+
+	return errs
+}
+
+// QuarantineBlobs moves the blob files of the *CorruptBlobError and
+// *MisfiledBlobError results of Verify out of the data directory into
+// .backup/quarantine of the store, where they are kept for inspection
+// instead of being read as valid blobs. It returns the new paths. Blobs of
+// a remote data location are left alone.
+func (b *Backup) QuarantineBlobs(errs []error) ([]string, error) {
+	dir := filepath.Join(b.StoreRoot, ".backup", "quarantine")
+	var moved []string
+	for _, err := range errs {
+		var path string
+		var corrupt *CorruptBlobError
+		var misfiled *MisfiledBlobError
+		switch {
+		case errors.As(err, &corrupt):
+			l, ok := b.Store.Blobs.(*localBlobstore)
+			if !ok {
+				return moved, fmt.Errorf("cannot quarantine blob %s of a remote data location", corrupt.Hash)
+			}
+			path = b.Store.blobPath(l.dir, corrupt.Hash)
+		case errors.As(err, &misfiled):
+			path = misfiled.Path
+		default:
+			continue
+		}
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			continue // Reported twice, e.g. as referenced and corrupted
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return moved, err
+		}
+		dest := filepath.Join(dir, filepath.Base(path))
+		for n := 1; fileExists(dest); n++ {
+			dest = filepath.Join(dir, fmt.Sprintf("%s.%d", filepath.Base(path), n))
+		}
+		if err := os.Rename(path, dest); err != nil {
+			return moved, fmt.Errorf("failed to quarantine %s: %w", path, err)
+		}
+		moved = append(moved, dest)
+	}
+	return moved, nil
+}
+
+// verifyRoots checks the blobs reachable from every snapshot.
+func (b *Backup) verifyRoots(deep bool) []error {
 	var errs []error
 	verifiedBlobs := make(map[string]bool)
-	traversedDirs := make(map[string]bool)
+	refKinds := make(map[string]byte)
 
 	roots, err := b.BackupRoots()
 	if err != nil {
@@ -31,147 +206,345 @@ func (b *Backup) Verify(deep bool) []error {
 		}
 
 		// Traverse
-		if err := b.verifyTree(h, deep, verifiedBlobs, traversedDirs, &errs); err != nil {
+		if err := b.verifyTree(h, verifiedBlobs, refKinds, &errs); err != nil {
 			errs = append(errs, fmt.Errorf("traversal error for root %s: %w", root.BackupHead, err))
 		}
 	}
+	if deep {
+		errs = append(errs, b.verifyBlobHashes(verifiedBlobs)...)
+	}
+	return errs
+}
 
-	// Unreferenced blobs
-	unreferenced, err := b.FindUnreferenced()
+// VerifySnapshot checks the blobs reachable from a single snapshot. Unlike
+// Verify it does not scan the store for unreferenced blobs or partial files,
+// so it is fast enough to run right after a backup.
+func (b *Backup) VerifySnapshot(root *BackupRoot, deep bool) []error {
+	var errs []error
+	h, err := root.Hash()
 	if err != nil {
-		errs = append(errs, fmt.Errorf("unreferenced blob detection failed: %w", err))
-	} else if len(unreferenced) > 0 {
-		// Report unreferenced blobs as errors?
-		// The user request was "detection of orphaned blobs in the check command".
-		// Typically orphans are not "errors" in integrity, but they are "cleanliness" issues.
-		// `git fsck` reports them.
-		// "integrity check failed" output in CLI implies CRITICAL errors.
-		// If I return them as errors, command exits with 1.
-		// Ideally we report them as warnings or just listed.
-		// But `Verify` signature is `[]error`.
-		// Let's create a custom error type or just format it.
-		// "Unreferenced blob: <hash>"
-		for _, o := range unreferenced {
-			errs = append(errs, fmt.Errorf("unreferenced blob: %s", o))
-		}
+		return []error{fmt.Errorf("root %s corrupted: %w", root.BackupHead, err)}
 	}
+	verifiedBlobs := make(map[string]bool)
+	if err := b.verifyTree(h, verifiedBlobs, make(map[string]byte), &errs); err != nil {
+		errs = append(errs, fmt.Errorf("traversal error for root %s: %w", root.BackupHead, err))
+	}
+	if deep {
+		errs = append(errs, b.verifyBlobHashes(verifiedBlobs)...)
+	}
+	return errs
+}
 
-	// Check hash cache if present
-	if b.HashCache != nil {
-		if err := b.HashCache.Verify(); err != nil {
-			errs = append(errs, fmt.Errorf("hash cache verification failed: %w", err))
+// VerifyHeads is the fast check of the snapshots: it only checks that every
+// snapshot head holds a valid hash and that its top directory listing is in
+// the store and decompresses, without following the listing or scanning the
+// store. Files among the heads that are not readable heads (see
+// InvalidHeads) are reported too. It returns the number of heads checked.
+func (b *Backup) VerifyHeads() (int, []error) {
+	invalid, err := b.InvalidHeads()
+	if err != nil {
+		return 0, []error{fmt.Errorf("failed to list snapshot heads: %w", err)}
+	}
+	roots, err := b.BackupRoots()
+	if err != nil {
+		return 0, []error{fmt.Errorf("failed to list backup roots: %w", err)}
+	}
+	var errs []error
+	checked := len(roots)
+	skip := make(map[string]bool)
+	for _, head := range invalid {
+		if b.ProjectName != "" && path.Dir(head.Ref) != b.ProjectName {
+			continue
 		}
+		errs = append(errs, fmt.Errorf("snapshot head %s: %w", head.Ref, head.Err))
+		skip[head.Ref] = true
+		checked++
 	}
+	verifiedBlobs := make(map[string]bool)
+	for _, root := range roots {
+		if skip[root.Ref] {
+			checked-- // Already counted and reported
+			continue
+		}
+		h, err := root.Hash()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("root %s corrupted: %w", root.BackupHead, err))
+			continue
+		}
+		if !b.Store.ValidHash(h) {
+			errs = append(errs, fmt.Errorf("root %s corrupted: %q is not a valid %s hash", root.BackupHead, h, b.Store.HashName))
+			continue
+		}
+		if _, ok := verifiedBlobs[h]; ok {
+			continue // Snapshots of an unchanged tree share their listing
+		}
+		if err := b.verifyBlob(h, verifiedBlobs, &errs); err != nil {
+			errs = append(errs, fmt.Errorf("root %s: %w", root.BackupHead, err))
+			continue
+		}
+		if !verifiedBlobs[h] {
+			continue
+		}
+		if err := b.Store.readListing(h); err != nil {
+			verifiedBlobs[h] = false
+			errs = append(errs, err)
+		}
+	}
+	return checked, errs
+}
 
-	return errs
+// readListing reads the directory listing hash to its end without following
+// it. Content that does not decompress is reported as a *CorruptBlobError,
+// content that is not a listing as a *TypeMismatchError.
+func (s *Store) readListing(hash string) error {
+	r, err := s.openBlob(hash)
+	if err != nil {
+		return &CorruptBlobError{Hash: hash, Err: err}
+	}
+	defer r.Close()
+	scanner := newListingScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		if _, err := scanner.Entry(); err != nil {
+			return &TypeMismatchError{Hash: hash, Err: fmt.Errorf("line %d: %w", line, err)}
+		}
+	}
+	if err := scanner.Err(); errors.Is(err, bufio.ErrTooLong) {
+		return &TypeMismatchError{Hash: hash, Err: err}
+	} else if err != nil {
+		return &CorruptBlobError{Hash: hash, Err: err}
+	}
+	return nil
 }
 
-func (b *Backup) verifyTree(hash string, deep bool, verifiedBlobs, traversedDirs map[string]bool, errs *[]error) error {
+func (b *Backup) verifyTree(hash string, verifiedBlobs map[string]bool, refKinds map[string]byte, errs *[]error) error {
 	// Root is a directory, so we verify blob and traverse
-	if err := b.verifyBlob(hash, deep, verifiedBlobs, errs); err != nil {
+	if err := b.verifyBlob(hash, verifiedBlobs, errs); err != nil {
 		return err // Blob invalid
 	}
-	return b.traverseDirectory(hash, deep, verifiedBlobs, traversedDirs, errs)
+	if !b.markReferenced(hash, 'D', refKinds, errs) {
+		return nil
+	}
+	return b.traverseDirectory(hash, verifiedBlobs, refKinds, errs)
+}
+
+// markReferenced records that hash is referenced as kind: 'D' for directory
+// listings, 'C' for chunk manifests and 'F' for file content. refKinds maps
+// every referenced blob to its kind, or to 0 once a mismatch was reported.
+// It reports a blob referenced both as a directory and otherwise, and
+// returns whether this is the first reference to hash. Empty content is
+// both an empty file and the empty directory listing of older versions, so
+// it may be referenced as both.
+func (b *Backup) markReferenced(hash string, kind byte, refKinds map[string]byte, errs *[]error) bool {
+	prev, seen := refKinds[hash]
+	if !seen {
+		refKinds[hash] = kind
+		return true
+	}
+	if prev != 0 && (prev == 'D') != (kind == 'D') && hash != b.Store.HashBytes(nil) {
+		*errs = append(*errs, &TypeMismatchError{Hash: hash})
+		refKinds[hash] = 0
+	}
+	return false
 }
 
-func (b *Backup) verifyBlob(hash string, deep bool, verifiedBlobs map[string]bool, errs *[]error) error {
-	if verifiedBlobs[hash] {
+// verifyBlob checks that a blob exists and is not empty. verifiedBlobs maps
+// every checked blob to whether it passed, so that only those are hashed by
+// a deep verification.
+func (b *Backup) verifyBlob(hash string, verifiedBlobs map[string]bool, errs *[]error) error {
+	if _, ok := verifiedBlobs[hash]; ok {
 		return nil
 	}
 
-	storePath := b.Store.DataStore(hash)
+	if !b.Store.ValidHash(hash) {
+		*errs = append(*errs, fmt.Errorf("invalid blob hash %s: expected %d hex characters for %s", hash, b.Store.HashLen(), b.Store.HashName))
+		verifiedBlobs[hash] = false
+		return nil
+	}
 
 	// 1. Check existence
-	info, err := os.Stat(storePath)
-	if os.IsNotExist(err) {
-		*errs = append(*errs, fmt.Errorf("missing blob: %s (path: %s)", hash, storePath))
-		verifiedBlobs[hash] = true // Mark as visited to avoid repeated error
+	size, err := b.Store.Blobs.Size(hash)
+	if errors.Is(err, fs.ErrNotExist) {
+		*errs = append(*errs, &MissingBlobError{Hash: hash, Path: b.Store.blobLocation(hash)})
+		verifiedBlobs[hash] = false // Mark as visited to avoid repeated error
 		return nil
 	}
 	if err != nil {
 		return err
 	}
-	if info.Size() == 0 {
-		*errs = append(*errs, fmt.Errorf("empty blob: %s", hash))
-		verifiedBlobs[hash] = true
+	if size == 0 {
+		*errs = append(*errs, &CorruptBlobError{Hash: hash})
+		verifiedBlobs[hash] = false
 		return nil
 	}
 
-	// 2. Check content integrity (Deep)
-	if deep {
-		if err := verifyBlobHash(storePath, hash); err != nil {
-			*errs = append(*errs, fmt.Errorf("corrupted blob %s: %w", hash, err))
-			verifiedBlobs[hash] = true
-			return nil
-		}
-	}
-
 	verifiedBlobs[hash] = true
 	return nil
 }
 
-func (b *Backup) traverseDirectory(hash string, deep bool, verifiedBlobs, traversedDirs map[string]bool, errs *[]error) error {
-	if traversedDirs[hash] {
+// verifyBlobHashes checks the content hash of the blobs that passed
+// verifyBlob. Decompressing and hashing dominates a deep verification and
+// the blobs are independent, so they are hashed by up to b.Jobs workers.
+func (b *Backup) verifyBlobHashes(verifiedBlobs map[string]bool) []error {
+	var hashes []string
+	for hash, ok := range verifiedBlobs {
+		if ok {
+			hashes = append(hashes, hash)
+		}
+	}
+	sort.Strings(hashes)
+	return b.hashBlobs(hashes)
+}
+
+// hashBlobs checks the content hash of the given blobs concurrently and
+// returns a *CorruptBlobError for each mismatch, in the order of hashes.
+func (b *Backup) hashBlobs(hashes []string) []error {
+	results := make([]error, len(hashes))
+	runParallel(b.Jobs, len(hashes), func(i int) error {
+		if err := b.Store.verifyBlobHash(hashes[i]); err != nil {
+			results[i] = &CorruptBlobError{Hash: hashes[i], Err: err}
+		}
 		return nil
+	})
+
+	var errs []error
+	for _, err := range results {
+		if err != nil {
+			errs = append(errs, err)
+		}
 	}
-	traversedDirs[hash] = true
+	return errs
+}
 
-	storePath := b.Store.DataStore(hash)
-	f, err := os.Open(storePath)
+// VerifySample checks the content hash of a random fraction of the blobs in
+// the store, rounded up to at least one blob. The same seed selects the same
+// blobs as long as the store does not change. It returns the number of blobs
+// checked and in the store.
+func (b *Backup) VerifySample(fraction float64, seed int64) (sampled, total int, errs []error) {
+	all, err := b.GetAllBlobs()
 	if err != nil {
-		return err
+		return 0, 0, []error{fmt.Errorf("failed to list blobs: %w", err)}
 	}
-	defer f.Close()
+	hashes := make([]string, 0, len(all))
+	for hash := range all {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
 
-	gz, err := gzip.NewReader(f)
+	n := int(math.Ceil(fraction * float64(len(hashes))))
+	if n > len(hashes) {
+		n = len(hashes)
+	}
+	rng := rand.New(rand.NewSource(seed))
+	rng.Shuffle(len(hashes), func(i, j int) { hashes[i], hashes[j] = hashes[j], hashes[i] })
+	sample := hashes[:n]
+	sort.Strings(sample)
+	return n, len(hashes), b.hashBlobs(sample)
+}
+
+// traverseDirectory checks the entries of the directory listing hash and
+// descends into its subdirectories and chunk manifests. A blob that does not
+// parse as a listing is reported as a *TypeMismatchError.
+func (b *Backup) traverseDirectory(hash string, verifiedBlobs map[string]bool, refKinds map[string]byte, errs *[]error) error {
+	gz, err := b.Store.openBlob(hash)
+	if errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
 	if err != nil {
 		*errs = append(*errs, fmt.Errorf("failed to read dir content %s: %w", hash, err))
 		return nil
 	}
 	defer gz.Close()
 
-	scanner := bufio.NewScanner(gz)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if len(line) < 36 {
-			continue
+	// Parse the whole listing before following it, so that nothing is
+	// checked on behalf of a blob that is not a listing
+	var entries []listingLine
+	scanner := newListingScanner(gz)
+	for line := 1; scanner.Scan(); line++ {
+		l, err := scanner.Entry()
+		if err == nil && !strings.ContainsRune("DFCL", rune(l.Type)) {
+			err = fmt.Errorf("unknown entry type %q", l.Type)
+		}
+		if err != nil {
+			*errs = append(*errs, &TypeMismatchError{Hash: hash, Err: fmt.Errorf("line %d: %w", line, err)})
+			refKinds[hash] = 0
+			return nil
 		}
-		typeChar := line[0]
-		childHash := line[2:34]
+		entries = append(entries, l)
+	}
+	if err := scanner.Err(); errors.Is(err, bufio.ErrTooLong) {
+		*errs = append(*errs, &TypeMismatchError{Hash: hash, Err: err})
+		refKinds[hash] = 0
+		return nil
+	} else if err != nil {
+		*errs = append(*errs, fmt.Errorf("failed to read dir content %s: %w", hash, err))
+		return nil
+	}
 
+	for _, l := range entries {
 		// Always verify the child blob exists/is valid
 		// This handles files and directories blobs.
-		b.verifyBlob(childHash, deep, verifiedBlobs, errs)
+		b.verifyBlob(l.Hash, verifiedBlobs, errs)
 
-		// If directory, recurse too
-		if typeChar == 'D' {
-			if err := b.traverseDirectory(childHash, deep, verifiedBlobs, traversedDirs, errs); err != nil {
-				// Don't append error here, assume traverseDirectory appended specifics
+		kind := l.Type
+		if kind == 'L' {
+			kind = 'F'
+		}
+		if !b.markReferenced(l.Hash, kind, refKinds, errs) {
+			continue
+		}
+		switch kind {
+		case 'D':
+			// Errors were appended by traverseDirectory
+			b.traverseDirectory(l.Hash, verifiedBlobs, refKinds, errs)
+		case 'C':
+			size, ok := b.verifyChunks(l.Hash, verifiedBlobs, refKinds, errs)
+			if ok && l.Attrs.Size > 0 && size != l.Attrs.Size {
+				*errs = append(*errs, fmt.Errorf("listing %s: %s is recorded with %d bytes, but its chunk manifest %s lists %d", hash, l.Name, l.Attrs.Size, l.Hash, size))
 			}
 		}
 	}
 	return nil
 }
 
-func verifyBlobHash(path, expectedHash string) error {
-	f, err := os.Open(path)
+// verifyChunks verifies every chunk listed in a chunk manifest and returns
+// the file size the manifest lists, if it could be read.
+func (b *Backup) verifyChunks(hash string, verifiedBlobs map[string]bool, refKinds map[string]byte, errs *[]error) (int64, bool) {
+	// A missing manifest was already reported by verifyBlob
+	if !b.Store.hasBlob(hash) {
+		return 0, false
+	}
+	chunks, err := b.Store.readManifest(hash)
+	if err != nil {
+		*errs = append(*errs, err)
+		return 0, false
+	}
+	var size int64
+	for _, c := range chunks {
+		b.verifyBlob(c.Hash, verifiedBlobs, errs)
+		b.markReferenced(c.Hash, 'F', refKinds, errs)
+		size += c.Size
+	}
+	return size, true
+}
+
+func (s *Store) verifyBlobHash(expectedHash string) error {
+	f, err := s.Blobs.Get(expectedHash)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	gz, err := gzip.NewReader(f)
+	// Decryption and decompression errors of every codec end up here
+	r, err := s.newReader(f)
 	if err != nil {
-		return fmt.Errorf("gzip error: %w", err)
+		return fmt.Errorf("decoding error: %w", err)
 	}
-	defer gz.Close()
+	defer r.Close()
 
-	h := md5.New()
-	if _, err := io.Copy(h, gz); err != nil {
+	actualHash, err := s.HashReader(r)
+	if err != nil {
 		return fmt.Errorf("hashing error: %w", err)
 	}
-
-	actualHash := fmt.Sprintf("%x", h.Sum(nil))
 	if actualHash != expectedHash {
 		return fmt.Errorf("hash mismatch: expected %s, got %s", expectedHash, actualHash)
 	}
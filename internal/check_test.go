@@ -0,0 +1,420 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifySnapshot(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "old.txt", "only in the first snapshot")
+	first := snapshotTestBackup(t, b, "260101-100000")
+	if err := os.Remove(filepath.Join(b.Top, "old.txt")); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, b, "new.txt", "only in the second snapshot")
+	second := snapshotTestBackup(t, b, "260102-100000")
+
+	// Damage the first snapshot and leave an unreferenced blob behind
+	if err := os.Remove(b.Store.DataStore(b.Store.HashBytes([]byte("only in the first snapshot")))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Store.saveBlob(b.Store.HashBytes([]byte("orphan")), []byte("orphan")); err != nil {
+		t.Fatal(err)
+	}
+
+	if errs := b.VerifySnapshot(second, true); len(errs) != 0 {
+		t.Errorf("Expected the second snapshot to verify, got %v", errs)
+	}
+	errs := b.VerifySnapshot(first, false)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "missing blob") {
+		t.Errorf("Expected one missing blob error, got %v", errs)
+	}
+
+	// The store-wide check reports both problems
+	if errs := b.Verify(false); len(errs) != 2 {
+		t.Errorf("Expected Verify to report 2 errors, got %v", errs)
+	}
+}
+
+func TestVerify_ErrorTypes(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "missing.txt", "missing")
+	writeTestFile(t, b, "empty.txt", "empty")
+	writeTestFile(t, b, "corrupt.txt", "corrupt")
+	snapshotTestBackup(t, b, "260101-100000")
+
+	missing := b.Store.HashBytes([]byte("missing"))
+	empty := b.Store.HashBytes([]byte("empty"))
+	corrupt := b.Store.HashBytes([]byte("corrupt"))
+	orphan := b.Store.HashBytes([]byte("orphan"))
+	if err := os.Remove(b.Store.DataStore(missing)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(b.Store.DataStore(empty), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(b.Store.DataStore(corrupt)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Store.saveBlob(corrupt, []byte("something else")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Store.saveBlob(orphan, []byte("orphan")); err != nil {
+		t.Fatal(err)
+	}
+	// A blob moved into the wrong shard directory
+	misfiled := b.Store.HashBytes([]byte("misfiled"))
+	if _, err := b.Store.saveBlob(misfiled, []byte("misfiled")); err != nil {
+		t.Fatal(err)
+	}
+	wrongShard := filepath.Join(b.StoreData, "zz", filepath.Base(b.Store.DataStore(misfiled)))
+	if err := os.MkdirAll(filepath.Dir(wrongShard), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(b.Store.DataStore(misfiled), wrongShard); err != nil {
+		t.Fatal(err)
+	}
+
+	found := make(map[string]string)
+	for _, err := range b.Verify(true) {
+		switch e := err.(type) {
+		case *MissingBlobError:
+			found[e.Hash] = "missing"
+		case *CorruptBlobError:
+			if e.Err == nil {
+				found[e.Hash] = "empty"
+			} else {
+				found[e.Hash] = "corrupt"
+			}
+		case *UnreferencedBlobError:
+			found[e.Hash] = "unreferenced"
+		case *MisfiledBlobError:
+			found[e.Hash] = "misfiled"
+			if e.Path != wrongShard {
+				t.Errorf("Expected the misfiled blob at %s, got %s", wrongShard, e.Path)
+			}
+		default:
+			t.Errorf("Unexpected error %v", err)
+		}
+	}
+	want := map[string]string{missing: "missing", empty: "empty", corrupt: "corrupt", orphan: "unreferenced", misfiled: "misfiled"}
+	for hash, kind := range want {
+		if found[hash] != kind {
+			t.Errorf("Expected %s to be reported as %s, got %q", hash, kind, found[hash])
+		}
+	}
+}
+
+func TestVerify_QuarantineMisnamed(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "a.txt", "a")
+	snapshotTestBackup(t, b, "260101-100000")
+
+	// An unreferenced blob whose content does not match its name, and one
+	// in the wrong shard directory
+	misnamed := b.Store.HashBytes([]byte("misnamed"))
+	if _, err := b.Store.saveBlob(misnamed, []byte("other content")); err != nil {
+		t.Fatal(err)
+	}
+	misfiled := b.Store.HashBytes([]byte("misfiled"))
+	if _, err := b.Store.saveBlob(misfiled, []byte("misfiled")); err != nil {
+		t.Fatal(err)
+	}
+	wrongShard := filepath.Join(b.StoreData, "zz", filepath.Base(b.Store.DataStore(misfiled)))
+	if err := os.MkdirAll(filepath.Dir(wrongShard), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(b.Store.DataStore(misfiled), wrongShard); err != nil {
+		t.Fatal(err)
+	}
+
+	if errs := b.Verify(false); containsCorrupt(errs, misnamed) {
+		t.Errorf("Expected only a deep check to hash unreferenced blobs, got %v", errs)
+	}
+	errs := b.Verify(true)
+	if !containsCorrupt(errs, misnamed) {
+		t.Fatalf("Expected the misnamed unreferenced blob to be reported, got %v", errs)
+	}
+
+	moved, err := b.QuarantineBlobs(errs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moved) != 2 {
+		t.Fatalf("Expected 2 quarantined blobs, got %v", moved)
+	}
+	for _, p := range []string{b.Store.DataStore(misnamed), wrongShard} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be moved away", p)
+		}
+	}
+	for _, p := range moved {
+		if filepath.Dir(p) != filepath.Join(b.StoreRoot, ".backup", "quarantine") {
+			t.Errorf("Unexpected quarantine path %s", p)
+		}
+	}
+	if errs := b.Verify(true); len(errs) != 0 {
+		t.Errorf("Expected a clean store after the quarantine, got %v", errs)
+	}
+}
+
+func containsCorrupt(errs []error, hash string) bool {
+	for _, err := range errs {
+		if e, ok := err.(*CorruptBlobError); ok && e.Hash == hash {
+			return true
+		}
+	}
+	return false
+}
+
+func TestVerify_DeepParallel(t *testing.T) {
+	b := newTestBackup(t)
+	var corrupted []string
+	for i := 0; i < 40; i++ {
+		content := strings.Repeat("x", i+1)
+		writeTestFile(t, b, filepath.Join("dir", strings.Repeat("f", i+1)), content)
+		if i%10 == 3 {
+			corrupted = append(corrupted, b.Store.HashBytes([]byte(content)))
+		}
+	}
+	snapshotTestBackup(t, b, "260101-100000")
+	for _, hash := range corrupted {
+		if err := os.Remove(b.Store.DataStore(hash)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Store.saveBlob(hash, []byte("damaged")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var results [][]error
+	for _, jobs := range []int{1, 8} {
+		b.Jobs = jobs
+		results = append(results, b.Verify(true))
+	}
+	if len(results[1]) != len(corrupted) {
+		t.Fatalf("Expected %d corrupted blobs, got %v", len(corrupted), results[1])
+	}
+	for i := range results[0] {
+		if results[0][i].Error() != results[1][i].Error() {
+			t.Errorf("Error %d differs between serial and parallel runs: %v, %v", i, results[0][i], results[1][i])
+		}
+	}
+}
+
+func TestVerifySample(t *testing.T) {
+	b := newTestBackup(t)
+	for i := 0; i < 20; i++ {
+		writeTestFile(t, b, strings.Repeat("f", i+1), strings.Repeat("x", i+1))
+	}
+	snapshotTestBackup(t, b, "260101-100000")
+	all, err := b.GetAllBlobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sampled, total, errs := b.VerifySample(0.25, 7)
+	if sampled != (len(all)+3)/4 || total != len(all) || len(errs) != 0 {
+		t.Errorf("Expected %d of %d blobs to verify, got %d of %d with %v", (len(all)+3)/4, len(all), sampled, total, errs)
+	}
+
+	// Damaging every blob shows which ones a seed selects
+	for hash := range all {
+		if err := os.WriteFile(b.Store.DataStore(hash), []byte("damaged"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, _, first := b.VerifySample(0.25, 7)
+	_, _, again := b.VerifySample(0.25, 7)
+	if len(first) != sampled || len(again) != sampled {
+		t.Fatalf("Expected %d corrupted blobs, got %v and %v", sampled, first, again)
+	}
+	for i := range first {
+		if first[i].(*CorruptBlobError).Hash != again[i].(*CorruptBlobError).Hash {
+			t.Errorf("The same seed sampled different blobs: %v, %v", first, again)
+			break
+		}
+	}
+	if sampled, _, errs := b.VerifySample(1, 1); sampled != len(all) || len(errs) != len(all) {
+		t.Errorf("Expected a full sample to check all %d blobs, got %d with %d errors", len(all), sampled, len(errs))
+	}
+}
+
+func TestVerify_TypeMismatch(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "a.txt", "plain content")
+	snapshotTestBackup(t, b, "260101-100000")
+	file := b.Store.HashBytes([]byte("plain content"))
+
+	other := b.Store.HashBytes([]byte("other content"))
+	if _, err := b.Store.saveBlob(other, []byte("other content")); err != nil {
+		t.Fatal(err)
+	}
+	sub := listingHeader + "\n" + formatListingLine('F', other, EntryAttrs{}, "x")
+	subHash := b.Store.HashBytes([]byte(sub))
+	if _, err := b.Store.saveBlob(subHash, []byte(sub)); err != nil {
+		t.Fatal(err)
+	}
+	// A file referenced as a directory, and a listing referenced both as a
+	// directory and as a file
+	top := listingHeader + "\n" +
+		formatListingLine('D', file, EntryAttrs{}, "not-a-dir") +
+		formatListingLine('F', file, EntryAttrs{}, "a.txt") +
+		formatListingLine('D', subHash, EntryAttrs{}, "sub") +
+		formatListingLine('F', subHash, EntryAttrs{}, "sub.txt")
+	topHash := b.Store.HashBytes([]byte(top))
+	if _, err := b.Store.saveBlob(topHash, []byte(top)); err != nil {
+		t.Fatal(err)
+	}
+	name, err := b.WriteSnapshotHead(b.ProjectName, time.Date(2026, 1, 2, 10, 0, 0, 0, time.Local), topHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := b.backupRoot(b.ProjectName + "/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := make(map[string]*TypeMismatchError)
+	for _, err := range b.VerifySnapshot(root, true) {
+		e, ok := err.(*TypeMismatchError)
+		if !ok {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		found[e.Hash] = e
+	}
+	if e := found[file]; e == nil || e.Err == nil || !strings.Contains(e.Error(), "not a directory listing") {
+		t.Errorf("Expected the file referenced as a directory to be reported, got %v", e)
+	}
+	if e := found[subHash]; e == nil || e.Err != nil {
+		t.Errorf("Expected the listing referenced as a file to be reported, got %v", e)
+	}
+	if len(found) != 2 {
+		t.Errorf("Expected 2 type mismatches, got %v", found)
+	}
+}
+
+func TestVerify_ChunkedSizeMismatch(t *testing.T) {
+	b := newTestBackup(t)
+	b.ChunkThreshold = 1 << 20
+	writeTestFile(t, b, "big.bin", string(randomData(5, 2<<20)))
+	root := snapshotTestBackup(t, b, "260101-100000")
+	if errs := b.VerifySnapshot(root, true); len(errs) > 0 {
+		t.Fatalf("Expected a clean snapshot, got %v", errs)
+	}
+	entry, err := root.Locate("big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := entry.(*BackupFile).hash
+
+	top := listingHeader + "\n" + formatListingLine('C', manifest, EntryAttrs{Size: 1234}, "big.bin")
+	topHash := b.Store.HashBytes([]byte(top))
+	if _, err := b.Store.saveBlob(topHash, []byte(top)); err != nil {
+		t.Fatal(err)
+	}
+	name, err := b.WriteSnapshotHead(b.ProjectName, time.Date(2026, 1, 2, 10, 0, 0, 0, time.Local), topHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root, err = b.backupRoot(b.ProjectName + "/" + name); err != nil {
+		t.Fatal(err)
+	}
+	errs := b.VerifySnapshot(root, true)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "recorded with 1234 bytes") {
+		t.Errorf("Expected the size mismatch to be reported, got %v", errs)
+	}
+}
+
+func TestVerifyHeads(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "a.txt", "content")
+	snapshotTestBackup(t, b, "260101-100000")
+	snapshotTestBackup(t, b, "260101-110000") // Shares its listing
+	// Damage below the top directory is not looked at
+	if err := os.Remove(b.Store.DataStore(b.Store.HashBytes([]byte("content")))); err != nil {
+		t.Fatal(err)
+	}
+	if checked, errs := b.VerifyHeads(); checked != 2 || len(errs) > 0 {
+		t.Fatalf("Expected 2 intact snapshots, got %d, %v", checked, errs)
+	}
+
+	missing := b.Store.HashBytes([]byte("missing"))
+	garbled := b.Store.HashBytes([]byte("garbled"))
+	if err := os.MkdirAll(filepath.Dir(b.Store.DataStore(garbled)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(b.Store.DataStore(garbled), []byte("not compressed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	notListing := b.Store.HashBytes([]byte("not a listing"))
+	if _, err := b.Store.saveBlob(notListing, []byte("not a listing")); err != nil {
+		t.Fatal(err)
+	}
+	heads := map[string]string{
+		"260102-100000": "no hash",
+		"260102-110000": missing,
+		"260102-120000": garbled,
+		"260102-130000": notListing,
+		"260102-140000": "", // Skipped by BackupRoots
+	}
+	for name, content := range heads {
+		if err := os.WriteFile(filepath.Join(b.StoreSnapshots, b.ProjectName, name), []byte(content+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checked, errs := b.VerifyHeads()
+	if checked != 7 || len(errs) != 5 {
+		t.Fatalf("Expected 5 errors in 7 snapshots, got %d, %v", checked, errs)
+	}
+	var missingErr *MissingBlobError
+	var corruptErr *CorruptBlobError
+	var mismatchErr *TypeMismatchError
+	if !strings.Contains(errs[0].Error(), "260102-100000") {
+		t.Errorf("Expected the invalid head to be reported, got %v", errs[0])
+	}
+	if !strings.Contains(errs[1].Error(), "260102-140000") || !strings.Contains(errs[1].Error(), "empty") {
+		t.Errorf("Expected the empty head to be reported, got %v", errs[1])
+	}
+	if !errors.As(errs[2], &missingErr) || missingErr.Hash != missing {
+		t.Errorf("Expected the missing listing to be reported, got %v", errs[2])
+	}
+	if !errors.As(errs[3], &corruptErr) || corruptErr.Hash != garbled {
+		t.Errorf("Expected the garbled listing to be reported, got %v", errs[3])
+	}
+	if !errors.As(errs[4], &mismatchErr) || mismatchErr.Hash != notListing {
+		t.Errorf("Expected the blob that is no listing to be reported, got %v", errs[4])
+	}
+}
+
+func TestVerify_EmptyFileAndLegacyDirectory(t *testing.T) {
+	b := newTestBackup(t)
+	// Older versions wrote an empty directory as an empty listing, which has
+	// the hash of an empty file
+	empty := b.Store.HashBytes(nil)
+	if _, err := b.Store.saveBlob(empty, nil); err != nil {
+		t.Fatal(err)
+	}
+	top := "D " + empty + " dir\nF " + empty + " empty.txt\n"
+	topHash := b.Store.HashBytes([]byte(top))
+	if _, err := b.Store.saveBlob(topHash, []byte(top)); err != nil {
+		t.Fatal(err)
+	}
+	name, err := b.WriteSnapshotHead(b.ProjectName, time.Date(2026, 1, 2, 10, 0, 0, 0, time.Local), topHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := b.backupRoot(b.ProjectName + "/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := b.VerifySnapshot(root, true); len(errs) > 0 {
+		t.Errorf("Expected a legacy store with empty files and directories to pass, got %v", errs)
+	}
+}
@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Content-defined chunking splits large files at positions chosen by a
+// rolling (gear) hash of the content, so an edit only changes the chunks
+// around it and the rest deduplicate against earlier snapshots.
+//
+// The parameters and gear table are part of the storage format: changing
+// them changes every chunk boundary.
+const (
+	chunkMinSize = 256 << 10
+	chunkMaxSize = 8 << 20
+	chunkAvgBits = 20 // 1 MiB average chunk size
+)
+
+// manifestHeader starts a chunk manifest blob. Each following line is
+// "<chunk hash> <size>".
+const manifestHeader = "#chunks"
+
+var gearTable = func() (t [256]uint64) {
+	// splitmix64 with a fixed seed
+	seed := uint64(0x6a09e667f3bcc908)
+	for i := range t {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		t[i] = z ^ (z >> 31)
+	}
+	return t
+}()
+
+// chunker splits a stream into content-defined chunks.
+type chunker struct {
+	r   io.Reader
+	buf []byte
+	pos int // start of unread data in buf
+	end int // end of buffered data
+	eof bool
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{r: r, buf: make([]byte, chunkMaxSize)}
+}
+
+// next returns the next chunk, or io.EOF after the last one. The returned
+// slice is only valid until the following call.
+func (c *chunker) next() ([]byte, error) {
+	// Move the remainder to the front and refill
+	c.end = copy(c.buf, c.buf[c.pos:c.end])
+	c.pos = 0
+	for c.end < len(c.buf) && !c.eof {
+		n, err := c.r.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if c.end == 0 {
+		return nil, io.EOF
+	}
+
+	c.pos = chunkBoundary(c.buf[:c.end])
+	return c.buf[:c.pos], nil
+}
+
+// chunkBoundary returns the length of the first chunk of data.
+func chunkBoundary(data []byte) int {
+	if len(data) <= chunkMinSize {
+		return len(data)
+	}
+	var h uint64
+	for i := chunkMinSize; i < len(data); i++ {
+		h = (h << 1) + gearTable[data[i]]
+		// The top bits depend on the last 64 bytes
+		if h>>(64-chunkAvgBits) == 0 {
+			return i + 1
+		}
+	}
+	return len(data)
+}
+
+// chunkRef is a chunk listed in a manifest.
+type chunkRef struct {
+	Hash string
+	Size int64
+}
+
+// chunkFile splits r into chunks and returns the manifest text. If save is
+// not nil, it is called for every chunk with its hash and content.
+func (s *Store) chunkFile(r io.Reader, save func(hash string, data []byte) error) (string, error) {
+	var sb strings.Builder
+	sb.WriteString(manifestHeader + "\n")
+	c := newChunker(r)
+	for {
+		data, err := c.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		h := s.HashBytes(data)
+		if save != nil {
+			if err := save(h, data); err != nil {
+				return "", err
+			}
+		}
+		fmt.Fprintf(&sb, "%s %d\n", h, len(data))
+	}
+	return sb.String(), nil
+}
+
+// manifestHash returns the hash of the chunk manifest of r's content.
+func (s *Store) manifestHash(r io.Reader) (string, error) {
+	manifest, err := s.chunkFile(r, nil)
+	if err != nil {
+		return "", err
+	}
+	return s.HashBytes([]byte(manifest)), nil
+}
+
+// readManifest reads the chunk list of a manifest blob.
+func (s *Store) readManifest(hash string) ([]chunkRef, error) {
+	gz, err := s.openBlob(hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open chunk manifest %s: %w", hash, err)
+	}
+	defer gz.Close()
+
+	var chunks []chunkRef
+	scanner := bufio.NewScanner(gz)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == manifestHeader {
+			continue
+		}
+		h, size, ok := strings.Cut(line, " ")
+		n, err := strconv.ParseInt(size, 10, 64)
+		if !ok || err != nil || !s.ValidHash(h) {
+			return nil, fmt.Errorf("invalid line in chunk manifest %s: %q", hash, line)
+		}
+		chunks = append(chunks, chunkRef{Hash: h, Size: n})
+	}
+	return chunks, scanner.Err()
+}
@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func randomData(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func chunkAll(t *testing.T, data []byte) [][]byte {
+	t.Helper()
+	var chunks [][]byte
+	c := newChunker(bytes.NewReader(data))
+	for {
+		chunk, err := c.next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, append([]byte(nil), chunk...))
+	}
+}
+
+func TestChunker_Boundaries(t *testing.T) {
+	data := randomData(1, 12<<20)
+	chunks := chunkAll(t, data)
+	if len(chunks) < 3 {
+		t.Fatalf("Expected several chunks, got %d", len(chunks))
+	}
+	if !bytes.Equal(bytes.Join(chunks, nil), data) {
+		t.Fatal("Chunks do not reassemble to the input")
+	}
+	for i, c := range chunks {
+		if len(c) > chunkMaxSize || (i < len(chunks)-1 && len(c) < chunkMinSize) {
+			t.Errorf("Chunk %d has invalid size %d", i, len(c))
+		}
+	}
+
+	// Inserting a byte only changes the chunks around the edit
+	edited := append(append(append([]byte(nil), data[:5<<20]...), 'x'), data[5<<20:]...)
+	known := make(map[string]bool)
+	for _, c := range chunks {
+		known[string(c)] = true
+	}
+	changed := 0
+	for _, c := range chunkAll(t, edited) {
+		if !known[string(c)] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Errorf("Expected at most 2 changed chunks after a one byte insert, got %d of %d", changed, len(chunks))
+	}
+}
+
+func TestFileEntry_Chunked(t *testing.T) {
+	b := newTestBackup(t)
+	b.ChunkThreshold = 1 << 20
+	data := randomData(2, 6<<20)
+	writeTestFile(t, b, "big.bin", string(data))
+	writeTestFile(t, b, "small.txt", "small")
+
+	root := snapshotTestBackup(t, b, "260101-100000")
+	top, err := root.TopDirectory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := top.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, ok := entries["big.bin"].(*BackupFile); !ok || !f.chunked {
+		t.Fatalf("Expected big.bin to be chunked, got %#v", entries["big.bin"])
+	}
+	if f, ok := entries["small.txt"].(*BackupFile); !ok || f.chunked {
+		t.Fatalf("Expected small.txt to be stored whole, got %#v", entries["small.txt"])
+	}
+
+	dest := filepath.Join(t.TempDir(), "restore")
+	if err := top.Restore(dest, RestoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := os.ReadFile(filepath.Join(dest, "big.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(restored, data) {
+		t.Fatal("Restored chunked file differs from the original")
+	}
+
+	// Change one byte: only the chunk containing it is stored again
+	blobsBefore, err := b.GetAllBlobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[3<<20] ^= 0xff
+	writeTestFile(t, b, "big.bin", string(data))
+	b.Stats = BackupStats{}
+	snapshotTestBackup(t, b, "260102-100000")
+	// Unchanged chunks and the small file count as deduplicated
+	if b.Stats.FilesDeduplicated != 1 || b.Stats.BytesDeduplicated+b.Stats.BytesArchived != int64(len(data)+len("small")) {
+		t.Errorf("Unexpected dedup stats %+v", b.Stats)
+	}
+	blobsAfter, err := b.GetAllBlobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// New chunk, new manifest and new top directory listing
+	if added := len(blobsAfter) - len(blobsBefore); added != 3 {
+		t.Errorf("Expected 3 new blobs after a one byte change, got %d", added)
+	}
+
+	if errs := b.Verify(true); len(errs) != 0 {
+		t.Errorf("Expected no verify errors, got %v", errs)
+	}
+	unreferenced, err := b.FindUnreferenced()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unreferenced) != 0 {
+		t.Errorf("Chunks must be reachable through their manifest, got unreferenced %v", unreferenced)
+	}
+}
@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// DefaultCompression is used when store.toml does not declare one.
+const DefaultCompression = "gzip"
+
+// Codec compresses blobs. The codec is fixed for the lifetime of a store and
+// determines the blob file extension, so blobs are never sniffed.
+type Codec struct {
+	Name      string
+	Ext       string
+	NewReader func(r io.Reader) (io.ReadCloser, error)
+	NewWriter func(w io.Writer) (io.WriteCloser, error)
+}
+
+var codecs = map[string]*Codec{
+	"gzip": {
+		Name: "gzip",
+		Ext:  ".gz",
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+	},
+	"none": {
+		Name: "none",
+		Ext:  "",
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(r), nil
+		},
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return nopWriteCloser{w}, nil
+		},
+	},
+	"zstd": {
+		Name: "zstd",
+		Ext:  ".zst",
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		},
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		},
+	},
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// LookupCodec returns the codec registered under name.
+func LookupCodec(name string) (*Codec, error) {
+	if name == "" {
+		name = DefaultCompression
+	}
+	c, ok := codecs[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported compression %q (supported: %s)", name, strings.Join(Compressions(), ", "))
+	}
+	return c, nil
+}
+
+// Compressions returns the names of the supported codecs.
+func Compressions() []string {
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
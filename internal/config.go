@@ -1,14 +1,131 @@
 package internal
 
 import (
+	"fmt"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
 
 type Config struct {
-	Store string `toml:"store"`
-	Name  string `toml:"name"`
+	Store          string   `toml:"store"`
+	Name           string   `toml:"name"`
+	MaxFileSize    string   `toml:"max_file_size"`
+	ChunkThreshold string   `toml:"chunk_threshold"`
+	GlobalIgnore   string   `toml:"global_ignore"`
+	Includes       []string `toml:"includes"`
+	// Exclude holds ignore patterns for the whole source tree. They
+	// override global_ignore, and ignore files in the tree override them.
+	Exclude []string `toml:"exclude"`
+	// ParanoidCache makes the hash cache recognize files whose modification
+	// time changed but whose content did not; see HashCache.Paranoid.
+	ParanoidCache bool `toml:"paranoid_cache"`
+	// PreBackup and PostBackup are shell commands that the create command
+	// runs in the source directory before and after a backup; see RunHook.
+	PreBackup  string `toml:"pre_backup"`
+	PostBackup string `toml:"post_backup"`
+}
+
+// StoreConfig is the content of a store's .backup/store.toml.
+type StoreConfig struct {
+	Store       string `toml:"store"`
+	Hash        string `toml:"hash"`
+	Compression string `toml:"compression"`
+	// ShardWidth and ShardDepth set the blob subdirectories in data/; see
+	// Shards. ShardDepth is a pointer so that 0 (no subdirectories) can be
+	// told apart from an unset value.
+	ShardWidth int  `toml:"shard_width"`
+	ShardDepth *int `toml:"shard_depth"`
+	// DefaultProject scopes commands run from the store (headless mode) to
+	// one project, like the name in a source directory's config does.
+	DefaultProject string `toml:"default_project"`
+	// Data moves the blobs from the data directory to a remote location,
+	// sftp://[user@]host[:port]/path. Snapshot heads stay in the store.
+	Data string `toml:"data"`
+	// Snapshots moves the snapshot heads from the snapshots directory to a
+	// remote location, like Data.
+	Snapshots string `toml:"snapshots"`
+	// Encryption encrypts blobs at rest (EncryptionAESGCM), with a key
+	// derived from a passphrase and EncryptionSalt. EncryptionCheck detects
+	// a wrong passphrase; see NewEncryptionConfig.
+	Encryption      string `toml:"encryption"`
+	EncryptionSalt  string `toml:"encryption_salt"`
+	EncryptionCheck string `toml:"encryption_check"`
+	// Xattrs records the extended attributes of files and directories in
+	// their directory listings (Linux and macOS).
+	Xattrs bool `toml:"xattrs"`
+	// Owners records the numeric owner and group of files and directories
+	// in their directory listings (not on Windows).
+	Owners bool `toml:"owners"`
+	// IORetries and IORetryDelay set how often blob operations failing with
+	// a transient IO error are retried, and the wait before the first
+	// retry; see IORetry. IORetries is a pointer so that 0 (no retries) can
+	// be told apart from an unset value.
+	IORetries    *int   `toml:"io_retries"`
+	IORetryDelay string `toml:"io_retry_delay"`
+	// KeepUnreferencedDays is the grace period of prune: blobs are only
+	// deleted once they have been unreferenced for this many days.
+	KeepUnreferencedDays int `toml:"keep_unreferenced_days"`
+}
+
+// Shards returns the number of hash characters per data subdirectory level
+// and the number of levels, applying the defaults of 2 and 1 (data/ab/abcd…).
+func (c *StoreConfig) Shards() (width, depth int, err error) {
+	width, depth = DefaultShardWidth, DefaultShardDepth
+	if c.ShardWidth != 0 {
+		width = c.ShardWidth
+	}
+	if c.ShardDepth != nil {
+		depth = *c.ShardDepth
+	}
+	if width < 1 || width > 4 {
+		return 0, 0, fmt.Errorf("shard_width must be between 1 and 4, got %d", width)
+	}
+	if depth < 0 || depth > 3 {
+		return 0, 0, fmt.Errorf("shard_depth must be between 0 and 3, got %d", depth)
+	}
+	return width, depth, nil
+}
+
+// IORetry returns the number of retries of a blob operation failing with a
+// transient IO error and the wait before the first retry, applying the
+// defaults of 3 and 100ms.
+func (c *StoreConfig) IORetry() (retries int, delay time.Duration, err error) {
+	retries, delay = DefaultIORetries, DefaultIORetryDelay
+	if c.IORetries != nil {
+		retries = *c.IORetries
+	}
+	if c.IORetryDelay != "" {
+		if delay, err = time.ParseDuration(c.IORetryDelay); err != nil {
+			return 0, 0, fmt.Errorf("invalid io_retry_delay %q: expected a duration such as 500ms", c.IORetryDelay)
+		}
+	}
+	if retries < 0 || retries > 10 {
+		return 0, 0, fmt.Errorf("io_retries must be between 0 and 10, got %d", retries)
+	}
+	if delay < 0 || delay > time.Minute {
+		return 0, 0, fmt.Errorf("io_retry_delay must be between 0 and 1m, got %s", delay)
+	}
+	return retries, delay, nil
+}
+
+// KeepUnreferenced returns the grace period of prune set by
+// keep_unreferenced_days.
+func (c *StoreConfig) KeepUnreferenced() (time.Duration, error) {
+	if c.KeepUnreferencedDays < 0 {
+		return 0, fmt.Errorf("keep_unreferenced_days must not be negative, got %d", c.KeepUnreferencedDays)
+	}
+	return time.Duration(c.KeepUnreferencedDays) * 24 * time.Hour, nil
+}
+
+func LoadStoreConfig(path string) (*StoreConfig, error) {
+	var config StoreConfig
+	if _, err := toml.DecodeFile(path, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -26,3 +143,14 @@ func LoadConfig(path string) (*Config, error) {
 	}
 	return &config, nil
 }
+
+// SetConfigName sets the project name in the config file at path, keeping
+// the other settings and comments as they are.
+func SetConfigName(path, name string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	content := setConfigLine(string(data), "name", "name = "+strconv.Quote(name))
+	return os.WriteFile(path, []byte(content), 0644)
+}
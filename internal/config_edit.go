@@ -0,0 +1,336 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// ConfigFile is the config.toml of a source directory or the store.toml of
+// a local store, as read and changed by the config command. Settings are
+// changed line by line, so comments and unknown keys are kept.
+type ConfigFile struct {
+	Path string
+	// Store is set for a store.toml.
+	Store bool
+	// top is the directory holding .backup, which relative paths in the
+	// settings are resolved against.
+	top string
+}
+
+// fixedStoreSettings cannot be changed once the store holds data: blobs and
+// snapshot heads are written according to them.
+var fixedStoreSettings = []string{
+	"store", "hash", "compression", "shard_width", "shard_depth",
+	"data", "snapshots", "encryption", "encryption_salt", "encryption_check",
+}
+
+// FindConfigFile returns the config file NewBackup would read for startDir
+// and storeDir: the store.toml of storeDir if it is given, otherwise the
+// store.toml or config.toml of the closest directory with a .backup
+// directory at or above startDir. Unlike NewBackup it does not load the
+// settings, so a config that keeps commands from starting can be fixed.
+func FindConfigFile(startDir, storeDir string) (*ConfigFile, error) {
+	if IsStoreURL(storeDir) {
+		return nil, fmt.Errorf("the config of the remote store %s cannot be edited; edit it locally and copy it to the server", storeDir)
+	}
+	if storeDir != "" {
+		root, err := ExpandPath(storeDir)
+		if err != nil {
+			return nil, err
+		}
+		if root, err = CanonicalPath(root); err != nil {
+			return nil, err
+		}
+		if !fileExists(filepath.Join(root, ".backup", "store.toml")) {
+			if storeRoot, _ := storeProject(root); storeRoot != "" {
+				root = storeRoot
+			}
+		}
+		path := filepath.Join(root, ".backup", "store.toml")
+		if !fileExists(path) {
+			return nil, fmt.Errorf("no store.toml found in %s", root)
+		}
+		return &ConfigFile{Path: path, Store: true, top: root}, nil
+	}
+
+	cwd, err := ExpandPath(startDir)
+	if err != nil {
+		return nil, err
+	}
+	if cwd == "" {
+		if cwd, err = os.Getwd(); err != nil {
+			return nil, err
+		}
+	}
+	cwd, err = CanonicalPath(cwd)
+	if err != nil {
+		return nil, err
+	}
+	top := lookupTop(cwd)
+	switch {
+	case top != "" && fileExists(filepath.Join(top, ".backup", "store.toml")):
+		return &ConfigFile{Path: filepath.Join(top, ".backup", "store.toml"), Store: true, top: top}, nil
+	case top != "" && fileExists(filepath.Join(top, ".backup", "config.toml")):
+		return &ConfigFile{Path: filepath.Join(top, ".backup", "config.toml"), top: top}, nil
+	}
+	return nil, fmt.Errorf("no source directory or store found at %s or above", cwd)
+}
+
+// Keys returns the known settings that are set in the file, in the order
+// of the fields of Config or StoreConfig.
+func (f *ConfigFile) Keys() ([]string, error) {
+	data, err := os.ReadFile(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	md, err := toml.Decode(string(data), f.newConfig())
+	if err != nil {
+		return nil, err
+	}
+	t := reflect.TypeOf(f.newConfig()).Elem()
+	var keys []string
+	for i := range t.NumField() {
+		if key := configKey(t.Field(i)); md.IsDefined(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Get returns the value of the setting key: strings as they are, list
+// items one per line, and nothing for unset settings.
+func (f *ConfigFile) Get(key string) (string, error) {
+	data, err := os.ReadFile(f.Path)
+	if err != nil {
+		return "", err
+	}
+	config, err := f.decode(data)
+	if err != nil {
+		return "", err
+	}
+	v, err := configField(config, key)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case v.Kind() == reflect.Pointer && v.IsNil():
+		return "", nil
+	case v.Kind() == reflect.Pointer:
+		v = v.Elem()
+	case v.Kind() == reflect.Slice:
+		return strings.Join(v.Interface().([]string), "\n"), nil
+	}
+	return fmt.Sprint(v.Interface()), nil
+}
+
+// Set changes the setting key to value and writes the file, refusing
+// values that the commands would reject. Lists are given comma-separated.
+// Settings that are fixed for the lifetime of a store cannot be set.
+func (f *ConfigFile) Set(key, value string) error {
+	config := f.newConfig()
+	field, err := configField(config, key)
+	if err != nil {
+		return err
+	}
+	if f.Store && slices.Contains(fixedStoreSettings, key) {
+		return fmt.Errorf("%s is fixed for the lifetime of the store and cannot be changed", key)
+	}
+
+	var typed any
+	switch field.Kind() {
+	case reflect.String:
+		typed = value
+	case reflect.Bool:
+		if typed, err = strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("%s must be true or false, got %q", key, value)
+		}
+	case reflect.Int, reflect.Pointer:
+		if typed, err = strconv.Atoi(value); err != nil {
+			return fmt.Errorf("%s must be a number, got %q", key, value)
+		}
+	case reflect.Slice:
+		items := []string{}
+		for item := range strings.SplitSeq(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		typed = items
+	}
+	var line bytes.Buffer
+	if err := toml.NewEncoder(&line).Encode(map[string]any{key: typed}); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(f.Path)
+	if err != nil {
+		return err
+	}
+	content := setConfigLine(string(data), key, strings.TrimSuffix(line.String(), "\n"))
+	changed, err := f.decode([]byte(content))
+	if err == nil {
+		err = f.check(changed)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot set %s in %s: %w", key, f.Path, err)
+	}
+	return os.WriteFile(f.Path, []byte(content), 0644)
+}
+
+func (f *ConfigFile) newConfig() any {
+	if f.Store {
+		return &StoreConfig{}
+	}
+	return &Config{}
+}
+
+// decode returns the settings of data as a *Config or *StoreConfig.
+func (f *ConfigFile) decode(data []byte) (any, error) {
+	config := f.newConfig()
+	if _, err := toml.Decode(string(data), config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// check checks the decoded settings config.
+func (f *ConfigFile) check(config any) error {
+	switch config := config.(type) {
+	case *Config:
+		return f.checkConfig(config)
+	case *StoreConfig:
+		return checkStoreConfig(config)
+	}
+	return nil
+}
+
+// checkConfig checks the settings of a config.toml the way NewBackup
+// applies them.
+func (f *ConfigFile) checkConfig(c *Config) error {
+	if c.Name != "" && !validProjectName(c.Name) {
+		return fmt.Errorf("invalid project name %q", c.Name)
+	}
+	if c.Store != "" && !IsStoreURL(c.Store) {
+		store, err := ExpandPath(c.Store)
+		if err != nil {
+			return err
+		}
+		if !filepath.IsAbs(store) {
+			store = filepath.Join(f.top, store)
+		}
+		if info, err := os.Stat(store); err != nil || !info.IsDir() {
+			return fmt.Errorf("store %s is not a directory", store)
+		}
+	}
+	for _, size := range []struct{ setting, value string }{
+		{"max_file_size", c.MaxFileSize},
+		{"chunk_threshold", c.ChunkThreshold},
+	} {
+		if size.value == "" {
+			continue
+		}
+		if _, err := ParseSize(size.value); err != nil {
+			return fmt.Errorf("invalid %s: %w", size.setting, err)
+		}
+	}
+	if c.GlobalIgnore != "" {
+		path, err := ExpandPath(c.GlobalIgnore)
+		if err != nil {
+			return err
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(f.top, path)
+		}
+		if !fileExists(path) {
+			return fmt.Errorf("global ignore file %s not found", path)
+		}
+	}
+	if len(c.Includes) > 0 {
+		if _, err := resolveIncludes(f.top, c.Includes); err != nil {
+			return fmt.Errorf("invalid includes: %w", err)
+		}
+	}
+	return nil
+}
+
+// checkStoreConfig checks the settings of a store.toml the way NewBackup
+// does.
+func checkStoreConfig(c *StoreConfig) error {
+	if _, err := LookupHashFunc(c.Hash); err != nil {
+		return err
+	}
+	if _, err := LookupCodec(c.Compression); err != nil {
+		return err
+	}
+	if _, _, err := c.Shards(); err != nil {
+		return err
+	}
+	if _, _, err := c.IORetry(); err != nil {
+		return err
+	}
+	if _, err := c.KeepUnreferenced(); err != nil {
+		return err
+	}
+	if c.DefaultProject != "" && !validProjectName(c.DefaultProject) {
+		return fmt.Errorf("invalid project name %q", c.DefaultProject)
+	}
+	return nil
+}
+
+func validProjectName(name string) bool {
+	return filepath.Base(name) == name && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+// configField returns the field of config, a *Config or *StoreConfig, for
+// the setting key.
+func configField(config any, key string) (reflect.Value, error) {
+	v := reflect.ValueOf(config).Elem()
+	var keys []string
+	for i := range v.NumField() {
+		name := configKey(v.Type().Field(i))
+		if name == key {
+			return v.Field(i), nil
+		}
+		keys = append(keys, name)
+	}
+	return reflect.Value{}, fmt.Errorf("unknown setting %q; settings are %s", key, strings.Join(keys, ", "))
+}
+
+func configKey(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("toml"), ",")
+	return name
+}
+
+// setConfigLine replaces the line setting key in the TOML content with
+// line, or adds line before the first table if key is not set.
+func setConfigLine(content, key, line string) string {
+	keyLine := regexp.MustCompile(`^\s*` + regexp.QuoteMeta(key) + `\s*=`)
+	lines := strings.SplitAfter(content, "\n")
+	for i, l := range lines {
+		if strings.HasPrefix(strings.TrimSpace(l), "[") {
+			break // Keys below belong to the table
+		}
+		if keyLine.MatchString(l) {
+			lines[i] = line + "\n"
+			return strings.Join(lines, "")
+		}
+	}
+	for i, l := range lines {
+		if strings.HasPrefix(strings.TrimSpace(l), "[") {
+			return strings.Join(lines[:i], "") + line + "\n" + strings.Join(lines[i:], "")
+		}
+	}
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	return content + line + "\n"
+}
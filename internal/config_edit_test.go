@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	store := filepath.Join(dir, "store")
+	for _, d := range []string{filepath.Join(src, ".backup"), filepath.Join(src, "sub"), filepath.Join(store, ".backup"), filepath.Join(store, "snapshots", "proj")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	configPath := filepath.Join(src, ".backup", "config.toml")
+	content := "# my project\nstore = \"../store\"\nunknown = 1\n\n[later]\nname = \"not the project\"\n"
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(store, ".backup", "store.toml"), []byte("store = \".\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := FindConfigFile(filepath.Join(src, "sub"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Store || filepath.Base(f.Path) != "config.toml" {
+		t.Fatalf("Expected the source config, got %+v", f)
+	}
+
+	if err := f.Set("name", "proj"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Set("includes", "sub, "); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(configPath)
+	want := "# my project\nstore = \"../store\"\nunknown = 1\n\nname = \"proj\"\nincludes = [\"sub\"]\n[later]\nname = \"not the project\"\n"
+	if string(data) != want {
+		t.Errorf("Unexpected config content %q, want %q", data, want)
+	}
+	if got, err := f.Get("name"); err != nil || got != "proj" {
+		t.Errorf("Get(name) = %q, %v", got, err)
+	}
+	if keys, err := f.Keys(); err != nil || strings.Join(keys, ",") != "store,name,includes" {
+		t.Errorf("Keys() = %v, %v", keys, err)
+	}
+
+	// Invalid values leave the file alone
+	for _, tt := range []struct{ key, value string }{
+		{"store", "../missing"},
+		{"name", "a/b"},
+		{"max_file_size", "lots"},
+		{"paranoid_cache", "maybe"},
+		{"no_such_setting", "x"},
+	} {
+		if err := f.Set(tt.key, tt.value); err == nil {
+			t.Errorf("Expected %s = %q to be refused", tt.key, tt.value)
+		}
+	}
+	if after, _ := os.ReadFile(configPath); string(after) != want {
+		t.Errorf("Refused values changed the config: %q", after)
+	}
+
+	sf, err := FindConfigFile(src, filepath.Join(store, "snapshots", "proj"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sf.Store {
+		t.Fatalf("Expected the store config, got %+v", sf)
+	}
+	if err := sf.Set("hash", "sha256"); err == nil {
+		t.Error("Expected the hash of a store to be fixed")
+	}
+	if err := sf.Set("xattrs", "true"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := sf.Get("xattrs"); got != "true" {
+		t.Errorf("Expected xattrs to be set, got %q", got)
+	}
+}
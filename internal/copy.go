@@ -0,0 +1,93 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// CopyResult summarizes a CopySnapshot run.
+type CopyResult struct {
+	Blobs  int   // Blobs reachable from the snapshot
+	Copied int   // Blobs missing in the destination, copied or to copy
+	Bytes  int64 // Size of the copied blobs in the source store
+	Head   string
+}
+
+// CopySnapshot copies root and the blobs it reaches to the store of dest,
+// under the same project and timestamp. Blobs the destination already has
+// are skipped, and every copied blob is verified against its hash. The head
+// is written last, so an interrupted copy leaves no snapshot behind, only
+// blobs that the next copy reuses. The caller holds the lock of dest.
+func (b *Backup) CopySnapshot(root *BackupRoot, dest *Backup, dryRun bool) (CopyResult, error) {
+	var result CopyResult
+	if dest.Store.HashName != b.Store.HashName {
+		return result, fmt.Errorf("stores use different hash algorithms (%s and %s)", b.Store.HashName, dest.Store.HashName)
+	}
+	h, err := root.Hash()
+	if err != nil {
+		return result, fmt.Errorf("cannot read snapshot %s: %w", root, err)
+	}
+
+	ref := path.Join(root.Project(), root.Timestamp())
+	result.Head = filepath.Join(dest.StoreSnapshots, filepath.FromSlash(ref))
+	content, err := dest.refs().Read(ref)
+	exists := err == nil
+	if exists {
+		if strings.TrimSpace(string(content)) != h {
+			return result, fmt.Errorf("snapshot %s already exists in %s with different content", root, dest.StoreRoot)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return result, err
+	}
+
+	reachable := make(map[string]bool)
+	if err := b.markReachable(h, reachable, make(map[string]bool)); err != nil {
+		return result, fmt.Errorf("cannot read snapshot %s (run check): %w", root, err)
+	}
+	hashes := make([]string, 0, len(reachable))
+	for hash := range reachable {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	result.Blobs = len(hashes)
+
+	for _, hash := range hashes {
+		if size, err := dest.Store.Blobs.Size(hash); err == nil && size > 0 {
+			continue
+		}
+		size, err := b.Store.Blobs.Size(hash)
+		if err != nil {
+			return result, &MissingBlobError{Hash: hash, Path: b.Store.blobLocation(hash)}
+		}
+		result.Copied++
+		result.Bytes += size
+		if dryRun {
+			continue
+		}
+		if err := dest.Store.copyBlobFrom(b.Store, hash); err != nil {
+			return result, fmt.Errorf("failed to copy blob %s: %w", hash, err)
+		}
+	}
+	if dryRun {
+		return result, nil
+	}
+
+	if !exists {
+		if err := dest.refs().Write(ref, []byte(h+"\n")); err != nil {
+			return result, fmt.Errorf("failed to write snapshot head: %w", err)
+		}
+	}
+	if meta, err := b.loadSnapshotMeta(root.Ref); err != nil {
+		b.warnf("%s: %v", root, err)
+	} else if meta != nil {
+		if err := dest.WriteSnapshotMeta(ref, *meta); err != nil {
+			b.warnf("Failed to write snapshot metadata: %v", err)
+		}
+	}
+	return result, nil
+}
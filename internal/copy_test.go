@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackup_CopySnapshot(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "a.txt", "a")
+	writeTestFile(t, b, "sub/b.txt", "b")
+	first := snapshotTestBackup(t, b, "260101-100000")
+	if err := b.WriteSnapshotMeta(first.Ref, SnapshotMeta{Message: "first"}); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, b, "c.txt", "c")
+	second := snapshotTestBackup(t, b, "260102-100000")
+
+	dest := newTestBackup(t)
+	dest.Store.Codec = codecs["zstd"]
+
+	result, err := b.CopySnapshot(first, dest, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, _ := dest.GetAllBlobs()
+	if result.Copied != result.Blobs || result.Blobs != 4 || len(all) != 0 {
+		t.Errorf("Unexpected dry run result %+v, %d blobs in the destination", result, len(all))
+	}
+
+	if _, err := b.CopySnapshot(first, dest, false); err != nil {
+		t.Fatal(err)
+	}
+	// The second snapshot only needs its new listing and c.txt
+	result, err = b.CopySnapshot(second, dest, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Copied != 2 || result.Blobs != 5 {
+		t.Errorf("Expected 2 of 5 blobs to be copied, got %+v", result)
+	}
+	if errs := dest.Verify(true); len(errs) != 0 {
+		t.Errorf("Destination store does not verify: %v", errs)
+	}
+	// Heads are written through the RefStore of the destination
+	if partials, _ := filepath.Glob(filepath.Join(dest.StoreSnapshots, "test", "*.partial")); len(partials) != 0 {
+		t.Errorf("Expected no leftover partial heads, got %v", partials)
+	}
+	secondHash, _ := second.Hash()
+	if data, err := dest.refs().Read("test/260102-100000"); err != nil || string(data) != secondHash+"\n" {
+		t.Errorf("Unexpected copied head %q, %v", data, err)
+	}
+	copied, err := dest.FindBackupRoot("260101-100000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta, _ := dest.loadSnapshotMeta(copied.Ref); meta == nil || meta.Message != "first" {
+		t.Errorf("Snapshot metadata was not copied: %+v", meta)
+	}
+
+	// Copying again is a no-op; a different snapshot of the same name fails
+	if result, err := b.CopySnapshot(second, dest, false); err != nil || result.Copied != 0 {
+		t.Errorf("Expected a repeated copy to copy nothing, got %+v, %v", result, err)
+	}
+	firstHash, _ := copied.Hash()
+	if err := os.WriteFile(filepath.Join(dest.StoreSnapshots, "test", "260102-100000"), []byte(firstHash+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.CopySnapshot(second, dest, false); err == nil {
+		t.Error("Expected copying over a different snapshot to fail")
+	}
+}
@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// CreateSnapshot backs up the source tree below b.Top: it saves all new
+// content, writes a snapshot head with its metadata (see b.Message) and
+// saves the hash caches. b.Stats and the lookup counts of b.HashCache are
+// reset first and describe the backup afterwards; the returned stats are a
+// copy of b.Stats, also when the backup fails. In dry-run mode nothing is
+// written and the returned root is nil.
+//
+// Blobs are renamed into place once complete and directory listings are
+// saved after their content, so an interrupted backup leaves no head and
+// only complete, unreferenced blobs. Running CreateSnapshot again reuses
+// them; see InterruptedBackup.
+//
+// Callers that may run concurrently with other writers should hold the
+// store lock (see Lock).
+func (b *Backup) CreateSnapshot() (*BackupRoot, BackupStats, error) {
+	if b.Top == "" {
+		return nil, BackupStats{}, fmt.Errorf("no source directory to back up")
+	}
+
+	b.Stats = BackupStats{}
+	b.Failed = nil
+	if b.HashCache != nil {
+		b.HashCache.ResetStats()
+	}
+	root, err := b.saveSnapshot()
+	return root, b.Stats.Load(), err
+}
+
+// saveSnapshot does the work of CreateSnapshot.
+func (b *Backup) saveSnapshot() (*BackupRoot, error) {
+	if !b.DryRun {
+		if err := b.setInProgress(time.Now()); err != nil {
+			b.warnf("Failed to write progress marker: %v", err)
+		}
+	}
+
+	top := NewDirectoryEntry(b, b.Top, nil)
+	if err := top.Save(); err != nil {
+		return nil, err
+	}
+	if b.DryRun {
+		return nil, nil
+	}
+
+	h, err := top.Hash()
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate top hash: %w", err)
+	}
+
+	// Format: yyMMdd-HHmmss, with a -N suffix for further snapshots of the same second
+	name, err := b.WriteSnapshotHead(b.ProjectName, time.Now(), h)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write backup head: %w", err)
+	}
+
+	ref := path.Join(b.ProjectName, name)
+	if err := b.setInProgress(time.Time{}); err != nil {
+		b.warnf("Failed to remove progress marker: %v", err)
+	}
+	if err := b.WriteSnapshotMeta(ref, NewSnapshotMeta(b.Message)); err != nil {
+		b.warnf("Failed to write snapshot metadata: %v", err)
+	}
+
+	// Entries for files that no longer exist are of no use
+	if b.HashCache != nil {
+		b.HashCache.Prune()
+		if err := b.HashCache.MaybeSaveCache(); err != nil {
+			b.warnf("Failed to save hash cache: %v", err)
+		}
+	}
+	if b.ChunkCache != nil {
+		b.ChunkCache.Prune()
+		if err := b.ChunkCache.MaybeSaveCache(); err != nil {
+			b.warnf("Failed to save chunk cache: %v", err)
+		}
+	}
+
+	return b.backupRoot(ref)
+}
+
+// progressPath is the store's record of backups that have started but not
+// written their snapshot head yet, one start time per project.
+func (b *Backup) progressPath() string {
+	return filepath.Join(b.StoreRoot, ".backup", "in-progress")
+}
+
+// InterruptedBackup returns the start time of a backup of the current
+// project that was interrupted before writing its snapshot head.
+func (b *Backup) InterruptedBackup() (time.Time, bool) {
+	props, err := LoadProperties(b.progressPath())
+	if err != nil {
+		return time.Time{}, false
+	}
+	started, err := time.Parse(time.RFC3339, props[b.ProjectName])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return started, true
+}
+
+// setInProgress records the start of a backup of the current project, or
+// clears the record if started is zero.
+func (b *Backup) setInProgress(started time.Time) error {
+	path := b.progressPath()
+	props, err := LoadProperties(path)
+	if err != nil {
+		return err
+	}
+	if started.IsZero() {
+		if _, ok := props[b.ProjectName]; !ok {
+			return nil
+		}
+		delete(props, b.ProjectName)
+		if len(props) == 0 {
+			return os.Remove(path)
+		}
+	} else {
+		props[b.ProjectName] = started.Format(time.RFC3339)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return props.Store(path, " Backups that have not written their snapshot head yet")
+}
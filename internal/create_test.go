@@ -0,0 +1,161 @@
+package internal
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestCreateSnapshot(t *testing.T) {
+	b := newTestBackup(t)
+	b.HashCache.file = filepath.Join(t.TempDir(), "hash-cache")
+	writeTestFile(t, b, "a.txt", "a")
+	writeTestFile(t, b, "sub/b.txt", "b")
+
+	b.DryRun = true
+	root, stats, err := b.CreateSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root != nil {
+		t.Errorf("Expected no snapshot in dry-run mode, got %s", root)
+	}
+	if stats.FilesArchived != 2 || stats.BytesArchived != 2 {
+		t.Errorf("Expected the dry run to count what it would archive, got %+v", stats)
+	}
+	if roots, _ := b.BackupRoots(); len(roots) != 0 {
+		t.Errorf("Dry run wrote %d snapshot heads", len(roots))
+	}
+
+	b.DryRun = false
+	root, stats, err = b.CreateSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.FilesArchived != 2 || stats.DirsTotal != 2 || stats.BytesArchived != 2 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	if stats != b.Stats {
+		t.Errorf("Expected the returned stats %+v to be those of the backup, %+v", stats, b.Stats)
+	}
+	entry, err := root.Locate("sub/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := entry.(*BackupFile); !ok {
+		t.Errorf("Expected sub/b.txt to be a file, got %T", entry)
+	}
+	if _, err := os.Stat(b.HashCache.file); err != nil {
+		t.Errorf("Expected the hash cache to be saved: %v", err)
+	}
+
+	// Stats are reset for every snapshot
+	second, stats, err := b.CreateSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.FilesArchived != 0 || stats.BytesArchived != 0 || stats.FilesTotal != 2 || stats.FilesDeduplicated != 2 || stats.BytesDeduplicated != 2 {
+		t.Errorf("Expected both files to be deduplicated, got %+v", stats)
+	}
+	if second.Timestamp() == root.Timestamp() {
+		t.Errorf("Expected a new snapshot name, got %s twice", root.Timestamp())
+	}
+	h1, _ := root.Hash()
+	h2, _ := second.Hash()
+	if h1 != h2 {
+		t.Errorf("Expected unchanged trees to hash the same, got %s and %s", h1, h2)
+	}
+}
+
+func TestCreateSnapshot_Resume(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "a.txt", "a")
+	writeTestFile(t, b, "sub/b.txt", "b")
+	writeTestFile(t, b, "sub/c.txt", "c")
+	want, err := NewDirectoryEntry(b, b.Top, nil).Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A backup killed after saving sub/ and while writing another blob
+	if err := b.setInProgress(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewDirectoryEntry(b, filepath.Join(b.Top, "sub"), nil).Save(); err != nil {
+		t.Fatal(err)
+	}
+	blob := b.Store.DataStore(b.Store.HashBytes([]byte("a")))
+	if err := os.MkdirAll(filepath.Dir(blob), 0755); err != nil {
+		t.Fatal(err)
+	}
+	partial, err := createPartial(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	partial.Close()
+
+	if roots, _ := b.BackupRoots(); len(roots) != 0 {
+		t.Fatalf("Expected no snapshot head, got %v", roots)
+	}
+	if _, ok := b.InterruptedBackup(); !ok {
+		t.Error("Expected the interrupted backup to be recorded")
+	}
+
+	root, _, err := b.CreateSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := root.Hash(); got != want {
+		t.Errorf("Expected the resumed snapshot to hash to %s, got %s", want, got)
+	}
+	if b.Stats.FilesArchived != 1 || b.Stats.FilesDeduplicated != 2 {
+		t.Errorf("Expected the files of sub/ to be reused, got %+v", b.Stats)
+	}
+	if _, ok := b.InterruptedBackup(); ok {
+		t.Error("Expected the progress marker to be cleared")
+	}
+	if _, err := os.Stat(b.progressPath()); !os.IsNotExist(err) {
+		t.Errorf("Expected the progress file to be removed, got %v", err)
+	}
+	for _, err := range b.Verify(true) {
+		t.Errorf("Unexpected verify error: %v", err)
+	}
+}
+
+func TestCreateSnapshot_UnreadableFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix sockets are not files on Windows")
+	}
+	b := newTestBackup(t)
+	b.HashCache.file = filepath.Join(t.TempDir(), "hash-cache")
+	writeTestFile(t, b, "a.txt", "a")
+	// A socket can be listed and stat'ed but not opened, even by root
+	l, err := net.Listen("unix", filepath.Join(b.Top, "s"))
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+
+	b.Strict = true
+	if _, _, err := b.CreateSnapshot(); err == nil {
+		t.Fatal("Expected a strict backup to fail")
+	}
+
+	b.Strict = false
+	root, _, err := b.CreateSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Stats.FilesFailed != 1 || len(b.Failed) != 1 || b.Failed[0].Path != filepath.Join(b.Top, "s") {
+		t.Errorf("Expected the socket to be recorded as failed, got %d %v", b.Stats.FilesFailed, b.Failed)
+	}
+	if entry, _ := root.Locate("s"); entry != nil {
+		t.Error("Expected the socket to be left out")
+	}
+	if entry, _ := root.Locate("a.txt"); entry == nil {
+		t.Error("Expected the readable file to be backed up")
+	}
+}
@@ -0,0 +1,162 @@
+package internal
+
+import (
+	"path"
+	"sort"
+)
+
+type DiffType int
+
+const (
+	DiffAdded       DiffType = iota // +
+	DiffRemoved                     // -
+	DiffModified                    // M
+	DiffTypeChanged                 // T
+)
+
+func (d DiffType) String() string {
+	switch d {
+	case DiffAdded:
+		return "+"
+	case DiffRemoved:
+		return "-"
+	case DiffModified:
+		return "M"
+	case DiffTypeChanged:
+		return "T"
+	default:
+		return "?"
+	}
+}
+
+// DiffEntry is a single difference between two snapshots.
+// Path uses forward slashes and ends with "/" for directories.
+type DiffEntry struct {
+	Type DiffType
+	Path string
+}
+
+// Diff compares r (the older snapshot) against other and returns the
+// added, removed, modified and type-changed paths, grouped by type and
+// sorted by path.
+func (r *BackupRoot) Diff(other *BackupRoot) ([]DiffEntry, error) {
+	from, err := r.TopDirectory()
+	if err != nil {
+		return nil, err
+	}
+	to, err := other.TopDirectory()
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []DiffEntry
+	if err := diffDirectories(from, to, "", &diffs); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(diffs, func(i, j int) bool {
+		if diffs[i].Type != diffs[j].Type {
+			return diffs[i].Type < diffs[j].Type
+		}
+		return diffs[i].Path < diffs[j].Path
+	})
+	return diffs, nil
+}
+
+func diffDirectories(from, to *BackupDirectory, prefix string, diffs *[]DiffEntry) error {
+	// Identical listings have identical content
+	if from.Hash() == to.Hash() {
+		return nil
+	}
+
+	fromEntries, err := from.Entries()
+	if err != nil {
+		return err
+	}
+	toEntries, err := to.Entries()
+	if err != nil {
+		return err
+	}
+
+	for name, oldEntry := range fromEntries {
+		entryPath := path.Join(prefix, name)
+		newEntry, ok := toEntries[name]
+		if !ok {
+			if err := diffSubtree(oldEntry, entryPath, DiffRemoved, diffs); err != nil {
+				return err
+			}
+			continue
+		}
+
+		oldDir, oldIsDir := oldEntry.(*BackupDirectory)
+		newDir, newIsDir := newEntry.(*BackupDirectory)
+		switch {
+		case oldIsDir && newIsDir:
+			if err := diffDirectories(oldDir, newDir, entryPath, diffs); err != nil {
+				return err
+			}
+		case entryKind(oldEntry) != entryKind(newEntry):
+			*diffs = append(*diffs, DiffEntry{Type: DiffTypeChanged, Path: entryPath})
+			// Contents of a directory that appeared or disappeared are listed too
+			if oldIsDir {
+				if err := diffChildren(oldDir, entryPath, DiffRemoved, diffs); err != nil {
+					return err
+				}
+			}
+			if newIsDir {
+				if err := diffChildren(newDir, entryPath, DiffAdded, diffs); err != nil {
+					return err
+				}
+			}
+		case oldEntry.Hash() != newEntry.Hash():
+			// Covers changed file content and changed symlink targets
+			*diffs = append(*diffs, DiffEntry{Type: DiffModified, Path: entryPath})
+		}
+	}
+
+	for name, newEntry := range toEntries {
+		if _, ok := fromEntries[name]; ok {
+			continue
+		}
+		if err := diffSubtree(newEntry, path.Join(prefix, name), DiffAdded, diffs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffSubtree records entry and, for directories, everything below it.
+func diffSubtree(entry BackupEntry, entryPath string, t DiffType, diffs *[]DiffEntry) error {
+	dir, ok := entry.(*BackupDirectory)
+	if !ok {
+		*diffs = append(*diffs, DiffEntry{Type: t, Path: entryPath})
+		return nil
+	}
+	*diffs = append(*diffs, DiffEntry{Type: t, Path: entryPath + "/"})
+	return diffChildren(dir, entryPath, t, diffs)
+}
+
+func diffChildren(dir *BackupDirectory, prefix string, t DiffType, diffs *[]DiffEntry) error {
+	entries, err := dir.Entries()
+	if err != nil {
+		return err
+	}
+	for name, child := range entries {
+		if err := diffSubtree(child, path.Join(prefix, name), t, diffs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entryKind returns the listing type character of a backup entry.
+func entryKind(e BackupEntry) byte {
+	switch e.(type) {
+	case *BackupDirectory:
+		return 'D'
+	case *BackupLink:
+		return 'L'
+	default:
+		return 'F'
+	}
+}
@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestBackupRoot_Diff(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "same.txt", "same")
+	writeTestFile(t, b, "changed.txt", "v1")
+	writeTestFile(t, b, "removed.txt", "gone")
+	writeTestFile(t, b, "becomes-dir", "file")
+	writeTestFile(t, b, "olddir/a.txt", "a")
+	first := snapshotTestBackup(t, b, "200101-000000")
+
+	writeTestFile(t, b, "changed.txt", "v2")
+	os.Remove(filepath.Join(b.Top, "removed.txt"))
+	os.Remove(filepath.Join(b.Top, "becomes-dir"))
+	writeTestFile(t, b, "becomes-dir/inner.txt", "inner")
+	os.RemoveAll(filepath.Join(b.Top, "olddir"))
+	writeTestFile(t, b, "newdir/sub/b.txt", "b")
+	second := snapshotTestBackup(t, b, "200101-000001")
+
+	diffs, err := first.Diff(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []DiffEntry{
+		{DiffAdded, "becomes-dir/inner.txt"},
+		{DiffAdded, "newdir/"},
+		{DiffAdded, "newdir/sub/"},
+		{DiffAdded, "newdir/sub/b.txt"},
+		{DiffRemoved, "olddir/"},
+		{DiffRemoved, "olddir/a.txt"},
+		{DiffRemoved, "removed.txt"},
+		{DiffModified, "changed.txt"},
+		{DiffTypeChanged, "becomes-dir"},
+	}
+	if !reflect.DeepEqual(diffs, want) {
+		t.Errorf("Diff mismatch:\n got %v\nwant %v", diffs, want)
+	}
+
+	// Comparing a snapshot with itself yields nothing
+	diffs, err = second.Diff(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("Expected no differences, got %v", diffs)
+	}
+}
+
+func TestBackupRoot_DiffSymlinkTarget(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require privileges on Windows")
+	}
+	b := newTestBackup(t)
+	link := filepath.Join(b.Top, "link")
+	if err := os.Symlink("a", link); err != nil {
+		t.Fatal(err)
+	}
+	first := snapshotTestBackup(t, b, "200101-000000")
+
+	os.Remove(link)
+	if err := os.Symlink("b", link); err != nil {
+		t.Fatal(err)
+	}
+	second := snapshotTestBackup(t, b, "200101-000001")
+
+	diffs, err := first.Diff(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []DiffEntry{{DiffModified, "link"}}
+	if !reflect.DeepEqual(diffs, want) {
+		t.Errorf("Diff mismatch: got %v, want %v", diffs, want)
+	}
+}
+
+func TestBackupRoot_DiffTypeTransitions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require privileges on Windows")
+	}
+	b := newTestBackup(t)
+	writeTestFile(t, b, "dir-to-link/a.txt", "a")
+	writeTestFile(t, b, "file-to-link", "file")
+	writeTestFile(t, b, "target.txt", "target")
+	if err := os.Symlink("target.txt", filepath.Join(b.Top, "link-to-dir")); err != nil {
+		t.Fatal(err)
+	}
+	first := snapshotTestBackup(t, b, "200101-000000")
+
+	for _, name := range []string{"dir-to-link", "file-to-link", "link-to-dir"} {
+		if err := os.RemoveAll(filepath.Join(b.Top, name)); err != nil {
+			t.Fatal(err)
+		}
+		if name != "link-to-dir" {
+			if err := os.Symlink("target.txt", filepath.Join(b.Top, name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	writeTestFile(t, b, "link-to-dir/b.txt", "b")
+	second := snapshotTestBackup(t, b, "200101-000001")
+
+	diffs, err := first.Diff(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []DiffEntry{
+		{DiffAdded, "link-to-dir/b.txt"},
+		{DiffRemoved, "dir-to-link/a.txt"},
+		{DiffTypeChanged, "dir-to-link"},
+		{DiffTypeChanged, "file-to-link"},
+		{DiffTypeChanged, "link-to-dir"},
+	}
+	if !reflect.DeepEqual(diffs, want) {
+		t.Errorf("Diff mismatch:\n got %v\nwant %v", diffs, want)
+	}
+}
@@ -0,0 +1,273 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DoctorFinding is the result of one check made by Doctor.
+type DoctorFinding struct {
+	Check   string `json:"check"`             // What was checked
+	Problem string `json:"problem,omitempty"` // Empty if the check passed
+	Hint    string `json:"hint,omitempty"`    // What to do about the problem
+	// Warning marks problems that do not keep commands from working.
+	Warning bool `json:"warning,omitempty"`
+}
+
+// Failed reports whether the finding is a problem other than a warning.
+func (f DoctorFinding) Failed() bool {
+	return f.Problem != "" && !f.Warning
+}
+
+type doctor struct {
+	findings []DoctorFinding
+}
+
+func (d *doctor) ok(check string) {
+	d.findings = append(d.findings, DoctorFinding{Check: check})
+}
+
+func (d *doctor) fail(check, problem, hint string) {
+	d.findings = append(d.findings, DoctorFinding{Check: check, Problem: problem, Hint: hint})
+}
+
+func (d *doctor) warn(check, problem, hint string) {
+	d.findings = append(d.findings, DoctorFinding{Check: check, Problem: problem, Hint: hint, Warning: true})
+}
+
+// Doctor checks the setup found from startDir and storeDir, which are
+// interpreted like the arguments of NewBackup: the source config and its
+// settings, the store and its store.toml, the hash caches, leftover
+// partial files, snapshot heads and the store lock. Checks that depend on
+// a failed one are skipped. Unlike NewBackup it asks nothing and does not
+// create a missing store.toml.
+func Doctor(startDir, storeDir string) []DoctorFinding {
+	d := &doctor{}
+	cwd, err := ExpandPath(startDir)
+	if cwd == "" && err == nil {
+		cwd, _ = os.Getwd()
+	}
+	if err == nil {
+		cwd, err = filepath.Abs(cwd)
+	}
+	if err != nil {
+		d.fail("source directory", err.Error(), "")
+		return d.findings
+	}
+
+	storeRoot := ""
+	if storeDir != "" {
+		storeRoot = storeDir
+		if !IsStoreURL(storeDir) {
+			if storeRoot, err = ExpandPath(storeDir); err == nil {
+				storeRoot, err = filepath.Abs(storeRoot)
+			}
+			if err != nil {
+				d.fail("store path "+storeDir, err.Error(), "")
+				return d.findings
+			}
+			if !fileExists(filepath.Join(storeRoot, ".backup", "store.toml")) {
+				if root, _ := storeProject(storeRoot); root != "" {
+					storeRoot = root
+				}
+			}
+		}
+	}
+
+	top := lookupTop(cwd)
+	switch {
+	case top != "" && fileExists(filepath.Join(top, ".backup", "store.toml")):
+		if storeRoot == "" {
+			storeRoot = top
+		}
+	case top != "" && fileExists(filepath.Join(top, ".backup", "config.toml")):
+		root, ok := d.checkSource(top, storeRoot)
+		if !ok {
+			return d.findings
+		}
+		storeRoot = root
+	case storeRoot == "":
+		d.fail("configuration", fmt.Sprintf("no source directory or store found at %s or above", cwd),
+			"run 'backup init <store>' in the source directory, or pass --store")
+		return d.findings
+	}
+
+	if !IsStoreURL(storeRoot) && !d.checkStoreDir(storeRoot) {
+		return d.findings
+	}
+
+	b, err := NewBackup(startDir, storeDir, false)
+	if err != nil {
+		d.fail("opening "+storeRoot, err.Error(), "")
+		return d.findings
+	}
+	d.ok("store " + b.StoreName() + " opens")
+	d.checkBackup(b)
+	return d.findings
+}
+
+// checkSource checks the config of the source directory top and returns
+// the store it names, unless storeRoot is given.
+func (d *doctor) checkSource(top, storeRoot string) (string, bool) {
+	configPath := filepath.Join(top, ".backup", "config.toml")
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		d.fail("source config "+configPath, err.Error(), "fix the TOML syntax at the position given")
+		return "", false
+	}
+	d.ok("source config " + configPath + " parses")
+
+	name := config.Name
+	switch {
+	case name == "":
+		d.warn("project name", "config.toml sets no name", "add name = \"<project>\" to "+configPath)
+	case filepath.Base(name) != name || name == "." || name == ".." || strings.ContainsAny(name, `/\`):
+		d.fail("project name", fmt.Sprintf("invalid project name %q", name), "use a plain name without slashes, e.g. with 'backup rename-project'")
+	default:
+		d.ok("project name " + name)
+	}
+
+	for _, size := range []struct{ setting, value string }{
+		{"max_file_size", config.MaxFileSize},
+		{"chunk_threshold", config.ChunkThreshold},
+	} {
+		if size.value == "" {
+			continue
+		}
+		if _, err := ParseSize(size.value); err != nil {
+			d.fail(size.setting, err.Error(), "use a size like \"100MiB\" in "+configPath)
+		}
+	}
+	if config.GlobalIgnore != "" {
+		if _, err := (*Backup)(nil).loadGlobalIgnore(top, config.GlobalIgnore); err != nil {
+			d.fail("global_ignore", err.Error(), "point global_ignore in "+configPath+" to an existing file")
+		}
+	}
+	if len(config.Includes) > 0 {
+		if _, err := resolveIncludes(top, config.Includes); err != nil {
+			d.fail("includes", err.Error(), "fix the includes in "+configPath)
+		}
+	}
+
+	if storeRoot != "" {
+		return storeRoot, true
+	}
+	if config.Store == "" {
+		d.fail("store setting", "config.toml names no store", "add store = \"<path>\" to "+configPath+" or pass --store")
+		return "", false
+	}
+	if IsStoreURL(config.Store) {
+		return config.Store, true
+	}
+	expanded, err := ExpandPath(config.Store)
+	if err != nil {
+		d.fail("store setting", err.Error(), "")
+		return "", false
+	}
+	if !filepath.IsAbs(expanded) {
+		expanded = filepath.Join(top, expanded)
+	}
+	return filepath.Clean(expanded), true
+}
+
+// checkStoreDir checks that the local store at root exists and has a valid
+// store.toml.
+func (d *doctor) checkStoreDir(root string) bool {
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		d.fail("store "+root, "store directory does not exist",
+			"check the store setting and that the drive is mounted, or create the store with 'backup init-store "+root+"'")
+		return false
+	}
+	storeToml := filepath.Join(root, ".backup", "store.toml")
+	config, err := LoadStoreConfig(storeToml)
+	if errors.Is(err, fs.ErrNotExist) {
+		d.fail("store config "+storeToml, "store.toml is missing, so this is not a backup store",
+			"check the store path, or run 'backup init-store "+root+"' if it is a new store")
+		return false
+	}
+	if err != nil {
+		d.fail("store config "+storeToml, err.Error(), "fix the TOML syntax at the position given")
+		return false
+	}
+	problems := false
+	if _, err := LookupHashFunc(config.Hash); err != nil {
+		d.fail("store config "+storeToml, err.Error(), "")
+		problems = true
+	}
+	if _, err := LookupCodec(config.Compression); err != nil {
+		d.fail("store config "+storeToml, err.Error(), "")
+		problems = true
+	}
+	if _, _, err := config.Shards(); err != nil {
+		d.fail("store config "+storeToml, err.Error(), "")
+		problems = true
+	}
+	if _, _, err := config.IORetry(); err != nil {
+		d.fail("store config "+storeToml, err.Error(), "")
+		problems = true
+	}
+	if _, err := config.KeepUnreferenced(); err != nil {
+		d.fail("store config "+storeToml, err.Error(), "")
+		problems = true
+	}
+	if problems {
+		return false
+	}
+	d.ok("store config " + storeToml + " parses")
+	return true
+}
+
+// checkBackup checks the state of the opened store and source directory.
+func (d *doctor) checkBackup(b *Backup) {
+	for _, hc := range []*HashCache{b.HashCache, b.ChunkCache} {
+		if hc == nil {
+			continue
+		}
+		if err := hc.Verify(); err != nil {
+			d.fail("hash cache "+hc.Path(), err.Error(), "remove the file; the next backup hashes all files again")
+		} else {
+			d.ok("hash cache " + hc.Path())
+		}
+	}
+
+	if partials, err := b.Store.FindPartials(); err != nil {
+		d.fail("partial files", err.Error(), "")
+	} else if len(partials) > 0 {
+		d.warn("partial files", fmt.Sprintf("%d leftover partial files of interrupted backups", len(partials)),
+			"remove them with 'backup check --clean-partials'")
+	} else {
+		d.ok("no partial files")
+	}
+
+	if invalid, err := b.InvalidHeads(); err != nil {
+		d.fail("snapshot heads", err.Error(), "")
+	} else if len(invalid) > 0 {
+		names := make([]string, len(invalid))
+		for i, h := range invalid {
+			names[i] = h.String()
+		}
+		d.fail("snapshot heads", fmt.Sprintf("%d unreadable snapshot heads: %s", len(invalid), strings.Join(names, ", ")),
+			"these snapshots are skipped by every command; restore the files from a copy of the store or remove them with 'backup list --verify-heads --fix'")
+	} else {
+		d.ok("snapshot heads")
+	}
+
+	if owner, err := b.LockOwner(); err != nil {
+		d.warn("store lock", err.Error(), "remove it with 'backup unlock'")
+	} else if owner != nil && owner.Stale() {
+		d.warn("store lock", "stale lock held by "+owner.String(), "the next command removes it, or run 'backup unlock'")
+	} else if owner != nil {
+		d.warn("store lock", "store is locked by "+owner.String(), "wait for that command, or run 'backup unlock' if it is not running")
+	} else {
+		d.ok("store is not locked")
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
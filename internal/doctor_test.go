@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDoctor(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	store := t.TempDir()
+	if _, err := NewBackup(t.TempDir(), store, true); err != nil {
+		t.Fatal(err)
+	}
+	src := t.TempDir()
+	configPath := filepath.Join(src, ".backup", "config.toml")
+	if err := os.MkdirAll(filepath.Dir(configPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeConfig := func(config string) {
+		t.Helper()
+		if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	problems := func() (failed, warnings []string) {
+		for _, f := range Doctor(src, "") {
+			if f.Failed() {
+				failed = append(failed, f.Check+": "+f.Problem)
+			} else if f.Problem != "" {
+				warnings = append(warnings, f.Check+": "+f.Problem)
+			}
+		}
+		return failed, warnings
+	}
+
+	writeConfig("store = \"" + filepath.ToSlash(store) + "\"\nname = \"proj\"\n")
+	if failed, warnings := problems(); len(failed) != 0 || len(warnings) != 0 {
+		t.Errorf("Expected no problems, got %v %v", failed, warnings)
+	}
+
+	// Leftovers of interrupted backups
+	if err := os.MkdirAll(filepath.Join(store, "snapshots", "proj"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(store, "snapshots", "proj", "260101-100000"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(store, "data", "x.partial"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	failed, warnings := problems()
+	if len(failed) != 1 || !strings.Contains(failed[0], "proj/260101-100000") {
+		t.Errorf("Expected the empty head to be reported, got %v", failed)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "partial") {
+		t.Errorf("Expected a warning about the partial file, got %v", warnings)
+	}
+
+	for config, want := range map[string]string{
+		"store = \"" + filepath.ToSlash(store) + "\"\nname = \"a/b\"\n":                            "invalid project name",
+		"store = \"" + filepath.ToSlash(store) + "\"\nname = \"proj\"\nmax_file_size = \"lots\"\n": "max_file_size",
+		"store = \"" + filepath.ToSlash(filepath.Join(store, "missing")) + "\"\nname = \"proj\"\n": "does not exist",
+		"store = \"" + filepath.ToSlash(src) + "\"\nname = \"proj\"\n":                             "store.toml is missing",
+		"name = \"proj\"\n":        "names no store",
+		"store = \"unterminated\n": "source config",
+	} {
+		writeConfig(config)
+		if failed, _ := problems(); len(failed) == 0 || !strings.Contains(strings.Join(failed, "\n"), want) {
+			t.Errorf("Expected %q for config %q, got %v", want, config, failed)
+		}
+	}
+}
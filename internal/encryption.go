@@ -0,0 +1,288 @@
+package internal
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+// EncryptionAESGCM encrypts blobs with AES-256-GCM under a key derived from
+// a passphrase with scrypt.
+const EncryptionAESGCM = "aes-gcm"
+
+// PassphraseEnv names the environment variable read for the passphrase of
+// encrypted stores before prompting for it.
+const PassphraseEnv = "BACKUP_PASSPHRASE"
+
+// Encrypted blobs start with encryptionMagic and a random nonce prefix,
+// followed by segments of up to encryptionSegment bytes of compressed
+// content, each sealed with its own authentication tag. The nonce of a
+// segment is the prefix and the segment counter, and the last segment is
+// sealed with different additional data, so that segments cannot be
+// reordered, dropped or truncated unnoticed.
+const (
+	encryptionMagic   = "BKE1"
+	encryptionSegment = 64 << 10
+	noncePrefixSize   = 8
+)
+
+var encryptionCheckLabel = []byte("backup encryption check")
+
+// NewEncryptionConfig returns the store settings for blobs encrypted with
+// passphrase: the hex encoded scrypt salt and a check value telling a wrong
+// passphrase apart from damaged blobs.
+func NewEncryptionConfig(passphrase string) (salt, check string, err error) {
+	if passphrase == "" {
+		return "", "", fmt.Errorf("empty passphrase")
+	}
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	_, checkKey, err := deriveKeys(passphrase, raw)
+	if err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(raw), encryptionCheck(checkKey), nil
+}
+
+// deriveKeys derives the blob key and the key of the check value from
+// passphrase.
+func deriveKeys(passphrase string, salt []byte) (blobKey, checkKey []byte, err error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 64)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key[:32], key[32:], nil
+}
+
+func encryptionCheck(checkKey []byte) string {
+	mac := hmac.New(sha256.New, checkKey)
+	mac.Write(encryptionCheckLabel)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// openEncryption sets up the blob encryption of the store configured in
+// store.toml, reading the passphrase with readPassphrase.
+func (s *Store) openEncryption(c *StoreConfig, storeRoot string) error {
+	if c.Encryption == "" {
+		return nil
+	}
+	if !strings.EqualFold(c.Encryption, EncryptionAESGCM) {
+		return fmt.Errorf("unsupported encryption %q (supported: %s)", c.Encryption, EncryptionAESGCM)
+	}
+	salt, err := hex.DecodeString(c.EncryptionSalt)
+	if err != nil || len(salt) == 0 {
+		return fmt.Errorf("invalid encryption_salt in store.toml")
+	}
+	passphrase, err := readPassphrase(fmt.Sprintf("Passphrase for %s: ", storeRoot))
+	if err != nil {
+		return err
+	}
+	return s.setEncryptionKey(passphrase, salt, c.EncryptionCheck)
+}
+
+// setEncryptionKey derives the blob key from passphrase and checks it
+// against check, the encryption_check of store.toml.
+func (s *Store) setEncryptionKey(passphrase string, salt []byte, check string) error {
+	blobKey, checkKey, err := deriveKeys(passphrase, salt)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(encryptionCheck(checkKey)), []byte(check)) {
+		return fmt.Errorf("wrong passphrase")
+	}
+	block, err := aes.NewCipher(blobKey)
+	if err != nil {
+		return err
+	}
+	s.aead, err = cipher.NewGCM(block)
+	return err
+}
+
+// readPassphrase returns the passphrase from PassphraseEnv, or prompts for
+// it when stdin is a terminal.
+func readPassphrase(prompt string) (string, error) {
+	if p := os.Getenv(PassphraseEnv); p != "" {
+		return p, nil
+	}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("store is encrypted; set %s when running non-interactively", PassphraseEnv)
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	p, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return string(p), nil
+}
+
+// ReadNewPassphrase prompts twice for a new passphrase, unless it is set in
+// PassphraseEnv.
+func ReadNewPassphrase() (string, error) {
+	if p := os.Getenv(PassphraseEnv); p != "" {
+		return p, nil
+	}
+	p, err := readPassphrase("New passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	again, err := readPassphrase("Repeat passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if p != again {
+		return "", fmt.Errorf("passphrases do not match")
+	}
+	return p, nil
+}
+
+func segmentNonce(prefix []byte, counter uint32) []byte {
+	nonce := make([]byte, noncePrefixSize+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	return nonce
+}
+
+func segmentAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// encryptWriter seals what is written to it into w. Close writes the last
+// segment; it does not close w.
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	started bool
+}
+
+func newEncryptWriter(w io.Writer, aead cipher.AEAD) (*encryptWriter, error) {
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, prefix: prefix, buf: make([]byte, 0, encryptionSegment)}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		// A full segment is only sealed once more content follows, since
+		// the last segment is sealed differently
+		if len(e.buf) == encryptionSegment {
+			if err := e.seal(false); err != nil {
+				return n, err
+			}
+		}
+		k := copy(e.buf[len(e.buf):encryptionSegment], p)
+		e.buf = e.buf[:len(e.buf)+k]
+		p = p[k:]
+		n += k
+	}
+	return n, nil
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	if !e.started {
+		if _, err := io.WriteString(e.w, encryptionMagic); err != nil {
+			return err
+		}
+		if _, err := e.w.Write(e.prefix); err != nil {
+			return err
+		}
+		e.started = true
+	}
+	if e.counter == ^uint32(0) {
+		return fmt.Errorf("blob too large to encrypt")
+	}
+	sealed := e.aead.Seal(nil, segmentNonce(e.prefix, e.counter), e.buf, segmentAD(last))
+	e.counter++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+// decryptReader opens the segments of an encrypted blob read from r.
+type decryptReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	sealed  []byte
+	plain   []byte
+	done    bool
+}
+
+func newDecryptReader(r io.Reader, aead cipher.AEAD) (*decryptReader, error) {
+	br := bufio.NewReaderSize(r, encryptionSegment+aead.Overhead()+1)
+	header := make([]byte, len(encryptionMagic)+noncePrefixSize)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("encrypted blob too short: %w", err)
+	}
+	if string(header[:len(encryptionMagic)]) != encryptionMagic {
+		return nil, fmt.Errorf("blob is not encrypted")
+	}
+	return &decryptReader{r: br, aead: aead, prefix: header[len(encryptionMagic):], sealed: make([]byte, encryptionSegment+aead.Overhead())}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptReader) open() error {
+	n, err := io.ReadFull(d.r, d.sealed)
+	last := false
+	switch {
+	case errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF):
+		last = true
+	case err != nil:
+		return err
+	default:
+		if _, err := d.r.Peek(1); errors.Is(err, io.EOF) {
+			last = true
+		}
+	}
+	plain, err := d.aead.Open(d.sealed[:0:0], segmentNonce(d.prefix, d.counter), d.sealed[:n], segmentAD(last))
+	if err != nil {
+		return fmt.Errorf("cannot decrypt blob: %w", err)
+	}
+	d.counter++
+	d.plain = plain
+	d.done = last
+	return nil
+}
@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func newTestEncryption(t *testing.T, s *Store, passphrase string) {
+	t.Helper()
+	salt, check, err := NewEncryptionConfig(passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := hex.DecodeString(salt)
+	if err := s.setEncryptionKey(passphrase, raw, check); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryption_RoundTrip(t *testing.T) {
+	s := &Store{}
+	newTestEncryption(t, s, "secret")
+	for _, n := range []int{0, 1, encryptionSegment - 1, encryptionSegment, encryptionSegment + 1, 3*encryptionSegment + 17} {
+		data := randomData(int64(n), n)
+		var sealed bytes.Buffer
+		e, err := newEncryptWriter(&sealed, s.aead)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := e.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Close(); err != nil {
+			t.Fatal(err)
+		}
+		d, err := newDecryptReader(bytes.NewReader(sealed.Bytes()), s.aead)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", n, err)
+		}
+		got, err := io.ReadAll(d)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", n, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%d bytes: round trip returned %d bytes", n, len(got))
+		}
+
+		// Dropping the last segment or flipping a bit is detected
+		damaged := [][]byte{append([]byte(nil), sealed.Bytes()...)}
+		damaged[0][len(damaged[0])-1] ^= 1
+		if n > encryptionSegment {
+			damaged = append(damaged, sealed.Bytes()[:len(encryptionMagic)+noncePrefixSize+encryptionSegment+s.aead.Overhead()])
+		}
+		for i, blob := range damaged {
+			d, err := newDecryptReader(bytes.NewReader(blob), s.aead)
+			if err == nil {
+				_, err = io.ReadAll(d)
+			}
+			if err == nil {
+				t.Errorf("%d bytes: damaged blob %d decrypted", n, i)
+			}
+		}
+	}
+}
+
+func TestEncryption_Store(t *testing.T) {
+	b := newTestBackup(t)
+	newTestEncryption(t, b.Store, "secret")
+	content := strings.Repeat("plain text ", 100)
+	writeTestFile(t, b, "a.txt", content)
+	root := snapshotTestBackup(t, b, "260101-100000")
+
+	entry, err := root.Locate("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Blobs are still named after the hash of their content
+	if entry.Hash() != b.Store.HashBytes([]byte(content)) {
+		t.Errorf("Expected the blob to be named after its plain text hash")
+	}
+	stored, err := os.ReadFile(b.Store.DataStore(entry.Hash()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(stored, []byte(encryptionMagic)) {
+		t.Errorf("Blob is not encrypted")
+	}
+	if errs := b.Verify(true); len(errs) != 0 {
+		t.Errorf("Unexpected verify errors: %v", errs)
+	}
+
+	// Without the key the blobs cannot be read
+	plain := NewStore(b)
+	if err := plain.verifyBlobHash(entry.Hash()); err == nil {
+		t.Error("Expected reading an encrypted blob without the key to fail")
+	}
+	salt, _ := hex.DecodeString(strings.Repeat("00", 16))
+	if err := plain.setEncryptionKey("secret", salt, "bad"); err == nil || !strings.Contains(err.Error(), "wrong passphrase") {
+		t.Errorf("Expected a wrong passphrase error, got %v", err)
+	}
+
+	// A damaged blob fails the deep check
+	stored[len(stored)-1] ^= 1
+	if err := os.WriteFile(b.Store.DataStore(entry.Hash()), stored, 0644); err != nil {
+		t.Fatal(err)
+	}
+	errs := b.Verify(true)
+	if len(errs) != 1 {
+		t.Fatalf("Expected one verify error, got %v", errs)
+	}
+	if _, ok := errs[0].(*CorruptBlobError); !ok {
+		t.Errorf("Expected a CorruptBlobError, got %T: %v", errs[0], errs[0])
+	}
+}
+
+func TestStore_OpenEncryption(t *testing.T) {
+	salt, check, err := NewEncryptionConfig("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &StoreConfig{Encryption: EncryptionAESGCM, EncryptionSalt: salt, EncryptionCheck: check}
+	s := &Store{}
+	t.Setenv(PassphraseEnv, "secret")
+	if err := s.openEncryption(c, "store"); err != nil || s.aead == nil {
+		t.Fatalf("Expected the key to be set up, got %v", err)
+	}
+	t.Setenv(PassphraseEnv, "wrong")
+	if err := s.openEncryption(c, "store"); err == nil {
+		t.Error("Expected a wrong passphrase to fail")
+	}
+	c.Encryption = "rot13"
+	if err := s.openEncryption(c, "store"); err == nil {
+		t.Error("Expected an unsupported encryption to fail")
+	}
+}
@@ -1,14 +1,15 @@
 package internal
 
 import (
-	"compress/gzip"
-	"crypto/md5"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
+	"sync/atomic"
 )
 
 type EntryType int
@@ -17,6 +18,8 @@ const (
 	EntryTypeFile      EntryType = 0
 	EntryTypeDirectory EntryType = 1
 	EntryTypeLink      EntryType = 2
+	// EntryTypeChunkedFile is a file stored as a manifest of content-defined chunks.
+	EntryTypeChunkedFile EntryType = 3
 )
 
 type Entry interface {
@@ -24,96 +27,204 @@ type Entry interface {
 	Hash() (string, error)
 	Save() error
 	Type() EntryType
+	Attrs() EntryAttrs
 }
 
-// FileEntry represents a file in the backup tree.
+// FileEntry represents a file in the backup tree. Files at or above the
+// backup's ChunkThreshold are chunked and hashed by their chunk manifest.
 type FileEntry struct {
-	b    *Backup
-	path string
-	name string
-	hash string
+	b       *Backup
+	path    string
+	name    string
+	hash    string
+	attrs   EntryAttrs
+	chunked bool
+	inode   string // Set for hardlinked files; see linkGroup
 }
 
 func NewFileEntry(b *Backup, path string) (*FileEntry, error) {
-	hash, err := b.HashCache.FileHash(path)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	chunked := b.ChunkThreshold > 0 && info.Size() >= b.ChunkThreshold
+	var hash string
+	if chunked {
+		hash, err = b.manifestHash(path)
+	} else {
+		hash, err = b.HashCache.FileHash(path)
+	}
 	if err != nil {
 		return nil, err
 	}
 	return &FileEntry{
-		b:    b,
-		path: path,
-		name: filepath.Base(path),
-		hash: hash,
+		b:       b,
+		path:    path,
+		name:    filepath.Base(path),
+		hash:    hash,
+		inode:   hardlinkID(info),
+		attrs:   EntryAttrs{ModTime: info.ModTime(), Mode: info.Mode().Perm(), Xattrs: b.captureXattrs(path), Owner: b.captureOwner(info), Size: info.Size()},
+		chunked: chunked,
 	}, nil
 }
 
 func (e *FileEntry) Name() string          { return e.name }
-func (e *FileEntry) Type() EntryType       { return EntryTypeFile }
 func (e *FileEntry) Hash() (string, error) { return e.hash, nil }
+func (e *FileEntry) Attrs() EntryAttrs     { return e.attrs }
+
+func (e *FileEntry) Type() EntryType {
+	if e.chunked {
+		return EntryTypeChunkedFile
+	}
+	return EntryTypeFile
+}
 
 func (e *FileEntry) Save() error {
-	e.b.Stats.FilesTotal++
-	dest := e.b.Store.DataStore(e.hash)
-	if dest == "" {
+	atomic.AddInt64(&e.b.Stats.FilesTotal, 1)
+	if !e.b.Store.ValidHash(e.hash) {
 		return fmt.Errorf("invalid hash")
 	}
 
 	// Even in dry-run we want to check if it exists to know if we WOULD save it?
 	// or simulate saving.
-	if _, err := os.Stat(dest); err == nil {
-		return nil // Already saved
+	if e.b.Store.hasBlob(e.hash) {
+		// Already saved
+		atomic.AddInt64(&e.b.Stats.FilesDeduplicated, 1)
+		if info, err := os.Stat(e.path); err == nil {
+			atomic.AddInt64(&e.b.Stats.BytesDeduplicated, info.Size())
+		}
+		return nil
 	}
 
-	e.b.Stats.FilesArchived++
+	atomic.AddInt64(&e.b.Stats.FilesArchived, 1)
+
+	if e.chunked && !e.b.DryRun {
+		return e.saveChunked()
+	}
 
 	// Just for stats purposes we might want size?
 	// But info.Size() is not readily available unless we call Stat again or store it in FileEntry.
 	// We can trust the user doesn't need byte exact count for now
 	// OR we can do a quick Stat here.
+	var size int64
 	if info, err := os.Stat(e.path); err == nil {
-		e.b.Stats.BytesArchived += info.Size()
+		size = info.Size()
+		atomic.AddInt64(&e.b.Stats.BytesArchived, size)
 	}
 
 	if e.b.DryRun {
-		fmt.Printf("[dry-run] Would save file: %s -> %s\n", e.path, dest)
+		e.b.debugf("[dry-run] Would save file: %s -> %s", e.path, e.hash)
 		return nil
 	}
 
 	relPath, _ := filepath.Rel(e.b.Top, e.path)
-	fmt.Printf("Archiving: %s\n", relPath)
+	e.b.debugf("Archiving: %s", relPath)
 
-	tempDest := dest + ".partial"
-	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+	var orig *os.File
+	err := e.b.Store.retry(func() (err error) {
+		orig, err = os.Open(e.path)
 		return err
-	}
-
-	// Gzip compress
-	orig, err := os.Open(e.path)
+	})
 	if err != nil {
 		return err
 	}
 	defer orig.Close()
 
-	out, err := os.Create(tempDest)
-	if err != nil {
-		return err
+	err = e.b.Store.writeBlob(e.hash, &sizedReader{r: orig, left: e.attrs.Size, path: relPath})
+	var changed *ChangedFileError
+	if errors.As(err, &changed) {
+		// Not part of the snapshot after all; see DirectoryEntry.Save
+		atomic.AddInt64(&e.b.Stats.FilesTotal, -1)
+		atomic.AddInt64(&e.b.Stats.FilesArchived, -1)
+		atomic.AddInt64(&e.b.Stats.BytesArchived, -size)
 	}
-	defer out.Close()
+	return err
+}
+
+// ChangedFileError reports a file whose content changed between hashing
+// and saving, so that it no longer has the content of its hash.
+type ChangedFileError struct {
+	Path string // Relative to the source root
+}
 
-	gw := gzip.NewWriter(out)
-	defer gw.Close()
+func (e *ChangedFileError) Error() string {
+	return fmt.Sprintf("%s changed during backup", e.Path)
+}
 
-	if _, err := io.Copy(gw, orig); err != nil {
-		return err
+// sizedReader reads a file that must still have the size recorded in its
+// attributes. A file that grew or shrank since it was hashed no longer has
+// the content of its hash, so reading it fails with a ChangedFileError
+// rather than storing that content under the hash.
+type sizedReader struct {
+	r    io.Reader
+	left int64
+	path string
+}
+
+func (r *sizedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.left -= int64(n)
+	if r.left < 0 || (err == io.EOF && r.left != 0) {
+		return n, &ChangedFileError{Path: r.path}
 	}
-	if err := gw.Close(); err != nil {
+	return n, err
+}
+
+// saveChunked stores the chunks that are not in the store yet, then the
+// manifest listing them.
+func (e *FileEntry) saveChunked() error {
+	relPath, _ := filepath.Rel(e.b.Top, e.path)
+	e.b.debugf("Archiving (chunked): %s", relPath)
+
+	var f *os.File
+	err := e.b.Store.retry(func() (err error) {
+		f, err = os.Open(e.path)
+		return err
+	})
+	if err != nil {
 		return err
 	}
-	if err := out.Close(); err != nil {
+	defer f.Close()
+
+	var archived, deduplicated int64
+	manifest, err := e.b.Store.chunkFile(f, func(hash string, data []byte) error {
+		saved, err := e.b.Store.saveBlob(hash, data)
+		if saved {
+			archived += int64(len(data))
+			atomic.AddInt64(&e.b.Stats.BytesArchived, int64(len(data)))
+		} else if err == nil {
+			deduplicated += int64(len(data))
+			atomic.AddInt64(&e.b.Stats.BytesDeduplicated, int64(len(data)))
+		}
 		return err
+	})
+	if err != nil {
+		return err
+	}
+	if h := e.b.Store.HashBytes([]byte(manifest)); h != e.hash {
+		// Not part of the snapshot after all, like in Save
+		atomic.AddInt64(&e.b.Stats.FilesTotal, -1)
+		atomic.AddInt64(&e.b.Stats.FilesArchived, -1)
+		atomic.AddInt64(&e.b.Stats.BytesArchived, -archived)
+		atomic.AddInt64(&e.b.Stats.BytesDeduplicated, -deduplicated)
+		return &ChangedFileError{Path: relPath}
 	}
+	_, err = e.b.Store.saveBlob(e.hash, []byte(manifest))
+	return err
+}
 
-	return os.Rename(tempDest, dest)
+// manifestHash returns the chunk manifest hash of the file at path, using
+// the chunk cache when available.
+func (b *Backup) manifestHash(path string) (string, error) {
+	if b.ChunkCache != nil {
+		return b.ChunkCache.Lookup(path, b.Store.manifestHash)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return b.Store.manifestHash(f)
 }
 
 // LinkEntry represents a symlink in the backup tree.
@@ -130,7 +241,7 @@ func NewLinkEntry(b *Backup, path string) (*LinkEntry, error) {
 	if err != nil {
 		return nil, err
 	}
-	hash := fmt.Sprintf("%x", md5.Sum([]byte(target)))
+	hash := b.Store.HashBytes([]byte(target))
 	return &LinkEntry{
 		b:      b,
 		path:   path,
@@ -144,59 +255,52 @@ func (e *LinkEntry) Name() string          { return e.name }
 func (e *LinkEntry) Type() EntryType       { return EntryTypeLink }
 func (e *LinkEntry) Hash() (string, error) { return e.hash, nil }
 
+// Attrs returns no attributes: link times cannot be restored portably.
+func (e *LinkEntry) Attrs() EntryAttrs { return EntryAttrs{} }
+
 func (e *LinkEntry) Save() error {
-	e.b.Stats.FilesTotal++
-	dest := e.b.Store.DataStore(e.hash)
-	if dest == "" {
+	atomic.AddInt64(&e.b.Stats.FilesTotal, 1)
+	if !e.b.Store.ValidHash(e.hash) {
 		return fmt.Errorf("invalid hash")
 	}
 
-	if _, err := os.Stat(dest); err == nil {
-		return nil // Already saved
+	if e.b.Store.hasBlob(e.hash) {
+		// Already saved
+		atomic.AddInt64(&e.b.Stats.FilesDeduplicated, 1)
+		// The blob holds the target, not the content of the file it names
+		atomic.AddInt64(&e.b.Stats.BytesDeduplicated, int64(len(e.target)))
+		return nil
 	}
 
-	e.b.Stats.FilesArchived++
+	atomic.AddInt64(&e.b.Stats.FilesArchived, 1)
 
 	if e.b.DryRun {
-		fmt.Printf("[dry-run] Would save link: %s -> %s (target: %s)\n", e.path, dest, e.target)
+		e.b.debugf("[dry-run] Would save link: %s -> %s (target: %s)", e.path, e.hash, e.target)
 		return nil
 	}
 
 	relPath, _ := filepath.Rel(e.b.Top, e.path)
-	fmt.Printf("Archiving link: %s -> %s\n", relPath, e.target)
-
-	tempDest := dest + ".partial"
-	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
-		return err
-	}
-
-	out, err := os.Create(tempDest)
-	if err != nil {
-		return err
-	}
-	defer out.Close()
-
-	gw := gzip.NewWriter(out)
-	defer gw.Close()
-
-	if _, err := gw.Write([]byte(e.target)); err != nil {
-		return err
-	}
-	if err := gw.Close(); err != nil {
-		return err
-	}
-	if err := out.Close(); err != nil {
-		return err
-	}
+	e.b.debugf("Archiving link: %s -> %s", relPath, e.target)
 
-	return os.Rename(tempDest, dest)
+	return e.b.Store.writeBlob(e.hash, strings.NewReader(e.target))
 }
 
-// DirectoryEntry represents a directory in the backup tree.
+// IgnoredEntry is a file or directory skipped during a scan.
 type IgnoredEntry struct {
 	Path   string
 	Name   string
 	Reason *Pattern
+	// Message explains why the entry was skipped when no pattern matched it
+	// (e.g. it exceeds the configured max_file_size).
+	Message string
+}
+
+// ReasonText describes why the entry was ignored.
+func (ie IgnoredEntry) ReasonText() string {
+	if ie.Reason != nil {
+		return fmt.Sprintf("Ignored by %s: %s", ie.Reason.Source, ie.Reason.raw)
+	}
+	return ie.Message
 }
 
 // DirectoryEntry represents a directory in the backup tree.
@@ -205,29 +309,78 @@ type DirectoryEntry struct {
 	path    string
 	name    string
 	hash    string
+	attrs   EntryAttrs
 	content []Entry
 	matcher *IgnoreMatcher
 	ignored []IgnoredEntry
 	scanned bool
+	// parent, depth and id let scan refuse trees nested too deeply or
+	// containing themselves.
+	parent *DirectoryEntry
+	depth  int
+	id     string
+	// linkGroups holds the link groups found by the scan below the top
+	// directory, by inode; see linkGroup.
+	linkGroups map[string]string
 }
 
+// keepFileName marks a directory to be archived even when all its other
+// entries are ignored. The marker itself is never ignored, so the
+// directory is restored even if it is otherwise empty. It does not keep a
+// directory that is ignored itself.
+const keepFileName = ".backupkeep"
+
 func NewDirectoryEntry(b *Backup, path string, parentMatcher *IgnoreMatcher) *DirectoryEntry {
+	// The global ignore file sits above the top-most ignore files
+	if parentMatcher == nil && b != nil && b.GlobalIgnore != nil {
+		parentMatcher = b.GlobalIgnore
+	}
+
 	// Create matcher for this directory
 	m := NewIgnoreMatcher(path, parentMatcher)
 
 	// Always try to load ignores
 	m.LoadIgnoreFiles() // Ignore error
 
+	var attrs EntryAttrs
+	var id string
+	if info, err := os.Stat(path); err == nil {
+		attrs.ModTime = info.ModTime()
+		attrs.Mode = info.Mode().Perm()
+		attrs.Xattrs = b.captureXattrs(path)
+		attrs.Owner = b.captureOwner(info)
+		id = dirID(info)
+	}
+
 	return &DirectoryEntry{
 		b:       b,
 		path:    path,
 		name:    filepath.Base(path),
+		attrs:   attrs,
 		matcher: m,
+		id:      id,
 	}
 }
 
-func (e *DirectoryEntry) Name() string    { return e.name }
-func (e *DirectoryEntry) Type() EntryType { return EntryTypeDirectory }
+// addDir makes child a subdirectory of e. It refuses a child nested deeper
+// than maxTreeDepth, or that is e or a directory above it again, which
+// would be scanned forever.
+func (e *DirectoryEntry) addDir(child *DirectoryEntry) (*DirectoryEntry, error) {
+	child.parent, child.depth = e, e.depth+1
+	if child.depth > maxTreeDepth {
+		return nil, fmt.Errorf("%s is nested more than %d levels deep", child.path, maxTreeDepth)
+	}
+	for a := e; a != nil && child.id != ""; a = a.parent {
+		if a.id == child.id {
+			return nil, fmt.Errorf("%s is the same directory as %s above it", child.path, a.path)
+		}
+	}
+	return child, nil
+}
+
+func (e *DirectoryEntry) Name() string      { return e.name }
+func (e *DirectoryEntry) Type() EntryType   { return EntryTypeDirectory }
+func (e *DirectoryEntry) Attrs() EntryAttrs { return e.attrs }
 
 func (e *DirectoryEntry) Content() ([]Entry, error) {
 	if err := e.scan(); err != nil {
@@ -249,36 +402,20 @@ func (e *DirectoryEntry) scan() error {
 
 	var entries []Entry
 	var ignored []IgnoredEntry
+	var filePaths []string
 
 	for _, f := range files {
 		fullPath := filepath.Join(e.path, f.Name())
 		isDir := f.IsDir()
 
-		// Check ignores
-		if e.matcher != nil {
-			shouldIgnore, pattern := e.matcher.Match(fullPath, isDir)
-			if shouldIgnore {
-				ignored = append(ignored, IgnoredEntry{
-					Path:   fullPath,
-					Name:   f.Name(),
-					Reason: pattern,
-				})
-				if isDir {
-					e.b.Stats.DirsIgnored++
-				} else {
-					e.b.Stats.FilesIgnored++
-				}
-
-				if e.b.ShowIgnored {
-					reason := ""
-					if pattern != nil {
-						reason = fmt.Sprintf(" (Ignored by %s: %s)", pattern.Source, pattern.raw)
-					}
-					relName, _ := filepath.Rel(e.b.Top, fullPath)
-					fmt.Printf("I %s%s\n", relName, reason)
-				}
-				continue
-			}
+		// Check ignores. The keep file is never ignored.
+		if shouldIgnore, pattern := e.match(fullPath, isDir); shouldIgnore && f.Name() != keepFileName {
+			ignored = append(ignored, e.ignore(IgnoredEntry{
+				Path:   fullPath,
+				Name:   f.Name(),
+				Reason: pattern,
+			}, isDir))
+			continue
 		}
 
 		// Ignore symlinks?
@@ -287,28 +424,6 @@ func (e *DirectoryEntry) scan() error {
 			return err
 		}
 		if info.Mode()&os.ModeSymlink != 0 {
-			// Check ignores for symlink? Match(fullPath, false)?
-			if e.matcher != nil {
-				shouldIgnore, pattern := e.matcher.Match(fullPath, false)
-				if shouldIgnore {
-					ignored = append(ignored, IgnoredEntry{
-						Path:   fullPath,
-						Name:   f.Name(),
-						Reason: pattern,
-					})
-
-					if e.b.ShowIgnored {
-						reason := ""
-						if pattern != nil {
-							reason = fmt.Sprintf(" (Ignored by %s: %s)", pattern.Source, pattern.raw)
-						}
-						relName, _ := filepath.Rel(e.b.Top, fullPath)
-						fmt.Printf("I %s%s\n", relName, reason)
-					}
-					continue
-				}
-			}
-
 			le, err := NewLinkEntry(e.b, fullPath)
 			if err != nil {
 				return err
@@ -323,12 +438,65 @@ func (e *DirectoryEntry) scan() error {
 
 		if f.IsDir() {
 			// Pass THIS directory's matcher as parent
-			entries = append(entries, NewDirectoryEntry(e.b, fullPath, e.matcher))
+			child, err := e.addDir(NewDirectoryEntry(e.b, fullPath, e.matcher))
+			if err != nil {
+				return err
+			}
+			entries = append(entries, child)
 		} else {
-			fe, err := NewFileEntry(e.b, fullPath)
+			if e.b.MaxFileSize > 0 && info.Size() > e.b.MaxFileSize {
+				ignored = append(ignored, e.ignore(IgnoredEntry{
+					Path:    fullPath,
+					Name:    f.Name(),
+					Message: fmt.Sprintf("exceeds max_file_size: %s > %s", HumanizeBytes(info.Size()), HumanizeBytes(e.b.MaxFileSize)),
+				}, false))
+				continue
+			}
+
+			filePaths = append(filePaths, fullPath)
+		}
+	}
+
+	// The extra source roots are subdirectories of the top directory. Each
+	// starts its own ignore hierarchy, like the top directory does.
+	if e.path == e.b.Top {
+		for _, inc := range e.b.Includes {
+			name := filepath.Base(inc)
+			for _, other := range entries {
+				if other.Name() == name {
+					return fmt.Errorf("included directory %s conflicts with %s", inc, filepath.Join(e.path, name))
+				}
+			}
+			for _, p := range filePaths {
+				if filepath.Base(p) == name {
+					return fmt.Errorf("included directory %s conflicts with %s", inc, p)
+				}
+			}
+			child, err := e.addDir(NewDirectoryEntry(e.b, inc, nil))
 			if err != nil {
 				return err
 			}
+			entries = append(entries, child)
+		}
+	}
+
+	// Hashing dominates the scan, so regular files are hashed concurrently.
+	// Files that cannot be read are left out unless the backup is strict.
+	fileEntries := make([]*FileEntry, len(filePaths))
+	err = runParallel(e.b.Jobs, len(filePaths), func(i int) error {
+		fe, err := NewFileEntry(e.b, filePaths[i])
+		if err != nil {
+			return e.b.fail(filePaths[i], err)
+		}
+		fileEntries[i] = fe
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, fe := range fileEntries {
+		if fe != nil {
+			fe.attrs.Hardlink = e.linkGroup(fe.inode)
 			entries = append(entries, fe)
 		}
 	}
@@ -341,6 +509,68 @@ func (e *DirectoryEntry) scan() error {
 	return nil
 }
 
+// linkGroup returns the hardlink ID recorded for the files of inode, or ""
+// for files that are not hardlinked. The IDs number the link groups of the
+// tree in the order its scan finds them, which follows the sorted tree, so
+// listings do not depend on inode numbers and the same tree always gets
+// the same hash.
+func (e *DirectoryEntry) linkGroup(inode string) string {
+	if inode == "" {
+		return ""
+	}
+	top := e
+	for top.parent != nil {
+		top = top.parent
+	}
+	if top.linkGroups == nil {
+		top.linkGroups = make(map[string]string)
+	}
+	id, ok := top.linkGroups[inode]
+	if !ok {
+		id = linkGroupID(len(top.linkGroups))
+		top.linkGroups[inode] = id
+	}
+	return id
+}
+
+// linkGroupID formats the hardlink ID of the n-th link group.
+func linkGroupID(n int) string {
+	return fmt.Sprintf("0:%d", n)
+}
+
+// match checks path against the command line patterns, and against the
+// ignore files if none of those matched.
+func (e *DirectoryEntry) match(path string, isDir bool) (bool, *Pattern) {
+	if m := e.b.CommandLineIgnore; m != nil {
+		if ignored, p := m.Match(path, isDir); p != nil {
+			return ignored, p
+		}
+	}
+	if e.matcher != nil {
+		return e.matcher.Match(path, isDir)
+	}
+	return false, nil
+}
+
+// ignore records a skipped entry in the stats and prints it if requested.
+func (e *DirectoryEntry) ignore(ie IgnoredEntry, isDir bool) IgnoredEntry {
+	if isDir {
+		atomic.AddInt64(&e.b.Stats.DirsIgnored, 1)
+	} else {
+		atomic.AddInt64(&e.b.Stats.FilesIgnored, 1)
+	}
+
+	if e.b.ShowIgnored {
+		reason := ""
+		if r := ie.ReasonText(); r != "" {
+			reason = fmt.Sprintf(" (%s)", r)
+		}
+		relName, _ := filepath.Rel(e.b.Top, ie.Path)
+		fmt.Printf("I %s%s\n", relName, reason)
+	}
+	return ie
+}
+
 func (e *DirectoryEntry) Ignored() ([]IgnoredEntry, error) {
 	if err := e.scan(); err != nil {
 		return nil, err
@@ -358,8 +588,7 @@ func (e *DirectoryEntry) Hash() (string, error) {
 		return "", err
 	}
 
-	h := md5.Sum([]byte(content))
-	e.hash = fmt.Sprintf("%x", h)
+	e.hash = e.b.Store.HashBytes([]byte(content))
 	return e.hash, nil
 }
 
@@ -370,33 +599,75 @@ func (e *DirectoryEntry) ContentAsText() (string, error) {
 	}
 
 	var sb strings.Builder
+	sb.WriteString(listingHeader + "\n")
 	for _, child := range entries {
 		h, err := child.Hash()
 		if err != nil {
 			return "", err
 		}
 
-		typeChar := "F"
-		if child.Type() == EntryTypeDirectory {
-			typeChar = "D"
-		} else if child.Type() == EntryTypeLink {
-			typeChar = "L"
+		var typeChar byte = 'F'
+		switch child.Type() {
+		case EntryTypeDirectory:
+			typeChar = 'D'
+		case EntryTypeLink:
+			typeChar = 'L'
+		case EntryTypeChunkedFile:
+			typeChar = 'C'
 		}
 
-		sb.WriteString(fmt.Sprintf("%s %s %s\n", typeChar, h, child.Name()))
+		sb.WriteString(formatListingLine(typeChar, h, child.Attrs(), child.Name()))
 	}
 	return sb.String(), nil
 }
 
 func (e *DirectoryEntry) Save() error {
-	e.b.Stats.DirsTotal++
+	atomic.AddInt64(&e.b.Stats.DirsTotal, 1)
 
 	// First save all children
 	children, err := e.Content()
 	if err != nil {
 		return err
 	}
+	// Files and links are compressed concurrently; subdirectories are saved
+	// one after another so each level gets the whole worker pool.
+	var leaves, dirs []Entry
 	for _, child := range children {
+		if child.Type() == EntryTypeDirectory {
+			dirs = append(dirs, child)
+		} else {
+			leaves = append(leaves, child)
+		}
+	}
+	// A file that changed since it was hashed is left out of the listing,
+	// like a file that cannot be read, unless the backup is strict.
+	changed := make([]bool, len(leaves))
+	if err := runParallel(e.b.Jobs, len(leaves), func(i int) error {
+		err := leaves[i].Save()
+		var cfe *ChangedFileError
+		if !errors.As(err, &cfe) {
+			return err
+		}
+		changed[i] = true
+		return e.b.fail(filepath.Join(e.path, leaves[i].Name()), err)
+	}); err != nil {
+		return err
+	}
+	if slices.Contains(changed, true) {
+		kept := e.content[:0:0]
+		for _, child := range e.content {
+			if i := slices.Index(leaves, child); i < 0 || !changed[i] {
+				kept = append(kept, child)
+			}
+		}
+		e.content = kept
+		// The directories above cached hashes of listings that still
+		// included the file, e.g. to sort their entries.
+		for a := e; a != nil; a = a.parent {
+			a.hash = ""
+		}
+	}
+	for _, child := range dirs {
 		if err := child.Save(); err != nil {
 			return err
 		}
@@ -408,52 +679,27 @@ func (e *DirectoryEntry) Save() error {
 		return err
 	}
 
-	dest := e.b.Store.DataStore(h)
-	if dest == "" {
+	if !e.b.Store.ValidHash(h) {
 		return fmt.Errorf("invalid hash")
 	}
 
-	if _, err := os.Stat(dest); err == nil {
+	if e.b.Store.hasBlob(h) {
 		return nil
 	}
 
-	e.b.Stats.DirsArchived++
+	atomic.AddInt64(&e.b.Stats.DirsArchived, 1)
 
 	if e.b.DryRun {
-		fmt.Printf("[dry-run] Would save directory listing: %s -> %s\n", e.path, dest)
+		e.b.debugf("[dry-run] Would save directory listing: %s -> %s", e.path, h)
 		return nil
 	}
 
-	tempDest := dest + ".partial"
-	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
-		return err
-	}
-
-	out, err := os.Create(tempDest)
-	if err != nil {
-		return err
-	}
-	defer out.Close()
-
-	gw := gzip.NewWriter(out)
-	defer gw.Close()
-
 	content, err := e.ContentAsText()
 	if err != nil {
 		return err
 	}
 
-	if _, err := io.WriteString(gw, content); err != nil {
-		return err
-	}
-	if err := gw.Close(); err != nil {
-		return err
-	}
-	if err := out.Close(); err != nil {
-		return err
-	}
-
-	return os.Rename(tempDest, dest)
+	return e.b.Store.writeBlob(h, strings.NewReader(content))
 }
 
 // entrySorter implements sort.Interface
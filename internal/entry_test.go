@@ -1,8 +1,12 @@
 package internal
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
 	"testing"
 )
 
@@ -60,6 +64,142 @@ func TestFileEntry_Save(t *testing.T) {
 	}
 }
 
+func TestFileEntry_SaveChanged(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "grow.txt", "hello")
+	fileEntry, err := NewFileEntry(b, filepath.Join(b.Top, "grow.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := fileEntry.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The file grows between hashing and saving
+	writeTestFile(t, b, "grow.txt", "hello world")
+	if err := fileEntry.Save(); err == nil || !strings.Contains(err.Error(), "changed during backup") {
+		t.Fatalf("Expected a changed file to fail, got %v", err)
+	}
+	if _, err := os.Stat(b.Store.DataStore(h)); !os.IsNotExist(err) {
+		t.Errorf("Expected no blob for the changed file, got %v", err)
+	}
+}
+
+func TestDirectoryEntry_SaveChanged(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		b := newTestBackup(t)
+		b.Strict = strict
+		writeTestFile(t, b, "grow.txt", "hello")
+		writeTestFile(t, b, "keep.txt", "kept")
+		top := NewDirectoryEntry(b, b.Top, nil)
+		if _, err := top.Content(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The file grows between the scan and the save
+		writeTestFile(t, b, "grow.txt", "hello world")
+		err := top.Save()
+		if strict {
+			if err == nil || !strings.Contains(err.Error(), "changed during backup") {
+				t.Errorf("Expected a strict backup to fail, got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Expected the changed file to be skipped, got %v", err)
+		}
+		if len(b.Failed) != 1 || b.Failed[0].Path != filepath.Join(b.Top, "grow.txt") {
+			t.Errorf("Expected grow.txt to be recorded as failed, got %v", b.Failed)
+		}
+		if b.Stats.FilesFailed != 1 || b.Stats.FilesArchived != 1 {
+			t.Errorf("Expected 1 failed and 1 archived file, got %+v", b.Stats)
+		}
+		listing, err := top.ContentAsText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(listing, "grow.txt") || !strings.Contains(listing, "keep.txt") {
+			t.Errorf("Expected only keep.txt in the listing, got:\n%s", listing)
+		}
+		h, err := top.Hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h != b.Store.HashBytes([]byte(listing)) {
+			t.Errorf("Expected the hash of the listing without the changed file")
+		}
+		if _, err := os.Stat(b.Store.DataStore(h)); err != nil {
+			t.Errorf("Expected the listing in the store: %v", err)
+		}
+	}
+
+	// A changed file deep in the tree and a changed chunked file are left
+	// out, and the directories above store listings under their new hashes
+	b := newTestBackup(t)
+	b.ChunkThreshold = 1 << 20
+	writeTestFile(t, b, "a/b/grow.txt", "hello")
+	writeTestFile(t, b, "a/b/keep.txt", "kept")
+	writeTestFile(t, b, "a/c/other.txt", "other")
+	writeTestFile(t, b, "d/x.txt", "x")
+	writeTestFile(t, b, "big.bin", string(randomData(3, 2<<20)))
+	top := NewDirectoryEntry(b, b.Top, nil)
+	if _, err := top.Content(); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, b, "a/b/grow.txt", "hello world")
+	writeTestFile(t, b, "big.bin", string(randomData(4, 2<<20)))
+	if err := top.Save(); err != nil {
+		t.Fatalf("Expected the changed files to be skipped, got %v", err)
+	}
+	if len(b.Failed) != 2 {
+		t.Errorf("Expected 2 failed files, got %v", b.Failed)
+	}
+	if b.Stats.FilesTotal != 3 || b.Stats.FilesArchived != 3 || b.Stats.BytesArchived != 10 || b.Stats.BytesDeduplicated != 0 {
+		t.Errorf("Expected only keep.txt, other.txt and x.txt to be counted, got %+v", b.Stats)
+	}
+	blobs, err := b.GetAllBlobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for hash := range blobs {
+		if err := b.Store.verifyBlobHash(hash); err != nil {
+			t.Errorf("Blob %s: %v", hash, err)
+		}
+	}
+	listing, err := top.ContentAsText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, _ := top.Hash(); h != b.Store.HashBytes([]byte(listing)) || !b.Store.hasBlob(h) {
+		t.Errorf("Expected the top listing to be stored under its hash")
+	}
+}
+
+func TestLinkEntry_SaveDeduplicated(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require privileges on Windows")
+	}
+	b := newTestBackup(t)
+	writeTestFile(t, b, "big.bin", strings.Repeat("x", 10000))
+	for _, name := range []string{"first", "second"} {
+		if err := os.Symlink("big.bin", filepath.Join(b.Top, name)); err != nil {
+			t.Fatal(err)
+		}
+		link, err := NewLinkEntry(b, filepath.Join(b.Top, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := link.Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The second link shares the blob of the target, not of big.bin
+	if b.Stats.FilesDeduplicated != 1 || b.Stats.BytesDeduplicated != int64(len("big.bin")) {
+		t.Errorf("Expected 1 deduplicated link of %d bytes, got %+v", len("big.bin"), b.Stats)
+	}
+}
+
 func TestDirectoryEntry_Hash(t *testing.T) {
 	sourceDir, err := os.MkdirTemp("", "entry_test_dir")
 	if err != nil {
@@ -84,3 +224,399 @@ func TestDirectoryEntry_Hash(t *testing.T) {
 		t.Error("Hash shouldn't be empty")
 	}
 }
+
+func TestStore_HashAlgorithm(t *testing.T) {
+	b := &Backup{StoreConfig: &StoreConfig{Hash: "sha256"}}
+	s := NewStore(b)
+	if s.HashName != "sha256" || s.HashLen() != 64 {
+		t.Errorf("Expected sha256 store, got %s (%d)", s.HashName, s.HashLen())
+	}
+	if got := s.HashBytes(nil); got != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Errorf("Unexpected sha256 of empty input: %s", got)
+	}
+
+	// Missing setting defaults to md5
+	s = NewStore(&Backup{})
+	if s.HashName != "md5" || s.HashLen() != 32 {
+		t.Errorf("Expected md5 default, got %s", s.HashName)
+	}
+
+	if _, err := LookupHashFunc("crc32"); err == nil {
+		t.Error("Expected error for unsupported hash algorithm")
+	}
+}
+
+func TestDirectoryEntry_MaxFileSize(t *testing.T) {
+	b := newTestBackup(t)
+	b.MaxFileSize = 10
+	writeTestFile(t, b, "small.txt", "small")
+	writeTestFile(t, b, "large.bin", "this file is too large")
+
+	dirEntry := NewDirectoryEntry(b, b.Top, nil)
+	content, err := dirEntry.Content()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(content) != 1 || content[0].Name() != "small.txt" {
+		t.Errorf("Expected only small.txt to be included, got %d entries", len(content))
+	}
+
+	ignored, err := dirEntry.Ignored()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ignored) != 1 || ignored[0].Name != "large.bin" {
+		t.Fatalf("Expected large.bin to be ignored, got %+v", ignored)
+	}
+	if !strings.Contains(ignored[0].ReasonText(), "exceeds max_file_size") {
+		t.Errorf("Unexpected ignore reason: %s", ignored[0].ReasonText())
+	}
+	if b.Stats.FilesIgnored != 1 {
+		t.Errorf("Expected 1 ignored file in stats, got %d", b.Stats.FilesIgnored)
+	}
+}
+
+func TestDirectoryEntry_Cycle(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "a.txt", "a")
+	// Including a directory above the source root reaches the root again
+	b.Includes = []string{filepath.Dir(b.Top)}
+	_, err := NewDirectoryEntry(b, b.Top, nil).Hash()
+	if err == nil || !strings.Contains(err.Error(), "is the same directory as "+b.Top) {
+		t.Errorf("Expected a cycle error, got %v", err)
+	}
+
+	deep := NewDirectoryEntry(b, b.Top, nil)
+	deep.depth = maxTreeDepth
+	if _, err := deep.addDir(NewDirectoryEntry(b, filepath.Join(b.Top, "sub"), nil)); err == nil {
+		t.Error("Expected a directory below the maximum depth to be refused")
+	}
+}
+
+func TestDirectoryEntry_CommandLineIgnores(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, ".backupignore", "*.log\n!build/\n")
+	writeTestFile(t, b, "a.log", "a")
+	writeTestFile(t, b, "keep.log", "keep")
+	writeTestFile(t, b, "build/out.o", "out")
+	writeTestFile(t, b, "node_modules/x.js", "x")
+	b.SetCommandLineIgnores([]string{"node_modules/", "build/"}, []string{"keep.log"})
+
+	dirEntry := NewDirectoryEntry(b, b.Top, nil)
+	content, err := dirEntry.Content()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range content {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != ".backupignore,keep.log" {
+		t.Errorf("Unexpected entries %v", names)
+	}
+
+	ignored, err := dirEntry.Ignored()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reasons := make(map[string]string)
+	for _, ie := range ignored {
+		reasons[ie.Name] = ie.ReasonText()
+	}
+	want := map[string]string{
+		"a.log":        "Ignored by .backupignore: *.log",
+		"build":        "Ignored by command-line: build/",
+		"node_modules": "Ignored by command-line: node_modules/",
+	}
+	for name, reason := range want {
+		if reasons[name] != reason {
+			t.Errorf("%s: expected reason %q, got %q", name, reason, reasons[name])
+		}
+	}
+	if len(ignored) != len(want) {
+		t.Errorf("Expected %d ignored entries, got %+v", len(want), ignored)
+	}
+}
+
+func TestDirectoryEntry_SaveParallel(t *testing.T) {
+	b := newTestBackup(t)
+	for i := 0; i < 20; i++ {
+		writeTestFile(t, b, fmt.Sprintf("dir%d/file%d.txt", i%3, i), fmt.Sprintf("content %d", i))
+	}
+
+	serialHash, err := NewDirectoryEntry(b, b.Top, nil).Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.Jobs = 8
+	top := NewDirectoryEntry(b, b.Top, nil)
+	if err := top.Save(); err != nil {
+		t.Fatal(err)
+	}
+	parallelHash, err := top.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parallelHash != serialHash {
+		t.Errorf("Parallel save changed the listing hash: %s != %s", parallelHash, serialHash)
+	}
+
+	if b.Stats.FilesArchived != 20 {
+		t.Errorf("Expected 20 archived files, got %d", b.Stats.FilesArchived)
+	}
+	if b.Stats.DirsTotal != 4 {
+		t.Errorf("Expected 4 directories, got %d", b.Stats.DirsTotal)
+	}
+	var size int64
+	for i := 0; i < 20; i++ {
+		size += int64(len(fmt.Sprintf("content %d", i)))
+	}
+	if b.Stats.BytesArchived != size {
+		t.Errorf("Expected %d archived bytes, got %d", size, b.Stats.BytesArchived)
+	}
+	for i := 0; i < 20; i++ {
+		h := b.Store.HashBytes([]byte(fmt.Sprintf("content %d", i)))
+		if _, err := os.Stat(b.Store.DataStore(h)); err != nil {
+			t.Errorf("Expected blob for file%d.txt: %v", i, err)
+		}
+	}
+}
+
+func TestStore_FindPartials(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "a.txt", "a")
+	snapshotTestBackup(t, b, "260101-100000")
+
+	partial := filepath.Join(b.StoreData, "ab", "abcdef.gz.partial")
+	if err := os.MkdirAll(filepath.Dir(partial), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(partial, []byte("junk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	partials, err := b.Store.FindPartials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(partials) != 1 || partials[0] != partial {
+		t.Fatalf("Expected %s, got %v", partial, partials)
+	}
+
+	// Partial files are warnings, not integrity errors
+	if errs := b.Verify(false); len(errs) != 0 {
+		t.Errorf("Expected no verify errors, got %v", errs)
+	}
+
+	if n, err := b.Store.CleanupPartials(); err != nil || n != 1 {
+		t.Fatalf("Expected 1 partial file removed, got %d (%v)", n, err)
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("Expected %s to be removed", partial)
+	}
+}
+
+func TestDirectoryEntry_SaveParallelDuplicates(t *testing.T) {
+	b := newTestBackup(t)
+	b.Jobs = 8
+	for i := 0; i < 16; i++ {
+		writeTestFile(t, b, fmt.Sprintf("copy%d.txt", i), "identical content")
+	}
+
+	if err := NewDirectoryEntry(b, b.Top, nil).Save(); err != nil {
+		t.Fatal(err)
+	}
+	partials, err := b.Store.FindPartials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(partials) != 0 {
+		t.Errorf("Expected no leftover partial files, got %v", partials)
+	}
+	if _, err := os.Stat(b.Store.DataStore(b.Store.HashBytes([]byte("identical content")))); err != nil {
+		t.Errorf("Expected shared blob to be saved: %v", err)
+	}
+}
+
+func TestStore_Compression(t *testing.T) {
+	for _, name := range Compressions() {
+		t.Run(name, func(t *testing.T) {
+			b := newTestBackup(t)
+			b.StoreConfig = &StoreConfig{Compression: name}
+			b.Store = NewStore(b)
+			writeTestFile(t, b, "a.txt", "hello compression")
+
+			root := snapshotTestBackup(t, b, "260101-100000")
+			top, err := root.TopDirectory()
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries, err := top.Entries()
+			if err != nil {
+				t.Fatal(err)
+			}
+			f := entries["a.txt"].(*BackupFile)
+			blob := b.Store.DataStore(f.Hash())
+			codec, _ := LookupCodec(name)
+			if !strings.HasSuffix(blob, f.Hash()+codec.Ext) {
+				t.Errorf("Expected blob extension %q, got %s", codec.Ext, blob)
+			}
+			if name == "none" {
+				raw, err := os.ReadFile(blob)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(raw) != "hello compression" {
+					t.Errorf("Expected uncompressed blob, got %q", raw)
+				}
+			}
+
+			dest := filepath.Join(t.TempDir(), "restore")
+			if err := top.Restore(dest, RestoreOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(filepath.Join(dest, "a.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != "hello compression" {
+				t.Errorf("Unexpected restored content %q", got)
+			}
+			if errs := b.Verify(true); len(errs) != 0 {
+				t.Errorf("Expected no verify errors, got %v", errs)
+			}
+			blobs, err := b.GetAllBlobs()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(blobs) != 2 {
+				t.Errorf("Expected 2 blobs, got %v", blobs)
+			}
+
+			if err := os.WriteFile(blob, []byte("not a blob"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			errs := b.Verify(true)
+			if len(errs) != 1 {
+				t.Fatalf("Expected the corrupted blob to be reported, got %v", errs)
+			}
+			if name != "gzip" && strings.Contains(errs[0].Error(), "gzip") {
+				t.Errorf("Expected a %s error, got %v", name, errs[0])
+			}
+			// Blobs that cannot be decrypted fail before the codec reads them
+			encrypted := NewStore(b)
+			newTestEncryption(t, encrypted, "secret")
+			if err := encrypted.verifyBlobHash(f.Hash()); err == nil || !strings.HasPrefix(err.Error(), "decoding error: ") {
+				t.Errorf("Expected a decoding error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestStore_Sharding(t *testing.T) {
+	tests := []struct {
+		name         string
+		width, depth int
+		dirs         func(hash string) []string
+	}{
+		{"default", 0, -1, func(h string) []string { return []string{h[:2]} }},
+		{"flat", 2, 0, func(h string) []string { return nil }},
+		{"two levels", 3, 2, func(h string) []string { return []string{h[:3], h[3:6]} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBackup(t)
+			b.StoreConfig = &StoreConfig{ShardWidth: tt.width}
+			if tt.depth >= 0 {
+				depth := tt.depth
+				b.StoreConfig.ShardDepth = &depth
+			}
+			b.Store = NewStore(b)
+			writeTestFile(t, b, "a.txt", "sharded")
+			root := snapshotTestBackup(t, b, "260101-100000")
+
+			hash := b.Store.HashBytes([]byte("sharded"))
+			want := filepath.Join(append(append([]string{b.StoreData}, tt.dirs(hash)...), hash+".gz")...)
+			if got := b.Store.DataStore(hash); got != want {
+				t.Errorf("Expected blob path %s, got %s", want, got)
+			}
+			if _, err := os.Stat(want); err != nil {
+				t.Error(err)
+			}
+			blobs, err := b.GetAllBlobs()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(blobs) != 2 || !blobs[hash] {
+				t.Errorf("Expected the file and listing blobs, got %v", blobs)
+			}
+			if errs := b.Verify(true); len(errs) != 0 {
+				t.Errorf("Expected no verify errors, got %v", errs)
+			}
+			if _, err := root.Locate("a.txt"); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestStoreConfig_Shards(t *testing.T) {
+	depth := 4
+	for _, c := range []StoreConfig{{ShardWidth: 5}, {ShardWidth: -1}, {ShardDepth: &depth}} {
+		if _, _, err := c.Shards(); err == nil {
+			t.Errorf("Expected an error for %+v", c)
+		}
+	}
+}
+
+func TestDirectoryEntry_KeepFile(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, ".backupignore", "*.log\n.*\ncache/\n")
+	writeTestFile(t, b, "logs/.backupkeep", "")
+	writeTestFile(t, b, "logs/app.log", "log")
+	writeTestFile(t, b, "cache/.backupkeep", "")
+	writeTestFile(t, b, "cache/data.bin", "data")
+	root := snapshotTestBackup(t, b, "260101-100000")
+
+	top, err := root.TopDirectory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := top.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, ok := entries["logs"].(*BackupDirectory)
+	if !ok {
+		t.Fatalf("Expected logs to be archived, got %v", entries)
+	}
+	sub, err := d.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sub[keepFileName]; !ok || len(sub) != 1 {
+		t.Errorf("Expected logs to hold only the keep file, got %v", sub)
+	}
+	// A keep file does not override the ignore pattern of its directory
+	if _, ok := entries["cache"]; ok {
+		t.Errorf("Expected the ignored cache directory to stay ignored, got %v", entries)
+	}
+
+	// The empty directory round-trips
+	logs := filepath.Join(b.Top, "logs")
+	if err := os.RemoveAll(logs); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Restore(root.Timestamp(), "logs", logs, RestoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := os.ReadDir(logs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored) != 1 || restored[0].Name() != keepFileName {
+		t.Errorf("Unexpected restored entries %v", restored)
+	}
+}
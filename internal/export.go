@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"time"
+)
+
+// ExportTar writes the tree below dir to w as a tar stream. File content is
+// streamed from the store; files that were hardlinks of each other are
+// written as tar hardlinks. modTime is used for entries without a recorded
+// modification time.
+func (b *Backup) ExportTar(dir *BackupDirectory, w io.Writer, modTime time.Time) error {
+	tw := tar.NewWriter(w)
+	hardlinks := make(map[string]string)
+	if err := exportDirectory(tw, dir, "", modTime, hardlinks); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func exportDirectory(tw *tar.Writer, dir *BackupDirectory, prefix string, modTime time.Time, hardlinks map[string]string) error {
+	entries, err := dir.Entries()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := exportEntry(tw, entries[name], path.Join(prefix, name), modTime, hardlinks); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExportEntryTar writes entry to w as a tar stream, named by its base name
+// and, for a directory, followed by the tree below it.
+func (b *Backup) ExportEntryTar(entry BackupEntry, w io.Writer, modTime time.Time) error {
+	tw := tar.NewWriter(w)
+	if err := exportEntry(tw, entry, entry.Name(), modTime, make(map[string]string)); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func exportEntry(tw *tar.Writer, entry BackupEntry, name string, modTime time.Time, hardlinks map[string]string) error {
+	mtime := entry.Attrs().ModTime
+	if mtime.IsZero() {
+		mtime = modTime
+	}
+	mode := int64(entry.Attrs().Mode)
+
+	switch e := entry.(type) {
+	case *BackupDirectory:
+		if mode == 0 {
+			mode = 0755
+		}
+		hdr := &tar.Header{Typeflag: tar.TypeDir, Name: name + "/", Mode: mode, ModTime: mtime}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		return exportDirectory(tw, e, name, modTime, hardlinks)
+	case *BackupLink:
+		target, err := e.Target()
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{Typeflag: tar.TypeSymlink, Name: name, Linkname: target, Mode: 0777, ModTime: mtime}
+		return tw.WriteHeader(hdr)
+	case *BackupFile:
+		if mode == 0 {
+			mode = 0644
+		}
+		if id := e.Attrs().Hardlink; id != "" {
+			if first, ok := hardlinks[id]; ok {
+				hdr := &tar.Header{Typeflag: tar.TypeLink, Name: name, Linkname: first, Mode: mode, ModTime: mtime}
+				return tw.WriteHeader(hdr)
+			}
+			hardlinks[id] = name
+		}
+		return exportFile(tw, e, name, mode, mtime)
+	}
+	return nil
+}
+
+func exportFile(tw *tar.Writer, f *BackupFile, name string, mode int64, mtime time.Time) error {
+	// Tar headers come before the content, so the size is needed up front
+	size, err := f.Size()
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	hdr := &tar.Header{Typeflag: tar.TypeReg, Name: name, Size: size, Mode: mode, ModTime: mtime}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if err := f.WriteContent(tw); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
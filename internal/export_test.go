@@ -0,0 +1,130 @@
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportTar(t *testing.T) {
+	b := newTestBackup(t)
+	b.ChunkThreshold = 1 << 20
+	big := randomData(5, 2<<20)
+	writeTestFile(t, b, "a.txt", "hello")
+	writeTestFile(t, b, "sub/big.bin", string(big))
+	if err := os.Mkdir(filepath.Join(b.Top, "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	hasLinks := runtime.GOOS != "windows"
+	if hasLinks {
+		if err := os.Symlink("a.txt", filepath.Join(b.Top, "link")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Link(filepath.Join(b.Top, "a.txt"), filepath.Join(b.Top, "sub", "hard.txt")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := snapshotTestBackup(t, b, "260101-100000")
+	top, err := root.TopDirectory()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := b.ExportTar(top, &buf, root.Time); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]*tar.Header)
+	content := make(map[string][]byte)
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[hdr.Name] = hdr
+		if hdr.Typeflag == tar.TypeReg {
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			content[hdr.Name] = data
+		}
+	}
+
+	if string(content["a.txt"]) != "hello" {
+		t.Errorf("Unexpected a.txt content %q", content["a.txt"])
+	}
+	if !bytes.Equal(content["sub/big.bin"], big) {
+		t.Error("Chunked file content differs in the archive")
+	}
+	for _, dir := range []string{"sub/", "empty/"} {
+		if hdr, ok := got[dir]; !ok || hdr.Typeflag != tar.TypeDir {
+			t.Errorf("Expected directory %s in the archive", dir)
+		}
+	}
+	if hdr := got["a.txt"]; hdr.ModTime.Before(time.Now().Add(-time.Hour)) {
+		t.Errorf("Expected the recorded modification time, got %v", hdr.ModTime)
+	}
+	if hasLinks {
+		if hdr, ok := got["link"]; !ok || hdr.Typeflag != tar.TypeSymlink || hdr.Linkname != "a.txt" {
+			t.Errorf("Expected symlink link -> a.txt, got %+v", hdr)
+		}
+		if hdr, ok := got["sub/hard.txt"]; !ok || hdr.Typeflag != tar.TypeLink || hdr.Linkname != "a.txt" {
+			t.Errorf("Expected hardlink sub/hard.txt -> a.txt, got %+v", hdr)
+		}
+	}
+}
+
+func TestBackup_RestoreTar(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "a.txt", "hello")
+	writeTestFile(t, b, "sub/b.txt", "world")
+	root := snapshotTestBackup(t, b, "260101-100000")
+
+	names := func(pathInside string) []string {
+		var buf bytes.Buffer
+		if err := b.RestoreTar(root.Timestamp(), pathInside, &buf); err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		tr := tar.NewReader(&buf)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return names
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, hdr.Name)
+		}
+	}
+
+	tests := []struct {
+		pathInside string
+		want       string
+	}{
+		{"", "a.txt,sub/,sub/b.txt"},
+		{"sub", "sub/,sub/b.txt"},
+		{"sub/b.txt", "b.txt"},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(names(tt.pathInside), ","); got != tt.want {
+			t.Errorf("RestoreTar(%q) wrote %s, want %s", tt.pathInside, got, tt.want)
+		}
+	}
+	if err := b.RestoreTar(root.Timestamp(), "missing", io.Discard); err == nil {
+		t.Error("Expected an error for a missing path")
+	}
+}
@@ -0,0 +1,39 @@
+//go:build !windows
+
+package internal
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// hardlinkID identifies the inode behind info when it has more than one
+// directory entry, so hardlinked files can be linked again on restore.
+// Listings record the link group of the inode instead (see linkGroup).
+func hardlinkID(info os.FileInfo) string {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 {
+		return ""
+	}
+	return fmt.Sprintf("%d:%d", st.Dev, st.Ino)
+}
+
+// dirID identifies the directory behind info, to recognize a directory
+// that is reached again below itself, e.g. through a bind mount.
+func dirID(info os.FileInfo) string {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%d:%d", st.Dev, st.Ino)
+}
+
+// fileOwner returns the numeric owner of info as "uid:gid".
+func fileOwner(info os.FileInfo) string {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%d:%d", st.Uid, st.Gid)
+}
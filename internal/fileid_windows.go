@@ -0,0 +1,23 @@
+//go:build windows
+
+package internal
+
+import "os"
+
+// hardlinkID is not supported on Windows: hardlinked files are backed up
+// and restored as independent copies.
+func hardlinkID(info os.FileInfo) string {
+	return ""
+}
+
+// dirID is not supported on Windows, where directories cannot be mounted
+// into themselves; junctions are archived as links.
+func dirID(info os.FileInfo) string {
+	return ""
+}
+
+// fileOwner is not supported on Windows, whose files have security
+// descriptors instead of numeric owners.
+func fileOwner(info os.FileInfo) string {
+	return ""
+}
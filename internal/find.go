@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// FindMatch is an entry of a snapshot whose name matched a Find pattern.
+type FindMatch struct {
+	Root *BackupRoot
+	Path string // Slash separated, relative to the top of the snapshot
+	Hash string
+	Dir  bool
+}
+
+// Find returns the entries of roots matching pattern (see path.Match). A
+// pattern containing a slash is matched against the whole path below the
+// top directory, any other pattern against the entry name. An entry with
+// the same path and hash as an earlier match is reported once, for the
+// first root it was found in; directories already searched at the same
+// path are not searched again.
+func (b *Backup) Find(pattern string, roots []*BackupRoot) ([]FindMatch, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	f := &finder{pattern: pattern, full: strings.Contains(pattern, "/"), seen: make(map[string]bool)}
+	for _, root := range roots {
+		top, err := root.TopDirectory()
+		if err != nil {
+			return f.matches, err
+		}
+		if err := f.searchDir(root, top, ""); err != nil {
+			return f.matches, err
+		}
+	}
+	return f.matches, nil
+}
+
+type finder struct {
+	pattern string
+	full    bool
+	seen    map[string]bool // path + "\x00" + hash of reported entries and searched directories
+	matches []FindMatch
+}
+
+func (f *finder) searchDir(root *BackupRoot, dir *BackupDirectory, dirPath string) error {
+	entries, err := dir.Entries()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		e := entries[name]
+		p := path.Join(dirPath, name)
+		key := p + "\x00" + e.Hash()
+		if f.seen[key] {
+			continue
+		}
+		f.seen[key] = true
+
+		subject := name
+		if f.full {
+			subject = p
+		}
+		sub, isDir := e.(*BackupDirectory)
+		if ok, _ := path.Match(f.pattern, subject); ok {
+			f.matches = append(f.matches, FindMatch{Root: root, Path: p, Hash: e.Hash(), Dir: isDir})
+		}
+		if isDir {
+			if err := f.searchDir(root, sub, p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// LatestRoots returns the newest snapshot of each project in roots.
+func LatestRoots(roots []*BackupRoot) []*BackupRoot {
+	latest := make(map[string]*BackupRoot)
+	var projects []string
+	for _, r := range roots {
+		p := r.Project()
+		cur, ok := latest[p]
+		if !ok {
+			projects = append(projects, p)
+		}
+		if !ok || r.Time.After(cur.Time) || (r.Time.Equal(cur.Time) && r.Timestamp() > cur.Timestamp()) {
+			latest[p] = r
+		}
+	}
+	sort.Strings(projects)
+	result := make([]*BackupRoot, 0, len(projects))
+	for _, p := range projects {
+		result = append(result, latest[p])
+	}
+	return result
+}
@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackup_Find(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "keys/server.key", "v1")
+	writeTestFile(t, b, "keys/old/client.key", "old")
+	writeTestFile(t, b, "notes.txt", "notes")
+	first := snapshotTestBackup(t, b, "260101-100000")
+	writeTestFile(t, b, "keys/server.key", "v2")
+	second := snapshotTestBackup(t, b, "260102-100000")
+	roots := []*BackupRoot{second, first}
+
+	matches, err := b.Find("*.key", roots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range matches {
+		got = append(got, m.Root.Timestamp()+":"+m.Path)
+	}
+	// The unchanged client.key is only reported for the newest snapshot
+	want := []string{"260102-100000:keys/old/client.key", "260102-100000:keys/server.key", "260101-100000:keys/server.key"}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Match %d: expected %s, got %s", i, want[i], got[i])
+		}
+	}
+
+	matches, err = b.Find("keys/*", roots[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 2 || matches[0].Path != "keys/old" || !matches[0].Dir || matches[1].Path != "keys/server.key" {
+		t.Errorf("Unexpected matches for a path pattern: %+v", matches)
+	}
+
+	if _, err := b.Find("[", roots); err == nil {
+		t.Error("Expected an invalid pattern to fail")
+	}
+}
+
+func TestLatestRoots(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "a.txt", "a")
+	snapshotTestBackup(t, b, "260101-100000")
+	latest := snapshotTestBackup(t, b, "260102-100000")
+	otherDir := filepath.Join(b.StoreSnapshots, "other")
+	if err := os.MkdirAll(otherDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(otherDir, "251231-100000"), []byte("abc\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	roots, err := b.AllBackupRoots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := LatestRoots(roots)
+	if len(got) != 2 || got[0].Project() != "other" || got[1].BackupHead != latest.BackupHead {
+		t.Errorf("Unexpected latest roots %v", got)
+	}
+}
@@ -1,35 +1,173 @@
 package internal
 
 import (
+	"bufio"
 	"crypto/md5"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
+	"sync"
 )
 
+// HashCache maps file path, size and modification time to a content hash.
+// It is safe for concurrent use.
 type HashCache struct {
-	file  string
-	top   string
-	cache Properties
-	dirty bool
+	mu       sync.Mutex
+	file     string
+	top      string
+	cache    Properties
+	dirty    bool
+	hashFunc HashFunc
+	stats    HashCacheStats
+	last     HashCacheStats
+	byPath   map[string]string // Key of the newest entry of each path, for Paranoid
+	b        *Backup           // Logs warnings; may be nil
+
+	// Paranoid replaces the entry of a file whose modification time changed
+	// as soon as it is hashed again, and counts the files whose size and
+	// hash are unchanged as touched (see HashCacheStats.Touched).
+	Paranoid bool
+	// RehashAll ignores the cached hashes and hashes every file again,
+	// counting and reporting files whose content changed although their
+	// size and modification time did not.
+	RehashAll bool
 }
 
-func NewHashCache(top, file string) (*HashCache, error) {
+// HashCacheStats counts the lookups of a hash cache.
+type HashCacheStats struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+	// BytesHashed is the size of the files read on misses.
+	BytesHashed int64 `json:"bytesHashed"`
+	// Touched counts the files whose modification time changed but whose
+	// content did not, with Paranoid.
+	Touched int64 `json:"touched"`
+	// Changed counts the files whose content changed although their size
+	// and modification time did not, with RehashAll.
+	Changed int64 `json:"changed"`
+}
+
+// HitRatio returns the fraction of lookups answered from the cache, or 0
+// without lookups.
+func (s HashCacheStats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// hashCacheStatsPrefix starts the comment line of the cache file that
+// records the lookups of the run that last saved it.
+const hashCacheStatsPrefix = "#lookups "
+
+// NewHashCache loads the hash cache from file. hashFunc must match the
+// store's algorithm; nil selects the default (md5).
+func NewHashCache(top, file string, hashFunc HashFunc) (*HashCache, error) {
 	cache, err := LoadProperties(file)
 	if err != nil {
 		return nil, err
 	}
+	last, err := loadHashCacheStats(file)
+	if err != nil {
+		return nil, err
+	}
 	// Verify top path can be resolved?
 	return &HashCache{
-		file:  file,
-		top:   top,
-		cache: cache,
+		file:     file,
+		top:      top,
+		cache:    cache,
+		hashFunc: hashFunc,
+		last:     last,
 	}, nil
 }
 
+// loadHashCacheStats reads the lookups recorded in the leading comments of
+// the cache file. Missing or malformed records read as zero.
+func loadHashCacheStats(file string) (HashCacheStats, error) {
+	var stats HashCacheStats
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return stats, nil
+	}
+	if err != nil {
+		return stats, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() && strings.HasPrefix(scanner.Text(), "#") {
+		if rest, ok := strings.CutPrefix(scanner.Text(), hashCacheStatsPrefix); ok {
+			// Records of older versions end early, leaving the rest zero
+			fmt.Sscanf(rest, "hits=%d misses=%d hashed=%d touched=%d changed=%d", &stats.Hits, &stats.Misses, &stats.BytesHashed, &stats.Touched, &stats.Changed)
+		}
+	}
+	return stats, scanner.Err()
+}
+
+// Path returns the file the cache is loaded from and saved to.
+func (hc *HashCache) Path() string {
+	return hc.file
+}
+
+// Len returns the number of cached hashes.
+func (hc *HashCache) Len() int {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	return len(hc.cache)
+}
+
+// Stats returns the lookups since the cache was loaded or ResetStats was
+// called.
+func (hc *HashCache) Stats() HashCacheStats {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	return hc.stats
+}
+
+// ResetStats sets the lookup counts to zero.
+func (hc *HashCache) ResetStats() {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.stats = HashCacheStats{}
+}
+
+// LastStats returns the lookups of the run that last saved the cache file,
+// typically the last backup.
+func (hc *HashCache) LastStats() HashCacheStats {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	return hc.last
+}
+
+func (hc *HashCache) newHash() hash.Hash {
+	if hc.hashFunc == nil {
+		return md5.New()
+	}
+	return hc.hashFunc()
+}
+
+// hashLen is the hex length of hashes produced by the cache's algorithm.
+func (hc *HashCache) hashLen() int {
+	return hc.newHash().Size() * 2
+}
+
 func (hc *HashCache) FileHash(path string) (string, error) {
+	return hc.Lookup(path, func(r io.Reader) (string, error) {
+		h := hc.newHash()
+		if _, err := io.Copy(h, r); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%x", h.Sum(nil)), nil
+	})
+}
+
+// Lookup returns the cached hash of the file at path, calling compute with
+// the file content on a miss. Entries are keyed by modification time, size
+// and path, so a cache holds hashes of one kind only.
+func (hc *HashCache) Lookup(path string, compute func(r io.Reader) (string, error)) (string, error) {
 	absPath, err := filepath.Abs(path)
 	if err != nil {
 		return "", err
@@ -50,8 +188,16 @@ func (hc *HashCache) FileHash(path string) (string, error) {
 	// If we want to be ultra safe we can force one style, but let's stick to system default.
 	key := fmt.Sprintf("%d %d %s", info.ModTime().UnixNano()/1000000, info.Size(), relPath)
 
-	if hash, ok := hc.cache[key]; ok && hash != "" {
-		return hash, nil
+	// Entries of a different length were computed with another algorithm.
+	hc.mu.Lock()
+	cached, ok := hc.cache[key]
+	hc.mu.Unlock()
+	ok = ok && len(cached) == hc.hashLen()
+	if ok && !hc.RehashAll {
+		hc.mu.Lock()
+		hc.stats.Hits++
+		hc.mu.Unlock()
+		return cached, nil
 	}
 
 	f, err := os.Open(absPath)
@@ -60,21 +206,64 @@ func (hc *HashCache) FileHash(path string) (string, error) {
 	}
 	defer f.Close()
 
-	h := md5.New()
-	if _, err := io.Copy(h, f); err != nil {
+	hash, err := compute(f)
+	if err != nil {
 		return "", err
 	}
 
-	hash := fmt.Sprintf("%x", h.Sum(nil))
-
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if ok && hash != cached {
+		hc.stats.Changed++
+		hc.b.warnf("%s changed without a new modification time or size", relPath)
+	}
+	if hc.Paranoid {
+		index := hc.pathIndex()
+		if prev, found := index[relPath]; found && prev != key {
+			_, size, _, _ := parseKeyPrefix(prev)
+			if size == info.Size() && hc.cache[prev] == hash {
+				hc.stats.Touched++
+			}
+			delete(hc.cache, prev)
+		}
+		index[relPath] = key
+	}
 	hc.cache[key] = hash
 	hc.dirty = true
+	hc.stats.Misses++
+	hc.stats.BytesHashed += info.Size()
 
 	return hash, nil
 }
 
+// pathIndex returns hc.byPath, building it from the keys on first use. The
+// caller must hold hc.mu.
+func (hc *HashCache) pathIndex() map[string]string {
+	if hc.byPath != nil {
+		return hc.byPath
+	}
+	hc.byPath = make(map[string]string, len(hc.cache))
+	newest := make(map[string]int64, len(hc.cache))
+	for key := range hc.cache {
+		t, _, idx, err := parseKeyPrefix(key)
+		if err != nil {
+			continue
+		}
+		relPath := key[idx:]
+		if prev, ok := newest[relPath]; !ok || t > prev {
+			newest[relPath] = t
+			hc.byPath[relPath] = key
+		}
+	}
+	return hc.byPath
+}
+
+// MaybeSaveCache writes the cache file if entries changed or lookups were
+// made since it was loaded, recording the lookups for LastStats.
 func (hc *HashCache) MaybeSaveCache() error {
-	if !hc.dirty {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if !hc.dirty && hc.stats == (HashCacheStats{}) {
 		return nil
 	}
 	// Custom save to enforce sort by Path (not key) to minimize diffs
@@ -86,6 +275,10 @@ func (hc *HashCache) MaybeSaveCache() error {
 	defer file.Close()
 
 	fmt.Fprintf(file, "#backup tool file hash store\n")
+	if hc.stats != (HashCacheStats{}) {
+		hc.last = hc.stats
+	}
+	fmt.Fprintf(file, "%shits=%d misses=%d hashed=%d touched=%d changed=%d\n", hashCacheStatsPrefix, hc.last.Hits, hc.last.Misses, hc.last.BytesHashed, hc.last.Touched, hc.last.Changed)
 
 	type entry struct {
 		key, path, val string
@@ -127,9 +320,12 @@ func (hc *HashCache) MaybeSaveCache() error {
 }
 
 func (hc *HashCache) Verify() error {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hashLen := hc.hashLen()
 	for key, hash := range hc.cache {
 		// 1. Verify Hash
-		if len(hash) != 32 {
+		if len(hash) != hashLen {
 			return fmt.Errorf("invalid hash length %d for key '%s'", len(hash), key)
 		}
 		// Check hex chars?
@@ -147,48 +343,71 @@ func (hc *HashCache) Verify() error {
 	return nil
 }
 
-// Prune removes entries from the cache that correspond to files that no longer exist
-// or have changed (stale entries).
+// Prune removes entries from the cache that correspond to files that no longer exist,
+// have changed (stale entries) or were hashed with a different algorithm.
 func (hc *HashCache) Prune() int {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
 	removedCount := 0
-	for key := range hc.cache {
-		// Key format: timestamp size path
-		t, s, idx, err := parseKeyPrefix(key)
-		if err != nil {
-			// Malformed, remove
+	hashLen := hc.hashLen()
+	for key, hash := range hc.cache {
+		if hc.stale(key, hash, hashLen) {
 			delete(hc.cache, key)
 			hc.dirty = true
 			removedCount++
-			continue
 		}
+	}
+	return removedCount
+}
 
-		relPath := key[idx:]
-		absPath := filepath.Join(hc.top, relPath)
-
-		info, err := os.Stat(absPath)
-		if os.IsNotExist(err) {
-			// File gone
-			delete(hc.cache, key)
-			hc.dirty = true
-			removedCount++
-			continue
-		}
-		if err != nil {
-			continue // Access error, keep entry? Or assume gone? Keep safe.
+// Stale returns the number of entries Prune would remove: the files changed
+// or disappeared since they were hashed, and the next backup hashes them
+// again.
+func (hc *HashCache) Stale() int {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	count := 0
+	hashLen := hc.hashLen()
+	for key, hash := range hc.cache {
+		if hc.stale(key, hash, hashLen) {
+			count++
 		}
+	}
+	return count
+}
 
-		// Check if stale
-		// Must match calculation in FileHash
-		currentT := info.ModTime().UnixNano() / 1000000
-		currentS := info.Size()
+// stale reports whether the entry is malformed, was hashed with another
+// algorithm or no longer matches its file.
+func (hc *HashCache) stale(key, hash string, hashLen int) bool {
+	if len(hash) != hashLen {
+		return true
+	}
 
-		if currentT != t || currentS != s {
-			delete(hc.cache, key)
-			hc.dirty = true
-			removedCount++
-		}
+	// Key format: timestamp size path
+	t, s, idx, err := parseKeyPrefix(key)
+	if err != nil {
+		// Malformed, remove
+		return true
 	}
-	return removedCount
+
+	relPath := key[idx:]
+	absPath := filepath.Join(hc.top, relPath)
+
+	info, err := os.Stat(absPath)
+	if os.IsNotExist(err) {
+		// File gone
+		return true
+	}
+	if err != nil {
+		return false // Access error, keep entry? Or assume gone? Keep safe.
+	}
+
+	// Check if stale
+	// Must match calculation in FileHash
+	currentT := info.ModTime().UnixNano() / 1000000
+	currentS := info.Size()
+
+	return currentT != t || currentS != s
 }
 
 func parseKeyPrefix(key string) (int64, int64, int, error) {
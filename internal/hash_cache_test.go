@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHashCache_Stats(t *testing.T) {
+	b := newTestBackup(t)
+	b.HashCache.file = filepath.Join(t.TempDir(), "hash-cache")
+	writeTestFile(t, b, "a.txt", "aaaa")
+	writeTestFile(t, b, "b.txt", "bb")
+
+	if _, _, err := b.CreateSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.HashCache.Stats(); got != (HashCacheStats{Misses: 2, BytesHashed: 6}) {
+		t.Errorf("Expected two misses on the first backup, got %+v", got)
+	}
+
+	// Touching a file busts its entry
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(b.Top, "b.txt"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if n := b.HashCache.Stale(); n != 1 {
+		t.Errorf("Expected 1 stale entry, got %d", n)
+	}
+	if _, _, err := b.CreateSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	want := HashCacheStats{Hits: 1, Misses: 1, BytesHashed: 2}
+	if got := b.HashCache.Stats(); got != want {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+	if r := want.HitRatio(); r != 0.5 {
+		t.Errorf("Expected a hit ratio of 0.5, got %v", r)
+	}
+
+	// The counts of the last backup are saved with the cache
+	loaded, err := NewHashCache(b.Top, b.HashCache.file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.LastStats(); got != want {
+		t.Errorf("Expected the saved counts %+v, got %+v", want, got)
+	}
+	if loaded.Len() != 2 || loaded.Stale() != 0 {
+		t.Errorf("Expected 2 current entries, got %d with %d stale", loaded.Len(), loaded.Stale())
+	}
+	if (HashCacheStats{}).HitRatio() != 0 {
+		t.Error("Expected no hit ratio without lookups")
+	}
+}
+
+func TestHashCache_ParanoidAndRehashAll(t *testing.T) {
+	top := t.TempDir()
+	hc, err := NewHashCache(top, filepath.Join(t.TempDir(), "hash-cache"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc.Paranoid = true
+	file := filepath.Join(top, "a.txt")
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	write := func(content string, t0 time.Time) {
+		t.Helper()
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, t0, t0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("same", mtime)
+	first, err := hc.FileHash(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Touched: the entry is replaced and counted
+	write("same", mtime.Add(time.Minute))
+	if h, err := hc.FileHash(file); err != nil || h != first {
+		t.Fatalf("Expected the same hash, got %s, %v", h, err)
+	}
+	if got := hc.Stats(); got.Touched != 1 || got.Misses != 2 {
+		t.Errorf("Expected one touched file, got %+v", got)
+	}
+	if hc.Len() != 1 {
+		t.Errorf("Expected the old entry to be replaced, got %d entries", hc.Len())
+	}
+
+	// Modified in place without a new modification time: the cache is
+	// trusted, unless RehashAll is set
+	write("diff", mtime.Add(time.Minute))
+	if h, _ := hc.FileHash(file); h != first {
+		t.Errorf("Expected the cached hash to be returned")
+	}
+	hc.RehashAll = true
+	h, err := hc.FileHash(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h == first {
+		t.Errorf("Expected RehashAll to hash the file again")
+	}
+	if got := hc.Stats(); got.Changed != 1 || got.Hits != 1 {
+		t.Errorf("Expected one changed file, got %+v", got)
+	}
+	if h2, _ := hc.FileHash(file); h2 != h || hc.Stats().Changed != 1 {
+		t.Errorf("Expected the new hash to be cached, got %s with %+v", h2, hc.Stats())
+	}
+}
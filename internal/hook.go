@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// RunHook runs command, the value of the pre_backup or post_backup setting
+// named by setting, with the shell in the source directory. env is added
+// to the environment of the command. The output of the command is logged
+// line by line, prefixed with setting: as info if the command succeeds and
+// as warnings if it fails.
+func (b *Backup) RunHook(setting, command string, env ...string) error {
+	if command == "" {
+		return nil
+	}
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	cmd.Dir = b.Top
+	cmd.Env = append(os.Environ(), env...)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	b.debugf("Running %s hook: %s", setting, command)
+	err := cmd.Run()
+	logf := b.infof
+	if err != nil {
+		logf = b.warnf
+	}
+	for line := range strings.Lines(out.String()) {
+		logf("%s: %s", setting, strings.TrimRight(line, "\r\n"))
+	}
+	if err != nil {
+		return fmt.Errorf("%s hook %q failed: %w", setting, command, err)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package internal
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestBackup_RunHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Hooks of the test are sh commands")
+	}
+	b := newTestBackup(t)
+	var stdout, stderr bytes.Buffer
+	h := NewConsoleHandler(slog.LevelInfo)
+	h.stdout, h.stderr = &stdout, &stderr
+	b.Logger = slog.New(h)
+
+	// The hook runs in the source directory with the extra environment
+	if err := b.RunHook("pre_backup", `echo "$HOOK_VALUE" > dump.sql && echo dumped`, "HOOK_VALUE=data"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(b.Top, "dump.sql")); err != nil || string(data) != "data\n" {
+		t.Errorf("Expected the hook to write dump.sql in the source directory, got %q, %v", data, err)
+	}
+	if got := stdout.String(); got != "pre_backup: dumped\n" {
+		t.Errorf("Unexpected hook output %q", got)
+	}
+
+	// A failing hook returns an error and its output is a warning
+	stdout.Reset()
+	err := b.RunHook("pre_backup", "echo no database >&2; exit 3")
+	if err == nil || !strings.Contains(err.Error(), "exit status 3") {
+		t.Errorf("Expected the exit status of the hook, got %v", err)
+	}
+	if got := stderr.String(); got != "Warning: pre_backup: no database\n" {
+		t.Errorf("Unexpected hook output %q", got)
+	}
+
+	if err := b.RunHook("post_backup", ""); err != nil {
+		t.Errorf("Expected an empty hook to do nothing, got %v", err)
+	}
+}
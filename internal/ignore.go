@@ -17,6 +17,12 @@ type Pattern struct {
 	Source     string // e.g. .gitignore, .backupignore
 }
 
+// IgnoreMatcher holds the patterns of the ignore files of one directory and
+// links to the matcher of its parent. The patterns apply to every entry
+// below the directory, including its own entries. A path is matched against
+// the deepest matcher first and the first matcher with a matching pattern
+// decides, so deeper ignore files override shallower ones; within a
+// matcher the last matching pattern decides.
 type IgnoreMatcher struct {
 	patterns []Pattern
 	parent   *IgnoreMatcher
@@ -30,12 +36,10 @@ func NewIgnoreMatcher(dir string, parent *IgnoreMatcher) *IgnoreMatcher {
 	}
 }
 
+// LoadIgnoreFiles loads the .gitignore and then the .backupignore file of
+// m's directory. Since later patterns take precedence, .backupignore
+// overrides .gitignore in the same directory.
 func (m *IgnoreMatcher) LoadIgnoreFiles() error {
-	// Priority: .backupignore > .gitignore
-	// User said "use them interchangeably". Let's load .gitignore then .backupignore, appending patterns.
-	// Later patterns override earlier ones in the same list.
-	// If valid, we append to m.patterns
-
 	files := []string{".gitignore", ".backupignore"}
 	for _, f := range files {
 		path := filepath.Join(m.dir, f)
@@ -61,38 +65,70 @@ func (m *IgnoreMatcher) loadFile(path, filename string) error {
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
+		m.AddPattern(line, filename)
+	}
+	return scanner.Err()
+}
 
-		p := Pattern{raw: line, Source: filename}
-
-		if strings.HasPrefix(line, "!") {
-			p.isNegation = true
-			line = line[1:]
-		}
+// AddPattern adds a pattern in .gitignore syntax. Later patterns take
+// precedence over earlier ones.
+func (m *IgnoreMatcher) AddPattern(line, source string) {
+	p := Pattern{raw: line, Source: source}
 
-		if strings.HasSuffix(line, "/") {
-			p.isDirOnly = true
-			line = line[:len(line)-1]
-		}
+	if strings.HasPrefix(line, "!") {
+		p.isNegation = true
+		line = line[1:]
+	}
 
-		if strings.HasPrefix(line, "/") {
-			p.isRooted = true
-			line = line[1:]
-		}
+	if strings.HasSuffix(line, "/") {
+		p.isDirOnly = true
+		line = line[:len(line)-1]
+	}
 
-		p.pattern = line
-		m.patterns = append(m.patterns, p)
+	if strings.HasPrefix(line, "/") {
+		p.isRooted = true
+		line = line[1:]
 	}
-	return scanner.Err()
+
+	p.pattern = line
+	m.patterns = append(m.patterns, p)
 }
 
 // Match returns (shouldIgnore, matchedPattern).
 // shouldIgnore is true if the file should be ignored.
 // matchedPattern is the pattern that caused the ignore (or un-ignore).
+//
+// As in git, a path inside an ignored directory is ignored as well and
+// cannot be re-included, so the directories leading to path are checked
+// first, from the top-most matcher down.
 func (m *IgnoreMatcher) Match(path string, isDir bool) (bool, *Pattern) {
+	root := m
+	for root.parent != nil {
+		root = root.parent
+	}
+	if rel, err := filepath.Rel(root.dir, path); err == nil && !isOutside(rel) {
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		dir := root.dir
+		for _, part := range parts[:len(parts)-1] {
+			dir = filepath.Join(dir, part)
+			if ignored, p := m.matchPath(dir, true); ignored {
+				return true, p
+			}
+		}
+	}
+	return m.matchPath(path, isDir)
+}
+
+// matchPath matches path itself against the patterns of m and its parents.
+func (m *IgnoreMatcher) matchPath(path string, isDir bool) (bool, *Pattern) {
 	// Calculate path relative to m.dir
 	relPath, err := filepath.Rel(m.dir, path)
-	if err != nil {
-		return false, nil // Should not happen if path is inside m.dir
+	if err != nil || isOutside(relPath) || relPath == "." {
+		// Patterns only apply below the ignore file's directory
+		if m.parent != nil {
+			return m.parent.matchPath(path, isDir)
+		}
+		return false, nil
 	}
 	relPath = filepath.ToSlash(relPath)
 
@@ -155,13 +191,49 @@ func (m *IgnoreMatcher) Match(path string, isDir bool) (bool, *Pattern) {
 	}
 
 	if m.parent != nil {
-		return m.parent.Match(path, isDir)
+		return m.parent.matchPath(path, isDir)
 	}
 
 	return false, nil
 }
 
+func isOutside(rel string) bool {
+	return rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// globMatch matches name against a gitignore glob. "*" does not cross "/";
+// a "**" path component matches zero or more directories, and a trailing
+// "/**" matches everything inside a directory.
 func (m *IgnoreMatcher) globMatch(pattern, name string) bool {
-	matched, _ := path.Match(pattern, name)
-	return matched
+	if !strings.Contains(pattern, "**") {
+		matched, _ := path.Match(pattern, name)
+		return matched
+	}
+	return matchComponents(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchComponents(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			pattern = pattern[1:]
+			if len(pattern) == 0 {
+				// "dir/**" matches what is inside dir, not dir itself
+				return len(name) > 0
+			}
+			for i := 0; i <= len(name); i++ {
+				if matchComponents(pattern, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if matched, _ := path.Match(pattern[0], name[0]); !matched {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
 }
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"os"
 	"path/filepath"
 	"testing"
 )
@@ -146,3 +147,158 @@ func TestIgnoreMatcher_Parent(t *testing.T) {
 		t.Error("Child should be able to negate parent ignore")
 	}
 }
+
+func TestIgnoreMatcher_DoubleStar(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"build/**/*.o", "build/a.o", true},
+		{"build/**/*.o", "build/x/y/a.o", true},
+		{"build/**/*.o", "build/x/y/a.c", false},
+		{"build/**/*.o", "src/build/a.o", false},
+		{"**/foo", "foo", true},
+		{"**/foo", "a/b/foo", true},
+		{"**/foo", "a/b/foobar", false},
+		{"**/foo/bar", "x/foo/bar", true},
+		{"logs/**", "logs/a.txt", true},
+		{"logs/**", "logs/x/y/a.txt", true},
+		{"logs/**", "logs", false},
+		{"a/**/b", "a/b", true},
+		{"a/**/b", "a/x/y/b", true},
+		{"a/**/b", "a/x/y/c", false},
+		// A single "*" still does not cross directories
+		{"doc/*.txt", "doc/sub/file.txt", false},
+		{"doc/*/file.txt", "doc/a/b/file.txt", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.path, func(t *testing.T) {
+			m := NewIgnoreMatcher("/tmp/root", nil)
+			m.patterns = []Pattern{{pattern: tt.pattern, raw: tt.pattern}}
+
+			got, _ := m.Match(filepath.Join("/tmp/root", tt.path), false)
+			if got != tt.want {
+				t.Errorf("Match(%q) with %q = %v, want %v", tt.path, tt.pattern, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIgnoreMatcher_Components(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern Pattern
+		path    string
+		isDir   bool
+		want    bool
+	}{
+		{"dir pattern at top", Pattern{pattern: "logs", raw: "logs/", isDirOnly: true}, "logs", true, true},
+		{"dir pattern deeper", Pattern{pattern: "logs", raw: "logs/", isDirOnly: true}, "a/b/logs", true, true},
+		{"file inside dir pattern", Pattern{pattern: "logs", raw: "logs/", isDirOnly: true}, "a/logs/x/app.log", false, true},
+		{"dir pattern does not match file", Pattern{pattern: "logs", raw: "logs/", isDirOnly: true}, "a/logs", false, false},
+		{"name inside ignored dir", Pattern{pattern: "tmp", raw: "tmp"}, "a/tmp/b/c.txt", false, true},
+		{"slashed pattern covers contents", Pattern{pattern: "a/tmp", raw: "a/tmp"}, "a/tmp/x/y", false, true},
+		{"slashed pattern stays anchored", Pattern{pattern: "a/tmp", raw: "a/tmp"}, "b/a/tmp/x", false, false},
+		{"rooted pattern covers contents", Pattern{pattern: "out", raw: "/out", isRooted: true}, "out/x.bin", false, true},
+		{"rooted pattern stays anchored", Pattern{pattern: "out", raw: "/out", isRooted: true}, "src/out/x.bin", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewIgnoreMatcher("/tmp/root", nil)
+			m.patterns = []Pattern{tt.pattern}
+
+			got, _ := m.Match(filepath.Join("/tmp/root", tt.path), tt.isDir)
+			if got != tt.want {
+				t.Errorf("Match(%q) with %q = %v, want %v", tt.path, tt.pattern.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIgnoreMatcher_NestedAnchoring(t *testing.T) {
+	root := NewIgnoreMatcher("/tmp/root", nil)
+	// A slashed pattern in a nested ignore file is relative to that file
+	sub := NewIgnoreMatcher("/tmp/root/sub", root)
+	sub.patterns = []Pattern{{pattern: "build/out", raw: "build/out"}, {pattern: "logs", raw: "logs/", isDirOnly: true}}
+	deep := NewIgnoreMatcher("/tmp/root/sub/x", sub)
+
+	tests := []struct {
+		m     *IgnoreMatcher
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{sub, "/tmp/root/sub/build/out", true, true},
+		{deep, "/tmp/root/sub/build/out/a.o", false, true},
+		{deep, "/tmp/root/sub/x/build/out", true, false},
+		{deep, "/tmp/root/sub/x/logs", true, true},
+		{deep, "/tmp/root/sub/x/logs/y/z.log", false, true},
+		{root, "/tmp/root/build/out", true, false},
+		{root, "/tmp/root/logs", true, false},
+	}
+	for _, tt := range tests {
+		if got, _ := tt.m.Match(tt.path, tt.isDir); got != tt.want {
+			t.Errorf("Match(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestIgnoreMatcher_Precedence(t *testing.T) {
+	top := t.TempDir()
+	files := map[string]string{
+		".gitignore":          "*.log\n!keep.txt\n",
+		".backupignore":       "!important.log\nkeep.txt\n",
+		"sub/.gitignore":      "!debug.log\n",
+		"sub/.backupignore":   "*.cache\n!trace.log\n",
+		"sub/deep/.gitignore": "trace.log\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(top, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Matchers as the scan of the source tree builds them
+	root := NewDirectoryEntry(nil, top, nil).matcher
+	sub := NewDirectoryEntry(nil, filepath.Join(top, "sub"), root).matcher
+	deep := NewDirectoryEntry(nil, filepath.Join(top, "sub", "deep"), sub).matcher
+
+	tests := []struct {
+		dir    *IgnoreMatcher
+		path   string
+		want   bool
+		source string
+	}{
+		// The root ignore files apply to the root's own entries
+		{root, "a.log", true, ".gitignore"},
+		// .backupignore overrides .gitignore in the same directory
+		{root, "important.log", false, ".backupignore"},
+		{root, "keep.txt", true, ".backupignore"},
+		// Shallower files apply to all descendants
+		{sub, "sub/a.log", true, ".gitignore"},
+		{deep, "sub/deep/a.log", true, ".gitignore"},
+		// Deeper files override shallower ones, whatever their kind
+		{sub, "sub/debug.log", false, ".gitignore"},
+		{sub, "sub/trace.log", false, ".backupignore"},
+		{deep, "sub/deep/trace.log", true, ".gitignore"},
+		// Patterns do not apply above their file
+		{root, "x.cache", false, ""},
+		{deep, "sub/deep/x.cache", true, ".backupignore"},
+	}
+	for _, tt := range tests {
+		got, p := tt.dir.Match(filepath.Join(top, tt.path), false)
+		source := ""
+		if p != nil {
+			source = p.Source
+		}
+		if got != tt.want || source != tt.source {
+			t.Errorf("%s: got ignored=%v by %q, want %v by %q", tt.path, got, source, tt.want, tt.source)
+		}
+	}
+}
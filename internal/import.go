@@ -0,0 +1,232 @@
+package internal
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// importNode is an entry of a tree being imported from a tar archive.
+type importNode struct {
+	typ      EntryType
+	hash     string
+	attrs    EntryAttrs
+	children map[string]*importNode
+}
+
+func newImportDir() *importNode {
+	return &importNode{typ: EntryTypeDirectory, children: make(map[string]*importNode)}
+}
+
+// ImportTar stores the content of the tar stream r and returns the hash of
+// the resulting top directory listing. Regular files, directories, symlinks
+// and hardlinks are imported; other entry types are skipped with a warning.
+// Writing the snapshot head is left to the caller.
+func (b *Backup) ImportTar(r io.Reader) (string, error) {
+	top := newImportDir()
+	links := 0
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		name := importName(hdr.Name)
+		if name == "" {
+			continue
+		}
+
+		dir, base := path.Split(name)
+		parent, err := top.mkdirAll(strings.TrimSuffix(dir, "/"))
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", name, err)
+		}
+		attrs := EntryAttrs{ModTime: hdr.ModTime}
+		if hdr.Typeflag != tar.TypeSymlink {
+			attrs.Mode = os.FileMode(hdr.Mode).Perm()
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			d, err := top.mkdirAll(name)
+			if err != nil {
+				return "", fmt.Errorf("%s: %w", name, err)
+			}
+			d.attrs = attrs
+		case tar.TypeReg:
+			attrs.Size = hdr.Size
+			typ, hash, err := b.importFile(tr, hdr.Size)
+			if err != nil {
+				return "", fmt.Errorf("%s: %w", name, err)
+			}
+			parent.children[base] = &importNode{typ: typ, hash: hash, attrs: attrs}
+		case tar.TypeSymlink:
+			hash := b.Store.HashBytes([]byte(hdr.Linkname))
+			if _, err := b.Store.saveBlob(hash, []byte(hdr.Linkname)); err != nil {
+				return "", fmt.Errorf("%s: %w", name, err)
+			}
+			parent.children[base] = &importNode{typ: EntryTypeLink, hash: hash, attrs: attrs}
+		case tar.TypeLink:
+			target := top.lookup(importName(hdr.Linkname))
+			if target == nil || (target.typ != EntryTypeFile && target.typ != EntryTypeChunkedFile) {
+				return "", fmt.Errorf("%s: hardlink target %s is not a file in the archive", name, hdr.Linkname)
+			}
+			if target.attrs.Hardlink == "" {
+				target.attrs.Hardlink = linkGroupID(links)
+				links++
+			}
+			attrs.Hardlink = target.attrs.Hardlink
+			attrs.Size = target.attrs.Size
+			atomic.AddInt64(&b.Stats.FilesTotal, 1)
+			parent.children[base] = &importNode{typ: target.typ, hash: target.hash, attrs: attrs}
+		default:
+			b.warnf("skipping %s: unsupported tar entry type %q", name, hdr.Typeflag)
+		}
+	}
+	return b.saveImportDir(top)
+}
+
+// importName cleans an archive member name into a slash separated path
+// relative to the top directory; ".." cannot climb above it. It returns ""
+// for the top directory itself.
+func importName(name string) string {
+	return path.Clean("/" + name)[1:]
+}
+
+// importFile stores the content of a regular file, chunked if it is at least
+// the chunk threshold, and returns its entry type and hash.
+func (b *Backup) importFile(r io.Reader, size int64) (EntryType, string, error) {
+	atomic.AddInt64(&b.Stats.FilesTotal, 1)
+	atomic.AddInt64(&b.Stats.BytesTotal, size)
+
+	if b.ChunkThreshold > 0 && size >= b.ChunkThreshold {
+		manifest, err := b.Store.chunkFile(r, func(hash string, data []byte) error {
+			saved, err := b.Store.saveBlob(hash, data)
+			if saved {
+				atomic.AddInt64(&b.Stats.BytesArchived, int64(len(data)))
+			} else if err == nil {
+				atomic.AddInt64(&b.Stats.BytesDeduplicated, int64(len(data)))
+			}
+			return err
+		})
+		if err != nil {
+			return 0, "", err
+		}
+		hash := b.Store.HashBytes([]byte(manifest))
+		saved, err := b.Store.saveBlob(hash, []byte(manifest))
+		if saved {
+			atomic.AddInt64(&b.Stats.FilesArchived, 1)
+		} else if err == nil {
+			atomic.AddInt64(&b.Stats.FilesDeduplicated, 1)
+		}
+		return EntryTypeChunkedFile, hash, err
+	}
+
+	hash, n, saved, err := b.Store.saveStream(r)
+	if err != nil {
+		return 0, "", err
+	}
+	if saved {
+		atomic.AddInt64(&b.Stats.FilesArchived, 1)
+		atomic.AddInt64(&b.Stats.BytesArchived, n)
+	} else {
+		atomic.AddInt64(&b.Stats.FilesDeduplicated, 1)
+		atomic.AddInt64(&b.Stats.BytesDeduplicated, n)
+	}
+	return EntryTypeFile, hash, nil
+}
+
+// mkdirAll returns the directory at the slash separated path below n,
+// creating missing directories on the way.
+func (n *importNode) mkdirAll(p string) (*importNode, error) {
+	if p == "" {
+		return n, nil
+	}
+	for _, part := range strings.Split(p, "/") {
+		child, ok := n.children[part]
+		if !ok {
+			child = newImportDir()
+			n.children[part] = child
+		} else if child.typ != EntryTypeDirectory {
+			return nil, fmt.Errorf("%s is not a directory", part)
+		}
+		n = child
+	}
+	return n, nil
+}
+
+// lookup returns the node at the slash separated path below n, or nil.
+func (n *importNode) lookup(p string) *importNode {
+	for _, part := range strings.Split(p, "/") {
+		if n.children == nil {
+			return nil
+		}
+		if n = n.children[part]; n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+// saveImportDir stores the listings of dir and its subdirectories, bottom
+// up, and returns the hash of dir's listing.
+func (b *Backup) saveImportDir(dir *importNode) (string, error) {
+	atomic.AddInt64(&b.Stats.DirsTotal, 1)
+	type child struct {
+		name string
+		node *importNode
+	}
+	children := make([]child, 0, len(dir.children))
+	for name, node := range dir.children {
+		if node.typ == EntryTypeDirectory {
+			hash, err := b.saveImportDir(node)
+			if err != nil {
+				return "", err
+			}
+			node.hash = hash
+		}
+		children = append(children, child{name, node})
+	}
+	// Same order as entrySorter, so that equal trees get equal listings
+	sort.Slice(children, func(i, j int) bool {
+		ci, cj := children[i], children[j]
+		if ci.node.typ != cj.node.typ {
+			return ci.node.typ < cj.node.typ
+		}
+		if ci.node.hash != cj.node.hash {
+			return ci.node.hash < cj.node.hash
+		}
+		return ci.name < cj.name
+	})
+
+	var sb strings.Builder
+	sb.WriteString(listingHeader + "\n")
+	for _, c := range children {
+		typeChar := byte('F')
+		switch c.node.typ {
+		case EntryTypeDirectory:
+			typeChar = 'D'
+		case EntryTypeLink:
+			typeChar = 'L'
+		case EntryTypeChunkedFile:
+			typeChar = 'C'
+		}
+		sb.WriteString(formatListingLine(typeChar, c.node.hash, c.node.attrs, c.name))
+	}
+
+	listing := sb.String()
+	hash := b.Store.HashBytes([]byte(listing))
+	saved, err := b.Store.saveBlob(hash, []byte(listing))
+	if saved {
+		atomic.AddInt64(&b.Stats.DirsArchived, 1)
+	}
+	return hash, err
+}
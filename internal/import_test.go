@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestImportTar_RoundTrip(t *testing.T) {
+	b := newTestBackup(t)
+	b.ChunkThreshold = 1 << 20
+	big := randomData(7, 2<<20)
+	writeTestFile(t, b, "a.txt", "hello")
+	writeTestFile(t, b, "sub/big.bin", string(big))
+	hasLinks := runtime.GOOS != "windows"
+	if hasLinks {
+		if err := os.Symlink("a.txt", filepath.Join(b.Top, "link")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Link(filepath.Join(b.Top, "a.txt"), filepath.Join(b.Top, "sub", "hard.txt")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := snapshotTestBackup(t, b, "260101-100000")
+	top, err := root.TopDirectory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := b.ExportTar(top, &buf, root.Time); err != nil {
+		t.Fatal(err)
+	}
+
+	imported := newTestBackup(t)
+	imported.ChunkThreshold = b.ChunkThreshold
+	hash, err := imported.ImportTar(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := filepath.Join(imported.StoreSnapshots, imported.ProjectName, "260101-110000")
+	if err := os.WriteFile(head, []byte(hash+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	importedRoot, err := NewBackupRoot(imported, head)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for p, want := range map[string][]byte{"a.txt": []byte("hello"), "sub/big.bin": big} {
+		entry, err := importedRoot.Locate(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var content bytes.Buffer
+		if err := entry.(*BackupFile).WriteContent(&content); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(content.Bytes(), want) {
+			t.Errorf("%s: imported content differs", p)
+		}
+	}
+	if entry, _ := importedRoot.Locate("sub/big.bin"); !entry.(*BackupFile).chunked {
+		t.Error("Expected a file above the chunk threshold to be imported chunked")
+	}
+	if hasLinks {
+		link, err := importedRoot.Locate("link")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if target, _ := link.(*BackupLink).Target(); target != "a.txt" {
+			t.Errorf("Expected link target a.txt, got %q", target)
+		}
+		a, _ := importedRoot.Locate("a.txt")
+		hard, err := importedRoot.Locate("sub/hard.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Attrs().Hardlink == "" || a.Attrs().Hardlink != hard.Attrs().Hardlink {
+			t.Errorf("Expected a shared hardlink ID, got %q and %q", a.Attrs().Hardlink, hard.Attrs().Hardlink)
+		}
+	}
+
+	if errs := imported.Verify(true); len(errs) != 0 {
+		t.Errorf("Expected no verify errors, got %v", errs)
+	}
+}
+
+func TestImportTar_SameTree(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "a.txt", "a")
+	writeTestFile(t, b, "sub/b.txt", "b")
+	writeTestFile(t, b, "sub/c.txt", "a")
+	// Tar headers only keep whole seconds
+	mtime := time.Date(2026, 1, 1, 10, 0, 0, 0, time.Local)
+	for _, p := range []string{"a.txt", "sub/b.txt", "sub/c.txt", "sub"} {
+		if err := os.Chtimes(filepath.Join(b.Top, filepath.FromSlash(p)), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := snapshotTestBackup(t, b, "260101-100000")
+	top, err := root.TopDirectory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := b.ExportTar(top, &buf, root.Time); err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := b.ImportTar(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := root.Hash(); hash != want {
+		t.Errorf("Expected the imported tree to hash to %s, got %s", want, hash)
+	}
+}
+
+func TestImportName(t *testing.T) {
+	for name, want := range map[string]string{
+		"./":         "",
+		"./a/b.txt":  "a/b.txt",
+		"/abs/x":     "abs/x",
+		"dir/":       "dir",
+		"a/./b//c":   "a/b/c",
+		"a/../b.txt": "b.txt",
+	} {
+		if got := importName(name); got != want {
+			t.Errorf("importName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
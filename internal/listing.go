@@ -0,0 +1,216 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listingHeader marks a directory listing that carries per-entry attributes.
+// Listings without it use the legacy "T hash name" format.
+const listingHeader = "#v2"
+
+// EntryAttrs holds the metadata recorded for an entry in a directory listing.
+// Zero values mean the attribute was not recorded.
+type EntryAttrs struct {
+	ModTime time.Time
+	// Hardlink is shared by files that were hardlinks of each other.
+	Hardlink string
+	// Mode holds the permission bits of files and directories.
+	Mode os.FileMode
+	// Xattrs holds the extended attributes of files and directories,
+	// recorded in stores with the xattrs setting.
+	Xattrs map[string][]byte
+	// Owner holds the numeric owner of files and directories as
+	// "uid:gid", recorded in stores with the owners setting.
+	Owner string
+	// Size holds the length of a file's content. Listings written by older
+	// versions do not record it; see BackupFile.Size.
+	Size int64
+}
+
+// String encodes the attributes as a comma separated list of key=value pairs,
+// or "-" when no attribute is set.
+func (a EntryAttrs) String() string {
+	var parts []string
+	if !a.ModTime.IsZero() {
+		parts = append(parts, "mtime="+strconv.FormatInt(a.ModTime.UnixNano(), 10))
+	}
+	if a.Hardlink != "" {
+		parts = append(parts, "hardlink="+a.Hardlink)
+	}
+	if a.Mode != 0 {
+		parts = append(parts, "mode="+strconv.FormatUint(uint64(a.Mode), 8))
+	}
+	if len(a.Xattrs) > 0 {
+		parts = append(parts, "xattrs="+encodeXattrs(a.Xattrs))
+	}
+	if a.Owner != "" {
+		parts = append(parts, "owner="+a.Owner)
+	}
+	if a.Size > 0 {
+		parts = append(parts, "size="+strconv.FormatInt(a.Size, 10))
+	}
+	if len(parts) == 0 {
+		return "-"
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseEntryAttrs decodes an attribute field. Unknown keys are ignored so that
+// listings written by newer versions remain readable.
+func parseEntryAttrs(s string) (EntryAttrs, error) {
+	var a EntryAttrs
+	if s == "-" {
+		return a, nil
+	}
+	for _, kv := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok {
+			return a, fmt.Errorf("invalid attribute %q", kv)
+		}
+		switch key {
+		case "mtime":
+			ns, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return a, fmt.Errorf("invalid mtime %q", value)
+			}
+			a.ModTime = time.Unix(0, ns)
+		case "hardlink":
+			a.Hardlink = value
+		case "mode":
+			mode, err := strconv.ParseUint(value, 8, 32)
+			if err != nil {
+				return a, fmt.Errorf("invalid mode %q", value)
+			}
+			a.Mode = os.FileMode(mode).Perm()
+		case "xattrs":
+			xattrs, err := decodeXattrs(value)
+			if err != nil {
+				return a, fmt.Errorf("invalid xattrs %q", value)
+			}
+			a.Xattrs = xattrs
+		case "owner":
+			if _, _, ok := parseOwner(value); !ok {
+				return a, fmt.Errorf("invalid owner %q", value)
+			}
+			a.Owner = value
+		case "size":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size < 0 {
+				return a, fmt.Errorf("invalid size %q", value)
+			}
+			a.Size = size
+		}
+	}
+	return a, nil
+}
+
+// listingLine is a single parsed directory listing entry.
+type listingLine struct {
+	Type  byte
+	Hash  string
+	Name  string
+	Attrs EntryAttrs
+}
+
+// formatListingLine renders an entry in the v2 listing format.
+func formatListingLine(typeChar byte, hash string, attrs EntryAttrs, name string) string {
+	return fmt.Sprintf("%c %s %s %s\n", typeChar, hash, attrs, name)
+}
+
+// parseListingLine parses a directory listing line.
+// Legacy format: T hash name
+// v2 format:     T hash attrs name
+// T is 1 char, then a space, then the hex hash (its length depends on the
+// store's hash algorithm), a space, and the name (which may contain spaces).
+func parseListingLine(line string, version int) (listingLine, error) {
+	var l listingLine
+	if len(line) < 5 || line[1] != ' ' {
+		return l, fmt.Errorf("malformed listing line")
+	}
+	l.Type = line[0]
+
+	hash, rest, ok := cutField(line[2:])
+	if !ok || !isHex(hash) {
+		return l, fmt.Errorf("invalid hash in listing line")
+	}
+	l.Hash = hash
+
+	if version >= 2 {
+		attrs, name, ok := cutField(rest)
+		if !ok {
+			return l, fmt.Errorf("missing attributes in listing line")
+		}
+		a, err := parseEntryAttrs(attrs)
+		if err != nil {
+			return l, err
+		}
+		l.Attrs = a
+		rest = name
+	}
+
+	if rest == "" {
+		return l, fmt.Errorf("missing name in listing line")
+	}
+	l.Name = rest
+	return l, nil
+}
+
+// cutField splits s at the first space. Both parts must be non-empty
+// for ok to be true.
+func cutField(s string) (string, string, bool) {
+	idx := strings.IndexByte(s, ' ')
+	if idx <= 0 || idx == len(s)-1 {
+		return "", "", false
+	}
+	return s[:idx], s[idx+1:], true
+}
+
+// listingScanner reads the entries of a directory listing blob,
+// handling both the legacy and the v2 formats.
+type listingScanner struct {
+	scanner *bufio.Scanner
+	version int
+	text    string
+	entry   listingLine
+	err     error
+}
+
+// maxListingLine is the longest listing line that can be read. Lines are
+// short except for entries with extended attributes, whose total size
+// captureXattrs limits to maxXattrsSize.
+const maxListingLine = 4 << 20
+
+func newListingScanner(r io.Reader) *listingScanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxListingLine)
+	return &listingScanner{scanner: scanner, version: 1}
+}
+
+// Scan advances to the next entry. Header lines are consumed silently.
+func (s *listingScanner) Scan() bool {
+	for s.scanner.Scan() {
+		s.text = s.scanner.Text()
+		if s.text == listingHeader {
+			s.version = 2
+			continue
+		}
+		s.entry, s.err = parseListingLine(s.text, s.version)
+		return true
+	}
+	return false
+}
+
+// Entry returns the current entry, or the error encountered parsing it.
+func (s *listingScanner) Entry() (listingLine, error) { return s.entry, s.err }
+
+// Text returns the raw text of the current line.
+func (s *listingScanner) Text() string { return s.text }
+
+// Err returns the first read error encountered by the underlying scanner.
+func (s *listingScanner) Err() error { return s.scanner.Err() }
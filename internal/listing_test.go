@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"maps"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseListingLine(t *testing.T) {
+	md5Hash := "d41d8cd98f00b204e9800998ecf8427e"
+	sha256Hash := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	tests := []struct {
+		line     string
+		version  int
+		wantType byte
+		wantHash string
+		wantName string
+		wantErr  bool
+	}{
+		{line: "F " + md5Hash + " file.txt", version: 1, wantType: 'F', wantHash: md5Hash, wantName: "file.txt"},
+		{line: "D " + sha256Hash + " dir with space", version: 1, wantType: 'D', wantHash: sha256Hash, wantName: "dir with space"},
+		{line: "F " + md5Hash + " - file.txt", version: 2, wantType: 'F', wantHash: md5Hash, wantName: "file.txt"},
+		{line: "F " + md5Hash + " mtime=1,unknown=x a b", version: 2, wantType: 'F', wantHash: md5Hash, wantName: "a b"},
+		{line: "F " + md5Hash + " - file.txt", version: 1, wantType: 'F', wantHash: md5Hash, wantName: "- file.txt"},
+		{line: "F " + md5Hash + " file.txt", version: 2, wantErr: true},
+		{line: "F " + md5Hash + " mtime=abc file.txt", version: 2, wantErr: true},
+		{line: "F " + md5Hash + " ", version: 1, wantErr: true},
+		{line: "F nothex file", version: 1, wantErr: true},
+		{line: "F" + md5Hash, version: 1, wantErr: true},
+		{line: "", version: 1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		l, err := parseListingLine(tt.line, tt.version)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseListingLine(%q, %d) expected error", tt.line, tt.version)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseListingLine(%q, %d) unexpected error: %v", tt.line, tt.version, err)
+			continue
+		}
+		if l.Type != tt.wantType || l.Hash != tt.wantHash || l.Name != tt.wantName {
+			t.Errorf("parseListingLine(%q, %d) = %c %s %q", tt.line, tt.version, l.Type, l.Hash, l.Name)
+		}
+	}
+}
+
+func TestListingScanner_Formats(t *testing.T) {
+	hash := "d41d8cd98f00b204e9800998ecf8427e"
+	mtime := time.Unix(1700000000, 123456789)
+
+	legacy := "F " + hash + " old.txt\n"
+	v2 := listingHeader + "\n" + formatListingLine('F', hash, EntryAttrs{ModTime: mtime}, "new file.txt")
+
+	s := newListingScanner(strings.NewReader(legacy))
+	if !s.Scan() {
+		t.Fatal("Expected an entry in legacy listing")
+	}
+	if l, err := s.Entry(); err != nil || l.Name != "old.txt" || !l.Attrs.ModTime.IsZero() {
+		t.Errorf("Unexpected legacy entry: %+v (%v)", l, err)
+	}
+
+	s = newListingScanner(strings.NewReader(v2))
+	if !s.Scan() {
+		t.Fatal("Expected an entry in v2 listing")
+	}
+	l, err := s.Entry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Name != "new file.txt" || !l.Attrs.ModTime.Equal(mtime) {
+		t.Errorf("Unexpected v2 entry: %+v", l)
+	}
+	if s.Scan() {
+		t.Error("Expected exactly one entry")
+	}
+}
+
+func TestEntryAttrs_RoundTrip(t *testing.T) {
+	attrs := EntryAttrs{ModTime: time.Unix(1700000000, 5), Hardlink: "66305:1234", Mode: 0750, Size: 4096}
+	s := attrs.String()
+	if s != "mtime=1700000000000000005,hardlink=66305:1234,mode=750,size=4096" {
+		t.Errorf("Unexpected encoding %q", s)
+	}
+	parsed, err := parseEntryAttrs(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.ModTime.Equal(attrs.ModTime) || parsed.Hardlink != attrs.Hardlink || parsed.Mode != attrs.Mode || parsed.Size != attrs.Size {
+		t.Errorf("Round trip mismatch: %+v != %+v", parsed, attrs)
+	}
+}
+
+func TestEntryAttrs_Owner(t *testing.T) {
+	parsed, err := parseEntryAttrs("mode=644,owner=0:100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Owner != "0:100" || parsed.String() != "mode=644,owner=0:100" {
+		t.Errorf("Round trip mismatch: %+v", parsed)
+	}
+	for _, bad := range []string{"owner=root:wheel", "owner=1000", "owner=-1:0"} {
+		if _, err := parseEntryAttrs(bad); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestEntryAttrs_Xattrs(t *testing.T) {
+	attrs := EntryAttrs{Xattrs: map[string][]byte{
+		"user.comment":         []byte("a, b = c"),
+		"com.apple.quarantine": {0, 1, 2, 0xff},
+		"user.empty":           {},
+	}}
+	s := attrs.String()
+	if strings.ContainsAny(strings.TrimPrefix(s, "xattrs="), " ,=") {
+		t.Errorf("Encoding %q breaks the attribute field", s)
+	}
+	parsed, err := parseEntryAttrs(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed.Xattrs, attrs.Xattrs) {
+		t.Errorf("Round trip mismatch: %q != %q", parsed.Xattrs, attrs.Xattrs)
+	}
+	// Listings of equal attributes are equal
+	if s != (EntryAttrs{Xattrs: maps.Clone(attrs.Xattrs)}).String() {
+		t.Error("Expected a stable encoding")
+	}
+	if _, err := parseEntryAttrs("xattrs=AAAA"); err == nil {
+		t.Error("Expected truncated xattrs to be refused")
+	}
+}
+
+func TestEntryAttrs_LargeXattrs(t *testing.T) {
+	b := newTestBackup(t)
+	big := map[string][]byte{
+		"user.big":   []byte(strings.Repeat("x", 100<<10)),
+		"user.huge":  []byte(strings.Repeat("y", maxXattrsSize)),
+		"user.small": []byte("kept"),
+	}
+	xattrs := b.limitXattrs("file", big)
+	if _, ok := xattrs["user.huge"]; ok || len(xattrs) != 2 {
+		t.Fatalf("Expected only the attribute over the limit to be dropped, got %d attributes", len(xattrs))
+	}
+
+	// A line longer than the default 64 KiB of a bufio.Scanner
+	hash := "d41d8cd98f00b204e9800998ecf8427e"
+	listing := listingHeader + "\n" + formatListingLine('F', hash, EntryAttrs{Xattrs: xattrs}, "file")
+	s := newListingScanner(strings.NewReader(listing))
+	if !s.Scan() {
+		t.Fatalf("Expected an entry, got %v", s.Err())
+	}
+	l, err := s.Entry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(l.Attrs.Xattrs, xattrs) {
+		t.Error("Round trip mismatch of large extended attributes")
+	}
+}
@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"path"
+	"sort"
+)
+
+// LocateHash returns the entries of roots that reference the blob hash:
+// entries with that hash, and chunked files with a chunk of that hash. A
+// snapshot whose top directory has the hash is reported with an empty path.
+// Directory listings and chunk manifests that cannot be read are skipped and
+// returned sorted, so that a damaged store can still be searched.
+func (b *Backup) LocateHash(hash string, roots []*BackupRoot) ([]FindMatch, []string, error) {
+	l := &locator{target: hash, dirs: make(map[string][]FindMatch), manifests: make(map[string]bool), unreadable: make(map[string]bool)}
+	var matches []FindMatch
+	for _, root := range roots {
+		top, err := root.TopDirectory()
+		if err != nil {
+			return matches, nil, err
+		}
+		if top.Hash() == hash {
+			matches = append(matches, FindMatch{Root: root, Hash: hash, Dir: true})
+			continue
+		}
+		for _, m := range l.searchDir(top) {
+			m.Root = root
+			matches = append(matches, m)
+		}
+	}
+	unreadable := make([]string, 0, len(l.unreadable))
+	for h := range l.unreadable {
+		unreadable = append(unreadable, h)
+	}
+	sort.Strings(unreadable)
+	return matches, unreadable, nil
+}
+
+type locator struct {
+	target     string
+	dirs       map[string][]FindMatch // Matches below a directory listing, relative to it
+	manifests  map[string]bool        // Whether a chunk manifest lists the target
+	unreadable map[string]bool
+}
+
+// searchDir returns the matches below dir, with paths relative to dir and
+// no Root. Listings are shared between snapshots, so results are memoized.
+func (l *locator) searchDir(dir *BackupDirectory) []FindMatch {
+	if found, ok := l.dirs[dir.Hash()]; ok {
+		return found
+	}
+	var found []FindMatch
+	entries, err := dir.Entries()
+	if err != nil {
+		l.unreadable[dir.Hash()] = true
+		l.dirs[dir.Hash()] = nil
+		return nil
+	}
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		e := entries[name]
+		switch e := e.(type) {
+		case *BackupDirectory:
+			if e.Hash() == l.target {
+				found = append(found, FindMatch{Path: name, Hash: e.Hash(), Dir: true})
+				continue // A listing cannot reference itself
+			}
+			for _, m := range l.searchDir(e) {
+				m.Path = path.Join(name, m.Path)
+				found = append(found, m)
+			}
+		case *BackupFile:
+			if e.Hash() == l.target || (e.chunked && l.manifestHasTarget(e)) {
+				found = append(found, FindMatch{Path: name, Hash: e.Hash()})
+			}
+		default:
+			if e.Hash() == l.target {
+				found = append(found, FindMatch{Path: name, Hash: e.Hash()})
+			}
+		}
+	}
+	l.dirs[dir.Hash()] = found
+	return found
+}
+
+func (l *locator) manifestHasTarget(f *BackupFile) bool {
+	if has, ok := l.manifests[f.Hash()]; ok {
+		return has
+	}
+	chunks, err := f.chunks()
+	if err != nil {
+		l.unreadable[f.Hash()] = true
+	}
+	has := false
+	for _, c := range chunks {
+		if c.Hash == l.target {
+			has = true
+			break
+		}
+	}
+	l.manifests[f.Hash()] = has
+	return has
+}
@@ -0,0 +1,85 @@
+package internal
+
+import (
+	"os"
+	"testing"
+)
+
+func TestBackup_LocateHash(t *testing.T) {
+	b := newTestBackup(t)
+	b.ChunkThreshold = 1 << 20
+	writeTestFile(t, b, "a.txt", "shared")
+	writeTestFile(t, b, "sub/b.txt", "shared")
+	writeTestFile(t, b, "big.bin", string(randomData(5, 2<<20)))
+	first := snapshotTestBackup(t, b, "260101-100000")
+	writeTestFile(t, b, "a.txt", "changed")
+	second := snapshotTestBackup(t, b, "260102-100000")
+	roots := []*BackupRoot{second, first}
+
+	top, err := first.TopDirectory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := top.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := entries["a.txt"].Hash()
+
+	matches, unreadable, err := b.LocateHash(shared, roots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range matches {
+		got = append(got, m.Root.Timestamp()+":"+m.Path)
+	}
+	want := []string{"260102-100000:sub/b.txt", "260101-100000:a.txt", "260101-100000:sub/b.txt"}
+	if len(got) != len(want) || len(unreadable) != 0 {
+		t.Fatalf("Expected %v, got %v (unreadable %v)", want, got, unreadable)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Match %d: expected %s, got %s", i, want[i], got[i])
+		}
+	}
+
+	// A chunk is located through the manifest of the file it belongs to
+	chunks, err := entries["big.bin"].(*BackupFile).chunks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches, _, err = b.LocateHash(chunks[0].Hash, roots[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].Path != "big.bin" || matches[0].Hash != entries["big.bin"].Hash() {
+		t.Errorf("Unexpected matches for a chunk: %+v", matches)
+	}
+
+	// The top directory itself, and a damaged listing on the way
+	matches, _, err = b.LocateHash(top.Hash(), roots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].Root != first || matches[0].Path != "" || !matches[0].Dir {
+		t.Errorf("Unexpected matches for a top directory: %+v", matches)
+	}
+	sub := entries["sub"].Hash()
+	if err := os.Remove(b.Store.DataStore(sub)); err != nil {
+		t.Fatal(err)
+	}
+	matches, unreadable, err = b.LocateHash(sub, roots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 2 || matches[0].Path != "sub" || !matches[0].Dir {
+		t.Errorf("Unexpected matches for a missing listing: %+v", matches)
+	}
+	if len(unreadable) != 0 {
+		t.Errorf("The located listing should not be read, got unreadable %v", unreadable)
+	}
+	if _, unreadable, _ = b.LocateHash(shared, roots); len(unreadable) != 1 || unreadable[0] != sub {
+		t.Errorf("Expected %s to be unreadable, got %v", sub, unreadable)
+	}
+}
@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// LockInfo describes the owner of the store lock, as recorded in the lock
+// file.
+type LockInfo struct {
+	PID      int       `toml:"pid" json:"pid"`
+	Hostname string    `toml:"hostname" json:"hostname"`
+	Started  time.Time `toml:"started" json:"started"`
+}
+
+// String describes the owner for messages, e.g. "PID 42 on host since …".
+func (l *LockInfo) String() string {
+	s := fmt.Sprintf("PID %d", l.PID)
+	if l.PID <= 0 {
+		s = "an unknown process"
+	}
+	if l.Hostname != "" {
+		s += " on " + l.Hostname
+	}
+	if !l.Started.IsZero() {
+		s += " since " + l.Started.Local().Format(time.RFC1123)
+	}
+	return s
+}
+
+// Local reports whether the owner runs on this host, so its PID can be
+// checked. Locks written before hostnames were recorded count as local.
+func (l *LockInfo) Local() bool {
+	if l.Hostname == "" {
+		return true
+	}
+	host, err := os.Hostname()
+	return err == nil && host == l.Hostname
+}
+
+// Stale reports whether the owner is known to no longer run: it ran on this
+// host and its PID is gone. Locks of other hosts, and locks without a PID,
+// are never stale.
+func (l *LockInfo) Stale() bool {
+	return l.PID > 0 && l.Local() && !processAlive(l.PID)
+}
+
+// lockName is the state file of the store lock, held by commands that
+// modify the store. It is kept in the store itself, so hosts sharing a
+// store at a URL see each other's lock.
+const lockName = "lock"
+
+// lockWriteDelay is how long Lock waits for the owner of a lock without a
+// PID, which may have created the lock file but not written it yet.
+var lockWriteDelay = 200 * time.Millisecond
+
+// Lock acquires the store lock for a mutating operation (backup, prune,
+// remove). The lock file records the PID, host and start time of its
+// owner; a lock left behind by a process of this host that no longer runs
+// is taken over.
+func (b *Backup) Lock() error {
+	state, where := b.state(), b.stateLocation(lockName)
+	for attempt := 0; ; attempt++ {
+		info := LockInfo{PID: os.Getpid(), Started: time.Now()}
+		info.Hostname, _ = os.Hostname()
+		var buf bytes.Buffer
+		if err := toml.NewEncoder(&buf).Encode(info); err != nil {
+			return fmt.Errorf("failed to write store lock %s: %w", where, err)
+		}
+		err := state.Create(lockName, buf.Bytes())
+		if err == nil {
+			b.locked = true
+			return nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return fmt.Errorf("failed to create store lock %s: %w", where, err)
+		}
+
+		owner, err := b.readLock()
+		if err == nil && owner != nil && owner.PID <= 0 {
+			time.Sleep(lockWriteDelay)
+			owner, err = b.readLock()
+		}
+		// Only a lock known to be left behind is removed; one that cannot
+		// be read may still be held.
+		if err != nil {
+			return fmt.Errorf("store is locked, but the lock cannot be read (run 'backup unlock' if no backup is running): %w", err)
+		}
+		if owner != nil && !owner.Stale() {
+			return fmt.Errorf("store is locked by %s (run 'backup unlock' if that process is not a backup)", owner)
+		}
+		if attempt > 0 {
+			return fmt.Errorf("failed to acquire store lock %s", where)
+		}
+		if owner == nil {
+			// Released in the meantime
+			continue
+		}
+		// Stale lock from a crashed or killed run
+		b.warnf("removing stale store lock %s", where)
+		if err := state.Delete(lockName); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove stale store lock %s: %w", where, err)
+		}
+	}
+}
+
+// Unlock releases the store lock if this Backup holds it.
+func (b *Backup) Unlock() error {
+	if !b.locked {
+		return nil
+	}
+	b.locked = false
+	if err := b.state().Delete(lockName); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// LockOwner returns the owner of the store lock, or nil if the store is
+// not locked.
+func (b *Backup) LockOwner() (*LockInfo, error) {
+	return b.readLock()
+}
+
+// BreakLock removes the store lock regardless of its owner. Commands of
+// the owner that still run may then conflict with other commands.
+func (b *Backup) BreakLock() error {
+	if err := b.state().Delete(lockName); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove store lock: %w", err)
+	}
+	return nil
+}
+
+// readLock reads the store lock, returning nil if the store is not
+// locked. Older versions wrote only the PID.
+func (b *Backup) readLock() (*LockInfo, error) {
+	data, err := b.state().Read(lockName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if pid, err := strconv.Atoi(string(bytes.TrimSpace(data))); err == nil {
+		return &LockInfo{PID: pid}, nil
+	}
+	var info LockInfo
+	if _, err := toml.Decode(string(data), &info); err != nil {
+		return nil, fmt.Errorf("invalid store lock %s: %w", b.stateLocation(lockName), err)
+	}
+	return &info, nil
+}
@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackup_Lock(t *testing.T) {
+	b := newTestBackup(t)
+	if err := b.Lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	other := &Backup{StoreRoot: b.StoreRoot}
+	err := other.Lock()
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("locked by PID %d", os.Getpid())) {
+		t.Fatalf("Expected lock conflict, got %v", err)
+	}
+
+	if err := b.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(b.stateLocation(lockName)); !os.IsNotExist(err) {
+		t.Errorf("Expected lock file to be removed, got %v", err)
+	}
+	if err := other.Lock(); err != nil {
+		t.Fatalf("Expected lock to be free after unlock, got %v", err)
+	}
+	if err := other.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	// Unlocking without holding the lock is a no-op
+	if err := b.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackup_LockStale(t *testing.T) {
+	b := newTestBackup(t)
+	if err := os.MkdirAll(filepath.Dir(b.stateLocation(lockName)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// PIDs are far below this on every supported platform
+	if err := os.WriteFile(b.stateLocation(lockName), []byte("999999999\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Lock(); err != nil {
+		t.Fatalf("Expected stale lock to be taken over, got %v", err)
+	}
+	info, err := b.LockOwner()
+	if err != nil || info == nil || info.PID != os.Getpid() {
+		t.Fatalf("Expected lock owned by %d, got %v (%v)", os.Getpid(), info, err)
+	}
+	if host, _ := os.Hostname(); info.Hostname != host || time.Since(info.Started) > time.Minute {
+		t.Errorf("Expected the lock to record this host and the start time, got %+v", info)
+	}
+	if err := b.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackup_LockUnwritten(t *testing.T) {
+	b := newTestBackup(t)
+	if err := os.MkdirAll(filepath.Dir(b.stateLocation(lockName)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(d time.Duration) { lockWriteDelay = d }(lockWriteDelay)
+	lockWriteDelay = time.Millisecond
+	// Another process has created the lock but not written it yet, or its
+	// lock is damaged; either way it is not removed
+	for _, content := range []string{"", "pid = 0\n", "not a lock ["} {
+		if err := os.WriteFile(b.stateLocation(lockName), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := b.Lock()
+		if err == nil || !strings.Contains(err.Error(), "store is locked") {
+			t.Errorf("Lock %q: expected the store to count as locked, got %v", content, err)
+		}
+		data, err := os.ReadFile(b.stateLocation(lockName))
+		if err != nil || string(data) != content {
+			t.Errorf("Lock %q: expected the lock to be kept, got %q (%v)", content, data, err)
+		}
+	}
+}
+
+func TestBackup_LockOtherHost(t *testing.T) {
+	b := newTestBackup(t)
+	if err := os.MkdirAll(filepath.Dir(b.stateLocation(lockName)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// The PID of another host cannot be checked, so the lock is kept
+	lock := "pid = 999999999\nhostname = \"elsewhere.invalid\"\nstarted = 2024-05-01T10:00:00Z\n"
+	if err := os.WriteFile(b.stateLocation(lockName), []byte(lock), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := b.Lock()
+	if err == nil || !strings.Contains(err.Error(), "PID 999999999 on elsewhere.invalid since") || !strings.Contains(err.Error(), "backup unlock") {
+		t.Fatalf("Expected a lock conflict naming the other host, got %v", err)
+	}
+	info, err := b.LockOwner()
+	if err != nil || info.Stale() || info.Local() {
+		t.Errorf("Expected a live lock of another host, got %+v (%v)", info, err)
+	}
+
+	if err := b.BreakLock(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := b.LockOwner(); info != nil || err != nil {
+		t.Errorf("Expected no lock after breaking it, got %v (%v)", info, err)
+	}
+	if err := b.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	b.Unlock()
+}
@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ConsoleHandler is the slog.Handler of the command line. Debug and info
+// messages go to stdout as they are; warnings and errors go to stderr,
+// prefixed with "Warning: " and "Error: ". Attributes are appended as
+// key=value pairs.
+type ConsoleHandler struct {
+	level  slog.Leveler
+	stdout io.Writer // nil means os.Stdout at the time of writing
+	stderr io.Writer // nil means os.Stderr at the time of writing
+	mu     *sync.Mutex
+	prefix string // Group prefix of attribute keys
+	attrs  string // Preformatted attributes of WithAttrs
+}
+
+// NewConsoleHandler returns a ConsoleHandler printing messages of at least
+// level.
+func NewConsoleHandler(level slog.Leveler) *ConsoleHandler {
+	return &ConsoleHandler{level: level, mu: &sync.Mutex{}}
+}
+
+func (h *ConsoleHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *ConsoleHandler) Handle(_ context.Context, r slog.Record) error {
+	var sb strings.Builder
+	switch {
+	case r.Level >= slog.LevelError:
+		sb.WriteString("Error: ")
+	case r.Level >= slog.LevelWarn:
+		sb.WriteString("Warning: ")
+	}
+	sb.WriteString(r.Message)
+	sb.WriteString(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		writeAttr(&sb, h.prefix, a)
+		return true
+	})
+	sb.WriteByte('\n')
+
+	out := h.stdout
+	if out == nil {
+		out = os.Stdout
+	}
+	if r.Level >= slog.LevelWarn {
+		out = h.stderr
+		if out == nil {
+			out = os.Stderr
+		}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(out, sb.String())
+	return err
+}
+
+func (h *ConsoleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var sb strings.Builder
+	for _, a := range attrs {
+		writeAttr(&sb, h.prefix, a)
+	}
+	h2 := *h
+	h2.attrs += sb.String()
+	return &h2
+}
+
+func (h *ConsoleHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.prefix += name + "."
+	return &h2
+}
+
+func writeAttr(sb *strings.Builder, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			writeAttr(sb, prefix, ga)
+		}
+		return
+	}
+	fmt.Fprintf(sb, " %s%s=%v", prefix, a.Key, a.Value)
+}
+
+// defaultLogger is used by a Backup without a Logger.
+var defaultLogger = slog.New(NewConsoleHandler(slog.LevelInfo))
+
+// Log returns the logger of b: b.Logger, or a ConsoleHandler at info level
+// if it is nil. b may be nil.
+func (b *Backup) Log() *slog.Logger {
+	if b == nil || b.Logger == nil {
+		return defaultLogger
+	}
+	return b.Logger
+}
+
+func (b *Backup) logf(level slog.Level, format string, args ...any) {
+	l := b.Log()
+	ctx := context.Background()
+	if l.Enabled(ctx, level) {
+		l.Log(ctx, level, fmt.Sprintf(format, args...))
+	}
+}
+
+func (b *Backup) debugf(format string, args ...any) { b.logf(slog.LevelDebug, format, args...) }
+func (b *Backup) infof(format string, args ...any)  { b.logf(slog.LevelInfo, format, args...) }
+func (b *Backup) warnf(format string, args ...any)  { b.logf(slog.LevelWarn, format, args...) }
+func (b *Backup) errorf(format string, args ...any) { b.logf(slog.LevelError, format, args...) }
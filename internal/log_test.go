@@ -0,0 +1,40 @@
+package internal
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+)
+
+func TestConsoleHandler(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	h := NewConsoleHandler(slog.LevelInfo)
+	h.stdout, h.stderr = &stdout, &stderr
+	b := &Backup{Logger: slog.New(h)}
+
+	b.debugf("Archiving: %s", "a.txt")
+	b.infof("Restoring %s", "a.txt")
+	b.warnf("cannot heal blob %s", "abc")
+	b.errorf("stating blob %s", "def")
+	b.Log().With("project", "proj").WithGroup("blob").Info("saved", "hash", "abc")
+
+	if got, want := stdout.String(), "Restoring a.txt\nsaved project=proj blob.hash=abc\n"; got != want {
+		t.Errorf("Unexpected stdout %q, want %q", got, want)
+	}
+	if got, want := stderr.String(), "Warning: cannot heal blob abc\nError: stating blob def\n"; got != want {
+		t.Errorf("Unexpected stderr %q, want %q", got, want)
+	}
+
+	// Debug messages are printed at debug level
+	stdout.Reset()
+	h.level = slog.LevelDebug
+	b.debugf("Archiving: %s", "a.txt")
+	if got := stdout.String(); got != "Archiving: a.txt\n" {
+		t.Errorf("Expected the debug message, got %q", got)
+	}
+
+	// A nil Backup logs to the console
+	if (*Backup)(nil).Log() != defaultLogger {
+		t.Error("Expected the default logger for a nil Backup")
+	}
+}
@@ -0,0 +1,9 @@
+package internal
+
+// SnapshotMount is a snapshot served read-only through FUSE.
+type SnapshotMount interface {
+	// Wait blocks until the file system is unmounted.
+	Wait()
+	// Unmount detaches the file system from its mount point.
+	Unmount() error
+}
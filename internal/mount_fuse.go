@@ -0,0 +1,263 @@
+//go:build linux || darwin
+
+package internal
+
+import (
+	"context"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// MountSnapshot serves dir read-only at mountpoint. Directory listings and
+// file content are read from the store on demand.
+func MountSnapshot(dir *BackupDirectory, mountpoint string) (SnapshotMount, error) {
+	// Snapshots never change, so the kernel may cache everything
+	timeout := time.Hour
+	root := &mountDir{dir: dir, mu: &sync.Mutex{}}
+	return fs.Mount(mountpoint, root, &fs.Options{
+		MountOptions: fuse.MountOptions{
+			FsName:  "backup",
+			Name:    "backup",
+			Options: []string{"ro"},
+			// Mount directly when running as root, where fusermount may be missing
+			DirectMount: true,
+		},
+		EntryTimeout: &timeout,
+		AttrTimeout:  &timeout,
+	})
+}
+
+// mountDir is a directory of a mounted snapshot.
+type mountDir struct {
+	fs.Inode
+	dir *BackupDirectory
+	// mu serializes listing reads, which BackupDirectory caches unsynchronized.
+	mu *sync.Mutex
+}
+
+var (
+	_ fs.NodeGetattrer = (*mountDir)(nil)
+	_ fs.NodeLookuper  = (*mountDir)(nil)
+	_ fs.NodeReaddirer = (*mountDir)(nil)
+)
+
+func (d *mountDir) entries() (map[string]BackupEntry, syscall.Errno) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	entries, err := d.dir.Entries()
+	if err != nil {
+		return nil, syscall.EIO
+	}
+	return entries, fs.OK
+}
+
+func (d *mountDir) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	setMountAttr(&out.Attr, d.dir, fuse.S_IFDIR|0555, 0)
+	return fs.OK
+}
+
+func (d *mountDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	entries, errno := d.entries()
+	if errno != fs.OK {
+		return nil, errno
+	}
+	entry, ok := entries[name]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+
+	var node fs.InodeEmbedder
+	var mode uint32
+	switch e := entry.(type) {
+	case *BackupDirectory:
+		node, mode = &mountDir{dir: e, mu: d.mu}, fuse.S_IFDIR
+	case *BackupLink:
+		node, mode = &mountLink{link: e}, fuse.S_IFLNK
+	case *BackupFile:
+		node, mode = &mountFile{file: e, size: -1}, fuse.S_IFREG
+	default:
+		return nil, syscall.ENOENT
+	}
+	var attr fuse.AttrOut
+	if errno := node.(fs.NodeGetattrer).Getattr(ctx, nil, &attr); errno != fs.OK {
+		return nil, errno
+	}
+	out.Attr = attr.Attr
+	return d.NewInode(ctx, node, fs.StableAttr{Mode: mode}), fs.OK
+}
+
+func (d *mountDir) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	entries, errno := d.entries()
+	if errno != fs.OK {
+		return nil, errno
+	}
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	list := make([]fuse.DirEntry, 0, len(names))
+	for _, name := range names {
+		mode := uint32(fuse.S_IFREG)
+		switch entries[name].(type) {
+		case *BackupDirectory:
+			mode = fuse.S_IFDIR
+		case *BackupLink:
+			mode = fuse.S_IFLNK
+		}
+		list = append(list, fuse.DirEntry{Name: name, Mode: mode})
+	}
+	return fs.NewListDirStream(list), fs.OK
+}
+
+// mountFile is a regular file of a mounted snapshot.
+type mountFile struct {
+	fs.Inode
+	file *BackupFile
+
+	mu   sync.Mutex
+	size int64 // -1 until known
+}
+
+var (
+	_ fs.NodeGetattrer = (*mountFile)(nil)
+	_ fs.NodeOpener    = (*mountFile)(nil)
+	_ fs.NodeReader    = (*mountFile)(nil)
+)
+
+func (f *mountFile) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// Listings of older snapshots lack sizes; then the first stat decompresses
+	// the file (or reads its chunk manifest)
+	if f.size < 0 {
+		size, err := f.file.Size()
+		if err != nil {
+			return syscall.EIO
+		}
+		f.size = size
+	}
+	setMountAttr(&out.Attr, f.file, fuse.S_IFREG|0444, uint64(f.size))
+	return fs.OK
+}
+
+func (f *mountFile) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	return &mountFileHandle{file: f.file}, fuse.FOPEN_KEEP_CACHE, fs.OK
+}
+
+func (f *mountFile) Read(ctx context.Context, fh fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	h, ok := fh.(*mountFileHandle)
+	if !ok {
+		return nil, syscall.EBADF
+	}
+	n, err := h.readAt(dest, off)
+	if err != nil {
+		return nil, syscall.EIO
+	}
+	return fuse.ReadResultData(dest[:n]), fs.OK
+}
+
+// mountFileHandle streams an open file's content. Reads are mostly
+// sequential; reading backwards starts the stream over.
+type mountFileHandle struct {
+	file *BackupFile
+
+	mu  sync.Mutex
+	r   io.ReadCloser
+	pos int64
+}
+
+var _ fs.FileReleaser = (*mountFileHandle)(nil)
+
+func (h *mountFileHandle) readAt(dest []byte, off int64) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.r == nil || off < h.pos {
+		if h.r != nil {
+			h.r.Close()
+		}
+		r, err := h.file.Open()
+		if err != nil {
+			h.r = nil
+			return 0, err
+		}
+		h.r, h.pos = r, 0
+	}
+	if off > h.pos {
+		skipped, err := io.CopyN(io.Discard, h.r, off-h.pos)
+		h.pos += skipped
+		if err == io.EOF {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := io.ReadFull(h.r, dest)
+	h.pos += int64(n)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (h *mountFileHandle) Release(ctx context.Context) syscall.Errno {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.r != nil {
+		h.r.Close()
+		h.r = nil
+	}
+	return fs.OK
+}
+
+// mountLink is a symlink of a mounted snapshot.
+type mountLink struct {
+	fs.Inode
+	link *BackupLink
+}
+
+var (
+	_ fs.NodeGetattrer  = (*mountLink)(nil)
+	_ fs.NodeReadlinker = (*mountLink)(nil)
+)
+
+func (l *mountLink) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	target, err := l.link.Target()
+	if err != nil {
+		return syscall.EIO
+	}
+	setMountAttr(&out.Attr, l.link, fuse.S_IFLNK|0777, uint64(len(target)))
+	return fs.OK
+}
+
+func (l *mountLink) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	target, err := l.link.Target()
+	if err != nil {
+		return nil, syscall.EIO
+	}
+	return []byte(target), fs.OK
+}
+
+// setMountAttr fills the attributes shared by all snapshot nodes. Files are
+// owned by the user serving the mount.
+func setMountAttr(attr *fuse.Attr, e BackupEntry, mode uint32, size uint64) {
+	attr.Mode = mode
+	attr.Size = size
+	attr.Nlink = 1
+	attr.Owner = fuse.Owner{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+	if mtime := e.Attrs().ModTime; !mtime.IsZero() {
+		attr.SetTimes(&mtime, &mtime, &mtime)
+	}
+}
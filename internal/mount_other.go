@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package internal
+
+import "fmt"
+
+// MountSnapshot is only supported on Linux and macOS.
+func MountSnapshot(dir *BackupDirectory, mountpoint string) (SnapshotMount, error) {
+	return nil, fmt.Errorf("mount is not supported on this platform")
+}
@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// captureOwner returns the owner of the file or directory described by info
+// as "uid:gid" if the store records owners, and "" otherwise.
+func (b *Backup) captureOwner(info os.FileInfo) string {
+	if b == nil || b.StoreConfig == nil || !b.StoreConfig.Owners {
+		return ""
+	}
+	return fileOwner(info)
+}
+
+// parseOwner splits an owner recorded as "uid:gid".
+func parseOwner(owner string) (uid, gid int, ok bool) {
+	u, g, found := strings.Cut(owner, ":")
+	uid, err1 := strconv.Atoi(u)
+	gid, err2 := strconv.Atoi(g)
+	if !found || err1 != nil || err2 != nil || uid < 0 || gid < 0 {
+		return 0, 0, false
+	}
+	return uid, gid, true
+}
+
+// restoreOwner sets the recorded owner on dest. A failure is reported as a
+// warning, like one to set extended attributes.
+func (e *BaseBackupEntry) restoreOwner(dest string) {
+	uid, gid, ok := parseOwner(e.attrs.Owner)
+	if !ok {
+		return
+	}
+	if err := os.Lchown(dest, uid, gid); err != nil {
+		e.b.warnf("cannot restore the owner of %s: %v", dest, err)
+	}
+}
+
+// checkPreserveOwner reports why owners cannot be restored by this process,
+// or nil if they can.
+func checkPreserveOwner() error {
+	if runtime.GOOS == "windows" {
+		return fmt.Errorf("owners are not restored on Windows")
+	}
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("restoring owners needs root privileges")
+	}
+	return nil
+}
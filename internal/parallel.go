@@ -0,0 +1,38 @@
+package internal
+
+import "sync"
+
+// runParallel calls fn for every index in [0, count) using at most jobs
+// goroutines. With jobs <= 1 the calls run serially in index order. The
+// error of the lowest failing index is returned.
+func runParallel(jobs, count int, fn func(i int) error) error {
+	if jobs <= 1 || count <= 1 {
+		for i := 0; i < count; i++ {
+			if err := fn(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	errs := make([]error, count)
+	sem := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = fn(i)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// RenameProject renames the snapshot directory of project oldName to
+// newName. Blobs are shared between projects, so only the snapshot heads
+// move. An interrupted backup recorded for oldName is carried over, and when
+// run from a source directory of oldName its config.toml is updated. With
+// dryRun only the checks are done.
+func (b *Backup) RenameProject(oldName, newName string, dryRun bool) error {
+	for _, name := range []string{oldName, newName} {
+		if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+			return fmt.Errorf("invalid project name: %q", name)
+		}
+	}
+	if oldName == newName {
+		return fmt.Errorf("project %s already has that name", oldName)
+	}
+	if _, err := b.refs().List(oldName); err != nil {
+		return fmt.Errorf("project not found: %s", oldName)
+	}
+	if exists, err := b.refExists(newName); err != nil {
+		return err
+	} else if exists {
+		return fmt.Errorf("project %s already exists", newName)
+	}
+	if dryRun {
+		return nil
+	}
+
+	if err := b.refs().Rename(oldName, newName); err != nil {
+		return fmt.Errorf("failed to rename project %s: %w", oldName, err)
+	}
+	if err := b.renameInProgress(oldName, newName); err != nil {
+		b.warnf("Failed to update progress marker: %v", err)
+	}
+	if b.Top != "" && b.ProjectName == oldName {
+		if err := SetConfigName(filepath.Join(b.BackupConfigDir, "config.toml"), newName); err != nil {
+			return fmt.Errorf("renamed the snapshots but failed to update config.toml: %w", err)
+		}
+		b.ProjectName = newName
+	}
+	return nil
+}
+
+// renameInProgress moves the interrupted backup record of a project.
+func (b *Backup) renameInProgress(oldName, newName string) error {
+	path := b.progressPath()
+	props, err := LoadProperties(path)
+	if err != nil {
+		return err
+	}
+	if _, ok := props[oldName]; !ok {
+		return nil
+	}
+	props[newName] = props[oldName]
+	delete(props, oldName)
+	return props.Store(path, " Backups that have not written their snapshot head yet")
+}
@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackup_RenameProject(t *testing.T) {
+	b := newTestBackup(t)
+	b.BackupConfigDir = filepath.Join(b.Top, ".backup")
+	writeTestFile(t, b, ".backup/config.toml", "# source\nstore = \"../store\"\nname = \"test\"\nmax_file_size = \"1MB\"\n")
+	writeTestFile(t, b, "a.txt", "a")
+	root := snapshotTestBackup(t, b, "260101-100000")
+	if err := os.MkdirAll(filepath.Join(b.StoreSnapshots, "taken"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	started := time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)
+	if err := b.setInProgress(started); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct{ oldName, newName string }{
+		{"missing", "new"},
+		{"test", "taken"},
+		{"test", "../escape"},
+		{"test", "test"},
+	} {
+		if err := b.RenameProject(tc.oldName, tc.newName, false); err == nil {
+			t.Errorf("Expected renaming %s to %s to fail", tc.oldName, tc.newName)
+		}
+	}
+	if err := b.RenameProject("test", "renamed", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(root.BackupHead); err != nil {
+		t.Fatalf("A dry run moved the snapshots: %v", err)
+	}
+
+	if err := b.RenameProject("test", "renamed", false); err != nil {
+		t.Fatal(err)
+	}
+	if b.ProjectName != "renamed" {
+		t.Errorf("Expected the current project to be renamed, got %s", b.ProjectName)
+	}
+	if _, err := b.FindBackupRoot("260101-100000"); err != nil {
+		t.Errorf("Snapshot not found under the new name: %v", err)
+	}
+	if got, ok := b.InterruptedBackup(); !ok || !got.Equal(started) {
+		t.Errorf("Expected the interrupted backup to move along, got %v, %v", got, ok)
+	}
+	config, err := LoadConfig(filepath.Join(b.BackupConfigDir, "config.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Name != "renamed" || config.MaxFileSize != "1MB" {
+		t.Errorf("Unexpected config after rename: %+v", config)
+	}
+}
+
+func TestSetConfigName(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte("store = \"../store\""), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetConfigName(path, "new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetConfigName(path, "newer"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "store = \"../store\"\nname = \"newer\"\n" {
+		t.Errorf("Unexpected config content %q", data)
+	}
+}
@@ -2,7 +2,9 @@ package internal
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"sort"
 	"strings"
@@ -11,17 +13,25 @@ import (
 type Properties map[string]string
 
 func LoadProperties(path string) (Properties, error) {
-	props := make(Properties)
 	file, err := os.Open(path)
 	if os.IsNotExist(err) {
-		return props, nil
+		return make(Properties), nil
 	}
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
+	return readProperties(file)
+}
 
-	scanner := bufio.NewScanner(file)
+// ParseProperties parses the properties held by data, as written by Format.
+func ParseProperties(data []byte) (Properties, error) {
+	return readProperties(bytes.NewReader(data))
+}
+
+func readProperties(r io.Reader) (Properties, error) {
+	props := make(Properties)
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		line := scanner.Text()
 		if strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") {
@@ -46,7 +56,17 @@ func (p Properties) Store(path string, comments string) error {
 		return err
 	}
 	defer file.Close()
+	return p.write(file, comments)
+}
+
+// Format returns the properties as written by Store.
+func (p Properties) Format(comments string) []byte {
+	var buf bytes.Buffer
+	p.write(&buf, comments)
+	return buf.Bytes()
+}
 
+func (p Properties) write(file io.Writer, comments string) error {
 	if comments != "" {
 		fmt.Fprintf(file, "#%s\n", comments)
 	}
@@ -61,7 +81,9 @@ func (p Properties) Store(path string, comments string) error {
 	for _, k := range keys {
 		// Escape spaces in key
 		escapedKey := strings.ReplaceAll(k, " ", "\\ ")
-		fmt.Fprintf(file, "%s=%s\n", escapedKey, p[k])
+		if _, err := fmt.Fprintf(file, "%s=%s\n", escapedKey, p[k]); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -1,41 +1,83 @@
 package internal
 
 import (
+	"errors"
 	"fmt"
-	"os"
+	"io/fs"
+	"time"
 )
 
 type PruneStats struct {
 	BlobsRemoved int
 	BytesRemoved int64
+	// Unreferenced blobs kept because their grace period has not passed
+	BlobsKept int
+	BytesKept int64
 }
 
-// Prune deletes unreferenced blobs from the store.
-func (b *Backup) Prune(dryRun bool) (PruneStats, error) {
+// Prune deletes unreferenced blobs from the store. Unless dryRun is set it
+// holds the store lock from the scan to the last deletion, taking it if the
+// caller does not hold it yet, so that no backup can write blobs or snapshot
+// heads in between. Snapshot heads are read after the lock is taken. Prune
+// refuses to run if a reachable directory listing or chunk manifest is
+// missing or unreadable, since the blobs below it could not be told apart
+// from unreferenced ones.
+//
+// With a positive keepUnreferenced, usually b.KeepUnreferenced(), a blob is
+// only deleted once that long has passed since a prune first found it
+// unreferenced, so snapshots removed by mistake can still be recreated from
+// their blobs. The time is recorded in the store (see unreferencedName)
+// and forgotten when the blob is referenced again or deleted.
+func (b *Backup) Prune(dryRun bool, keepUnreferenced time.Duration) (PruneStats, error) {
 	stats := PruneStats{}
 
+	if !dryRun && !b.locked {
+		if err := b.Lock(); err != nil {
+			return stats, err
+		}
+		defer b.Unlock()
+	}
+
 	unreferenced, err := b.FindUnreferenced()
+	if err != nil {
+		return stats, fmt.Errorf("cannot determine unreferenced blobs (run check): %w", err)
+	}
+	since, err := b.loadUnreferenced()
 	if err != nil {
 		return stats, err
 	}
 
+	now := time.Now()
+	kept := Properties{}
 	for _, hash := range unreferenced {
-		path := b.Store.DataStore(hash)
-
-		info, err := os.Stat(path)
+		size, err := b.Store.Blobs.Size(hash)
 		if err != nil {
 			// If missing, it's already gone (race or weirdness)
-			if !os.IsNotExist(err) {
+			if !errors.Is(err, fs.ErrNotExist) {
 				// Report error but continue?
-				fmt.Fprintf(os.Stderr, "Error stating to-be-pruned unreferenced blob %s: %v\n", hash, err)
+				b.errorf("stating to-be-pruned unreferenced blob %s: %v", hash, err)
+				if t, ok := since[hash]; ok {
+					kept[hash] = t
+				}
 			}
 			continue
 		}
 
-		size := info.Size()
+		if keepUnreferenced > 0 {
+			first, err := time.Parse(time.RFC3339, since[hash])
+			if err != nil {
+				first = now
+			}
+			if now.Sub(first) < keepUnreferenced {
+				kept[hash] = first.Format(time.RFC3339)
+				stats.BlobsKept++
+				stats.BytesKept += size
+				continue
+			}
+		}
 
 		if !dryRun {
-			if err := os.Remove(path); err != nil {
+			if err := b.Store.Blobs.Delete(hash); err != nil {
 				return stats, fmt.Errorf("failed to remove unreferenced blob %s: %w", hash, err)
 			}
 		}
@@ -44,5 +86,110 @@ func (b *Backup) Prune(dryRun bool) (PruneStats, error) {
 		stats.BytesRemoved += size
 	}
 
+	if !dryRun {
+		if err := b.storeUnreferenced(kept); err != nil {
+			return stats, fmt.Errorf("failed to record unreferenced blobs: %w", err)
+		}
+	}
 	return stats, nil
 }
+
+// KeepUnreferenced returns the grace period of prune set by
+// keep_unreferenced_days in store.toml.
+func (b *Backup) KeepUnreferenced() time.Duration {
+	if b.StoreConfig == nil {
+		return 0
+	}
+	keep, _ := b.StoreConfig.KeepUnreferenced() // Checked by NewBackup
+	return keep
+}
+
+// unreferencedName is the state file recording the unreferenced blobs
+// kept by Prune, with the time a prune first found each of them
+// unreferenced.
+const unreferencedName = "unreferenced"
+
+// loadUnreferenced returns the record of unreferenced blobs.
+func (b *Backup) loadUnreferenced() (Properties, error) {
+	data, err := b.readState(unreferencedName)
+	if err != nil {
+		return nil, err
+	}
+	return ParseProperties(data)
+}
+
+// storeUnreferenced replaces the record of unreferenced blobs with kept,
+// removing it if kept is empty.
+func (b *Backup) storeUnreferenced(kept Properties) error {
+	if len(kept) == 0 {
+		if err := b.state().Delete(unreferencedName); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	return b.state().Write(unreferencedName, kept.Format(" Unreferenced blobs kept by prune and when it first found them unreferenced"))
+}
+
+// PruneBlobResult describes the blob removed by PruneBlob.
+type PruneBlobResult struct {
+	Bytes int64
+	// Entries of snapshots referencing the blob; they cannot be restored
+	// once it is removed.
+	References []FindMatch
+	// Directory listings and chunk manifests that could not be read, so
+	// references below them may be missing from References.
+	Unreadable []string
+}
+
+// PruneBlob deletes the blob hash from the store, e.g. a blob known to be
+// corrupt beyond repair, so that a new backup stores its content again.
+// All snapshots of all projects are searched for references first; unless
+// force is set, PruneBlob refuses to delete a referenced blob, or one whose
+// references cannot be ruled out because a listing is unreadable, and
+// returns the references with the error. Unless dryRun is set it holds the
+// store lock like Prune.
+func (b *Backup) PruneBlob(hash string, force, dryRun bool) (PruneBlobResult, error) {
+	var result PruneBlobResult
+	if !b.Store.ValidHash(hash) {
+		return result, fmt.Errorf("invalid hash: %s", hash)
+	}
+	if !dryRun && !b.locked {
+		if err := b.Lock(); err != nil {
+			return result, err
+		}
+		defer b.Unlock()
+	}
+
+	size, err := b.Store.Blobs.Size(hash)
+	if errors.Is(err, fs.ErrNotExist) {
+		return result, fmt.Errorf("blob not found: %s", hash)
+	}
+	if err != nil {
+		return result, err
+	}
+	result.Bytes = size
+
+	roots, err := b.referencingRoots()
+	if err != nil {
+		return result, fmt.Errorf("cannot determine references of %s (run check): %w", hash, err)
+	}
+	result.References, result.Unreadable, err = b.LocateHash(hash, roots)
+	if err != nil {
+		return result, fmt.Errorf("cannot determine references of %s (run check): %w", hash, err)
+	}
+	if !force {
+		if len(result.References) > 0 {
+			return result, fmt.Errorf("blob %s is referenced by %d entries of snapshots (use --force to remove it anyway)", hash, len(result.References))
+		}
+		if len(result.Unreadable) > 0 {
+			return result, fmt.Errorf("cannot rule out references to %s: %d directory listings or chunk manifests are unreadable (use --force to remove it anyway)", hash, len(result.Unreadable))
+		}
+	}
+
+	if !dryRun {
+		if err := b.Store.Blobs.Delete(hash); err != nil {
+			return result, fmt.Errorf("failed to remove blob %s: %w", hash, err)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,222 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackup_Prune(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "sub/a.txt", "a")
+	root := snapshotTestBackup(t, b, "260101-100000")
+	orphan := b.Store.HashBytes([]byte("orphan"))
+	if _, err := b.Store.saveBlob(orphan, []byte("orphan")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another process holds the lock
+	other := &Backup{StoreRoot: b.StoreRoot}
+	if err := other.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Prune(false, 0); err == nil || !strings.Contains(err.Error(), "locked") {
+		t.Errorf("Expected prune to fail on a locked store, got %v", err)
+	}
+	if err := other.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := b.Prune(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.BlobsRemoved != 1 {
+		t.Errorf("Expected the orphan to be removed, got %+v", stats)
+	}
+	if _, err := os.Stat(b.stateLocation(lockName)); !os.IsNotExist(err) {
+		t.Error("Expected prune to release the lock it took")
+	}
+
+	// Without the listing of sub, a.txt cannot be told apart from an orphan
+	sub, err := root.Locate("sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	subHash := sub.Hash()
+	if err := os.Remove(b.Store.DataStore(subHash)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Store.saveBlob(orphan, []byte("orphan")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Prune(false, 0); err == nil || !strings.Contains(err.Error(), "missing directory listing") {
+		t.Errorf("Expected prune to refuse with a missing listing, got %v", err)
+	}
+	if _, err := os.Stat(b.Store.DataStore(orphan)); err != nil {
+		t.Errorf("Expected nothing to be pruned, got %v", err)
+	}
+}
+
+func TestBackup_PruneUnreadableHead(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "a.txt", "a")
+	root := snapshotTestBackup(t, b, "260101-100000")
+	orphan := b.Store.HashBytes([]byte("orphan"))
+	if _, err := b.Store.saveBlob(orphan, []byte("orphan")); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Dir(root.BackupHead)
+
+	// The blobs of a head that cannot be read would look unreferenced
+	unreadable := filepath.Join(dir, "260101-110000")
+	if err := os.Symlink("missing", unreadable); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Prune(false, 0); err == nil || !strings.Contains(err.Error(), "260101-110000") {
+		t.Errorf("Expected prune to refuse with an unreadable head, got %v", err)
+	}
+	if _, err := b.PruneBlob(orphan, false, false); err == nil || !strings.Contains(err.Error(), "260101-110000") {
+		t.Errorf("Expected prune-blob to refuse with an unreadable head, got %v", err)
+	}
+	if _, err := os.Stat(b.Store.DataStore(orphan)); err != nil {
+		t.Errorf("Expected nothing to be pruned, got %v", err)
+	}
+	if err := os.Remove(unreadable); err != nil {
+		t.Fatal(err)
+	}
+
+	// A damaged head references nothing and does not stop prune
+	if err := os.WriteFile(filepath.Join(dir, "260101-120000"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := b.Prune(false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.BlobsRemoved != 1 {
+		t.Errorf("Expected only the orphan to be removed, got %+v", stats)
+	}
+}
+
+func TestBackup_PruneBlob(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "sub/a.txt", "a")
+	snapshotTestBackup(t, b, "260101-100000")
+	orphan := b.Store.HashBytes([]byte("orphan"))
+	if _, err := b.Store.saveBlob(orphan, []byte("orphan")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := b.PruneBlob("xyz", false, false); err == nil || !strings.Contains(err.Error(), "invalid hash") {
+		t.Errorf("Expected an invalid hash error, got %v", err)
+	}
+	if _, err := b.PruneBlob(b.Store.HashBytes([]byte("none")), false, false); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Expected a missing blob error, got %v", err)
+	}
+
+	// A referenced blob is only removed with force
+	a := b.Store.HashBytes([]byte("a"))
+	result, err := b.PruneBlob(a, false, false)
+	if err == nil || !strings.Contains(err.Error(), "referenced") {
+		t.Errorf("Expected a referenced blob to be kept, got %v", err)
+	}
+	if len(result.References) != 1 || result.References[0].Path != "sub/a.txt" {
+		t.Errorf("Expected the reference of sub/a.txt, got %+v", result.References)
+	}
+	if _, err := os.Stat(b.Store.DataStore(a)); err != nil {
+		t.Errorf("Expected the referenced blob to be kept: %v", err)
+	}
+	if _, err := os.Stat(b.stateLocation(lockName)); !os.IsNotExist(err) {
+		t.Error("Expected PruneBlob to release the lock it took")
+	}
+	if _, err := b.PruneBlob(a, true, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(b.Store.DataStore(a)); err != nil {
+		t.Errorf("Expected a dry run to keep the blob: %v", err)
+	}
+	if result, err = b.PruneBlob(a, true, false); err != nil || len(result.References) != 1 {
+		t.Fatalf("Expected the referenced blob to be forced out, got %+v (%v)", result, err)
+	}
+	if _, err := os.Stat(b.Store.DataStore(a)); !os.IsNotExist(err) {
+		t.Errorf("Expected the blob to be removed, got %v", err)
+	}
+
+	result, err = b.PruneBlob(orphan, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Bytes == 0 || len(result.References) != 0 {
+		t.Errorf("Unexpected result %+v", result)
+	}
+	if _, err := os.Stat(b.Store.DataStore(orphan)); !os.IsNotExist(err) {
+		t.Errorf("Expected the orphan to be removed, got %v", err)
+	}
+}
+
+func TestBackup_PruneKeepUnreferenced(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "a.txt", "a")
+	snapshotTestBackup(t, b, "260101-100000")
+	saveOrphan := func(content string) string {
+		hash := b.Store.HashBytes([]byte(content))
+		if _, err := b.Store.saveBlob(hash, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+	old, recent := saveOrphan("old orphan"), saveOrphan("recent orphan")
+
+	// The grace period is a store setting
+	b.StoreConfig = &StoreConfig{KeepUnreferencedDays: 7}
+	if keep := b.KeepUnreferenced(); keep != 7*24*time.Hour {
+		t.Fatalf("Expected a grace period of 7 days, got %s", keep)
+	}
+
+	// The first prune only records when it found the blobs unreferenced
+	stats, err := b.Prune(false, b.KeepUnreferenced())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.BlobsRemoved != 0 || stats.BlobsKept != 2 {
+		t.Errorf("Expected both orphans to be kept, got %+v", stats)
+	}
+	since, err := LoadProperties(b.stateLocation(unreferencedName))
+	if err != nil || len(since) != 2 {
+		t.Fatalf("Expected both orphans to be recorded, got %v, %v", since, err)
+	}
+
+	// Once the grace period has passed, the blob is deleted
+	since[old] = time.Now().Add(-8 * 24 * time.Hour).Format(time.RFC3339)
+	if err := since.Store(b.stateLocation(unreferencedName), ""); err != nil {
+		t.Fatal(err)
+	}
+	if stats, err = b.Prune(true, 7*24*time.Hour); err != nil || stats.BlobsRemoved != 1 || stats.BlobsKept != 1 {
+		t.Errorf("Unexpected dry run %+v, %v", stats, err)
+	}
+	if _, err := os.Stat(b.Store.DataStore(old)); err != nil {
+		t.Errorf("Expected the dry run to keep the old orphan: %v", err)
+	}
+	if stats, err = b.Prune(false, 7*24*time.Hour); err != nil || stats.BlobsRemoved != 1 || stats.BlobsKept != 1 {
+		t.Errorf("Expected only the old orphan to be removed, got %+v, %v", stats, err)
+	}
+	if _, err := os.Stat(b.Store.DataStore(old)); !os.IsNotExist(err) {
+		t.Error("Expected the old orphan to be removed")
+	}
+	if _, err := os.Stat(b.Store.DataStore(recent)); err != nil {
+		t.Errorf("Expected the recent orphan to be kept: %v", err)
+	}
+
+	// A blob referenced again is forgotten
+	writeTestFile(t, b, "b.txt", "recent orphan")
+	snapshotTestBackup(t, b, "260101-110000")
+	if stats, err = b.Prune(false, 7*24*time.Hour); err != nil || stats.BlobsKept != 0 {
+		t.Errorf("Expected no unreferenced blobs, got %+v, %v", stats, err)
+	}
+	if _, err := os.Stat(b.stateLocation(unreferencedName)); !os.IsNotExist(err) {
+		t.Errorf("Expected the record of unreferenced blobs to be removed: %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// RefStore holds the snapshot heads and their metadata sidecars: small
+// files named by slash separated paths below the snapshots directory. A
+// head is named "<project>/<timestamp>" and holds the hash of the
+// snapshot's top directory followed by a newline. Missing refs are
+// reported with errors matching fs.ErrNotExist.
+type RefStore interface {
+	// List returns the entries of the directory dir, "" for the top.
+	List(dir string) ([]fs.DirEntry, error)
+	Read(name string) ([]byte, error)
+	// Write replaces the ref name with data, creating its directory. The
+	// ref only becomes visible once it is complete.
+	Write(name string, data []byte) error
+	Delete(name string) error
+	// Rename moves the ref or directory oldName to newName, which must not
+	// exist.
+	Rename(oldName, newName string) error
+}
+
+// localRefStore keeps the refs in the snapshots directory of the store.
+type localRefStore struct {
+	dir string
+}
+
+func (l *localRefStore) path(name string) string {
+	return filepath.Join(l.dir, filepath.FromSlash(name))
+}
+
+func (l *localRefStore) List(dir string) ([]fs.DirEntry, error) {
+	return os.ReadDir(l.path(dir))
+}
+
+func (l *localRefStore) Read(name string) ([]byte, error) {
+	return os.ReadFile(l.path(name))
+}
+
+// Write writes data to a partial file next to the ref and renames it into
+// place.
+func (l *localRefStore) Write(name string, data []byte) error {
+	dest := l.path(name)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	f, err := createPartial(dest)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), dest)
+}
+
+func (l *localRefStore) Delete(name string) error {
+	return os.Remove(l.path(name))
+}
+
+func (l *localRefStore) Rename(oldName, newName string) error {
+	if _, err := os.Lstat(l.path(newName)); err == nil {
+		return fs.ErrExist
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return os.Rename(l.path(oldName), l.path(newName))
+}
+
+// refs returns the store's RefStore, the snapshots directory unless
+// store.toml names a remote location.
+func (b *Backup) refs() RefStore {
+	if b.Refs == nil {
+		return &localRefStore{dir: b.StoreSnapshots}
+	}
+	return b.Refs
+}
+
+// refExists reports whether the ref or directory name exists.
+func (b *Backup) refExists(name string) (bool, error) {
+	dir := path.Dir(name)
+	if dir == "." {
+		dir = ""
+	}
+	entries, err := b.refs().List(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		if e.Name() == path.Base(name) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+
+	"github.com/pkg/sftp"
+)
+
+// sftpRefStore keeps the refs in a directory of an SFTP server, with the
+// same layout as the snapshots directory of a local store.
+type sftpRefStore struct {
+	client *sftp.Client
+	root   string
+}
+
+func (r *sftpRefStore) path(name string) string {
+	return path.Join(r.root, name)
+}
+
+func (r *sftpRefStore) List(dir string) ([]fs.DirEntry, error) {
+	infos, err := r.client.ReadDir(r.path(dir))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]fs.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = fs.FileInfoToDirEntry(info)
+	}
+	return entries, nil
+}
+
+func (r *sftpRefStore) Read(name string) ([]byte, error) {
+	f, err := r.client.Open(r.path(name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// Write uploads data to a partial file next to the ref and renames it into
+// place. Servers without the posix-rename extension cannot rename over an
+// existing ref, which is removed first.
+func (r *sftpRefStore) Write(name string, data []byte) error {
+	dest := r.path(name)
+	temp, err := sftpUpload(nil, r.client, dest, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if err := r.client.PosixRename(temp, dest); err == nil {
+		return nil
+	}
+	if err := r.client.Remove(dest); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		r.client.Remove(temp)
+		return err
+	}
+	if err := r.client.Rename(temp, dest); err != nil {
+		r.client.Remove(temp)
+		return err
+	}
+	return nil
+}
+
+func (r *sftpRefStore) Delete(name string) error {
+	return r.client.Remove(r.path(name))
+}
+
+func (r *sftpRefStore) Rename(oldName, newName string) error {
+	if _, err := r.client.Lstat(r.path(newName)); err == nil {
+		return fs.ErrExist
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return r.client.Rename(r.path(oldName), r.path(newName))
+}
+
+// sftpStateFiles keeps the state files in the .backup directory of a store
+// on an SFTP server.
+type sftpStateFiles struct {
+	sftpRefStore
+}
+
+// Create opens the file with O_EXCL, which SFTP servers pass on to
+// open(2), so only one of several hosts creating it succeeds.
+func (r *sftpStateFiles) Create(name string, data []byte) error {
+	dest := r.path(name)
+	if err := r.client.MkdirAll(path.Dir(dest)); err != nil {
+		return err
+	}
+	f, err := r.client.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		// SFTP reports most failures as a generic failure status
+		if _, serr := r.client.Lstat(dest); serr == nil {
+			return fs.ErrExist
+		}
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		r.client.Remove(dest)
+	}
+	return err
+}
@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSFTPRefStore(t *testing.T) {
+	b, client := newTestSFTPBackup(t)
+	b.Refs = &sftpRefStore{client: client, root: "/backup/snapshots"}
+	b.HashCache.file = filepath.Join(t.TempDir(), "hash-cache")
+	writeTestFile(t, b, "a.txt", "a")
+
+	b.Message = "first"
+	first, _, err := b.CreateSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Stat("/backup/snapshots/test/" + first.Timestamp()); err != nil {
+		t.Errorf("Snapshot head not on the server: %v", err)
+	}
+	if files, _ := os.ReadDir(filepath.Join(b.StoreSnapshots, "test")); len(files) != 0 {
+		t.Errorf("Expected no local snapshot heads, got %d", len(files))
+	}
+
+	// Heads of the same second get a counter suffix, like local ones
+	now := time.Date(2026, 1, 1, 10, 0, 0, 0, time.Local)
+	h, _ := first.Hash()
+	for _, want := range []string{"260101-100000", "260101-100000-1"} {
+		if name, err := b.WriteSnapshotHead(b.ProjectName, now, h); err != nil || name != want {
+			t.Errorf("Expected head %s, got %s, %v", want, name, err)
+		}
+	}
+
+	roots, err := b.BackupRoots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 3 {
+		t.Fatalf("Expected 3 snapshots, got %v", roots)
+	}
+	found, err := b.FindBackupRoot(first.Timestamp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Meta == nil || found.Meta.Message != "first" {
+		t.Errorf("Expected the metadata to be read from the server, got %+v", found.Meta)
+	}
+	if errs := b.Verify(true); len(errs) != 0 {
+		t.Errorf("Unexpected verify errors: %v", errs)
+	}
+
+	b.BackupConfigDir = filepath.Join(b.Top, ".backup")
+	writeTestFile(t, b, ".backup/config.toml", "name = \"test\"\n")
+	if err := b.RenameProject("test", "renamed", false); err != nil {
+		t.Fatal(err)
+	}
+	if roots, _ := b.BackupRoots(); len(roots) != 3 {
+		t.Errorf("Expected 3 snapshots after the rename, got %v", roots)
+	}
+	found, err = b.FindBackupRoot(first.Timestamp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := found.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Stat("/backup/snapshots/renamed/" + first.Timestamp() + snapshotMetaExt); err == nil {
+		t.Error("Expected the metadata to be removed with the head")
+	}
+	if roots, _ := b.BackupRoots(); len(roots) != 2 {
+		t.Errorf("Expected 2 snapshots after removing one, got %v", roots)
+	}
+}
@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// RepairResult lists the blobs handled by Repair.
+type RepairResult struct {
+	Healed        []string
+	Unrecoverable []string
+}
+
+// OpenStore opens the store at dir, a path or a store URL, for reading
+// blobs, e.g. as the source of a repair. Unlike NewBackup it never creates
+// or modifies anything in a local store.
+func OpenStore(dir string) (*Backup, error) {
+	if IsStoreURL(dir) {
+		b := &Backup{StoreURL: dir}
+		if err := b.openStoreURL(); err != nil {
+			return nil, err
+		}
+		return b.openStoreConfig(dir)
+	}
+	dir, err := ExpandPath(dir)
+	if err != nil {
+		return nil, err
+	}
+	if dir, err = CanonicalPath(dir); err != nil {
+		return nil, err
+	}
+	b := &Backup{
+		StoreRoot:      dir,
+		StoreData:      filepath.Join(dir, "data"),
+		StoreSnapshots: filepath.Join(dir, "snapshots"),
+		StoreConfig:    &StoreConfig{},
+	}
+	if info, err := os.Stat(b.StoreData); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("not a backup store: %s", dir)
+	}
+	storeTomlPath := filepath.Join(dir, ".backup", "store.toml")
+	if _, err := os.Stat(storeTomlPath); err == nil {
+		if b.StoreConfig, err = LoadStoreConfig(storeTomlPath); err != nil {
+			return nil, fmt.Errorf("failed to load store config from %s: %v", storeTomlPath, err)
+		}
+	}
+	return b.openStoreConfig(storeTomlPath)
+}
+
+// openStoreConfig validates the store configuration loaded from
+// storeTomlPath and sets up the store of b.
+func (b *Backup) openStoreConfig(storeTomlPath string) (*Backup, error) {
+	if _, err := LookupHashFunc(b.StoreConfig.Hash); err != nil {
+		return nil, fmt.Errorf("invalid store config %s: %w", storeTomlPath, err)
+	}
+	if _, err := LookupCodec(b.StoreConfig.Compression); err != nil {
+		return nil, fmt.Errorf("invalid store config %s: %w", storeTomlPath, err)
+	}
+	if _, _, err := b.StoreConfig.Shards(); err != nil {
+		return nil, fmt.Errorf("invalid store config %s: %w", storeTomlPath, err)
+	}
+	if _, _, err := b.StoreConfig.IORetry(); err != nil {
+		return nil, fmt.Errorf("invalid store config %s: %w", storeTomlPath, err)
+	}
+	if _, err := b.StoreConfig.KeepUnreferenced(); err != nil {
+		return nil, fmt.Errorf("invalid store config %s: %w", storeTomlPath, err)
+	}
+	b.Store = NewStore(b)
+	if err := b.setupStore(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Repair copies the missing, empty and corrupted blobs reachable from the
+// snapshots of b from the store of from. Copies are verified against their
+// hash before they replace anything. Healed directory listings and chunk
+// manifests can reference further damaged blobs, so the snapshots are
+// checked again until no more blobs can be healed.
+func (b *Backup) Repair(from *Backup, deep bool) (RepairResult, error) {
+	var result RepairResult
+	if from.Store.HashName != b.Store.HashName {
+		return result, fmt.Errorf("stores use different hash algorithms (%s and %s)", b.Store.HashName, from.Store.HashName)
+	}
+
+	tried := make(map[string]bool)
+	for {
+		var damaged []string
+		for _, err := range b.verifyRoots(deep) {
+			if hash, ok := damagedBlob(err); ok && !tried[hash] {
+				tried[hash] = true
+				damaged = append(damaged, hash)
+			}
+		}
+		if len(damaged) == 0 {
+			return result, nil
+		}
+		for _, hash := range damaged {
+			if err := b.Store.copyBlobFrom(from.Store, hash); err != nil {
+				b.warnf("cannot heal blob %s: %v", hash, err)
+				result.Unrecoverable = append(result.Unrecoverable, hash)
+				continue
+			}
+			result.Healed = append(result.Healed, hash)
+		}
+	}
+}
+
+// damagedBlob returns the hash of the missing or corrupted blob err reports.
+func damagedBlob(err error) (string, bool) {
+	var missing *MissingBlobError
+	if errors.As(err, &missing) {
+		return missing.Hash, true
+	}
+	var corrupt *CorruptBlobError
+	if errors.As(err, &corrupt) {
+		return corrupt.Hash, true
+	}
+	return "", false
+}
+
+// copyBlobFrom copies the blob hash from the store src, recompressing it
+// if the stores use different codecs. The content is verified before it
+// replaces the blob in s.
+func (s *Store) copyBlobFrom(src *Store, hash string) error {
+	r, err := src.openBlob(hash)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	temp, got, _, err := s.writeHashed(r)
+	if err != nil {
+		return err
+	}
+	if got != hash {
+		os.Remove(temp)
+		return fmt.Errorf("hash mismatch in source store: got %s", got)
+	}
+	return s.commitTemp(temp, hash)
+}
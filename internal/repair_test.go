@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"os"
+	"testing"
+)
+
+func TestRepair(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "a.txt", "a")
+	writeTestFile(t, b, "sub/b.txt", "b")
+	root := snapshotTestBackup(t, b, "260101-100000")
+
+	// A second store with the same content, compressed differently
+	mirror := newTestBackup(t)
+	mirror.Top = b.Top
+	mirror.HashCache = &HashCache{top: b.Top, cache: make(Properties)}
+	mirror.Store.Codec = codecs["zstd"]
+	snapshotTestBackup(t, mirror, "260101-100000")
+
+	writeTestFile(t, b, "c.txt", "only in the damaged store")
+	snapshotTestBackup(t, b, "260102-100000")
+
+	sub, err := root.Locate("sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aHash := b.Store.HashBytes([]byte("a"))
+	bHash := b.Store.HashBytes([]byte("b"))
+	cHash := b.Store.HashBytes([]byte("only in the damaged store"))
+	// b.txt is only found to be missing once the sub listing is healed
+	for _, h := range []string{sub.Hash(), bHash, cHash} {
+		if err := os.Remove(b.Store.DataStore(h)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(b.Store.DataStore(aHash), []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := b.Repair(mirror, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Healed) != 3 {
+		t.Errorf("Expected 3 healed blobs, got %v", result.Healed)
+	}
+	if len(result.Unrecoverable) != 1 || result.Unrecoverable[0] != cHash {
+		t.Errorf("Expected %s to be unrecoverable, got %v", cHash, result.Unrecoverable)
+	}
+
+	errs := b.verifyRoots(true)
+	if len(errs) != 1 {
+		t.Fatalf("Expected only the unrecoverable blob to be reported, got %v", errs)
+	}
+	if be, ok := errs[0].(*MissingBlobError); !ok || be.Hash != cHash {
+		t.Errorf("Expected a blob error for %s, got %v", cHash, errs[0])
+	}
+
+	sha := newTestBackup(t)
+	sha.Store.HashName = "sha256"
+	if _, err := b.Repair(sha, false); err == nil {
+		t.Error("Expected repair from a store with another hash algorithm to fail")
+	}
+}
@@ -0,0 +1,417 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// RestoreConflictError is returned by Restore when existing paths would be
+// overwritten and Force is not set.
+type RestoreConflictError struct {
+	Paths []string
+}
+
+func (e *RestoreConflictError) Error() string {
+	return fmt.Sprintf("%d existing paths would be overwritten; use --force to overwrite them", len(e.Paths))
+}
+
+// RestoreFailedError is returned by Restore with ContinueOnError when some
+// paths could not be restored; everything else was.
+type RestoreFailedError struct {
+	Failures []FailedFile
+}
+
+func (e *RestoreFailedError) Error() string {
+	return fmt.Sprintf("%d paths could not be restored", len(e.Failures))
+}
+
+// Restore restores pathInside (or the whole tree when empty) of the named
+// snapshot to dest. From a source directory a relative pathInside is taken
+// relative to the current working directory, and dest defaults to the
+// current directory or, for a single path, to its name. Without a source
+// directory dest is required. With opts.DryRun the paths that would be
+// written are printed instead.
+func (b *Backup) Restore(snapshotName, pathInside, dest string, opts RestoreOptions) error {
+	_, entry, rel, err := b.locateRestoreEntry(snapshotName, pathInside)
+	if err != nil {
+		return err
+	}
+
+	if dest == "" {
+		if b.Top == "" {
+			return fmt.Errorf("destination required when not running from source directory")
+		}
+		// Relative to the current directory
+		dest = "."
+		if pathInside != "" {
+			dest = entry.Name()
+		}
+	}
+
+	if err := checkRestoreDest(dest); err != nil {
+		return err
+	}
+	if !opts.CaseInsensitive {
+		opts.CaseInsensitive = caseInsensitiveDest(dest, opts.DryRun)
+	}
+	if opts.PreserveOwner {
+		if err := checkPreserveOwner(); err != nil {
+			b.warnf("%v; restoring without owners", err)
+			opts.PreserveOwner = false
+		}
+	}
+
+	// Filter patterns are relative to the top of the snapshot
+	opts.rel = rel
+
+	units := []restoreUnit{{entry, dest, opts}}
+	if opts.StripComponents > 0 {
+		if units, err = stripComponents(entry, dest, opts); err != nil {
+			return err
+		}
+	}
+
+	b.infof("Restoring %s from %s to %s...", pathInside, snapshotName, dest)
+	if opts.DryRun {
+		var targets []RestoreTarget
+		for _, u := range units {
+			found, err := restoreTargets(u.entry, u.dest, u.opts)
+			if err != nil {
+				return fmt.Errorf("failed to list restore targets: %w", err)
+			}
+			targets = append(targets, found...)
+		}
+		existing := 0
+		for _, t := range targets {
+			name := t.Path
+			if _, ok := t.Entry.(*BackupDirectory); ok {
+				name += string(filepath.Separator)
+			}
+			if t.Exists {
+				existing++
+				b.infof("[dry-run] Would restore %s (exists)", name)
+			} else {
+				b.infof("[dry-run] Would restore %s", name)
+			}
+		}
+		b.infof("[dry-run] %d paths, %d already exist", len(targets), existing)
+		return nil
+	}
+
+	if !opts.Force {
+		var conflicts []string
+		for _, u := range units {
+			found, err := restoreConflicts(u.entry, u.dest, u.opts)
+			if err != nil {
+				return fmt.Errorf("failed to check restore destination: %w", err)
+			}
+			conflicts = append(conflicts, found...)
+		}
+		if len(conflicts) > 0 {
+			return &RestoreConflictError{Paths: conflicts}
+		}
+	}
+
+	// Hardlinks are re-created among the files of all units
+	hardlinks := make(map[string]string)
+	var failed []FailedFile
+	for _, u := range units {
+		u.opts.hardlinks = hardlinks
+		if opts.ContinueOnError {
+			u.opts.failed = &failed
+		}
+		if err := u.entry.Restore(u.dest, u.opts); err != nil {
+			if err := u.opts.fail(u.dest, err); err != nil {
+				return fmt.Errorf("restore failed: %w", err)
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return &RestoreFailedError{Failures: failed}
+	}
+	b.infof("Restore complete.")
+	return nil
+}
+
+// RestoreTar writes pathInside of the snapshot to w as a tar stream
+// instead of restoring it to disk, e.g. to pipe it into tar -x. The top of
+// the snapshot is written as its contents, any other path under its base
+// name, like a restore to the default destination.
+func (b *Backup) RestoreTar(snapshotName, pathInside string, w io.Writer) error {
+	root, entry, rel, err := b.locateRestoreEntry(snapshotName, pathInside)
+	if err != nil {
+		return err
+	}
+	if dir, ok := entry.(*BackupDirectory); ok && rel == "" {
+		return b.ExportTar(dir, w, root.Time)
+	}
+	return b.ExportEntryTar(entry, w, root.Time)
+}
+
+// locateRestoreEntry finds pathInside in the snapshot and returns it along
+// with its slash-separated path from the top of the snapshot.
+func (b *Backup) locateRestoreEntry(snapshotName, pathInside string) (*BackupRoot, BackupEntry, string, error) {
+	root, err := b.FindBackupRoot(snapshotName)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("snapshot not found: %s", snapshotName)
+	}
+
+	// Paths typed in a subdirectory of the source are relative to it, as
+	// with tar or git
+	resolvedPathInside := pathInside
+	if b.Top != "" && pathInside != "" && !filepath.IsAbs(pathInside) {
+		relCwd, err := filepath.Rel(b.Top, b.CurrentWorkingDir)
+		if err == nil && relCwd != "." {
+			resolvedPathInside = filepath.Join(relCwd, pathInside)
+		}
+	}
+
+	entry, err := root.Locate(resolvedPathInside)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to locate path '%s' (resolved: '%s') in snapshot: %w", pathInside, resolvedPathInside, err)
+	}
+	if entry == nil {
+		return nil, nil, "", fmt.Errorf("path '%s' not found in snapshot %s", resolvedPathInside, snapshotName)
+	}
+
+	rel := strings.TrimPrefix(filepath.ToSlash(filepath.Clean(resolvedPathInside)), "/")
+	if rel == "." {
+		rel = ""
+	}
+	return root, entry, rel, nil
+}
+
+// restoreUnit is an entry restored to dest with its own options.
+type restoreUnit struct {
+	entry BackupEntry
+	dest  string
+	opts  RestoreOptions
+}
+
+// stripComponents returns the units restoring the entries opts.StripComponents
+// levels below the directory entry directly into dest. It fails if two
+// entries would be restored to the same path, unless both are directories,
+// which are merged.
+func stripComponents(entry BackupEntry, dest string, opts RestoreOptions) ([]restoreUnit, error) {
+	if _, ok := entry.(*BackupDirectory); !ok {
+		return nil, fmt.Errorf("--strip-components needs a directory to restore, %s is not one", entry.Name())
+	}
+	level := []restoreUnit{{entry, dest, opts}}
+	for i := 0; i <= opts.StripComponents; i++ {
+		var next []restoreUnit
+		for _, u := range level {
+			dir, ok := u.entry.(*BackupDirectory)
+			if !ok {
+				continue // Not deep enough, like tar
+			}
+			inner, err := u.opts.enter(dir)
+			if err != nil {
+				return nil, err
+			}
+			entries, err := dir.Entries()
+			if err != nil {
+				return nil, err
+			}
+			// By name, so that collisions are reported in path order
+			for _, name := range slices.Sorted(maps.Keys(entries)) {
+				child := entries[name]
+				childOpts := inner
+				childOpts.rel = path.Join(u.opts.rel, name)
+				if !opts.Filter.restores(child, childOpts.rel) {
+					continue
+				}
+				next = append(next, restoreUnit{child, filepath.Join(dest, name), childOpts})
+			}
+		}
+		level = next
+	}
+
+	// Paths of the snapshot restored to each destination, to report
+	// collisions
+	restoredFrom := make(map[string]string)
+	isDir := make(map[string]bool)
+	for _, u := range level {
+		targets, err := restoreTargets(u.entry, u.dest, u.opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range targets {
+			_, dir := t.Entry.(*BackupDirectory)
+			rel, _ := filepath.Rel(u.dest, t.Path)
+			from := path.Join(u.opts.rel, filepath.ToSlash(rel))
+			key := t.Path
+			if opts.CaseInsensitive {
+				key = strings.ToLower(key)
+			}
+			if other, ok := restoredFrom[key]; ok && !(dir && isDir[key]) {
+				return nil, fmt.Errorf("--strip-components %d restores both %s and %s to %s", opts.StripComponents, other, from, t.Path)
+			}
+			restoredFrom[key] = from
+			isDir[key] = dir
+		}
+	}
+	return level, nil
+}
+
+// RestoreFilter selects the paths restored from a snapshot with patterns in
+// .gitignore syntax, relative to the top of the snapshot. A path matching
+// an exclude pattern, or inside a directory that does, is not restored.
+// With include patterns only the paths matching one of them, or inside a
+// directory that does, are restored, along with the directories leading to
+// them.
+type RestoreFilter struct {
+	exclude *IgnoreMatcher
+	include *IgnoreMatcher
+}
+
+// filterRoot anchors the snapshot paths matched by a RestoreFilter.
+var filterRoot = string(filepath.Separator)
+
+// NewRestoreFilter returns a filter for the given patterns, or nil if there
+// are none.
+func NewRestoreFilter(excludes, includes []string) *RestoreFilter {
+	if len(excludes) == 0 && len(includes) == 0 {
+		return nil
+	}
+	f := &RestoreFilter{}
+	if len(excludes) > 0 {
+		f.exclude = NewIgnoreMatcher(filterRoot, nil)
+		for _, p := range excludes {
+			f.exclude.AddPattern(p, "--exclude")
+		}
+	}
+	if len(includes) > 0 {
+		f.include = NewIgnoreMatcher(filterRoot, nil)
+		for _, p := range includes {
+			f.include.AddPattern(p, "--include")
+		}
+	}
+	return f
+}
+
+func (f *RestoreFilter) match(m *IgnoreMatcher, rel string, isDir bool) bool {
+	matched, _ := m.Match(filepath.Join(filterRoot, filepath.FromSlash(rel)), isDir)
+	return matched
+}
+
+// includes reports whether the path rel of the snapshot is selected by the
+// include patterns. The top of the snapshot always is.
+func (f *RestoreFilter) includes(rel string, isDir bool) bool {
+	if f == nil || f.include == nil || rel == "" {
+		return true
+	}
+	return f.match(f.include, rel, isDir)
+}
+
+// restores reports whether entry, at rel in the snapshot, is restored.
+// Directories that are not excluded are visited for the paths below them
+// that are included.
+func (f *RestoreFilter) restores(entry BackupEntry, rel string) bool {
+	if f == nil {
+		return true
+	}
+	_, isDir := entry.(*BackupDirectory)
+	if f.exclude != nil && f.match(f.exclude, rel, isDir) {
+		return false
+	}
+	return isDir || f.includes(rel, false)
+}
+
+// caseInsensitiveDest reports whether dest, or the closest existing
+// directory above it, is on a filesystem that ignores case in names. A
+// probe file is created in that directory and looked up under its name
+// with the case swapped, since a directory may be the mount point of a
+// filesystem other than its parent's. A dry run writes nothing, so it
+// looks up the names already in the directory instead, and assumes a
+// case-sensitive filesystem if none of them has a letter.
+func caseInsensitiveDest(dest string, dryRun bool) bool {
+	abs, err := filepath.Abs(dest)
+	if err != nil {
+		return false
+	}
+	for dir := abs; ; dir = filepath.Dir(dir) {
+		if info, err := os.Stat(dir); err == nil {
+			if !info.IsDir() {
+				return false
+			}
+			if dryRun {
+				return caseInsensitiveEntries(dir)
+			}
+			f, err := os.CreateTemp(dir, ".backup-case-probe-*")
+			if err != nil {
+				return false
+			}
+			f.Close()
+			defer os.Remove(f.Name())
+			return sameCaseSwapped(dir, filepath.Base(f.Name()))
+		}
+		if filepath.Dir(dir) == dir {
+			return false
+		}
+	}
+}
+
+// caseInsensitiveEntries looks up the first entry of dir with a letter in
+// its name under the name with the case swapped.
+func caseInsensitiveEntries(dir string) bool {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	for _, e := range entries {
+		if swapCase(e.Name()) != e.Name() {
+			return sameCaseSwapped(dir, e.Name())
+		}
+	}
+	return false
+}
+
+// sameCaseSwapped reports whether name in dir is found under its name with
+// the case swapped as the same file.
+func sameCaseSwapped(dir, name string) bool {
+	info, err := os.Lstat(filepath.Join(dir, name))
+	if err != nil {
+		return false
+	}
+	other, err := os.Lstat(filepath.Join(dir, swapCase(name)))
+	return err == nil && os.SameFile(info, other)
+}
+
+func swapCase(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsUpper(r) {
+			return unicode.ToLower(r)
+		}
+		return unicode.ToUpper(r)
+	}, s)
+}
+
+// checkRestoreDest makes sure the directories leading to dest can be
+// created: the closest existing ancestor of dest must be a directory.
+// Missing directories on the way are created by the restore.
+func checkRestoreDest(dest string) error {
+	abs, err := filepath.Abs(dest)
+	if err != nil {
+		return err
+	}
+	for dir := filepath.Dir(abs); ; dir = filepath.Dir(dir) {
+		info, err := os.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("cannot restore to %s: %s exists and is not a directory", dest, dir)
+			}
+			return nil
+		}
+		// Missing, or below a file (ENOTDIR): look further up
+		if parent := filepath.Dir(dir); parent == dir {
+			return nil
+		}
+	}
+}
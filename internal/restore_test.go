@@ -0,0 +1,541 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackup_Restore(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "sub/a.txt", "a")
+	writeTestFile(t, b, "sub/b.txt", "b")
+	root := snapshotTestBackup(t, b, "260101-100000")
+
+	// A relative path is resolved against the current directory
+	b.CurrentWorkingDir = filepath.Join(b.Top, "sub")
+	dest := filepath.Join(t.TempDir(), "a.txt")
+	if err := b.Restore(root.Timestamp(), "a.txt", dest, RestoreOptions{DryRun: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Error("Dry run restored a file")
+	}
+	if err := b.Restore(root.Timestamp(), "a.txt", dest, RestoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(dest); string(content) != "a" {
+		t.Errorf("Unexpected restored content %q", content)
+	}
+
+	err := b.Restore(root.Timestamp(), "a.txt", dest, RestoreOptions{})
+	var conflict *RestoreConflictError
+	if !errors.As(err, &conflict) || len(conflict.Paths) != 1 || conflict.Paths[0] != dest {
+		t.Errorf("Expected a conflict for %s, got %v", dest, err)
+	}
+
+	if err := b.Restore(root.Timestamp(), "missing.txt", dest, RestoreOptions{}); err == nil {
+		t.Error("Expected restoring a missing path to fail")
+	}
+
+	// Without a source directory the destination is required
+	b.Top = ""
+	if err := b.Restore(root.Timestamp(), "", "", RestoreOptions{}); err == nil {
+		t.Error("Expected a missing destination to fail")
+	}
+}
+
+func TestRestore_PreservePerms(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permission bits are not supported on Windows")
+	}
+	b := newTestBackup(t)
+	writeTestFile(t, b, "private/key", "secret")
+	writeTestFile(t, b, "script.sh", "#!/bin/sh")
+	for p, mode := range map[string]os.FileMode{"private/key": 0600, "private": 0700, "script.sh": 0755} {
+		if err := os.Chmod(filepath.Join(b.Top, filepath.FromSlash(p)), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := snapshotTestBackup(t, b, "260101-100000")
+	top, err := root.TopDirectory()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain := filepath.Join(t.TempDir(), "plain")
+	if err := top.Restore(plain, RestoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(filepath.Join(plain, "script.sh")); info.Mode().Perm() == 0755 {
+		t.Error("Permissions were restored without PreservePerms")
+	}
+
+	dest := filepath.Join(t.TempDir(), "perms")
+	if err := top.Restore(dest, RestoreOptions{PreservePerms: true}); err != nil {
+		t.Fatal(err)
+	}
+	for p, want := range map[string]os.FileMode{"private/key": 0600, "private": 0700, "script.sh": 0755} {
+		info, err := os.Stat(filepath.Join(dest, filepath.FromSlash(p)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != want {
+			t.Errorf("%s: expected mode %o, got %o", p, want, info.Mode().Perm())
+		}
+	}
+}
+
+func TestBackup_RestoreNestedDest(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "sub/a.txt", "a")
+	writeTestFile(t, b, "sub/deeper/b.txt", "b")
+	root := snapshotTestBackup(t, b, "260101-100000")
+	out := t.TempDir()
+
+	// Missing directories on the way are created
+	for _, p := range []string{"sub", "sub/a.txt"} {
+		dest := filepath.Join(out, "x", "y", "z", filepath.Base(p))
+		if err := b.Restore(root.Timestamp(), p, dest, RestoreOptions{}); err != nil {
+			t.Fatalf("restore %s: %v", p, err)
+		}
+	}
+	if content, _ := os.ReadFile(filepath.Join(out, "x", "y", "z", "sub", "deeper", "b.txt")); string(content) != "b" {
+		t.Errorf("Unexpected restored content %q", content)
+	}
+	if content, _ := os.ReadFile(filepath.Join(out, "x", "y", "z", "a.txt")); string(content) != "a" {
+		t.Errorf("Unexpected restored content %q", content)
+	}
+
+	// A file in the way is named in the error, also for dry runs
+	blocker := filepath.Join(out, "file")
+	if err := os.WriteFile(blocker, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(blocker, "new", "sub")
+	for _, opts := range []RestoreOptions{{}, {DryRun: true}, {Force: true}} {
+		err := b.Restore(root.Timestamp(), "sub", dest, opts)
+		if err == nil || !strings.Contains(err.Error(), blocker+" exists and is not a directory") {
+			t.Errorf("Expected an error naming %s with %+v, got %v", blocker, opts, err)
+		}
+	}
+}
+
+func TestRestore_Filter(t *testing.T) {
+	b := newTestBackup(t)
+	for _, p := range []string{"docs/a.md", "docs/b.txt", "docs/old/c.md", "src/main.go", "src/gen/x.md", "empty/e.txt"} {
+		writeTestFile(t, b, p, p)
+	}
+	root := snapshotTestBackup(t, b, "260101-100000")
+
+	restored := func(dest string) []string {
+		t.Helper()
+		var paths []string
+		filepath.WalkDir(dest, func(p string, d os.DirEntry, err error) error {
+			if err == nil && p != dest {
+				rel, _ := filepath.Rel(dest, p)
+				paths = append(paths, filepath.ToSlash(rel))
+			}
+			return nil
+		})
+		return paths
+	}
+
+	// Only matching files, with the directories leading to them
+	dest := filepath.Join(t.TempDir(), "out")
+	filter := NewRestoreFilter([]string{"old/"}, []string{"*.md"})
+	if err := b.Restore(root.Timestamp(), "", dest, RestoreOptions{Filter: filter}); err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(restored(dest), " ")
+	if want := "docs docs/a.md src src/gen src/gen/x.md"; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+
+	// An included directory is restored as a whole; the dry run agrees
+	dest = filepath.Join(t.TempDir(), "out")
+	opts := RestoreOptions{Filter: NewRestoreFilter([]string{"/src/gen"}, []string{"docs/", "/src"})}
+	if err := b.Restore(root.Timestamp(), "", dest, opts); err != nil {
+		t.Fatal(err)
+	}
+	got = strings.Join(restored(dest), " ")
+	if want := "docs docs/a.md docs/b.txt docs/old docs/old/c.md src src/main.go"; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	top, err := root.TopDirectory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets, err := restoreTargets(top, dest, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 8 {
+		t.Errorf("Expected the top and 7 paths as targets, got %d", len(targets))
+	}
+
+	// Patterns are relative to the top of the snapshot, also for a subtree
+	dest = filepath.Join(t.TempDir(), "docs")
+	if err := b.Restore(root.Timestamp(), "docs", dest, RestoreOptions{Filter: NewRestoreFilter([]string{"/docs/old"}, nil)}); err != nil {
+		t.Fatal(err)
+	}
+	got = strings.Join(restored(dest), " ")
+	if want := "a.md b.txt"; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestRestore_Xattrs(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "sub/a.txt", "a")
+	path := filepath.Join(b.Top, "sub", "a.txt")
+	want := map[string][]byte{"user.backup.test": []byte("value")}
+	if err := writeXattrs(path, want); err != nil {
+		t.Skipf("extended attributes not supported: %v", err)
+	}
+	if err := writeXattrs(filepath.Join(b.Top, "sub"), want); err != nil {
+		t.Fatal(err)
+	}
+	plain := snapshotTestBackup(t, b, "260101-100000")
+	b.StoreConfig = &StoreConfig{Xattrs: true}
+	root := snapshotTestBackup(t, b, "260101-100001")
+
+	for _, r := range []*BackupRoot{plain, root} {
+		entry, err := r.Locate("sub/a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorded := entry.Attrs().Xattrs
+		if r == plain && recorded != nil {
+			t.Errorf("Expected no extended attributes without the store setting, got %q", recorded)
+		}
+		if r == root && !reflect.DeepEqual(recorded, want) {
+			t.Errorf("Expected recorded extended attributes %q, got %q", want, recorded)
+		}
+	}
+
+	top, err := root.TopDirectory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(t.TempDir(), "xattrs")
+	if err := top.Restore(dest, RestoreOptions{PreservePerms: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"sub", "sub/a.txt"} {
+		got, err := readXattrs(filepath.Join(dest, filepath.FromSlash(p)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected extended attributes %q, got %q", p, want, got)
+		}
+	}
+}
+
+func TestBackup_RestoreStripComponents(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "top.txt", "top")
+	writeTestFile(t, b, "a/x/1.txt", "1")
+	writeTestFile(t, b, "a/y/2.txt", "2")
+	writeTestFile(t, b, "b/x/3.txt", "3")
+	root := snapshotTestBackup(t, b, "260101-100000")
+
+	exists := func(dest string, want []string, missing ...string) {
+		t.Helper()
+		for _, p := range want {
+			if _, err := os.Stat(filepath.Join(dest, filepath.FromSlash(p))); err != nil {
+				t.Errorf("Expected %s to be restored: %v", p, err)
+			}
+		}
+		for _, p := range missing {
+			if _, err := os.Lstat(filepath.Join(dest, filepath.FromSlash(p))); err == nil {
+				t.Errorf("Expected %s not to be restored", p)
+			}
+		}
+	}
+
+	// Directories of the same name are merged; top.txt is too shallow
+	dest := filepath.Join(t.TempDir(), "one")
+	if err := b.Restore(root.Timestamp(), "", dest, RestoreOptions{StripComponents: 1}); err != nil {
+		t.Fatal(err)
+	}
+	exists(dest, []string{"x/1.txt", "x/3.txt", "y/2.txt"}, "top.txt", "a", "b")
+
+	dest = filepath.Join(t.TempDir(), "two")
+	if err := b.Restore(root.Timestamp(), "a", dest, RestoreOptions{StripComponents: 1}); err != nil {
+		t.Fatal(err)
+	}
+	exists(dest, []string{"1.txt", "2.txt"}, "x", "y")
+
+	// Filters apply to the paths in the snapshot
+	dest = filepath.Join(t.TempDir(), "filtered")
+	opts := RestoreOptions{StripComponents: 2, Filter: NewRestoreFilter([]string{"/b/"}, nil)}
+	if err := b.Restore(root.Timestamp(), "", dest, opts); err != nil {
+		t.Fatal(err)
+	}
+	exists(dest, []string{"1.txt", "2.txt"}, "3.txt")
+
+	// Files restored to the same path are refused before writing anything
+	writeTestFile(t, b, "b/x/1.txt", "other")
+	root = snapshotTestBackup(t, b, "260101-100001")
+	dest = filepath.Join(t.TempDir(), "collision")
+	err := b.Restore(root.Timestamp(), "", dest, RestoreOptions{StripComponents: 1})
+	if err == nil || !strings.Contains(err.Error(), "a/x/1.txt and b/x/1.txt") {
+		t.Errorf("Expected a collision error, got %v", err)
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing restored after a collision")
+	}
+
+	if err := b.Restore(root.Timestamp(), "top.txt", filepath.Join(t.TempDir(), "f"), RestoreOptions{StripComponents: 1}); err == nil {
+		t.Error("Expected stripping components of a file to fail")
+	}
+}
+
+func TestBackup_RestoreCaseCollision(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "docs/File.txt", "upper")
+	writeTestFile(t, b, "docs/file.txt", "lower")
+	if entries, _ := os.ReadDir(filepath.Join(b.Top, "docs")); len(entries) != 2 {
+		t.Skip("The source filesystem is case-insensitive")
+	}
+	root := snapshotTestBackup(t, b, "260101-100000")
+
+	// The destination is case-sensitive here, so folding is simulated
+	dest := filepath.Join(t.TempDir(), "out")
+	err := b.Restore(root.Timestamp(), "", dest, RestoreOptions{CaseInsensitive: true})
+	if err == nil || !strings.Contains(err.Error(), "docs/File.txt and docs/file.txt differ only in case") {
+		t.Errorf("Expected a case collision error, got %v", err)
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Error("Expected nothing restored after a case collision")
+	}
+	if err := b.Restore(root.Timestamp(), "", dest, RestoreOptions{CaseInsensitive: true, DryRun: true}); err == nil {
+		t.Error("Expected a dry run to report the case collision")
+	}
+
+	if err := b.Restore(root.Timestamp(), "", dest, RestoreOptions{CaseInsensitive: true, Force: true}); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"File.txt": "upper", "file~2.txt": "lower"} {
+		if content, err := os.ReadFile(filepath.Join(dest, "docs", name)); err != nil || string(content) != want {
+			t.Errorf("Expected %s with %q, got %q, %v", name, want, content, err)
+		}
+	}
+
+	// Without folding both names are kept
+	dest = filepath.Join(t.TempDir(), "sensitive")
+	if err := b.Restore(root.Timestamp(), "", dest, RestoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, dryRun := range []bool{false, true} {
+		if runtime.GOOS == "linux" && caseInsensitiveDest(dest, dryRun) {
+			t.Errorf("Expected a case-sensitive temporary directory on Linux (dry run %v)", dryRun)
+		}
+	}
+	entries, err := os.ReadDir(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".backup-case-probe") {
+			t.Errorf("Expected the case probe to be removed, found %s", e.Name())
+		}
+	}
+
+	// A dry run writes nothing to the destination, not even the probe,
+	// which would change the time of the directory
+	empty := t.TempDir()
+	past := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(empty, past, past); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Restore(root.Timestamp(), "", filepath.Join(empty, "out"), RestoreOptions{DryRun: true}); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(empty); err != nil || !info.ModTime().Equal(past) {
+		t.Errorf("Expected a dry run to write nothing to %s", empty)
+	}
+}
+
+func TestBackup_RestoreVerify(t *testing.T) {
+	b := newTestBackup(t)
+	b.ChunkThreshold = 1 << 20
+	writeTestFile(t, b, "big.bin", string(randomData(5, 3<<20)))
+	writeTestFile(t, b, "small.txt", "small")
+	root := snapshotTestBackup(t, b, "260101-100000")
+
+	if err := b.Restore(root.Timestamp(), "", filepath.Join(t.TempDir(), "ok"), RestoreOptions{Verify: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A blob whose content no longer matches its hash is restored as it
+	// is without verification and refused with it
+	small := b.Store.HashBytes([]byte("small"))
+	if err := os.Remove(b.Store.DataStore(small)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Store.saveBlob(small, []byte("SMALL")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Restore(root.Timestamp(), "small.txt", filepath.Join(t.TempDir(), "unverified"), RestoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	err := b.Restore(root.Timestamp(), "small.txt", filepath.Join(t.TempDir(), "verified"), RestoreOptions{Verify: true})
+	if err == nil || !strings.Contains(err.Error(), "verification of") {
+		t.Errorf("Expected a verification error, got %v", err)
+	}
+}
+
+func TestBackupDirectory_RestoreCycle(t *testing.T) {
+	b := newTestBackup(t)
+	// A listing that contains itself two levels down, which no backup
+	// writes: its hash would have to be part of its own content
+	loop := b.Store.HashBytes([]byte("loop"))
+	inner := b.Store.HashBytes([]byte("inner"))
+	file := b.Store.HashBytes([]byte("content"))
+	if _, err := b.Store.saveBlob(file, []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	listings := map[string]string{
+		loop:  formatListingLine('F', file, EntryAttrs{}, "a.txt") + formatListingLine('D', inner, EntryAttrs{}, "inner"),
+		inner: formatListingLine('D', loop, EntryAttrs{}, "again"),
+	}
+	for hash, content := range listings {
+		if _, err := b.Store.saveBlob(hash, []byte(listingHeader+"\n"+content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir := NewBackupDirectory(b, loop, "loop", EntryAttrs{})
+
+	dest := filepath.Join(t.TempDir(), "out")
+	err := dir.Restore(dest, RestoreOptions{})
+	if err == nil || !strings.Contains(err.Error(), "inner/again contains itself") {
+		t.Errorf("Expected a cycle error, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "inner", "again", "inner")); !os.IsNotExist(err) {
+		t.Error("Expected the restore to stop at the cycle")
+	}
+	if _, err := RestoreConflicts(dir, dest); err == nil || !strings.Contains(err.Error(), "contains itself") {
+		t.Errorf("Expected listing the restore targets to report the cycle, got %v", err)
+	}
+
+	// The same directory twice side by side is no cycle
+	twice := b.Store.HashBytes([]byte("twice"))
+	leaf := b.Store.HashBytes([]byte("leaf"))
+	if _, err := b.Store.saveBlob(leaf, []byte(listingHeader+"\n"+formatListingLine('F', file, EntryAttrs{}, "b.txt"))); err != nil {
+		t.Fatal(err)
+	}
+	content := formatListingLine('D', leaf, EntryAttrs{}, "x") + formatListingLine('D', leaf, EntryAttrs{}, "y")
+	if _, err := b.Store.saveBlob(twice, []byte(listingHeader+"\n"+content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewBackupDirectory(b, twice, "twice", EntryAttrs{}).Restore(filepath.Join(t.TempDir(), "twice"), RestoreOptions{}); err != nil {
+		t.Errorf("Expected a directory listed twice to be restored: %v", err)
+	}
+}
+
+func TestBackup_RestoreContinueOnError(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "a.txt", "a")
+	writeTestFile(t, b, "sub/b.txt", "b")
+	writeTestFile(t, b, "sub/c.txt", "c")
+	writeTestFile(t, b, "lost/d.txt", "d")
+	root := snapshotTestBackup(t, b, "260101-100000")
+
+	// A missing file blob and a missing directory listing
+	lost, err := root.LocateDirectory("lost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range []string{b.Store.HashBytes([]byte("b")), lost.Hash()} {
+		if err := os.Remove(b.Store.DataStore(h)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := b.Restore(root.Timestamp(), "", filepath.Join(t.TempDir(), "abort"), RestoreOptions{}); err == nil {
+		t.Error("Expected the restore to fail without ContinueOnError")
+	}
+
+	dest := filepath.Join(t.TempDir(), "out")
+	err = b.Restore(root.Timestamp(), "", dest, RestoreOptions{ContinueOnError: true})
+	var failed *RestoreFailedError
+	if !errors.As(err, &failed) {
+		t.Fatalf("Expected a RestoreFailedError, got %v", err)
+	}
+	var paths []string
+	for _, f := range failed.Failures {
+		paths = append(paths, f.Path)
+	}
+	want := []string{filepath.Join(dest, "lost"), filepath.Join(dest, "sub", "b.txt")}
+	slices.Sort(paths)
+	if !slices.Equal(paths, want) {
+		t.Errorf("Expected failures %v, got %v", want, paths)
+	}
+	for _, name := range []string{"a.txt", "sub/c.txt"} {
+		if _, err := os.Stat(filepath.Join(dest, filepath.FromSlash(name))); err != nil {
+			t.Errorf("Expected %s to be restored: %v", name, err)
+		}
+	}
+}
+
+func TestRestore_Owner(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Owners are not recorded on Windows")
+	}
+	b := newTestBackup(t)
+	writeTestFile(t, b, "sub/a.txt", "a")
+	path := filepath.Join(b.Top, "sub", "a.txt")
+	root := os.Geteuid() == 0
+	if root {
+		if err := os.Chown(path, 12345, 23456); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fileOwner(info)
+	plain := snapshotTestBackup(t, b, "260101-100000")
+	b.StoreConfig = &StoreConfig{Owners: true}
+	owned := snapshotTestBackup(t, b, "260101-100001")
+
+	for _, r := range []*BackupRoot{plain, owned} {
+		entry, err := r.Locate("sub/a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorded := entry.Attrs().Owner
+		if r == plain && recorded != "" {
+			t.Errorf("Expected no owner without the store setting, got %q", recorded)
+		}
+		if r == owned && recorded != want {
+			t.Errorf("Expected recorded owner %q, got %q", want, recorded)
+		}
+	}
+
+	// Without privileges the owners are skipped with a warning
+	dest := filepath.Join(t.TempDir(), "owned")
+	if err := b.Restore(owned.Timestamp(), "", dest, RestoreOptions{PreserveOwner: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !root {
+		return
+	}
+	info, err = os.Stat(filepath.Join(dest, "sub", "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fileOwner(info); got != want {
+		t.Errorf("Expected restored owner %q, got %q", want, got)
+	}
+}
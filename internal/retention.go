@@ -0,0 +1,165 @@
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RetentionPolicy describes how many snapshots to keep per time bucket.
+// The newest snapshot of each of the last KeepDaily days, KeepWeekly ISO
+// weeks and KeepMonthly months (counting only buckets that have snapshots)
+// is kept.
+type RetentionPolicy struct {
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+	// KeepTags keeps the snapshots labeled with one of these tags
+	// regardless of their age.
+	KeepTags []string
+	// Tags restricts Forget to the snapshots labeled with one of these
+	// tags; the others are left alone.
+	Tags []string
+}
+
+// Empty reports whether the policy keeps nothing.
+func (p RetentionPolicy) Empty() bool {
+	return p.KeepDaily <= 0 && p.KeepWeekly <= 0 && p.KeepMonthly <= 0 && len(p.KeepTags) == 0
+}
+
+// RetentionDecision is the outcome of a policy for a single snapshot.
+type RetentionDecision struct {
+	Root *BackupRoot
+	Keep bool
+	// Reasons lists the buckets ("daily", "weekly", "monthly") and the
+	// tags ("tag release") that keep the snapshot.
+	Reasons []string
+}
+
+type retentionBucket struct {
+	name  string
+	count int
+	key   func(t time.Time) string
+}
+
+// Apply decides which of roots to keep. All roots are treated as one series,
+// so callers should apply the policy per project. Decisions are returned
+// newest first.
+func (p RetentionPolicy) Apply(roots []*BackupRoot) []RetentionDecision {
+	sorted := make([]*BackupRoot, len(roots))
+	copy(sorted, roots)
+	sort.Sort(sort.Reverse(BackupRoots(sorted)))
+
+	buckets := []*retentionBucket{
+		{name: "daily", count: p.KeepDaily, key: func(t time.Time) string { return t.Format("2006-01-02") }},
+		{name: "weekly", count: p.KeepWeekly, key: func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{name: "monthly", count: p.KeepMonthly, key: func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	last := make(map[string]string)
+
+	decisions := make([]RetentionDecision, 0, len(sorted))
+	for _, root := range sorted {
+		d := RetentionDecision{Root: root}
+		for _, bucket := range buckets {
+			if bucket.count <= 0 {
+				continue
+			}
+			key := bucket.key(root.Time)
+			if key == last[bucket.name] {
+				continue
+			}
+			last[bucket.name] = key
+			bucket.count--
+			d.Keep = true
+			d.Reasons = append(d.Reasons, bucket.name)
+		}
+		for _, tag := range p.KeepTags {
+			if root.HasTag(tag) {
+				d.Keep = true
+				d.Reasons = append(d.Reasons, "tag "+tag)
+			}
+		}
+		decisions = append(decisions, d)
+	}
+	return decisions
+}
+
+// Forget applies policy to the snapshots of project, or of every project
+// when project is empty, and deletes the head files of snapshots that are
+// not kept. With dryRun nothing is deleted. Unreferenced blobs are left for
+// Prune.
+func (b *Backup) Forget(policy RetentionPolicy, project string, dryRun bool) ([]RetentionDecision, error) {
+	if policy.Empty() {
+		return nil, fmt.Errorf("refusing to remove every snapshot: set at least one of --keep-daily, --keep-weekly, --keep-monthly or --keep-tag")
+	}
+
+	roots, err := b.AllBackupRoots()
+	if err != nil {
+		return nil, err
+	}
+
+	byProject := make(map[string][]*BackupRoot)
+	var projects []string
+	for _, root := range FilterTagged(roots, policy.Tags) {
+		p := root.Project()
+		if project != "" && p != project {
+			continue
+		}
+		if _, ok := byProject[p]; !ok {
+			projects = append(projects, p)
+		}
+		byProject[p] = append(byProject[p], root)
+	}
+	sort.Strings(projects)
+
+	// Decide for every project before removing anything. Buckets always
+	// keep the newest snapshot, but tags may keep none, e.g. when mistyped
+	var decisions []RetentionDecision
+	for _, p := range projects {
+		projectDecisions := policy.Apply(byProject[p])
+		if !slices.ContainsFunc(projectDecisions, func(d RetentionDecision) bool { return d.Keep }) {
+			return nil, fmt.Errorf("refusing to remove every snapshot of project %s: none carries a tag of --keep-tag %s", p, strings.Join(policy.KeepTags, ", "))
+		}
+		decisions = append(decisions, projectDecisions...)
+	}
+	if !dryRun {
+		for i, d := range decisions {
+			if d.Keep {
+				continue
+			}
+			if err := d.Root.Remove(); err != nil {
+				return decisions[:i], fmt.Errorf("failed to remove snapshot %s: %w", d.Root, err)
+			}
+		}
+	}
+	return decisions, nil
+}
+
+// SnapshotsByAge returns the snapshots of project, or of every project when
+// project is empty, taken before olderThan and after newerThan. A zero time
+// does not restrict that side.
+func (b *Backup) SnapshotsByAge(project string, olderThan, newerThan time.Time) ([]*BackupRoot, error) {
+	roots, err := b.AllBackupRoots()
+	if err != nil {
+		return nil, err
+	}
+	var selected []*BackupRoot
+	for _, root := range roots {
+		if project != "" && root.Project() != project {
+			continue
+		}
+		if !olderThan.IsZero() && !root.Time.Before(olderThan) {
+			continue
+		}
+		if !newerThan.IsZero() && !root.Time.After(newerThan) {
+			continue
+		}
+		selected = append(selected, root)
+	}
+	return selected, nil
+}
@@ -0,0 +1,208 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetentionPolicy_Apply(t *testing.T) {
+	at := func(s string) *BackupRoot {
+		tm, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &BackupRoot{Time: tm}
+	}
+	roots := []*BackupRoot{
+		at("2026-01-05 10:00"), // Monday, week 2
+		at("2026-01-31 09:00"), // Saturday, week 5
+		at("2026-02-02 08:00"), // Monday, week 6
+		at("2026-02-02 18:00"),
+		at("2026-02-03 12:00"),
+	}
+
+	policy := RetentionPolicy{KeepDaily: 2, KeepWeekly: 2, KeepMonthly: 2}
+	decisions := policy.Apply(roots)
+	if len(decisions) != len(roots) {
+		t.Fatalf("Expected %d decisions, got %d", len(roots), len(decisions))
+	}
+
+	expected := []struct {
+		time    string
+		keep    bool
+		reasons []string
+	}{
+		{"2026-02-03 12:00", true, []string{"daily", "weekly", "monthly"}},
+		{"2026-02-02 18:00", true, []string{"daily"}},
+		{"2026-02-02 08:00", false, nil},
+		{"2026-01-31 09:00", true, []string{"weekly", "monthly"}},
+		{"2026-01-05 10:00", false, nil},
+	}
+	for i, e := range expected {
+		d := decisions[i]
+		if got := d.Root.Time.Format("2006-01-02 15:04"); got != e.time {
+			t.Errorf("Decision %d: expected %s, got %s", i, e.time, got)
+		}
+		if d.Keep != e.keep {
+			t.Errorf("Decision %d (%s): expected keep=%v", i, e.time, e.keep)
+		}
+		if len(d.Reasons) != len(e.reasons) {
+			t.Errorf("Decision %d (%s): expected reasons %v, got %v", i, e.time, e.reasons, d.Reasons)
+			continue
+		}
+		for j := range e.reasons {
+			if d.Reasons[j] != e.reasons[j] {
+				t.Errorf("Decision %d (%s): expected reasons %v, got %v", i, e.time, e.reasons, d.Reasons)
+				break
+			}
+		}
+	}
+}
+
+func TestBackup_Forget(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "a.txt", "a")
+	snapshotTestBackup(t, b, "260101-100000")
+	snapshotTestBackup(t, b, "260101-110000")
+
+	// Another project must be left alone by a project-scoped forget
+	otherDir := filepath.Join(b.StoreSnapshots, "other")
+	if err := os.MkdirAll(otherDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	otherHead := filepath.Join(otherDir, "260101-100000")
+	if err := os.WriteFile(otherHead, []byte("abc\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := b.Forget(RetentionPolicy{}, "test", false); err == nil {
+		t.Error("Expected an empty policy to be rejected")
+	}
+
+	policy := RetentionPolicy{KeepDaily: 1}
+	removedHead := filepath.Join(b.StoreSnapshots, "test", "260101-100000")
+
+	decisions, err := b.Forget(policy, "test", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decisions) != 2 || !decisions[0].Keep || decisions[1].Keep {
+		t.Fatalf("Unexpected decisions: %+v", decisions)
+	}
+	if _, err := os.Stat(removedHead); err != nil {
+		t.Errorf("Dry run removed snapshot head: %v", err)
+	}
+
+	if _, err := b.Forget(policy, "test", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(removedHead); !os.IsNotExist(err) {
+		t.Errorf("Expected %s to be removed", removedHead)
+	}
+	if _, err := os.Stat(filepath.Join(b.StoreSnapshots, "test", "260101-110000")); err != nil {
+		t.Errorf("Expected newest snapshot to be kept: %v", err)
+	}
+	if _, err := os.Stat(otherHead); err != nil {
+		t.Errorf("Expected other project to be untouched: %v", err)
+	}
+}
+
+func TestBackup_ForgetTags(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "a.txt", "a")
+	release := snapshotTestBackup(t, b, "260101-100000")
+	snapshotTestBackup(t, b, "260101-110000")
+	nightly := snapshotTestBackup(t, b, "260101-120000")
+	snapshotTestBackup(t, b, "260101-130000")
+	if _, err := b.TagSnapshot(release, []string{"release"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.TagSnapshot(nightly, []string{"nightly"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A tag alone is a policy
+	decisions, err := b.Forget(RetentionPolicy{KeepTags: []string{"release"}}, "test", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept []string
+	for _, d := range decisions {
+		if d.Keep {
+			kept = append(kept, d.Root.Timestamp()+" "+strings.Join(d.Reasons, ","))
+		}
+	}
+	if strings.Join(kept, ";") != "260101-100000 tag release" {
+		t.Errorf("Unexpected kept snapshots %v", kept)
+	}
+
+	// A tag that no snapshot carries keeps nothing, so nothing is removed
+	if _, err := b.Forget(RetentionPolicy{KeepTags: []string{"relase"}}, "test", false); err == nil || !strings.Contains(err.Error(), "refusing to remove every snapshot") {
+		t.Errorf("Expected a policy keeping nothing to be refused, got %v", err)
+	}
+	if roots, _ := b.BackupRoots(); len(roots) != 4 {
+		t.Errorf("Expected all 4 snapshots to be kept, got %d", len(roots))
+	}
+
+	// --tag only considers the nightly snapshot, which is the newest of its day
+	decisions, err = b.Forget(RetentionPolicy{KeepDaily: 1, Tags: []string{"nightly"}}, "test", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decisions) != 1 || decisions[0].Root.Timestamp() != "260101-120000" || !decisions[0].Keep {
+		t.Errorf("Unexpected decisions %+v", decisions)
+	}
+}
+
+func TestBackup_SnapshotsByAge(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "a.txt", "a")
+	for _, name := range []string{"260101-100000", "260201-100000", "260301-100000"} {
+		snapshotTestBackup(t, b, name)
+	}
+	otherDir := filepath.Join(b.StoreSnapshots, "other")
+	if err := os.MkdirAll(otherDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(otherDir, "260101-100000"), []byte("abc\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	at := func(s string) time.Time {
+		tm, err := time.ParseInLocation(snapshotTimeFormat, s, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	names := func(roots []*BackupRoot) []string {
+		var out []string
+		for _, r := range roots {
+			out = append(out, r.Project()+"/"+r.Timestamp())
+		}
+		return out
+	}
+
+	tests := []struct {
+		project              string
+		olderThan, newerThan time.Time
+		want                 []string
+	}{
+		{"test", at("260215-000000"), time.Time{}, []string{"test/260101-100000", "test/260201-100000"}},
+		{"test", time.Time{}, at("260215-000000"), []string{"test/260301-100000"}},
+		{"test", at("260215-000000"), at("260115-000000"), []string{"test/260201-100000"}},
+		{"", at("260115-000000"), time.Time{}, []string{"other/260101-100000", "test/260101-100000"}},
+	}
+	for _, tt := range tests {
+		got, err := b.SnapshotsByAge(tt.project, tt.olderThan, tt.newerThan)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(names(got), ",") != strings.Join(tt.want, ",") {
+			t.Errorf("SnapshotsByAge(%q, %v, %v) = %v, want %v", tt.project, tt.olderThan, tt.newerThan, names(got), tt.want)
+		}
+	}
+}
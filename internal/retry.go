@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"errors"
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+// Default retrying of blob operations failing with a transient IO error.
+const (
+	DefaultIORetries    = 3
+	DefaultIORetryDelay = 100 * time.Millisecond
+)
+
+// isTransient reports whether err is an IO error that may not happen again
+// when the operation is repeated, as seen on flaky network file systems and
+// connections. Errors such as a missing file or a denied permission are
+// permanent.
+func isTransient(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.EIO, syscall.ETIMEDOUT, syscall.EAGAIN, syscall.EINTR} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	var timeout interface{ Timeout() bool }
+	return errors.As(err, &timeout) && timeout.Timeout()
+}
+
+// retry calls op until it succeeds or fails with an error that is not
+// transient, retrying up to s.IORetries times. It waits s.IORetryDelay
+// before the first retry and twice as long before each further one. Only
+// operations that can be repeated as a whole, such as opening or renaming
+// a file, are retried; a failure while streaming content is not.
+func (s *Store) retry(op func() error) error {
+	err := op()
+	if s == nil {
+		return err
+	}
+	delay := s.IORetryDelay
+	for i := 0; i < s.IORetries && err != nil && isTransient(err); i++ {
+		s.b.warnf("%v; retrying in %s", err, delay)
+		time.Sleep(delay)
+		delay *= 2
+		err = op()
+	}
+	return err
+}
+
+// retryMove is retry for op, a rename or remove. These are not idempotent:
+// an attempt that failed with a transient error may still have taken
+// effect, so that repeating it fails because the file is gone or already
+// in place. A repeated attempt failing like that counts as success if done
+// reports that the operation took effect.
+func (s *Store) retryMove(op func() error, done func() bool) error {
+	repeated := false
+	return s.retry(func() error {
+		err := op()
+		if err != nil && repeated && (errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrExist)) && done() {
+			return nil
+		}
+		repeated = true
+		return err
+	})
+}
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestStore_Retry(t *testing.T) {
+	b := newTestBackup(t)
+	b.Store.IORetryDelay = time.Millisecond
+	transient := &fs.PathError{Op: "open", Path: "blob", Err: syscall.EIO}
+
+	calls := 0
+	err := b.Store.retry(func() error {
+		if calls++; calls < 3 {
+			return transient
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("Expected success on the third call, got %v after %d calls", err, calls)
+	}
+
+	calls = 0
+	err = b.Store.retry(func() error { calls++; return transient })
+	if !errors.Is(err, syscall.EIO) || calls != DefaultIORetries+1 {
+		t.Errorf("Expected the error after %d calls, got %v after %d calls", DefaultIORetries+1, err, calls)
+	}
+
+	// Permanent errors are returned right away
+	calls = 0
+	err = b.Store.retry(func() error {
+		calls++
+		_, err := os.Open("/does/not/exist")
+		return err
+	})
+	if !errors.Is(err, fs.ErrNotExist) || calls != 1 {
+		t.Errorf("Expected a missing file not to be retried, got %v after %d calls", err, calls)
+	}
+}
+
+func TestStore_RetryMove(t *testing.T) {
+	b := newTestBackup(t)
+	b.Store.IORetryDelay = time.Millisecond
+	dir := t.TempDir()
+	src, dest := filepath.Join(dir, "blob.partial"), filepath.Join(dir, "blob")
+	if err := os.WriteFile(src, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first rename takes effect but reports a transient error
+	calls := 0
+	err := b.Store.retryMove(func() error {
+		err := os.Rename(src, dest)
+		if calls++; calls == 1 && err == nil {
+			return &os.LinkError{Op: "rename", Old: src, New: dest, Err: syscall.EIO}
+		}
+		return err
+	}, func() bool { return moved(src, dest) })
+	if err != nil || calls != 2 {
+		t.Errorf("Expected the repeated rename to succeed, got %v after %d calls", err, calls)
+	}
+
+	// The same for a remove
+	calls = 0
+	err = b.Store.retryMove(func() error {
+		err := os.Remove(dest)
+		if calls++; calls == 1 && err == nil {
+			return &fs.PathError{Op: "remove", Path: dest, Err: syscall.EIO}
+		}
+		return err
+	}, func() bool { return true })
+	if err != nil || calls != 2 {
+		t.Errorf("Expected the repeated remove to succeed, got %v after %d calls", err, calls)
+	}
+
+	// A first attempt failing because the file is missing is an error
+	err = b.Store.retryMove(func() error { return os.Remove(dest) }, func() bool { return true })
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected a missing file to be reported, got %v", err)
+	}
+}
+
+func TestStoreConfig_IORetry(t *testing.T) {
+	var c StoreConfig
+	if retries, delay, err := c.IORetry(); err != nil || retries != DefaultIORetries || delay != DefaultIORetryDelay {
+		t.Errorf("Expected the defaults, got %d, %s, %v", retries, delay, err)
+	}
+	none := 0
+	c = StoreConfig{IORetries: &none, IORetryDelay: "2s"}
+	if retries, delay, err := c.IORetry(); err != nil || retries != 0 || delay != 2*time.Second {
+		t.Errorf("Expected no retries after 2s, got %d, %s, %v", retries, delay, err)
+	}
+	many := 11
+	for _, c := range []StoreConfig{{IORetries: &many}, {IORetryDelay: "soon"}, {IORetryDelay: "2m"}} {
+		if _, _, err := c.IORetry(); err == nil {
+			t.Errorf("Expected an error for %+v", c)
+		}
+	}
+}
@@ -1,30 +1,110 @@
 package internal
 
 import (
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// snapshotTimeFormat is the timestamp part of a snapshot name (yyMMdd-HHmmss).
+const snapshotTimeFormat = "060102-150405"
+
 type BackupRoot struct {
 	b          *Backup
 	Time       time.Time
-	BackupHead string
+	Seq        int           // Counter telling apart snapshots created within the same second
+	BackupHead string        // Path of the head in the snapshots directory
+	Ref        string        // Name of the head in the store's RefStore
+	Meta       *SnapshotMeta // nil for snapshots created without metadata
 	hash       string
 }
 
+// ParseSnapshotName parses a snapshot name: a timestamp (yyMMdd-HHmmss),
+// optionally followed by "-N" for the N-th extra snapshot of that second.
+func ParseSnapshotName(name string) (time.Time, int, error) {
+	stamp, suffix, hasSeq := name, "", false
+	if len(name) > len(snapshotTimeFormat) {
+		stamp, suffix = name[:len(snapshotTimeFormat)], name[len(snapshotTimeFormat):]
+		hasSeq = true
+	}
+	t, err := time.ParseInLocation(snapshotTimeFormat, stamp, time.Local)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	seq := 0
+	if hasSeq {
+		n, err := strconv.Atoi(strings.TrimPrefix(suffix, "-"))
+		if !strings.HasPrefix(suffix, "-") || err != nil || n < 1 || suffix != fmt.Sprintf("-%d", n) {
+			return time.Time{}, 0, fmt.Errorf("invalid snapshot name %q", name)
+		}
+		seq = n
+	}
+	return t, seq, nil
+}
+
+// SnapshotName formats a snapshot name; seq 0 gives the plain timestamp.
+func SnapshotName(t time.Time, seq int) string {
+	name := t.Format(snapshotTimeFormat)
+	if seq > 0 {
+		name += fmt.Sprintf("-%d", seq)
+	}
+	return name
+}
+
+// WriteSnapshotHead creates a snapshot head for hash in project, named
+// after t. If a snapshot of the same second exists, a counter suffix is
+// added, so names never collide. The RefStore only makes the head visible
+// once it is written, so an interrupted write never leaves an empty head.
+// Writers are serialized by the store lock, which is taken for the write
+// unless b holds it. It returns the name of the new snapshot.
+func (b *Backup) WriteSnapshotHead(project string, t time.Time, hash string) (string, error) {
+	if !b.locked {
+		if err := b.Lock(); err != nil {
+			return "", err
+		}
+		defer b.Unlock()
+	}
+	for seq := 0; ; seq++ {
+		name := SnapshotName(t, seq)
+		_, err := b.refs().Read(path.Join(project, name))
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		if err := b.refs().Write(path.Join(project, name), []byte(hash+"\n")); err != nil {
+			return "", err
+		}
+		return name, nil
+	}
+}
+
+// NewBackupRoot returns the snapshot whose head is at headPath in the
+// snapshots directory.
 func NewBackupRoot(b *Backup, headPath string) (*BackupRoot, error) {
-	name := filepath.Base(headPath)
-	// Format: yyMMdd-HHmmss
-	t, err := time.ParseInLocation("060102-150405", name, time.Local)
+	ref, err := filepath.Rel(b.StoreSnapshots, headPath)
+	if err != nil || ref == ".." || strings.HasPrefix(ref, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("snapshot head %s is outside of %s", headPath, b.StoreSnapshots)
+	}
+	return b.backupRoot(filepath.ToSlash(ref))
+}
+
+// backupRoot returns the snapshot whose head is the ref name.
+func (b *Backup) backupRoot(ref string) (*BackupRoot, error) {
+	t, seq, err := ParseSnapshotName(path.Base(ref))
 	if err != nil {
 		return nil, err
 	}
+	headPath := filepath.Join(b.StoreSnapshots, filepath.FromSlash(ref))
 	// Validate content (must not be empty)
-	content, err := ioutil.ReadFile(headPath)
+	content, err := b.refs().Read(ref)
 	if err != nil {
 		return nil, err
 	}
@@ -33,34 +113,146 @@ func NewBackupRoot(b *Backup, headPath string) (*BackupRoot, error) {
 		return nil, fmt.Errorf("snapshot file is empty")
 	}
 
+	// Metadata is informational; a damaged sidecar must not hide the snapshot
+	meta, err := b.loadSnapshotMeta(ref)
+	if err != nil {
+		b.warnf("%s: %v", headPath, err)
+	}
+
 	return &BackupRoot{
 		b:          b,
 		Time:       t,
+		Seq:        seq,
 		BackupHead: headPath,
+		Ref:        ref,
+		Meta:       meta,
 		hash:       hash,
 	}, nil
 }
 
+// InvalidHead is a file among the snapshot heads that is not a readable
+// head. Commands listing snapshots skip it.
+type InvalidHead struct {
+	Ref string // project/name
+	Err error
+	// Damaged is set for files that are not heads: misnamed files and heads
+	// that are empty or hold no valid hash. It is not set for heads that
+	// could not be read, which may be valid once the error goes away.
+	Damaged bool
+}
+
+func (h InvalidHead) String() string {
+	return fmt.Sprintf("%s (%v)", h.Ref, h.Err)
+}
+
+// InvalidHeads returns the files in the project directories of the
+// snapshots that are not readable heads: empty or unreadable heads, heads
+// that hold no valid hash, and files whose name is not a snapshot name.
+// Metadata sidecars of valid names and partial files of heads being
+// written are not reported.
+func (b *Backup) InvalidHeads() ([]InvalidHead, error) {
+	projects, err := b.refs().List("")
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var invalid []InvalidHead
+	for _, p := range projects {
+		if !p.IsDir() {
+			continue
+		}
+		files, err := b.refs().List(p.Name())
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			name := f.Name()
+			if f.IsDir() || strings.HasSuffix(name, ".partial") {
+				continue
+			}
+			if head, ok := strings.CutSuffix(name, snapshotMetaExt); ok {
+				if _, _, err := ParseSnapshotName(head); err == nil {
+					continue // A metadata sidecar
+				}
+			}
+			ref := path.Join(p.Name(), name)
+			if _, _, err := ParseSnapshotName(name); err != nil {
+				invalid = append(invalid, InvalidHead{Ref: ref, Err: fmt.Errorf("not a snapshot name"), Damaged: true})
+				continue
+			}
+			content, err := b.refs().Read(ref)
+			if err != nil {
+				invalid = append(invalid, InvalidHead{Ref: ref, Err: err})
+				continue
+			}
+			switch hash := strings.TrimSpace(string(content)); {
+			case hash == "":
+				invalid = append(invalid, InvalidHead{Ref: ref, Err: fmt.Errorf("snapshot file is empty"), Damaged: true})
+			case !b.Store.ValidHash(hash):
+				invalid = append(invalid, InvalidHead{Ref: ref, Err: fmt.Errorf("snapshot file does not hold a valid %s hash", b.Store.HashName), Damaged: true})
+			}
+		}
+	}
+	return invalid, nil
+}
+
+// RemoveHead deletes the file ref among the snapshot heads, with its
+// metadata sidecar if it has one. It removes no blobs; prune does.
+func (b *Backup) RemoveHead(ref string) error {
+	if err := b.refs().Delete(ref); err != nil {
+		return err
+	}
+	if err := b.refs().Delete(ref + snapshotMetaExt); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Remove deletes the snapshot head and its metadata. The blobs it
+// references are left for prune.
+func (r *BackupRoot) Remove() error {
+	if err := r.b.refs().Delete(r.Ref); err != nil {
+		return err
+	}
+	if err := r.b.refs().Delete(r.Ref + snapshotMetaExt); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
 func (r *BackupRoot) String() string {
-	name := r.Time.Format("060102-150405")
+	name := r.Timestamp()
 	if r.b.ProjectName == "" {
-		// Headless: check if we are in a subdirectory of StoreSnapshots
-		// Structure: .../snapshots/<project>/<timestamp>
-		dir := filepath.Dir(r.BackupHead)
-		parent := filepath.Dir(dir)
-		if filepath.Base(parent) == "snapshots" {
-			projectName := filepath.Base(dir)
-			return filepath.Join(projectName, name)
+		// Headless: name the project of heads in <project>/<timestamp>
+		if p := r.Project(); p != "" {
+			return filepath.Join(p, name)
 		}
 	}
 	return name
 }
 
+// Timestamp returns the snapshot's timestamp name (yyMMdd-HHmmss[-N]).
+func (r *BackupRoot) Timestamp() string {
+	return SnapshotName(r.Time, r.Seq)
+}
+
+// Project returns the name of the project the snapshot belongs to,
+// or "" for snapshots stored directly under the snapshots directory.
+func (r *BackupRoot) Project() string {
+	dir := path.Dir(r.Ref)
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
+
 func (r *BackupRoot) Hash() (string, error) {
 	if r.hash != "" {
 		return r.hash, nil
 	}
-	content, err := ioutil.ReadFile(r.BackupHead)
+	content, err := r.b.refs().Read(r.Ref)
 	if err != nil {
 		return "", err
 	}
@@ -70,7 +262,7 @@ func (r *BackupRoot) Hash() (string, error) {
 
 func (b *Backup) ListProjects() ([]string, error) {
 	var projects []string
-	entries, err := os.ReadDir(b.StoreSnapshots)
+	entries, err := b.refs().List("")
 	if err != nil {
 		return nil, err
 	}
@@ -196,6 +388,11 @@ func (r *BackupRoot) Locate(fullName string) (BackupEntry, error) {
 
 type BackupRoots []*BackupRoot
 
-func (s BackupRoots) Len() int           { return len(s) }
-func (s BackupRoots) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
-func (s BackupRoots) Less(i, j int) bool { return s[i].Time.Before(s[j].Time) }
+func (s BackupRoots) Len() int      { return len(s) }
+func (s BackupRoots) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s BackupRoots) Less(i, j int) bool {
+	if !s[i].Time.Equal(s[j].Time) {
+		return s[i].Time.Before(s[j].Time)
+	}
+	return s[i].Seq < s[j].Seq
+}
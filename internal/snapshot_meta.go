@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+)
+
+// snapshotMetaExt is appended to a snapshot head's ref to name its
+// metadata sidecar.
+const snapshotMetaExt = ".meta"
+
+// SnapshotMeta describes who created a snapshot and why. It is stored in a
+// TOML sidecar next to the snapshot head; older snapshots have none.
+type SnapshotMeta struct {
+	Message  string    `toml:"message,omitempty" json:"message,omitempty"`
+	Hostname string    `toml:"hostname" json:"hostname"`
+	User     string    `toml:"user" json:"user"`
+	Time     time.Time `toml:"time" json:"time"`
+	// Tags label the snapshot, e.g. "release"; see Backup.TagSnapshot.
+	Tags []string `toml:"tags,omitempty" json:"tags,omitempty"`
+}
+
+// NewSnapshotMeta returns metadata for a snapshot created now by the
+// current user on this host.
+func NewSnapshotMeta(message string) SnapshotMeta {
+	meta := SnapshotMeta{Message: message, Time: time.Now()}
+	meta.Hostname, _ = os.Hostname()
+	if u, err := user.Current(); err == nil {
+		meta.User = u.Username
+	} else if name := os.Getenv("USER"); name != "" {
+		meta.User = name
+	} else {
+		meta.User = os.Getenv("USERNAME")
+	}
+	return meta
+}
+
+// WriteSnapshotMeta writes the metadata sidecar of the snapshot head ref
+// (see BackupRoot.Ref).
+func (b *Backup) WriteSnapshotMeta(ref string, meta SnapshotMeta) error {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(meta); err != nil {
+		return err
+	}
+	return b.refs().Write(ref+snapshotMetaExt, buf.Bytes())
+}
+
+// loadSnapshotMeta reads the metadata sidecar of the snapshot head ref. It
+// returns nil if the snapshot has none.
+func (b *Backup) loadSnapshotMeta(ref string) (*SnapshotMeta, error) {
+	data, err := b.refs().Read(ref + snapshotMetaExt)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var meta SnapshotMeta
+	if _, err := toml.Decode(string(data), &meta); err != nil {
+		return nil, fmt.Errorf("invalid snapshot metadata: %w", err)
+	}
+	return &meta, nil
+}
+
+// ValidTag checks that tag can label a snapshot: it must not be empty or
+// contain whitespace or commas.
+func ValidTag(tag string) error {
+	if tag == "" || strings.ContainsFunc(tag, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		return fmt.Errorf("invalid tag %q: tags must not be empty or contain spaces or commas", tag)
+	}
+	return nil
+}
+
+// TagSnapshot adds the tags add to and removes the tags remove from the
+// metadata of root, creating the sidecar for snapshots without one, and
+// returns the resulting tags.
+func (b *Backup) TagSnapshot(root *BackupRoot, add, remove []string) ([]string, error) {
+	for _, tag := range append(slices.Clone(add), remove...) {
+		if err := ValidTag(tag); err != nil {
+			return nil, err
+		}
+	}
+	meta := SnapshotMeta{}
+	if root.Meta != nil {
+		meta = *root.Meta
+	}
+	tags := slices.DeleteFunc(append(slices.Clone(meta.Tags), add...), func(t string) bool {
+		return slices.Contains(remove, t)
+	})
+	slices.Sort(tags)
+	meta.Tags = slices.Compact(tags)
+	if err := b.WriteSnapshotMeta(root.Ref, meta); err != nil {
+		return nil, err
+	}
+	root.Meta = &meta
+	return meta.Tags, nil
+}
+
+// HasTag reports whether the snapshot is labeled with tag.
+func (r *BackupRoot) HasTag(tag string) bool {
+	return r.Meta != nil && slices.Contains(r.Meta.Tags, tag)
+}
+
+// Tags returns the tags of the snapshot.
+func (r *BackupRoot) Tags() []string {
+	if r.Meta == nil {
+		return nil
+	}
+	return r.Meta.Tags
+}
+
+// FilterTagged returns the snapshots of roots labeled with at least one of
+// tags, or roots itself when tags is empty.
+func FilterTagged(roots []*BackupRoot, tags []string) []*BackupRoot {
+	if len(tags) == 0 {
+		return roots
+	}
+	var tagged []*BackupRoot
+	for _, r := range roots {
+		if slices.ContainsFunc(tags, r.HasTag) {
+			tagged = append(tagged, r)
+		}
+	}
+	return tagged
+}
@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotMeta(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "a.txt", "a")
+	old := snapshotTestBackup(t, b, "260101-100000")
+	if old.Meta != nil {
+		t.Errorf("Expected no metadata for a snapshot without sidecar, got %+v", old.Meta)
+	}
+
+	b.Message = "before the upgrade"
+	root, _, err := b.CreateSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Meta == nil {
+		t.Fatal("Expected metadata for a new snapshot")
+	}
+	if root.Meta.Message != "before the upgrade" || root.Meta.Time.IsZero() {
+		t.Errorf("Unexpected metadata %+v", root.Meta)
+	}
+	if host, _ := os.Hostname(); root.Meta.Hostname != host {
+		t.Errorf("Expected hostname %q, got %q", host, root.Meta.Hostname)
+	}
+
+	// A damaged sidecar does not hide the snapshot
+	if err := os.WriteFile(old.BackupHead+snapshotMetaExt, []byte("not = [toml"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	roots, err := b.BackupRoots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 2 || roots[0].Meta != nil || roots[1].Meta == nil {
+		t.Errorf("Expected both snapshots, only the second with metadata, got %v", roots)
+	}
+
+	if err := root.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(root.BackupHead + snapshotMetaExt); !os.IsNotExist(err) {
+		t.Error("Expected the metadata to be removed with the snapshot")
+	}
+}
+
+func TestBackup_TagSnapshot(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "a.txt", "a")
+	root := snapshotTestBackup(t, b, "260101-100000")
+	snapshotTestBackup(t, b, "260101-110000")
+
+	// A snapshot without sidecar gets one
+	tags, err := b.TagSnapshot(root, []string{"release", "keep", "release"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(tags, ",") != "keep,release" {
+		t.Errorf("Expected sorted unique tags, got %v", tags)
+	}
+	if _, err := b.TagSnapshot(root, []string{"bad tag"}, nil); err == nil {
+		t.Error("Expected a tag with a space to be rejected")
+	}
+	if tags, err := b.TagSnapshot(root, nil, []string{"keep"}); err != nil || strings.Join(tags, ",") != "release" {
+		t.Errorf("Expected only release after removing keep, got %v, %v", tags, err)
+	}
+
+	roots, err := b.BackupRoots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !roots[0].HasTag("release") || roots[1].HasTag("release") {
+		t.Errorf("Expected only the first snapshot tagged release, got %v", roots)
+	}
+	if tagged := FilterTagged(roots, []string{"other", "release"}); len(tagged) != 1 || tagged[0].Timestamp() != "260101-100000" {
+		t.Errorf("Unexpected tagged snapshots %v", tagged)
+	}
+	if all := FilterTagged(roots, nil); len(all) != 2 {
+		t.Errorf("Expected no tags to select all snapshots, got %v", all)
+	}
+}
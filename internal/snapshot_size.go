@@ -0,0 +1,202 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SnapshotSize is the logical size of a snapshot: what a full restore
+// would write.
+type SnapshotSize struct {
+	Bytes int64 `json:"bytes"`
+	Files int64 `json:"files"`
+}
+
+// SnapshotSizer computes snapshot sizes by walking their trees. Results are
+// cached by root hash in the store's .backup/size-cache, and directory sizes
+// are memoized so subtrees shared between snapshots are only walked once.
+type SnapshotSizer struct {
+	b     *Backup
+	file  string
+	cache Properties
+	dirty bool
+	dirs  map[string]SnapshotSize
+}
+
+func (b *Backup) NewSnapshotSizer() (*SnapshotSizer, error) {
+	file := filepath.Join(b.StoreRoot, ".backup", "size-cache")
+	cache, err := LoadProperties(file)
+	if err != nil {
+		return nil, err
+	}
+	return &SnapshotSizer{b: b, file: file, cache: cache, dirs: make(map[string]SnapshotSize)}, nil
+}
+
+// Size returns the size of the snapshot.
+func (s *SnapshotSizer) Size(root *BackupRoot) (SnapshotSize, error) {
+	h, err := root.Hash()
+	if err != nil {
+		return SnapshotSize{}, err
+	}
+	if cached, ok := s.cache[h]; ok {
+		if size, ok := parseSnapshotSize(cached); ok {
+			return size, nil
+		}
+	}
+	top, err := root.TopDirectory()
+	if err != nil {
+		return SnapshotSize{}, err
+	}
+	size, err := s.dirSize(top)
+	if err != nil {
+		return SnapshotSize{}, err
+	}
+	s.cache[h] = fmt.Sprintf("%d,%d", size.Bytes, size.Files)
+	s.dirty = true
+	return size, nil
+}
+
+func (s *SnapshotSizer) dirSize(dir *BackupDirectory) (SnapshotSize, error) {
+	if size, ok := s.dirs[dir.Hash()]; ok {
+		return size, nil
+	}
+	entries, err := dir.Entries()
+	if err != nil {
+		return SnapshotSize{}, err
+	}
+	var size SnapshotSize
+	for _, entry := range entries {
+		switch e := entry.(type) {
+		case *BackupDirectory:
+			sub, err := s.dirSize(e)
+			if err != nil {
+				return SnapshotSize{}, err
+			}
+			size.Bytes += sub.Bytes
+			size.Files += sub.Files
+		case *BackupFile:
+			n, err := e.Size()
+			if err != nil {
+				return SnapshotSize{}, fmt.Errorf("%s: %w", e.Name(), err)
+			}
+			size.Bytes += n
+			size.Files++
+		}
+	}
+	s.dirs[dir.Hash()] = size
+	return size, nil
+}
+
+// Save writes newly computed sizes to the cache file.
+func (s *SnapshotSizer) Save() error {
+	if !s.dirty {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(s.file), 0755); err != nil {
+		return err
+	}
+	if err := s.cache.Store(s.file, "Snapshot sizes by root hash: bytes,files"); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+func parseSnapshotSize(value string) (SnapshotSize, bool) {
+	bytesStr, filesStr, ok := strings.Cut(value, ",")
+	if !ok {
+		return SnapshotSize{}, false
+	}
+	n, err1 := strconv.ParseInt(bytesStr, 10, 64)
+	files, err2 := strconv.ParseInt(filesStr, 10, 64)
+	if err1 != nil || err2 != nil {
+		return SnapshotSize{}, false
+	}
+	return SnapshotSize{Bytes: n, Files: files}, true
+}
+
+// BlobGrowth is what a snapshot added to the store: the blobs reachable from
+// it but not from the snapshot of its project before it, and their stored
+// size.
+type BlobGrowth struct {
+	NewBlobs int   `json:"new_blobs"`
+	Bytes    int64 `json:"bytes_added"`
+}
+
+// GrowthCounter computes the BlobGrowth of snapshots. The reachable blobs of
+// the last snapshot are kept, so consecutive snapshots passed in time order
+// are only walked once.
+type GrowthCounter struct {
+	b        *Backup
+	all      []*BackupRoot
+	lastHash string
+	last     map[string]bool
+}
+
+// NewGrowthCounter returns a GrowthCounter comparing snapshots with their
+// predecessors in all, which must be in time order.
+func (b *Backup) NewGrowthCounter(all []*BackupRoot) *GrowthCounter {
+	return &GrowthCounter{b: b, all: all}
+}
+
+// Growth returns what root added over the snapshot before it. Everything
+// the first snapshot of a project references counts as new.
+func (g *GrowthCounter) Growth(root *BackupRoot) (BlobGrowth, error) {
+	var before map[string]bool
+	if prev := g.previous(root); prev != nil {
+		var err error
+		if before, err = g.reachable(prev); err != nil {
+			return BlobGrowth{}, fmt.Errorf("%s: %w", prev, err)
+		}
+	}
+	blobs, err := g.reachable(root)
+	if err != nil {
+		return BlobGrowth{}, err
+	}
+	var growth BlobGrowth
+	for hash := range blobs {
+		if before[hash] {
+			continue
+		}
+		growth.NewBlobs++
+		if size, err := g.b.Store.Blobs.Size(hash); err == nil {
+			growth.Bytes += size
+		}
+	}
+	return growth, nil
+}
+
+// previous returns the snapshot of root's project before it, or nil.
+func (g *GrowthCounter) previous(root *BackupRoot) *BackupRoot {
+	var prev *BackupRoot
+	for _, r := range g.all {
+		if r.Project() != root.Project() {
+			continue
+		}
+		if r.Timestamp() == root.Timestamp() {
+			return prev
+		}
+		prev = r
+	}
+	return nil
+}
+
+// reachable returns the blobs reachable from root, including its listing.
+func (g *GrowthCounter) reachable(root *BackupRoot) (map[string]bool, error) {
+	h, err := root.Hash()
+	if err != nil {
+		return nil, err
+	}
+	if h == g.lastHash {
+		return g.last, nil
+	}
+	blobs := make(map[string]bool)
+	if err := g.b.markReachable(h, blobs, make(map[string]bool)); err != nil {
+		return nil, err
+	}
+	g.lastHash, g.last = h, blobs
+	return blobs, nil
+}
@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotSizer(t *testing.T) {
+	b := newTestBackup(t)
+	b.ChunkThreshold = 1 << 20
+	writeTestFile(t, b, "a.txt", "12345")
+	writeTestFile(t, b, "sub/b.txt", "123")
+	writeTestFile(t, b, "big.bin", string(randomData(4, 2<<20)))
+	if err := os.Symlink("a.txt", filepath.Join(b.Top, "link")); err != nil {
+		t.Fatal(err)
+	}
+	first := snapshotTestBackup(t, b, "260101-100000")
+	writeTestFile(t, b, "sub/c.txt", "1234567")
+	second := snapshotTestBackup(t, b, "260102-100000")
+
+	sizer, err := b.NewSnapshotSizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[*BackupRoot]SnapshotSize{
+		first:  {Bytes: 5 + 3 + 2<<20, Files: 3},
+		second: {Bytes: 5 + 3 + 7 + 2<<20, Files: 4},
+	}
+	for root, w := range want {
+		got, err := sizer.Size(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != w {
+			t.Errorf("%s: expected %+v, got %+v", root, w, got)
+		}
+	}
+	if err := sizer.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cached sizes are used without reading the tree
+	h, _ := first.Hash()
+	if err := os.Remove(b.Store.DataStore(h)); err != nil {
+		t.Fatal(err)
+	}
+	sizer, err = b.NewSnapshotSizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := sizer.Size(first); err != nil || got != want[first] {
+		t.Errorf("Expected cached size %+v, got %+v (%v)", want[first], got, err)
+	}
+}
+
+func TestGrowthCounter(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "a.txt", "12345")
+	writeTestFile(t, b, "sub/b.txt", "123")
+	first := snapshotTestBackup(t, b, "260101-100000")
+	second := snapshotTestBackup(t, b, "260102-100000")
+	writeTestFile(t, b, "sub/c.txt", "1234567")
+	third := snapshotTestBackup(t, b, "260103-100000")
+
+	all, err := b.SnapshotsByAge("", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter := b.NewGrowthCounter(all)
+	size := func(hashes ...string) int64 {
+		var n int64
+		for _, h := range hashes {
+			s, err := b.Store.Blobs.Size(h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n += s
+		}
+		return n
+	}
+	listings := func(root *BackupRoot) []string {
+		top, err := root.Hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sub, err := root.LocateDirectory("sub")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []string{top, sub.Hash()}
+	}
+	fileA, fileB, fileC := b.Store.HashBytes([]byte("12345")), b.Store.HashBytes([]byte("123")), b.Store.HashBytes([]byte("1234567"))
+
+	// The top listing, sub's listing and both files are new in the first
+	// snapshot; an unchanged snapshot adds nothing; a new file adds itself
+	// and the listings leading to it
+	for _, tt := range []struct {
+		root *BackupRoot
+		want BlobGrowth
+	}{
+		{first, BlobGrowth{NewBlobs: 4, Bytes: size(append(listings(first), fileA, fileB)...)}},
+		{second, BlobGrowth{}},
+		{third, BlobGrowth{NewBlobs: 3, Bytes: size(append(listings(third), fileC)...)}},
+	} {
+		got, err := counter.Growth(tt.root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: expected %+v, got %+v", tt.root, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// StateFiles holds the files of a store's .backup directory that every
+// host using the store must see: the store lock and the record of the
+// unreferenced blobs kept by prune. Missing files are reported with errors
+// matching fs.ErrNotExist.
+type StateFiles interface {
+	Read(name string) ([]byte, error)
+	// Create writes the new file name with data, failing with an error
+	// matching fs.ErrExist if it exists. The store lock is taken with it,
+	// so of two hosts creating the same file only one may succeed.
+	Create(name string, data []byte) error
+	// Write replaces the file name with data.
+	Write(name string, data []byte) error
+	Delete(name string) error
+}
+
+// localStateFiles keeps the state files in the .backup directory of a
+// local store.
+type localStateFiles struct {
+	localRefStore
+}
+
+func (l *localStateFiles) Create(name string, data []byte) error {
+	path := l.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// state returns the store's StateFiles, the local .backup directory unless
+// the store is kept at a URL.
+func (b *Backup) state() StateFiles {
+	if b.State == nil {
+		return &localStateFiles{localRefStore{dir: filepath.Join(b.StoreRoot, ".backup")}}
+	}
+	return b.State
+}
+
+// stateLocation describes where the state file name is kept, for messages.
+func (b *Backup) stateLocation(name string) string {
+	if b.State == nil {
+		return filepath.Join(b.StoreRoot, ".backup", name)
+	}
+	return b.StoreURL + "/.backup/" + name
+}
+
+// readState returns the content of the state file name, or nil if it does
+// not exist.
+func (b *Backup) readState(name string) ([]byte, error) {
+	data, err := b.state().Read(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
@@ -0,0 +1,205 @@
+package internal
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// StoreStats summarizes the content of a store.
+type StoreStats struct {
+	Blobs        int            `json:"blobs"`
+	Bytes        int64          `json:"bytes"` // Size of the blobs on disk, after compression
+	Snapshots    map[string]int `json:"snapshots"`
+	Reachable    int            `json:"reachable_blobs"`
+	Shared       int            `json:"shared_blobs"` // Reachable from more than one snapshot
+	Unreferenced int            `json:"unreferenced_blobs"`
+	MostShared   []BlobRefs     `json:"most_referenced"`
+}
+
+// BlobRefs is the number of snapshots that reach a blob.
+type BlobRefs struct {
+	Hash string `json:"hash"`
+	Refs int    `json:"refs"`
+}
+
+// StoreStats computes the statistics of the store. MostShared holds up to top
+// blobs with the most referencing snapshots, all of them if top <= 0.
+func (b *Backup) StoreStats(top int) (StoreStats, error) {
+	stats := StoreStats{Snapshots: make(map[string]int)}
+
+	all, err := b.GetAllBlobs()
+	if err != nil {
+		return stats, err
+	}
+	stats.Blobs = len(all)
+	for hash := range all {
+		if size, err := b.Store.Blobs.Size(hash); err == nil {
+			stats.Bytes += size
+		}
+	}
+
+	roots, err := b.AllBackupRoots()
+	if err != nil {
+		return stats, err
+	}
+	for _, root := range roots {
+		stats.Snapshots[root.Project()]++
+	}
+
+	refs, err := b.BlobRefCounts()
+	if err != nil {
+		return stats, err
+	}
+	stats.Reachable = len(refs)
+	for hash, n := range refs {
+		if n > 1 {
+			stats.Shared++
+			stats.MostShared = append(stats.MostShared, BlobRefs{Hash: hash, Refs: n})
+		}
+	}
+	for hash := range all {
+		if refs[hash] == 0 {
+			stats.Unreferenced++
+		}
+	}
+
+	sort.Slice(stats.MostShared, func(i, j int) bool {
+		if stats.MostShared[i].Refs != stats.MostShared[j].Refs {
+			return stats.MostShared[i].Refs > stats.MostShared[j].Refs
+		}
+		return stats.MostShared[i].Hash < stats.MostShared[j].Hash
+	})
+	if top > 0 && len(stats.MostShared) > top {
+		stats.MostShared = stats.MostShared[:top]
+	}
+	return stats, nil
+}
+
+// BlobRefCounts returns, for every reachable blob, the number of snapshots
+// that reach it. Each snapshot is traversed on its own, so a blob referenced
+// several times within one snapshot counts once.
+func (b *Backup) BlobRefCounts() (map[string]int, error) {
+	refs := make(map[string]int)
+	roots, err := b.AllBackupRoots()
+	if err != nil {
+		return nil, err
+	}
+	for _, root := range roots {
+		h, err := root.Hash()
+		if err != nil {
+			continue
+		}
+		reachable := make(map[string]bool)
+		if err := b.markReachable(h, reachable, make(map[string]bool)); err != nil {
+			return nil, err
+		}
+		for hash := range reachable {
+			refs[hash]++
+		}
+	}
+	return refs, nil
+}
+
+// ExtensionStats is the number and logical size of the files with one
+// extension. Extension is lower case with its dot, or "" for files without
+// one.
+type ExtensionStats struct {
+	Extension string `json:"extension"`
+	Files     int64  `json:"files"`
+	Bytes     int64  `json:"bytes"`
+}
+
+// StatsByExtension walks the trees of roots and sums up the files and their
+// sizes by extension, largest first. With a single root every file is
+// counted; with several, each content is counted once and directories
+// shared between the snapshots are only walked once, so the result
+// approximates what the store holds for each extension before compression.
+func (b *Backup) StatsByExtension(roots []*BackupRoot) ([]ExtensionStats, error) {
+	w := &extensionWalk{
+		distinct: len(roots) > 1,
+		byExt:    make(map[string]*ExtensionStats),
+		dirs:     make(map[string]bool),
+		files:    make(map[string]bool),
+	}
+	for _, root := range roots {
+		top, err := root.TopDirectory()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", root, err)
+		}
+		if err := w.walk(top); err != nil {
+			return nil, fmt.Errorf("%s: %w", root, err)
+		}
+	}
+
+	stats := make([]ExtensionStats, 0, len(w.byExt))
+	for _, s := range w.byExt {
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Bytes != stats[j].Bytes {
+			return stats[i].Bytes > stats[j].Bytes
+		}
+		return stats[i].Extension < stats[j].Extension
+	})
+	return stats, nil
+}
+
+type extensionWalk struct {
+	distinct bool
+	byExt    map[string]*ExtensionStats
+	// The directories walked and the files counted, if distinct
+	dirs, files map[string]bool
+}
+
+func (w *extensionWalk) walk(dir *BackupDirectory) error {
+	if w.distinct {
+		if w.dirs[dir.Hash()] {
+			return nil
+		}
+		w.dirs[dir.Hash()] = true
+	}
+	entries, err := dir.Entries()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		switch e := entry.(type) {
+		case *BackupDirectory:
+			if err := w.walk(e); err != nil {
+				return err
+			}
+		case *BackupFile:
+			if w.distinct {
+				if w.files[e.Hash()] {
+					continue
+				}
+				w.files[e.Hash()] = true
+			}
+			size, err := e.Size()
+			if err != nil {
+				return fmt.Errorf("%s: %w", e.Name(), err)
+			}
+			ext := fileExtension(e.Name())
+			s := w.byExt[ext]
+			if s == nil {
+				s = &ExtensionStats{Extension: ext}
+				w.byExt[ext] = s
+			}
+			s.Files++
+			s.Bytes += size
+		}
+	}
+	return nil
+}
+
+// fileExtension returns the lower case extension of name, or "" if it has
+// none. Names starting with their only dot, such as .bashrc, have none.
+func fileExtension(name string) string {
+	ext := filepath.Ext(name)
+	if ext == name {
+		return ""
+	}
+	return strings.ToLower(ext)
+}
@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestStoreStats(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "shared.txt", "shared")
+	writeTestFile(t, b, "a.txt", "first")
+	snapshotTestBackup(t, b, "260101-100000")
+	writeTestFile(t, b, "a.txt", "second")
+	snapshotTestBackup(t, b, "260101-110000")
+	if _, err := b.Store.saveBlob(b.Store.HashBytes([]byte("orphan")), []byte("orphan")); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := b.StoreStats(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two listings, three file blobs and the orphan
+	if stats.Blobs != 6 || stats.Reachable != 5 || stats.Unreferenced != 1 {
+		t.Errorf("Unexpected blob counts %+v", stats)
+	}
+	if stats.Bytes <= 0 {
+		t.Errorf("Expected the size on disk, got %d", stats.Bytes)
+	}
+	if stats.Snapshots["test"] != 2 {
+		t.Errorf("Expected 2 snapshots of project test, got %v", stats.Snapshots)
+	}
+	sharedHash := b.Store.HashBytes([]byte("shared"))
+	if stats.Shared != 1 || len(stats.MostShared) != 1 || stats.MostShared[0] != (BlobRefs{Hash: sharedHash, Refs: 2}) {
+		t.Errorf("Expected only shared.txt to be shared, got %+v", stats.MostShared)
+	}
+
+	// Like the extensions of StatsByExtension, top <= 0 lists all
+	for _, top := range []int{0, -1} {
+		if stats, err = b.StoreStats(top); err != nil || len(stats.MostShared) != 1 {
+			t.Errorf("Expected all most referenced blobs with top %d, got %v (%v)", top, stats.MostShared, err)
+		}
+	}
+}
+
+func TestBackup_StatsByExtension(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "video.MP4", "0123456789")
+	writeTestFile(t, b, "notes.txt", "abc")
+	writeTestFile(t, b, "sub/copy.txt", "abc")
+	writeTestFile(t, b, ".bashrc", "x")
+	first := snapshotTestBackup(t, b, "260101-100000")
+	writeTestFile(t, b, "notes.txt", "abcdef")
+	second := snapshotTestBackup(t, b, "260101-110000")
+
+	format := func(stats []ExtensionStats) string {
+		var parts []string
+		for _, s := range stats {
+			parts = append(parts, fmt.Sprintf("%s:%d:%d", s.Extension, s.Files, s.Bytes))
+		}
+		return strings.Join(parts, " ")
+	}
+
+	// Every file of a single snapshot counts
+	stats, err := b.StatsByExtension([]*BackupRoot{first})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := format(stats), ".mp4:1:10 .txt:2:6 :1:1"; got != want {
+		t.Errorf("Unexpected stats %q, want %q", got, want)
+	}
+
+	// Across snapshots, each content counts once
+	stats, err = b.StatsByExtension([]*BackupRoot{first, second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := format(stats), ".mp4:1:10 .txt:2:9 :1:1"; got != want {
+		t.Errorf("Unexpected stats %q, want %q", got, want)
+	}
+}
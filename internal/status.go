@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -16,6 +17,10 @@ const (
 	StatusArchivedContentMissing              // E
 	StatusNew                                 // N
 	StatusNewContentKnown                     // n
+	StatusIgnored                             // I
+	StatusDeleted                             // D
+	StatusTypeChanged                         // T
+	StatusModified                            // M
 )
 
 func (s BackupStatus) String() string {
@@ -28,11 +33,25 @@ func (s BackupStatus) String() string {
 		return "N"
 	case StatusNewContentKnown:
 		return "n"
+	case StatusIgnored:
+		return "I"
+	case StatusDeleted:
+		return "D"
+	case StatusTypeChanged:
+		return "T"
+	case StatusModified:
+		return "M"
 	default:
 		return "?"
 	}
 }
 
+// MarshalText encodes the status as its single character code,
+// which is also used for JSON object keys.
+func (s BackupStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
 func (s BackupStatus) Description() string {
 	switch s {
 	case StatusArchived:
@@ -43,40 +62,108 @@ func (s BackupStatus) Description() string {
 		return "New file or directory, needs to be archived"
 	case StatusNewContentKnown:
 		return "New file or directory, content previously archived"
+	case StatusIgnored:
+		return "Ignored file or directory"
+	case StatusDeleted:
+		return "Deleted file or directory, only in the backup"
+	case StatusTypeChanged:
+		return "Type changed since the backup, e.g. a file that became a directory"
+	case StatusModified:
+		return "Modified since the backup, needs to be archived"
 	default:
 		return "Unknown status"
 	}
 }
 
 type StatusReport struct {
-	Files       int
-	Directories int
-	Ignored     int
-	Counters    map[BackupStatus]int
+	Snapshot    string               `json:"snapshot,omitempty"`
+	Files       int                  `json:"files"`
+	Directories int                  `json:"directories"`
+	Links       int                  `json:"links"`
+	Ignored     int                  `json:"ignored"`
+	Counters    map[BackupStatus]int `json:"counters"`
+	Entries     []StatusEntry        `json:"entries"`
+	// base is the directory the paths of the entries are relative to; the
+	// current working directory if empty.
+	base string
+}
+
+// StatusEntry is the status of a single path, relative to the current working directory.
+type StatusEntry struct {
+	Status BackupStatus `json:"status"`
+	Path   string       `json:"path"`
+	Dir    bool         `json:"dir,omitempty"`
+	// Link is the target of symlinks, which are never followed.
+	Link string `json:"link,omitempty"`
+	// Reason is the ignore rule for ignored entries or the missing
+	// content path for archived entries whose content is missing.
+	Reason string `json:"reason,omitempty"`
+}
+
+func (e StatusEntry) String() string {
+	name := e.Path
+	if e.Dir {
+		name += "/"
+	}
+	if e.Link != "" {
+		name += " -> " + e.Link
+	}
+	switch {
+	case e.Reason == "":
+		return fmt.Sprintf("%s %s", e.Status, name)
+	case e.Status == StatusIgnored || e.Status == StatusTypeChanged:
+		return fmt.Sprintf("%s %s (%s)", e.Status, name, e.Reason)
+	default:
+		return fmt.Sprintf("%s %s #%s", e.Status, name, e.Reason)
+	}
 }
 
 func NewStatusReport() *StatusReport {
 	return &StatusReport{
 		Counters: make(map[BackupStatus]int),
+		Entries:  []StatusEntry{},
 	}
 }
 
-func (b *Backup) Status(showIgnored bool) error {
-	latest, err := b.LatestBackupRoot()
-	if err != nil {
-		return err
+// Status compares the current directory with the named snapshot, or with
+// the latest snapshot when snapshotName is empty. short prints only the
+// entries that differ from the snapshot, one per line, without headers and
+// counters.
+func (b *Backup) Status(snapshotName string, showIgnored, short bool) error {
+	var latest *BackupRoot
+	var err error
+	if snapshotName != "" {
+		if b.Top == "" {
+			return fmt.Errorf("comparing with a snapshot requires a source directory")
+		}
+		latest, err = b.FindBackupRoot(snapshotName)
+		if err != nil {
+			return fmt.Errorf("snapshot not found: %s", snapshotName)
+		}
+	} else {
+		latest, err = b.LatestBackupRoot()
+		if err != nil {
+			return err
+		}
 	}
 
-	if latest == nil {
-		fmt.Println("No previous backups")
-	} else {
-		fmt.Printf("Last backup was at %s\n", latest)
+	if !b.JSON && !short {
+		switch {
+		case latest == nil:
+			fmt.Println("No previous backups")
+		case snapshotName != "":
+			fmt.Printf("Comparing with backup %s\n", latest)
+		default:
+			fmt.Printf("Last backup was at %s\n", latest)
+		}
+		fmt.Println()
 	}
-	fmt.Println()
 
 	// If running headless (no source context), stop here.
 	if b.Top == "" {
-		fmt.Println("Source directory not specified (headless mode). Listing all projects:")
+		if !b.JSON && !short {
+			fmt.Println("Source directory not specified (headless mode). Listing all projects:")
+		}
 		return b.printHeadlessStatus()
 	}
 
@@ -98,21 +185,32 @@ func (b *Backup) Status(showIgnored bool) error {
 	}
 
 	report := NewStatusReport()
+	if latest != nil {
+		report.Snapshot = latest.String()
+	}
 	if err := b.runStatus(latest, currentDir, backupDir, report, showIgnored); err != nil {
 		return err
 	}
 
-	fmt.Println()
-	fmt.Printf("\t%d\tFiles\n", report.Files)
-	fmt.Printf("\t%d\tDirectories\n", report.Directories)
+	if b.JSON {
+		return PrintJSON(report)
+	}
 
-	for _, status := range []BackupStatus{StatusArchived, StatusArchivedContentMissing, StatusNew, StatusNewContentKnown} {
-		count := report.Counters[status]
-		if count > 0 {
-			fmt.Printf("%s\t%d\t%s\n", status, count, status.Description())
+	if short {
+		for _, e := range report.Entries {
+			if e.Status != StatusArchived {
+				fmt.Println(e)
+			}
 		}
+		return nil
 	}
 
+	for _, e := range report.Entries {
+		fmt.Println(e)
+	}
+
+	fmt.Println()
+	report.printCounts()
 	if showIgnored {
 		fmt.Printf("I\t%d\tIgnored files\n", report.Ignored)
 	}
@@ -120,6 +218,72 @@ func (b *Backup) Status(showIgnored bool) error {
 	return nil
 }
 
+// PrintTreeChanges prints what a backup would change compared to the latest
+// snapshot, for create --dry-run: the entries of the whole source tree that
+// differ from the snapshot, like status --short run from the source root,
+// followed by the counts of status.
+func (b *Backup) PrintTreeChanges() error {
+	latest, err := b.LatestBackupRoot()
+	if err != nil {
+		return err
+	}
+	var top *BackupDirectory
+	if latest != nil {
+		if top, err = latest.TopDirectory(); err != nil {
+			return err
+		}
+		fmt.Printf("Changes since backup %s:\n", latest)
+	} else {
+		fmt.Println("Changes (no previous backups):")
+	}
+
+	report := NewStatusReport()
+	report.base = b.Top
+	if err := b.runStatus(latest, NewDirectoryEntry(b, b.Top, nil), top, report, false); err != nil {
+		return err
+	}
+	changed := 0
+	for _, e := range report.Entries {
+		if e.Status != StatusArchived {
+			fmt.Println(e)
+			changed++
+		}
+	}
+	if changed == 0 {
+		fmt.Println("No changes")
+	}
+	fmt.Println()
+	report.printCounts()
+	return nil
+}
+
+// printCounts prints the number of files, directories and symlinks of the
+// report and how many entries have each status.
+func (r *StatusReport) printCounts() {
+	fmt.Printf("\t%d\tFiles\n", r.Files)
+	fmt.Printf("\t%d\tDirectories\n", r.Directories)
+	if r.Links > 0 {
+		fmt.Printf("\t%d\tSymlinks\n", r.Links)
+	}
+
+	for _, status := range []BackupStatus{StatusArchived, StatusArchivedContentMissing, StatusModified, StatusNew, StatusNewContentKnown, StatusTypeChanged, StatusDeleted} {
+		count := r.Counters[status]
+		if count > 0 {
+			fmt.Printf("%s\t%d\t%s\n", status, count, status.Description())
+		}
+	}
+}
+
+// relPath returns path relative to the base of the report.
+func (r *StatusReport) relPath(b *Backup, path string) string {
+	base := r.base
+	if base == "" {
+		base = b.CurrentWorkingDir
+	}
+	rel, _ := filepath.Rel(base, path)
+	return rel
+}
+
 func (b *Backup) runStatus(latest *BackupRoot, current *DirectoryEntry, backupDir *BackupDirectory, report *StatusReport, showIgnored bool) error {
 	// Get current entries (filesystem)
 	currentEntries, err := current.Content()
@@ -130,22 +294,19 @@ func (b *Backup) runStatus(latest *BackupRoot, current *DirectoryEntry, backupDi
 		return currentEntries[i].Name() < currentEntries[j].Name()
 	})
 
+	ignored, err := current.Ignored()
+	if err != nil {
+		return err
+	}
+
 	// Print ignored if requested
 	if showIgnored {
-		ignored, err := current.Ignored()
-		if err != nil {
-			return err
-		}
 		sort.Slice(ignored, func(i, j int) bool {
 			return ignored[i].Name < ignored[j].Name
 		})
 		for _, e := range ignored {
-			reason := ""
-			if e.Reason != nil {
-				reason = fmt.Sprintf(" (Ignored by %s: %s)", e.Reason.Source, e.Reason.raw)
-			}
-			relName, _ := filepath.Rel(b.CurrentWorkingDir, e.Path)
-			fmt.Printf("I %s%s\n", relName, reason)
+			relName := report.relPath(b, e.Path)
+			report.Entries = append(report.Entries, StatusEntry{Status: StatusIgnored, Path: relName, Reason: e.ReasonText()})
 			report.Ignored++
 		}
 	}
@@ -159,46 +320,82 @@ func (b *Backup) runStatus(latest *BackupRoot, current *DirectoryEntry, backupDi
 		}
 	}
 
+	// Entries of the backup that are neither on disk nor ignored now were
+	// deleted. They are merged into the alphabetical order of the others.
+	present := make(map[string]bool, len(currentEntries)+len(ignored))
+	for _, entry := range currentEntries {
+		present[entry.Name()] = true
+	}
+	for _, ie := range ignored {
+		present[ie.Name] = true
+	}
+	var deleted []string
+	for name := range backupEntries {
+		if !present[name] {
+			deleted = append(deleted, name)
+		}
+	}
+	sort.Strings(deleted)
+	reportDeleted := func(before string) {
+		for len(deleted) > 0 && (before == "" || deleted[0] < before) {
+			e := backupEntries[deleted[0]]
+			relName := report.relPath(b, filepath.Join(current.path, deleted[0]))
+			_, isDir := e.(*BackupDirectory)
+			se := StatusEntry{Status: StatusDeleted, Path: relName, Dir: isDir}
+			if l, ok := e.(*BackupLink); ok {
+				se.Link, _ = l.Target()
+			}
+			report.Counters[StatusDeleted]++
+			report.Entries = append(report.Entries, se)
+			deleted = deleted[1:]
+		}
+	}
+
 	for _, entry := range currentEntries {
 		name := entry.Name()
+		reportDeleted(name)
 		var status BackupStatus = StatusUnknown
 
-		inLatest := false
-		if backupEntries != nil {
-			_, inLatest = backupEntries[name]
-		}
+		backupEntry, inLatest := backupEntries[name]
 
 		// Check if content is saved in store
 		h, err := entry.Hash()
 		if err != nil {
 			return err
 		}
-		contentPath := b.Store.DataStore(h)
-		contentExists := false
-		if _, err := os.Stat(contentPath); err == nil {
-			contentExists = true
-		}
+		contentExists := b.Store.hasBlob(h)
 
 		dirEntry, isDir := entry.(*DirectoryEntry)
 
-		if inLatest {
-			if contentExists {
+		if inLatest && entryKind(backupEntry) != currentKind(entry) {
+			// The new content is listed below a directory that replaced
+			// a file or symlink
+			status = StatusTypeChanged
+		} else if inLatest && !isDir && backupEntry.Hash() != h {
+			// Also when the new content is in the store, e.g. as the
+			// content of another file or of an older snapshot
+			status = StatusModified
+		} else if inLatest {
+			switch {
+			case contentExists && backupEntry.Hash() == h:
 				status = StatusArchived
-			} else {
-				if isDir {
-					// Recursive check for dir
-					allSaved, err := dirEntry.AllFilesContentIsSaved()
-					if err != nil {
-						return err
-					}
-					if allSaved {
-						status = StatusArchivedContentMissing
-					} else {
-						status = StatusNewContentKnown
-					}
-				} else {
+			case contentExists:
+				// A changed directory whose new listing another snapshot
+				// stored
+				status = StatusNewContentKnown
+			case isDir:
+				// Recursive check for dir
+				allSaved, err := dirEntry.AllFilesContentIsSaved()
+				if err != nil {
+					return err
+				}
+				if allSaved {
 					status = StatusArchivedContentMissing
+				} else {
+					status = StatusNewContentKnown
 				}
+			default:
+				status = StatusArchivedContentMissing
 			}
 		} else {
 			// Not in latest
@@ -212,42 +409,67 @@ func (b *Backup) runStatus(latest *BackupRoot, current *DirectoryEntry, backupDi
 		report.Counters[status]++
 
 		extra := ""
-		if status == StatusArchivedContentMissing {
-			extra = " #" + contentPath
+		switch status {
+		case StatusArchivedContentMissing:
+			extra = b.Store.blobLocation(h)
+		case StatusTypeChanged:
+			extra = "was a " + kindName(entryKind(backupEntry))
 		}
 
 		if isDir {
-			relName, _ := filepath.Rel(b.CurrentWorkingDir, dirEntry.path)
+			relName := report.relPath(b, dirEntry.path)
 			report.Directories++
-			fmt.Printf("%s %s/%s\n", status, relName, extra)
+			report.Entries = append(report.Entries, StatusEntry{Status: status, Path: relName, Dir: true, Reason: extra})
 
 			// Recursion
 			var subBackupDir *BackupDirectory
-			if inLatest {
-				subEntry := backupEntries[name]
-				if bd, ok := subEntry.(*BackupDirectory); ok {
-					subBackupDir = bd
-				}
+			if bd, ok := backupEntry.(*BackupDirectory); ok {
+				subBackupDir = bd
 			}
 			if err := b.runStatus(latest, dirEntry, subBackupDir, report, showIgnored); err != nil {
 				return err
 			}
 
 		} else if linkEntry, ok := entry.(*LinkEntry); ok {
-			relName, _ := filepath.Rel(b.CurrentWorkingDir, linkEntry.path)
-			report.Files++ // Or report.Links++? Using Files for now as per Save()
-			fmt.Printf("%s %s%s\n", status, relName, extra)
+			relName := report.relPath(b, linkEntry.path)
+			report.Links++
+			report.Entries = append(report.Entries, StatusEntry{Status: status, Path: relName, Link: linkEntry.target, Reason: extra})
 		} else {
 			// For files, we need path accessible
 			fileEntry := entry.(*FileEntry)
-			relName, _ := filepath.Rel(b.CurrentWorkingDir, fileEntry.path)
+			relName := report.relPath(b, fileEntry.path)
 			report.Files++
-			fmt.Printf("%s %s%s\n", status, relName, extra)
+			report.Entries = append(report.Entries, StatusEntry{Status: status, Path: relName, Reason: extra})
 		}
 	}
+	reportDeleted("")
 	return nil
 }
 
+// currentKind is the entryKind of the backup entry that e would become.
+func currentKind(e Entry) byte {
+	switch e.(type) {
+	case *DirectoryEntry:
+		return 'D'
+	case *LinkEntry:
+		return 'L'
+	default:
+		return 'F'
+	}
+}
+
+// kindName names an entryKind for messages.
+func kindName(kind byte) string {
+	switch kind {
+	case 'D':
+		return "directory"
+	case 'L':
+		return "symlink"
+	default:
+		return "file"
+	}
+}
+
 // AllFilesContentIsSaved checks if all files in directory (recursively) are saved.
 func (d *DirectoryEntry) AllFilesContentIsSaved() (bool, error) {
 	contents, err := d.Content()
@@ -259,8 +481,7 @@ func (d *DirectoryEntry) AllFilesContentIsSaved() (bool, error) {
 		if err != nil {
 			return false, err
 		}
-		dest := d.b.Store.DataStore(h)
-		if _, err := os.Stat(dest); os.IsNotExist(err) {
+		if !d.b.Store.hasBlob(h) {
 			return false, nil
 		}
 
@@ -278,16 +499,56 @@ func (d *DirectoryEntry) AllFilesContentIsSaved() (bool, error) {
 }
 
 type ProjectStatus struct {
-	Name       string
-	LastBackup time.Time
+	Name       string    `json:"name"`
+	LastBackup time.Time `json:"lastBackup"`
+	AgeSeconds int64     `json:"ageSeconds"`
 }
 
 func (b *Backup) printHeadlessStatus() error {
-	projects, err := b.ListProjects()
+	stats, err := b.ProjectStatuses()
 	if err != nil {
 		return err
 	}
 
+	if b.JSON {
+		return PrintJSON(stats)
+	}
+
+	fmt.Println()
+	if len(stats) == 0 {
+		fmt.Println("No backups found.")
+		return nil
+	}
+
+	// Simple column printing
+	// Calculate max name length for padding
+	maxLen := 0
+	for _, s := range stats {
+		if len(s.Name) > maxLen {
+			maxLen = len(s.Name)
+		}
+	}
+
+	format := fmt.Sprintf("%%-%ds  %%s  %%s\n", maxLen)
+
+	// Header?
+	// fmt.Printf(format, "PROJECT", "LAST BACKUP", "AGO")
+
+	for _, s := range stats {
+		fmt.Printf(format, s.Name, s.LastBackup.Format("2006-01-02 15:04:05"), timeAgo(s.LastBackup))
+	}
+
+	return nil
+}
+
+// ProjectStatuses returns the latest backup time of every project in the
+// store, newest first.
+func (b *Backup) ProjectStatuses() ([]ProjectStatus, error) {
+	projects, err := b.ListProjects()
+	if err != nil {
+		return nil, err
+	}
+
 	var stats []ProjectStatus
 
 	for _, p := range projects {
@@ -299,8 +560,7 @@ func (b *Backup) printHeadlessStatus() error {
 		// No, `BackupRoots` uses `b.ProjectName`.
 		// Let's manually look into the project dir.
 
-		projectDir := filepath.Join(b.StoreSnapshots, p)
-		files, err := os.ReadDir(projectDir)
+		files, err := b.refs().List(p)
 		if err != nil {
 			continue // Skip bad projects
 		}
@@ -313,7 +573,7 @@ func (b *Backup) printHeadlessStatus() error {
 			if f.IsDir() {
 				continue
 			}
-			t, err := time.ParseInLocation("060102-150405", f.Name(), time.Local)
+			t, _, err := ParseSnapshotName(f.Name())
 			if err != nil {
 				continue
 			}
@@ -324,7 +584,11 @@ func (b *Backup) printHeadlessStatus() error {
 		}
 
 		if found {
-			stats = append(stats, ProjectStatus{Name: p, LastBackup: latestTime})
+			stats = append(stats, ProjectStatus{
+				Name:       p,
+				LastBackup: latestTime,
+				AgeSeconds: int64(time.Since(latestTime).Seconds()),
+			})
 		}
 	}
 
@@ -333,31 +597,14 @@ func (b *Backup) printHeadlessStatus() error {
 		return stats[i].LastBackup.After(stats[j].LastBackup)
 	})
 
-	fmt.Println()
-	if len(stats) == 0 {
-		fmt.Println("No backups found.")
-		return nil
-	}
-
-	// Simple column printing
-	// Calculate max name length for padding
-	maxLen := 0
-	for _, s := range stats {
-		if len(s.Name) > maxLen {
-			maxLen = len(s.Name)
-		}
-	}
-
-	format := fmt.Sprintf("%%-%ds  %%s  %%s\n", maxLen)
-
-	// Header?
-	// fmt.Printf(format, "PROJECT", "LAST BACKUP", "AGO")
-
-	for _, s := range stats {
-		fmt.Printf(format, s.Name, s.LastBackup.Format("2006-01-02 15:04:05"), timeAgo(s.LastBackup))
-	}
+	return stats, nil
+}
 
-	return nil
+// PrintJSON writes v to stdout as indented JSON.
+func PrintJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
 }
 
 func timeAgo(t time.Time) string {
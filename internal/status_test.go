@@ -1,6 +1,10 @@
 package internal
 
 import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -21,3 +25,182 @@ func TestStatusReport_Counters(t *testing.T) {
 		t.Error("Expected 1 New status")
 	}
 }
+
+func TestStatus_EmptyDirectory(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "a.txt", "a")
+	if err := os.Mkdir(filepath.Join(b.Top, "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	root := snapshotTestBackup(t, b, "260101-100000")
+	top, err := root.TopDirectory()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := NewStatusReport()
+	if err := b.runStatus(root, NewDirectoryEntry(b, b.Top, nil), top, report, false); err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, e := range report.Entries {
+		if e.Path == "empty" {
+			found = true
+			if !e.Dir || e.Status != StatusArchived {
+				t.Errorf("Expected empty/ to be an archived directory, got %s", e)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Expected empty/ in status entries, got %v", report.Entries)
+	}
+	if report.Directories != 1 || report.Counters[StatusArchived] != 2 {
+		t.Errorf("Unexpected counts: %d directories, counters %v", report.Directories, report.Counters)
+	}
+}
+
+func TestStatus_SnapshotNotFound(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "a.txt", "a")
+	snapshotTestBackup(t, b, "260101-100000")
+
+	if err := b.Status("260101-110000", false, false); err == nil {
+		t.Error("Expected an error for a missing snapshot")
+	}
+	b.JSON = true
+	if err := b.Status("260101-100000", false, false); err != nil {
+		t.Errorf("Expected status against an existing snapshot to succeed, got %v", err)
+	}
+}
+
+func TestStatus_Deleted(t *testing.T) {
+	b := newTestBackup(t)
+	for _, name := range []string{"a.txt", "c.txt", "gone/x.txt", "sub/b.txt", "sub/keep.txt", "z.log"} {
+		writeTestFile(t, b, name, name)
+	}
+	root := snapshotTestBackup(t, b, "260101-100000")
+	for _, name := range []string{"a.txt", "gone", "sub/b.txt"} {
+		if err := os.RemoveAll(filepath.Join(b.Top, filepath.FromSlash(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Ignored entries are not deleted
+	if err := os.WriteFile(filepath.Join(b.Top, ".backupignore"), []byte("*.log\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	top, err := root.TopDirectory()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := NewStatusReport()
+	if err := b.runStatus(root, NewDirectoryEntry(b, b.Top, nil), top, report, false); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, e := range report.Entries {
+		got = append(got, e.Status.String()+" "+e.Path)
+	}
+	want := []string{"N .backupignore", "D a.txt", ". c.txt", "D gone", "E sub", "D sub/b.txt", ". sub/keep.txt"}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Unexpected status entries:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if !report.Entries[3].Dir {
+		t.Error("Expected the deleted gone/ to be reported as a directory")
+	}
+	if report.Counters[StatusDeleted] != 3 || report.Files != 3 {
+		t.Errorf("Unexpected counts: %d files, counters %v", report.Files, report.Counters)
+	}
+}
+
+func TestStatus_TypeChanged(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require privileges on Windows")
+	}
+	b := newTestBackup(t)
+	writeTestFile(t, b, "dir-to-file/a.txt", "a")
+	writeTestFile(t, b, "file-to-dir", "file")
+	writeTestFile(t, b, "file-to-link", "file")
+	writeTestFile(t, b, "same.txt", "same")
+	if err := os.Symlink("same.txt", filepath.Join(b.Top, "link-to-file")); err != nil {
+		t.Fatal(err)
+	}
+	root := snapshotTestBackup(t, b, "260101-100000")
+
+	for _, name := range []string{"dir-to-file", "file-to-dir", "file-to-link", "link-to-file"} {
+		if err := os.RemoveAll(filepath.Join(b.Top, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestFile(t, b, "dir-to-file", "file")
+	writeTestFile(t, b, "file-to-dir/b.txt", "b")
+	writeTestFile(t, b, "link-to-file", "file")
+	if err := os.Symlink("same.txt", filepath.Join(b.Top, "file-to-link")); err != nil {
+		t.Fatal(err)
+	}
+	top, err := root.TopDirectory()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := NewStatusReport()
+	if err := b.runStatus(root, NewDirectoryEntry(b, b.Top, nil), top, report, false); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range report.Entries {
+		got = append(got, e.String())
+	}
+	want := []string{
+		"T dir-to-file (was a directory)",
+		"T file-to-dir/ (was a file)",
+		"N file-to-dir/b.txt",
+		"T file-to-link -> same.txt (was a file)",
+		"T link-to-file (was a symlink)",
+		". same.txt",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Unexpected status entries:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if report.Counters[StatusTypeChanged] != 4 || report.Counters[StatusDeleted] != 0 {
+		t.Errorf("Unexpected counters %v", report.Counters)
+	}
+}
+
+func TestStatus_Modified(t *testing.T) {
+	b := newTestBackup(t)
+	writeTestFile(t, b, "a.txt", "a")
+	writeTestFile(t, b, "c.txt", "c")
+	writeTestFile(t, b, "same.txt", "same")
+	writeTestFile(t, b, "sub/b.txt", "b")
+	root := snapshotTestBackup(t, b, "260101-100000")
+
+	writeTestFile(t, b, "a.txt", "changed")
+	writeTestFile(t, b, "c.txt", "same")    // Changed to content already in the store
+	writeTestFile(t, b, "copy.txt", "same") // Content already in the store
+	top, err := root.TopDirectory()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Paths are relative to the base of the report, not the working directory
+	b.CurrentWorkingDir = filepath.Join(b.Top, "sub")
+	report := NewStatusReport()
+	report.base = b.Top
+	if err := b.runStatus(root, NewDirectoryEntry(b, b.Top, nil), top, report, false); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range report.Entries {
+		got = append(got, e.String())
+	}
+	want := []string{"M a.txt", "M c.txt", "n copy.txt", ". same.txt", ". sub/", ". sub/b.txt"}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Unexpected status entries:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if report.Counters[StatusModified] != 2 || report.Counters[StatusArchivedContentMissing] != 0 {
+		t.Errorf("Unexpected counters %v", report.Counters)
+	}
+}
@@ -1,30 +1,298 @@
 package internal
 
 import (
-	"compress/gzip"
+	"bytes"
+	"crypto/cipher"
 	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
+)
+
+// DefaultHashAlgorithm is used when store.toml does not declare one.
+const DefaultHashAlgorithm = "md5"
+
+// HashFunc creates a new hash used for content addressing.
+type HashFunc func() hash.Hash
+
+var hashAlgorithms = map[string]HashFunc{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// LookupHashFunc returns the hash function registered under name.
+func LookupHashFunc(name string) (HashFunc, error) {
+	if name == "" {
+		name = DefaultHashAlgorithm
+	}
+	f, ok := hashAlgorithms[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash algorithm %q (supported: %s)", name, strings.Join(HashAlgorithms(), ", "))
+	}
+	return f, nil
+}
+
+// HashAlgorithms returns the names of the supported hash algorithms.
+func HashAlgorithms() []string {
+	names := make([]string, 0, len(hashAlgorithms))
+	for name := range hashAlgorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Default data directory sharding: one level of two hash characters.
+const (
+	DefaultShardWidth = 2
+	DefaultShardDepth = 1
 )
 
 type Store struct {
-	b *Backup
+	b          *Backup
+	HashName   string
+	HashFunc   HashFunc
+	Codec      *Codec
+	ShardWidth int // Hash characters per data subdirectory
+	ShardDepth int // Levels of data subdirectories; 0 stores blobs directly in data/
+	// IORetries is the number of times a blob operation failing with a
+	// transient IO error is retried, waiting IORetryDelay before the first
+	// retry and twice as long before each further one.
+	IORetries    int
+	IORetryDelay time.Duration
+	// Blobs holds the blobs, in the data directory unless store.toml names
+	// a remote location.
+	Blobs Blobstore
+	aead  cipher.AEAD // Encrypts blobs after compression; nil for plain stores
 }
 
 func NewStore(b *Backup) *Store {
-	return &Store{b: b}
+	s := &Store{b: b, HashName: DefaultHashAlgorithm, HashFunc: md5.New, Codec: codecs[DefaultCompression],
+		ShardWidth: DefaultShardWidth, ShardDepth: DefaultShardDepth,
+		IORetries: DefaultIORetries, IORetryDelay: DefaultIORetryDelay}
+	if b.StoreConfig != nil && b.StoreConfig.Hash != "" {
+		// NewBackup validates the algorithm before the store is created.
+		if f, err := LookupHashFunc(b.StoreConfig.Hash); err == nil {
+			s.HashName = strings.ToLower(b.StoreConfig.Hash)
+			s.HashFunc = f
+		}
+	}
+	if b.StoreConfig != nil && b.StoreConfig.Compression != "" {
+		if c, err := LookupCodec(b.StoreConfig.Compression); err == nil {
+			s.Codec = c
+		}
+	}
+	if b.StoreConfig != nil {
+		if width, depth, err := b.StoreConfig.Shards(); err == nil {
+			s.ShardWidth, s.ShardDepth = width, depth
+		}
+		if retries, delay, err := b.StoreConfig.IORetry(); err == nil {
+			s.IORetries, s.IORetryDelay = retries, delay
+		}
+	}
+	s.Blobs = &localBlobstore{s: s, dir: b.StoreData}
+	return s
+}
+
+// codec returns the store's blob codec, falling back to the default.
+func (s *Store) codec() *Codec {
+	if s == nil || s.Codec == nil {
+		return codecs[DefaultCompression]
+	}
+	return s.Codec
+}
+
+// shards returns the data directory sharding, falling back to the default.
+func (s *Store) shards() (width, depth int) {
+	if s == nil || s.ShardWidth == 0 {
+		return DefaultShardWidth, DefaultShardDepth
+	}
+	return s.ShardWidth, s.ShardDepth
+}
+
+// newReader decrypts and decompresses a blob read from r.
+func (s *Store) newReader(r io.Reader) (io.ReadCloser, error) {
+	if s != nil && s.aead != nil {
+		d, err := newDecryptReader(r, s.aead)
+		if err != nil {
+			return nil, err
+		}
+		r = d
+	}
+	return s.codec().NewReader(r)
+}
+
+// newWriter compresses and encrypts a blob written to w. The writer must be
+// closed to flush the blob.
+func (s *Store) newWriter(w io.Writer) (io.WriteCloser, error) {
+	if s == nil || s.aead == nil {
+		return s.codec().NewWriter(w)
+	}
+	e, err := newEncryptWriter(w, s.aead)
+	if err != nil {
+		return nil, err
+	}
+	cw, err := s.codec().NewWriter(e)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptingWriter{WriteCloser: cw, enc: e}, nil
+}
+
+// encryptingWriter closes the encryption after the compression it follows.
+type encryptingWriter struct {
+	io.WriteCloser
+	enc io.Closer
+}
+
+func (w *encryptingWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	return w.enc.Close()
+}
+
+// NewHash returns a fresh hash.Hash for the store's algorithm.
+// A nil store falls back to the default algorithm.
+func (s *Store) NewHash() hash.Hash {
+	if s == nil || s.HashFunc == nil {
+		return md5.New()
+	}
+	return s.HashFunc()
+}
+
+// HashLen returns the length of a hex encoded hash for the store's algorithm.
+func (s *Store) HashLen() int {
+	return s.NewHash().Size() * 2
+}
+
+// HashBytes returns the hex encoded hash of data.
+func (s *Store) HashBytes(data []byte) string {
+	h := s.NewHash()
+	h.Write(data)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// HashReader returns the hex encoded hash of everything read from r.
+func (s *Store) HashReader(r io.Reader) (string, error) {
+	h := s.NewHash()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// ValidHash reports whether hash is a hex string of the store's hash length.
+func (s *Store) ValidHash(hash string) bool {
+	return len(hash) == s.HashLen() && isHex(hash)
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !((c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')) {
+			return false
+		}
+	}
+	return true
 }
 
 // DataStore returns the path to the stored file for a given hash.
 func (s *Store) DataStore(hash string) string {
-	if len(hash) < 2 {
+	return s.blobPath(s.b.StoreData, hash)
+}
+
+// blobPath returns the path of the blob hash in the data directory dir.
+func (s *Store) blobPath(dir, hash string) string {
+	width, depth := s.shards()
+	if len(hash) < width*depth || len(hash) < 2 {
 		return ""
 	}
-	subStore := hash[:2]
-	return filepath.Join(s.b.StoreData, subStore, hash+".gz")
+	parts := []string{dir}
+	for i := 0; i < depth; i++ {
+		parts = append(parts, hash[i*width:(i+1)*width])
+	}
+	parts = append(parts, hash+s.codec().Ext)
+	return filepath.Join(parts...)
+}
+
+// HashFromPath returns the hash of the blob stored at p, the reverse of
+// DataStore. It reports false if p is not where DataStore puts a blob: a
+// path outside the data directory, in the wrong number of shard
+// directories, a name that is not a valid hash with the codec's
+// extension, or shard directories that do not match the hash.
+func (s *Store) HashFromPath(p string) (string, bool) {
+	rel, err := filepath.Rel(s.b.StoreData, p)
+	if err != nil || isOutside(rel) {
+		return "", false
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	hash, ok := s.blobName(parts[len(parts)-1])
+	if !ok || !s.inShard(hash, parts[:len(parts)-1]) {
+		return "", false
+	}
+	return hash, true
+}
+
+// BlobName returns the slash separated name of the blob hash below the
+// data directory, for Blobstore implementations of other backends.
+func (s *Store) BlobName(hash string) (string, error) {
+	width, depth := s.shards()
+	if !s.ValidHash(hash) || len(hash) < width*depth {
+		return "", fmt.Errorf("invalid hash %q", hash)
+	}
+	parts := make([]string, 0, depth+1)
+	for i := 0; i < depth; i++ {
+		parts = append(parts, hash[i*width:(i+1)*width])
+	}
+	return path.Join(append(parts, hash+s.codec().Ext)...), nil
+}
+
+// HashFromName returns the hash of the blob named name below the data
+// directory, the reverse of BlobName. It reports false if name is not
+// where BlobName puts a blob.
+func (s *Store) HashFromName(name string) (string, bool) {
+	parts := strings.Split(name, "/")
+	hash, ok := s.blobName(parts[len(parts)-1])
+	if !ok || !s.inShard(hash, parts[:len(parts)-1]) {
+		return "", false
+	}
+	return hash, true
+}
+
+// blobName returns the hash of a blob file named name.
+func (s *Store) blobName(name string) (string, bool) {
+	ext := s.codec().Ext
+	if !strings.HasSuffix(name, ext) {
+		return "", false
+	}
+	hash := strings.TrimSuffix(name, ext)
+	return hash, s.ValidHash(hash)
+}
+
+// inShard reports whether shards are the directories blobPath puts hash
+// in.
+func (s *Store) inShard(hash string, shards []string) bool {
+	width, depth := s.shards()
+	if len(shards) != depth {
+		return false
+	}
+	for i, dir := range shards {
+		if dir != hash[i*width:(i+1)*width] {
+			return false
+		}
+	}
+	return true
 }
 
 // Copy copies from in to out using a buffer.
@@ -33,50 +301,234 @@ func Copy(in io.Reader, out io.Writer) error {
 	return err
 }
 
-// GzipContentHash calculates the MD5 of the uncompressed content of a gzip file.
-func (s *Store) GzipContentHash(gzipPath string) (string, error) {
-	f, err := os.Open(gzipPath)
+// BlobContentHash calculates the hash of the uncompressed content of a blob file.
+func (s *Store) BlobContentHash(blobPath string) (string, error) {
+	f, err := os.Open(blobPath)
 	if err != nil {
 		return "", err
 	}
 	defer f.Close()
 
-	gz, err := gzip.NewReader(f)
+	gz, err := s.newReader(f)
 	if err != nil {
 		return "", err
 	}
 	defer gz.Close()
 
-	hash := md5.New()
-	if _, err := io.Copy(hash, gz); err != nil {
-		return "", err
+	return s.HashReader(gz)
+}
+
+// saveBlob stores data under hash unless the blob already exists.
+// It reports whether a new blob was written.
+func (s *Store) saveBlob(hash string, data []byte) (bool, error) {
+	if !s.ValidHash(hash) {
+		return false, fmt.Errorf("invalid hash")
 	}
+	if s.hasBlob(hash) {
+		return false, nil
+	}
+	return true, s.writeBlob(hash, bytes.NewReader(data))
+}
 
-	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+// writeBlob compresses r into the blob hash. The blob store only makes the
+// blob visible once it is complete.
+func (s *Store) writeBlob(hash string, r io.Reader) error {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		gw, err := s.newWriter(pw)
+		if err == nil {
+			_, err = io.Copy(gw, r)
+			if cerr := gw.Close(); err == nil {
+				err = cerr
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	err := s.Blobs.Put(hash, pr)
+	// Unblocks the compression if Put stopped reading early
+	pr.CloseWithError(errors.New("blob store stopped reading"))
+	<-done
+	return err
 }
 
-// CleanupPartials removes any leftover .partial files in the store.
-// Returns the number of files removed.
-func (s *Store) CleanupPartials() (int, error) {
-	count := 0
+// saveStream stores the content of r as a blob when its hash is not known
+// up front: the content is hashed while it is compressed into a temporary
+// file, which is then stored under its hash. It returns the hash, the
+// content length and whether a new blob was stored.
+func (s *Store) saveStream(r io.Reader) (string, int64, bool, error) {
+	temp, hash, n, err := s.writeHashed(r)
+	if err != nil {
+		return "", 0, false, err
+	}
+	if s.hasBlob(hash) {
+		return hash, n, false, os.Remove(temp)
+	}
+	return hash, n, true, s.commitTemp(temp, hash)
+}
+
+// tempPath names the temporary files of writeHashed. Local stores keep them
+// next to the blobs, so that they can be renamed into place and leftovers
+// are found by FindPartials.
+func (s *Store) tempPath() string {
+	if l, ok := s.Blobs.(*localBlobstore); ok {
+		return filepath.Join(l.dir, "stream")
+	}
+	return filepath.Join(os.TempDir(), "backup-stream")
+}
+
+// commitTemp stores the temporary file temp of writeHashed as the blob hash
+// and removes it.
+func (s *Store) commitTemp(temp, hash string) error {
+	if l, ok := s.Blobs.(*localBlobstore); ok {
+		if err := l.putFile(hash, temp); err != nil {
+			os.Remove(temp)
+			return err
+		}
+		return nil
+	}
+	defer os.Remove(temp)
+	f, err := os.Open(temp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.Blobs.Put(hash, f)
+}
+
+// writeHashed compresses r into a temporary file and returns its name with
+// the hash and length of the content. The caller commits or removes the
+// temporary file.
+func (s *Store) writeHashed(r io.Reader) (string, string, int64, error) {
+	dest := s.tempPath()
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", "", 0, err
+	}
+	out, err := createPartial(dest)
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer out.Close()
+
+	h := s.NewHash()
+	n, err := func() (int64, error) {
+		gw, err := s.newWriter(out)
+		if err != nil {
+			return 0, err
+		}
+		n, err := io.Copy(gw, io.TeeReader(r, h))
+		if cerr := gw.Close(); err == nil {
+			err = cerr
+		}
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		return n, err
+	}()
+	if err != nil {
+		os.Remove(out.Name())
+		return "", "", 0, err
+	}
+	return out.Name(), fmt.Sprintf("%x", h.Sum(nil)), n, nil
+}
+
+// copyBlob writes the uncompressed content of the blob hash to w.
+func (s *Store) copyBlob(w io.Writer, hash string) error {
+	gz, err := s.openBlob(hash)
+	if err != nil {
+		return fmt.Errorf("failed to open store file: %w", err)
+	}
+	defer gz.Close()
+
+	if _, err := io.Copy(w, gz); err != nil {
+		return fmt.Errorf("failed to copy content: %w", err)
+	}
+	return nil
+}
+
+// createPartial creates a uniquely named .partial file next to dest. Content
+// is written there and renamed into place, so concurrent saves of the same
+// blob never share a temporary file.
+func createPartial(dest string) (*os.File, error) {
+	f, err := os.CreateTemp(filepath.Dir(dest), filepath.Base(dest)+".*.partial")
+	if err != nil {
+		// A create that failed with a transient error may still have made
+		// the file; the error names it. A retry uses a new name.
+		var pe *fs.PathError
+		if errors.As(err, &pe) && strings.HasSuffix(pe.Path, ".partial") && !strings.Contains(pe.Path, "*") {
+			os.Remove(pe.Path)
+		}
+		return nil, err
+	}
+	// CreateTemp uses 0600; blobs keep the permissions os.Create would give them
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// FindPartials returns the paths of leftover .partial files in the store,
+// written by backups that were interrupted before renaming them into place.
+func (s *Store) FindPartials() ([]string, error) {
+	var partials []string
 	err := filepath.Walk(s.b.StoreData, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
-			return err // Or return nil to continue? Better to report.
+			if os.IsNotExist(err) && path == s.b.StoreData {
+				return filepath.SkipDir
+			}
+			return err
 		}
 		if !info.IsDir() && strings.HasSuffix(info.Name(), ".partial") {
-			if s.b.DryRun {
-				fmt.Printf("[dry-run] Would remove partial file: %s\n", path)
-				count++
-			} else {
-				if err := os.Remove(path); err != nil {
-					// Warn but continue
-					fmt.Fprintf(os.Stderr, "Warning: failed to remove partial file %s: %v\n", path, err)
-				} else {
-					count++
-				}
+			partials = append(partials, path)
+		}
+		return nil
+	})
+	return partials, err
+}
+
+// FindMisfiled returns the paths of blobs in the data directory that are
+// not in the shard directories of their hash, e.g. because they were copied
+// into the store by hand. Such blobs cannot be read by their hash.
+func (s *Store) FindMisfiled() ([]string, error) {
+	var misfiled []string
+	err := filepath.Walk(s.b.StoreData, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == s.b.StoreData {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if _, ok := s.blobName(info.Name()); ok {
+			if _, ok := s.HashFromPath(path); !ok {
+				misfiled = append(misfiled, path)
 			}
 		}
 		return nil
 	})
+	return misfiled, err
+}
+
+// CleanupPartials removes any leftover .partial files in the store.
+// Returns the number of files removed.
+func (s *Store) CleanupPartials() (int, error) {
+	partials, err := s.FindPartials()
+	count := 0
+	for _, path := range partials {
+		if s.b.DryRun {
+			s.b.infof("[dry-run] Would remove partial file: %s", path)
+			count++
+		} else if err := os.Remove(path); err != nil {
+			// Warn but continue
+			s.b.warnf("failed to remove partial file %s: %v", path, err)
+		} else {
+			count++
+		}
+	}
 	return count, err
 }
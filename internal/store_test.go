@@ -0,0 +1,45 @@
+package internal
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestStore_HashFromPath(t *testing.T) {
+	b := newTestBackup(t)
+	hash := b.Store.HashBytes([]byte("a"))
+	ext := b.Store.codec().Ext
+
+	got, ok := b.Store.HashFromPath(b.Store.DataStore(hash))
+	if !ok || got != hash {
+		t.Errorf("Expected %s from its own path, got %q (%v)", hash, got, ok)
+	}
+
+	for name, path := range map[string]string{
+		"wrong shard":      filepath.Join(b.StoreData, "zz", hash+ext),
+		"no shard":         filepath.Join(b.StoreData, hash+ext),
+		"too deep":         filepath.Join(b.StoreData, hash[:2], hash[:2], hash+ext),
+		"other extension":  filepath.Join(b.StoreData, hash[:2], hash+".txt"),
+		"partial file":     filepath.Join(b.StoreData, hash[:2], hash+ext+".partial"),
+		"invalid hash":     filepath.Join(b.StoreData, "ab", "abc"+ext),
+		"outside the data": filepath.Join(b.StoreRoot, hash[:2], hash+ext),
+	} {
+		if got, ok := b.Store.HashFromPath(path); ok {
+			t.Errorf("%s: expected %s to be rejected, got %s", name, path, got)
+		}
+	}
+
+	// Deeper sharding as configured in store.toml
+	b.Store.ShardWidth, b.Store.ShardDepth = 1, 3
+	path := b.Store.DataStore(hash)
+	if got, ok := b.Store.HashFromPath(path); !ok || got != hash {
+		t.Errorf("Expected %s from %s, got %q (%v)", hash, path, got, ok)
+	}
+	wrong := "0"
+	if hash[1] == '0' {
+		wrong = "1"
+	}
+	if _, ok := b.Store.HashFromPath(filepath.Join(b.StoreData, hash[:1], wrong, hash[2:3], hash+ext)); ok {
+		t.Error("Expected a wrong inner shard to be rejected")
+	}
+}
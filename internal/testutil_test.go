@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestBackup returns a Backup with an empty source tree and store in
+// temporary directories.
+func newTestBackup(t *testing.T) *Backup {
+	t.Helper()
+	sourceDir := t.TempDir()
+	storeDir := t.TempDir()
+
+	b := &Backup{
+		Top:               sourceDir,
+		CurrentWorkingDir: sourceDir,
+		StoreRoot:         storeDir,
+		StoreData:         filepath.Join(storeDir, "data"),
+		StoreSnapshots:    filepath.Join(storeDir, "snapshots"),
+		ProjectName:       "test",
+		HashCache:         &HashCache{top: sourceDir, cache: make(Properties)},
+	}
+	b.Store = NewStore(b)
+	if err := os.MkdirAll(b.StoreData, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(b.StoreSnapshots, b.ProjectName), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// writeTestFile creates a file (and its parent directories) below the source root.
+func writeTestFile(t *testing.T, b *Backup, rel, content string) {
+	t.Helper()
+	p := filepath.Join(b.Top, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// snapshotTestBackup saves the source tree and writes a snapshot head
+// with the given timestamp name (yyMMdd-HHmmss).
+func snapshotTestBackup(t *testing.T, b *Backup, name string) *BackupRoot {
+	t.Helper()
+	top := NewDirectoryEntry(b, b.Top, nil)
+	if err := top.Save(); err != nil {
+		t.Fatal(err)
+	}
+	h, err := top.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := filepath.Join(b.StoreSnapshots, b.ProjectName, name)
+	if err := os.WriteFile(head, []byte(h+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	root, err := NewBackupRoot(b, head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
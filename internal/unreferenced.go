@@ -1,12 +1,11 @@
 package internal
 
 import (
-	"bufio"
-	"compress/gzip"
+	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
-	"strings"
+	"io/fs"
+	"path"
+	"sort"
 )
 
 // FindUnreferenced returns a list of blob hashes that are present in the store
@@ -40,31 +39,71 @@ func (b *Backup) GetReachableBlobs() (map[string]bool, error) {
 	visitedDirs := make(map[string]bool)
 
 	// We must check ALL projects to ensure we don't count blobs from other projects as unreferenced.
-	roots, err := b.AllBackupRoots()
+	roots, err := b.referencingRoots()
 	if err != nil {
 		return nil, err
 	}
 
 	for _, root := range roots {
-		h, err := root.Hash()
-		if err != nil {
-			// If root is corrupted (can't read existing hash file), we can't traverse it.
-			// But we should warn? For now, if we can't read the hash, we can't mark its children.
-			// This might risk pruning blobs that are actually needed if the root file is restored later?
-			// The root file is in `snapshots/`, not `data/`.
-			// If `snapshots/` entry cannot be read, we skip it.
-			continue
-		}
-
+		h, _ := root.Hash()
 		if err := b.markReachable(h, reachable, visitedDirs); err != nil {
-			// If we fail to read a directory, we risk missing its children.
-			// Should we abort?
 			return nil, err
 		}
 	}
 	return reachable, nil
 }
 
+// referencingRoots returns the snapshots of all projects, like
+// AllBackupRoots, for finding the blobs they reference. The blobs of a
+// snapshot that is left out would look unreferenced, so it fails if a
+// project or head cannot be read; only the damaged heads of InvalidHeads,
+// which reference nothing, are skipped.
+func (b *Backup) referencingRoots() ([]*BackupRoot, error) {
+	invalid, err := b.InvalidHeads()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	damaged := make(map[string]bool)
+	for _, h := range invalid {
+		if !h.Damaged {
+			return nil, fmt.Errorf("failed to read snapshot head %s: %w", h.Ref, h.Err)
+		}
+		damaged[h.Ref] = true
+	}
+
+	projects, err := b.refs().List("")
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	var roots []*BackupRoot
+	for _, p := range projects {
+		if !p.IsDir() {
+			continue
+		}
+		files, err := b.refs().List(p.Name())
+		if err != nil {
+			return nil, fmt.Errorf("failed to list snapshots of %s: %w", p.Name(), err)
+		}
+		for _, f := range files {
+			ref := path.Join(p.Name(), f.Name())
+			// Partial heads and metadata sidecars are no snapshot names
+			if _, _, err := ParseSnapshotName(f.Name()); err != nil || f.IsDir() || damaged[ref] {
+				continue
+			}
+			root, err := b.backupRoot(ref)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read snapshot head %s: %w", ref, err)
+			}
+			roots = append(roots, root)
+		}
+	}
+	sort.Sort(BackupRoots(roots))
+	return roots, nil
+}
+
 // markReachable recursively adds hashes to the reachable set
 func (b *Backup) markReachable(hash string, reachable, visitedDirs map[string]bool) error {
 	// Mark current
@@ -96,41 +135,25 @@ func (b *Backup) markReachable(hash string, reachable, visitedDirs map[string]bo
 func (b *Backup) traverseReachable(hash string, reachable, visitedDirs map[string]bool) error {
 	visitedDirs[hash] = true // Mark as visited to prevent re-traversal/cycles
 
-	storePath := b.Store.DataStore(hash)
-	f, err := os.Open(storePath)
+	gz, err := b.Store.openBlob(hash)
 	if err != nil {
-		// If we can't open a blob that is referenced, it's missing.
-		// We can't traverse it.
-		// Check will report this. For prune, we just assume we can't find its children.
-		// Does this risk deleting children?
-		// Yes. If A -> B, and A is missing, we don't visit B.
-		// If B is not referenced by anything else, B becomes an orphan.
-		// So `prune` on a corrupted store (missing directory blobs) is DESTRUCTIVE to potentially recoverable hidden data.
-		// Prune should probably abort if it encounters missing reachable directories?
-		// Or warn.
-		// Let's return error to be safe.
-		if os.IsNotExist(err) {
-			return nil // Can't traverse
+		// The children of a missing listing cannot be marked, and prune
+		// would delete the ones no other listing references
+		if errors.Is(err, fs.ErrNotExist) {
+			return &MissingBlobError{Hash: hash, Kind: "directory listing"}
 		}
-		return err
-	}
-	defer f.Close()
-
-	gz, err := gzip.NewReader(f)
-	if err != nil {
 		return fmt.Errorf("failed to read blob %s: %w", hash, err)
 	}
 	defer gz.Close()
 
-	scanner := bufio.NewScanner(gz)
+	scanner := newListingScanner(gz)
 	for scanner.Scan() {
-		line := scanner.Text()
-		if len(line) < 36 {
+		// Format: "D <hash> [attrs] <name>" or "F <hash> [attrs] <name>"
+		l, err := scanner.Entry()
+		if err != nil {
 			continue
 		}
-		// Format: "D <hash> <name>" or "F <hash> <name>"
-		typeChar := line[0]
-		childHash := line[2:34]
+		typeChar, childHash := l.Type, l.Hash
 
 		reachable[childHash] = true
 
@@ -141,6 +164,11 @@ func (b *Backup) traverseReachable(hash string, reachable, visitedDirs map[strin
 				}
 			}
 		}
+		if typeChar == 'C' && !visitedDirs[childHash] {
+			if err := b.markChunksReachable(childHash, reachable, visitedDirs); err != nil {
+				return err
+			}
+		}
 	}
 
 	if err := scanner.Err(); err != nil {
@@ -149,36 +177,31 @@ func (b *Backup) traverseReachable(hash string, reachable, visitedDirs map[strin
 	return nil
 }
 
+// markChunksReachable adds the chunks listed in a chunk manifest to the reachable set.
+func (b *Backup) markChunksReachable(hash string, reachable, visitedDirs map[string]bool) error {
+	visitedDirs[hash] = true
+	if !b.Store.hasBlob(hash) {
+		return &MissingBlobError{Hash: hash, Kind: "chunk manifest"}
+	}
+	chunks, err := b.Store.readManifest(hash)
+	if err != nil {
+		return err
+	}
+	for _, c := range chunks {
+		reachable[c.Hash] = true
+	}
+	return nil
+}
+
 // GetAllBlobs returns a set of all blob hashes found in the data store.
 func (b *Backup) GetAllBlobs() (map[string]bool, error) {
-	all := make(map[string]bool)
-
-	// Data stored in data/<subDir>/<hash>.gz
-	dataDir := b.StoreData
-	entries, err := os.ReadDir(dataDir)
+	hashes, err := b.Store.Blobs.List()
 	if err != nil {
-		if os.IsNotExist(err) {
-			return all, nil
-		}
 		return nil, err
 	}
-
-	for _, sub := range entries {
-		if !sub.IsDir() {
-			continue
-		}
-		subPath := filepath.Join(dataDir, sub.Name())
-		files, err := os.ReadDir(subPath)
-		if err != nil {
-			return nil, err
-		}
-		for _, f := range files {
-			name := f.Name()
-			if strings.HasSuffix(name, ".gz") {
-				hash := strings.TrimSuffix(name, ".gz")
-				all[hash] = true
-			}
-		}
+	all := make(map[string]bool, len(hashes))
+	for _, hash := range hashes {
+		all[hash] = true
 	}
 	return all, nil
 }
@@ -1,31 +1,212 @@
 package internal
 
 import (
+	"fmt"
 	"os"
+	"os/user"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
-// ExpandPath expands tilde (~) to the user's home directory.
+// ExpandPath expands a path given by the user on the command line or in a
+// config file: a leading ~ or ~user becomes the home directory of the
+// current or the named user, and $VAR or ${VAR} the value of the
+// environment variable. $$ stands for a literal $, and a $ not followed by
+// a variable name, as in "share$1", is kept. Unset variables are an error
+// rather than expanding to nothing, which could turn a path into a
+// different existing one.
 func ExpandPath(path string) (string, error) {
-	if !strings.HasPrefix(path, "~") {
-		return path, nil
+	if strings.HasPrefix(path, "~") {
+		name, rest, _ := strings.Cut(path[1:], "/")
+		if filepath.Separator == '\\' {
+			name, rest, _ = strings.Cut(strings.ReplaceAll(path[1:], `\`, "/"), "/")
+		}
+		var home string
+		if name == "" {
+			var err error
+			if home, err = os.UserHomeDir(); err != nil {
+				return "", err
+			}
+		} else {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", fmt.Errorf("cannot expand %s: unknown user %s", path, name)
+			}
+			home = u.HomeDir
+		}
+		path = home
+		if rest != "" {
+			path = filepath.Join(home, filepath.FromSlash(rest))
+		}
 	}
 
-	home, err := os.UserHomeDir()
+	path, unset := expandEnv(path)
+	if len(unset) > 0 {
+		return "", fmt.Errorf("cannot expand path: environment variable %s is not set", strings.Join(unset, ", "))
+	}
+	return path, nil
+}
+
+// expandEnv expands the variables of path for ExpandPath and returns the
+// names of those that are not set. Unlike os.Expand it only takes names of
+// letters, digits and underscores not starting with a digit, and $$ for $.
+func expandEnv(path string) (string, []string) {
+	var sb strings.Builder
+	var unset []string
+	for i := 0; i < len(path); i++ {
+		if path[i] != '$' || i+1 == len(path) {
+			sb.WriteByte(path[i])
+			continue
+		}
+		rest := path[i+1:]
+		if rest[0] == '$' {
+			sb.WriteByte('$')
+			i++
+			continue
+		}
+		name, braced := rest, false
+		if rest[0] == '{' {
+			end := strings.IndexByte(rest, '}')
+			if end < 0 {
+				sb.WriteByte('$')
+				continue
+			}
+			name, braced = rest[1:end], true
+		}
+		n := 0
+		for n < len(name) && (name[n] == '_' || name[n] >= 'a' && name[n] <= 'z' || name[n] >= 'A' && name[n] <= 'Z' || n > 0 && name[n] >= '0' && name[n] <= '9') {
+			n++
+		}
+		if n == 0 || braced && n != len(name) {
+			sb.WriteByte('$')
+			continue
+		}
+		name = name[:n]
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			unset = append(unset, name)
+		}
+		sb.WriteString(value)
+		i += n
+		if braced {
+			i += 2
+		}
+	}
+	return sb.String(), unset
+}
+
+// CanonicalPath returns the absolute path of path with symlinks resolved,
+// so that paths reaching the same directory through links (e.g. /var and
+// /private/var on macOS) compare equal. The part of path that does not
+// exist yet is kept as given.
+func CanonicalPath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
 	if err != nil {
 		return "", err
 	}
+	missing := ""
+	for dir := abs; ; {
+		if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+			return filepath.Join(resolved, missing), nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return abs, nil
+		}
+		missing = filepath.Join(filepath.Base(dir), missing)
+		dir = parent
+	}
+}
+
+var sizeUnits = map[string]int64{
+	"":    1,
+	"B":   1,
+	"K":   1 << 10,
+	"KB":  1000,
+	"KIB": 1 << 10,
+	"M":   1 << 20,
+	"MB":  1000 * 1000,
+	"MIB": 1 << 20,
+	"G":   1 << 30,
+	"GB":  1000 * 1000 * 1000,
+	"GIB": 1 << 30,
+	"T":   1 << 40,
+	"TB":  1000 * 1000 * 1000 * 1000,
+	"TIB": 1 << 40,
+}
 
-	if path == "~" {
-		return home, nil
+// ParseSize parses a byte size with an optional unit, e.g. "512", "100MB" or "1.5GiB".
+// KB/MB/GB/TB are decimal units; K/M/G/T and KiB/MiB/GiB/TiB are binary units.
+func ParseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	i := 0
+	for i < len(s) && (s[i] >= '0' && s[i] <= '9' || s[i] == '.') {
+		i++
+	}
+	if i == 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
 	}
+	value, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	unit, ok := sizeUnits[strings.ToUpper(strings.TrimSpace(s[i:]))]
+	if !ok {
+		return 0, fmt.Errorf("invalid size unit in %q", s)
+	}
+	return int64(value * float64(unit)), nil
+}
 
-	if strings.HasPrefix(path, "~/") || strings.HasPrefix(path, "~\\") {
-		return filepath.Join(home, path[2:]), nil
+// HumanizeBytes formats a byte count with binary units, e.g. "512 B" or
+// "1.5 GiB".
+func HumanizeBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
 	}
+	value := float64(n) / unit
+	i := 0
+	for value >= unit && i < 4 {
+		value /= unit
+		i++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTP"[i])
+}
 
-	// For other tilde prefixes (e.g. ~user), we don't support them for now.
-	// But let's return it as is or handle it if needed.
-	return path, nil
+// ParseAge parses an age such as "12h", "30d", "2w", "6m" (months) or "1y"
+// and returns the point in time that long before now.
+func ParseAge(s string, now time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if len(s) < 2 {
+		return time.Time{}, fmt.Errorf("invalid age %q", s)
+	}
+	n, err := strconv.Atoi(s[:len(s)-1])
+	if err != nil || n < 0 {
+		return time.Time{}, fmt.Errorf("invalid age %q", s)
+	}
+	switch strings.ToLower(s[len(s)-1:]) {
+	case "h":
+		return now.Add(-time.Duration(n) * time.Hour), nil
+	case "d":
+		return now.AddDate(0, 0, -n), nil
+	case "w":
+		return now.AddDate(0, 0, -7*n), nil
+	case "m":
+		return now.AddDate(0, -n, 0), nil
+	case "y":
+		return now.AddDate(-n, 0, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid age unit in %q (use h, d, w, m or y)", s)
+}
+
+// ParsePercent parses a percentage such as "10%" or "2.5" and returns it
+// as a fraction in (0, 1].
+func ParsePercent(s string) (float64, error) {
+	v, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "%"), 64)
+	if err != nil || v <= 0 || v > 100 {
+		return 0, fmt.Errorf("invalid percentage %q (use a value in (0, 100])", s)
+	}
+	return v / 100, nil
 }
@@ -0,0 +1,184 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "512", want: 512},
+		{in: "10B", want: 10},
+		{in: "1K", want: 1024},
+		{in: "1KB", want: 1000},
+		{in: "1KiB", want: 1024},
+		{in: "100MB", want: 100 * 1000 * 1000},
+		{in: "100 mb", want: 100 * 1000 * 1000},
+		{in: "1.5GiB", want: 3 << 29},
+		{in: "", wantErr: true},
+		{in: "MB", wantErr: true},
+		{in: "10XB", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSize(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseSize(%q) expected error", tt.in)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, %v; want %d", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestHumanizeBytes(t *testing.T) {
+	tests := []struct {
+		in   int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{100 << 20, "100.0 MiB"},
+		{3 << 29, "1.5 GiB"},
+		{5 << 40, "5.0 TiB"},
+		{2 << 50, "2.0 PiB"},
+	}
+	for _, tt := range tests {
+		if got := HumanizeBytes(tt.in); got != tt.want {
+			t.Errorf("HumanizeBytes(%d) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	now := time.Date(2026, 3, 31, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		in      string
+		want    time.Time
+		wantErr bool
+	}{
+		{in: "12h", want: time.Date(2026, 3, 31, 0, 0, 0, 0, time.UTC)},
+		{in: "30d", want: time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)},
+		{in: "2w", want: time.Date(2026, 3, 17, 12, 0, 0, 0, time.UTC)},
+		{in: "1m", want: now.AddDate(0, -1, 0)},
+		{in: "1Y", want: time.Date(2025, 3, 31, 12, 0, 0, 0, time.UTC)},
+		{in: "", wantErr: true},
+		{in: "d", wantErr: true},
+		{in: "30", wantErr: true},
+		{in: "-1d", wantErr: true},
+		{in: "3x", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseAge(tt.in, now)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseAge(%q) expected error", tt.in)
+			}
+			continue
+		}
+		if err != nil || !got.Equal(tt.want) {
+			t.Errorf("ParseAge(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestParsePercent(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    float64
+		wantErr bool
+	}{
+		{in: "10%", want: 0.1},
+		{in: "2.5", want: 0.025},
+		{in: "100%", want: 1},
+		{in: "0%", wantErr: true},
+		{in: "101%", wantErr: true},
+		{in: "ten", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParsePercent(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParsePercent(%q) expected error", tt.in)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParsePercent(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestCanonicalPath(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Symlinks need privileges on Windows")
+	}
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "real"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "real"), filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{
+		filepath.Join(dir, "link"):                   filepath.Join(dir, "real"),
+		filepath.Join(dir, "link", "missing", "sub"): filepath.Join(dir, "real", "missing", "sub"),
+		filepath.Join(dir, "link", "..", "real"):     filepath.Join(dir, "real"),
+		filepath.Join(dir, "missing"):                filepath.Join(dir, "missing"),
+	} {
+		if got, err := CanonicalPath(path); err != nil || got != want {
+			t.Errorf("CanonicalPath(%s) = %s (%v), want %s", path, got, err, want)
+		}
+	}
+}
+
+func TestExpandPath(t *testing.T) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Skip("No home directory")
+	}
+	dir := t.TempDir()
+	t.Setenv("BACKUP_TEST_DIR", dir)
+	t.Setenv("BACKUP_TEST_NAME", "proj")
+	for path, want := range map[string]string{
+		"":                              "",
+		"-":                             "-",
+		"~":                             home,
+		"~/backups":                     filepath.Join(home, "backups"),
+		"$BACKUP_TEST_DIR/out":          dir + "/out",
+		"${BACKUP_TEST_DIR}/out":        dir + "/out",
+		"~/backups/${BACKUP_TEST_NAME}": filepath.Join(home, "backups", "proj"),
+		"relative/$BACKUP_TEST_DIR":     "relative/" + dir,
+		`C:\$$Recycle.Bin`:              `C:\$Recycle.Bin`,
+		"/srv/share$1":                  "/srv/share$1",
+		"/srv/$$BACKUP_TEST_DIR":        "/srv/$BACKUP_TEST_DIR",
+		"/srv/$$$BACKUP_TEST_NAME":      "/srv/$proj",
+		"/srv/cost$":                    "/srv/cost$",
+		"/srv/${not a name}/${x":        "/srv/${not a name}/${x",
+	} {
+		if got, err := ExpandPath(path); err != nil || got != want {
+			t.Errorf("ExpandPath(%q) = %q (%v), want %q", path, got, err, want)
+		}
+	}
+
+	for _, path := range []string{"$BACKUP_TEST_UNSET/out", "${BACKUP_TEST_UNSET}", "~no-such-user-of-backup/out"} {
+		if _, err := ExpandPath(path); err == nil {
+			t.Errorf("Expected ExpandPath(%q) to fail", path)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// WatchOptions configures Watch.
+type WatchOptions struct {
+	// Debounce is how long the source tree must stay unchanged after a
+	// change before a backup starts.
+	Debounce time.Duration
+	// MinInterval is the least time between the starts of two backups.
+	MinInterval time.Duration
+	// OnChange, if set, is called with the path of every change that is not
+	// ignored.
+	OnChange func(path string)
+	// OnSnapshot, if set, is called after every backup with its result.
+	// Failed backups are retried after the next change.
+	OnSnapshot func(root *BackupRoot, err error)
+}
+
+// Watch monitors the source tree below b.Top, including b.Includes, and
+// backs it up with CreateSnapshot once changes settle, until ctx is done.
+// Changes to ignored paths, the .backup directory and a store inside the
+// tree do not trigger backups. Each backup holds the store lock only while
+// it runs, so other commands can use the store in between.
+func (b *Backup) Watch(ctx context.Context, opts WatchOptions) error {
+	w, err := b.newTreeWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	return b.runWatch(ctx, w, opts)
+}
+
+func (b *Backup) runWatch(ctx context.Context, w *treeWatcher, opts WatchOptions) error {
+	// The timer only runs while changes are pending
+	timer := time.NewTimer(0)
+	<-timer.C
+	var lastStart time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return nil
+			}
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				// Changes were lost; back up anyway
+				timer.Reset(opts.Debounce)
+				continue
+			}
+			b.warnf("watch error: %v", err)
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return nil
+			}
+			if !w.handle(event) {
+				continue
+			}
+			if opts.OnChange != nil {
+				opts.OnChange(event.Name)
+			}
+			timer.Reset(opts.Debounce)
+		case <-timer.C:
+			if wait := opts.MinInterval - time.Since(lastStart); wait > 0 {
+				timer.Reset(wait)
+				continue
+			}
+			lastStart = time.Now()
+			root, err := b.watchSnapshot()
+			if opts.OnSnapshot != nil {
+				opts.OnSnapshot(root, err)
+			}
+		}
+	}
+}
+
+// watchSnapshot creates a snapshot under the store lock.
+func (b *Backup) watchSnapshot() (*BackupRoot, error) {
+	if !b.DryRun {
+		if err := b.Lock(); err != nil {
+			return nil, err
+		}
+		defer b.Unlock()
+	}
+	root, _, err := b.CreateSnapshot()
+	return root, err
+}
+
+// treeWatcher watches every directory of the source tree that is not
+// ignored, keeping the directory entries that match the ignore patterns of
+// each.
+type treeWatcher struct {
+	b       *Backup
+	watcher *fsnotify.Watcher
+	dirs    map[string]*DirectoryEntry
+}
+
+func (b *Backup) newTreeWatcher() (*treeWatcher, error) {
+	if b.Top == "" {
+		return nil, fmt.Errorf("no source directory to watch")
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w := &treeWatcher{b: b, watcher: watcher}
+	if err := w.addRoots(); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *treeWatcher) Close() error {
+	return w.watcher.Close()
+}
+
+// addRoots (re)builds the watches of the top directory and the includes.
+func (w *treeWatcher) addRoots() error {
+	for dir := range w.dirs {
+		w.watcher.Remove(dir)
+	}
+	w.dirs = make(map[string]*DirectoryEntry)
+	if err := w.add(NewDirectoryEntry(w.b, w.b.Top, nil)); err != nil {
+		return err
+	}
+	for _, inc := range w.b.Includes {
+		if err := w.add(NewDirectoryEntry(w.b, inc, nil)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add watches the directory of e and its subdirectories that are not
+// ignored.
+func (w *treeWatcher) add(e *DirectoryEntry) error {
+	if err := w.watcher.Add(e.path); err != nil {
+		return fmt.Errorf("failed to watch %s: %w", e.path, err)
+	}
+	w.dirs[e.path] = e
+	files, err := os.ReadDir(e.path)
+	if err != nil {
+		return nil // Removed meanwhile; the event of its parent follows
+	}
+	for _, f := range files {
+		if !f.IsDir() {
+			continue
+		}
+		path := filepath.Join(e.path, f.Name())
+		if w.skip(e, path, true) {
+			continue
+		}
+		if err := w.add(NewDirectoryEntry(w.b, path, e.matcher)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skip reports whether changes to path, an entry of the directory e, are
+// left out of backups.
+func (w *treeWatcher) skip(e *DirectoryEntry, path string, isDir bool) bool {
+	if filepath.Base(path) == ".backup" || path == w.b.StoreRoot {
+		return true
+	}
+	ignored, _ := e.match(path, isDir)
+	return ignored && filepath.Base(path) != keepFileName
+}
+
+// handle updates the watches for event and reports whether it changes what
+// a backup would store.
+func (w *treeWatcher) handle(event fsnotify.Event) bool {
+	parent, ok := w.dirs[filepath.Dir(event.Name)]
+	if !ok {
+		return false
+	}
+	info, statErr := os.Lstat(event.Name)
+	isDir := statErr == nil && info.IsDir()
+
+	if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+		// A renamed directory is watched again under its new name
+		for dir := range w.dirs {
+			if dir == event.Name || strings.HasPrefix(dir, event.Name+string(filepath.Separator)) {
+				w.watcher.Remove(dir)
+				delete(w.dirs, dir)
+			}
+		}
+	}
+
+	// Ignore files change what the other events mean
+	if name := filepath.Base(event.Name); name == ".gitignore" || name == ".backupignore" {
+		if err := w.addRoots(); err != nil {
+			w.b.warnf("%v", err)
+		}
+		return true
+	}
+
+	if w.skip(parent, event.Name, isDir) {
+		return false
+	}
+	if event.Has(fsnotify.Create) && isDir {
+		if err := w.add(NewDirectoryEntry(w.b, event.Name, parent.matcher)); err != nil {
+			w.b.warnf("%v", err)
+		}
+	}
+	return true
+}
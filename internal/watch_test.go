@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	b := newTestBackup(t)
+	b.HashCache.file = filepath.Join(t.TempDir(), "hash-cache")
+	writeTestFile(t, b, ".backupignore", "*.swp\nbuild/\n")
+	writeTestFile(t, b, "build/out.o", "old")
+	writeTestFile(t, b, "sub/a.txt", "a")
+
+	w, err := b.newTreeWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if _, ok := w.dirs[filepath.Join(b.Top, "build")]; ok {
+		t.Errorf("Expected the ignored directory not to be watched")
+	}
+
+	changes := make(chan string, 100)
+	snapshots := make(chan *BackupRoot, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- b.runWatch(ctx, w, WatchOptions{
+			Debounce:    50 * time.Millisecond,
+			MinInterval: 0,
+			OnChange:    func(path string) { changes <- path },
+			OnSnapshot: func(root *BackupRoot, err error) {
+				if err != nil {
+					t.Error(err)
+				}
+				snapshots <- root
+			},
+		})
+	}()
+
+	// Ignored changes do not trigger a backup
+	writeTestFile(t, b, "sub/.a.txt.swp", "swap")
+	writeTestFile(t, b, "build/out.o", "new")
+	select {
+	case path := <-changes:
+		t.Errorf("Unexpected change %s", path)
+	case <-snapshots:
+		t.Error("Unexpected backup")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	writeTestFile(t, b, "sub/new/b.txt", "b")
+	var root *BackupRoot
+	select {
+	case root = <-snapshots:
+	case <-time.After(5 * time.Second):
+		t.Fatal("No backup after a change")
+	}
+
+	// New directories are watched as well
+	writeTestFile(t, b, "sub/new/c.txt", "c")
+	select {
+	case root = <-snapshots:
+	case <-time.After(5 * time.Second):
+		t.Fatal("No backup after a change in a new directory")
+	}
+	if entry, _ := root.Locate("sub/new/c.txt"); entry == nil {
+		t.Error("Expected the file in the new directory to be backed up")
+	}
+	if entry, _ := root.Locate("sub/.a.txt.swp"); entry != nil {
+		t.Error("Expected the ignored file not to be backed up")
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWatch_MinInterval(t *testing.T) {
+	b := newTestBackup(t)
+	b.HashCache.file = filepath.Join(t.TempDir(), "hash-cache")
+	w, err := b.newTreeWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	starts := make(chan time.Time, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.runWatch(ctx, w, WatchOptions{
+		Debounce:    10 * time.Millisecond,
+		MinInterval: 500 * time.Millisecond,
+		OnSnapshot:  func(*BackupRoot, error) { starts <- time.Now() },
+	})
+
+	writeTestFile(t, b, "a.txt", "1")
+	first := <-starts
+	writeTestFile(t, b, "a.txt", "2")
+	second := <-starts
+	if gap := second.Sub(first); gap < 450*time.Millisecond {
+		t.Errorf("Expected backups at least the minimum interval apart, got %v", gap)
+	}
+}
@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// errXattrsUnsupported is returned by readXattrs and writeXattrs on
+// platforms and file systems without extended attributes.
+var errXattrsUnsupported = errors.New("extended attributes are not supported")
+
+// encodeXattrs encodes extended attributes for a listing attribute field:
+// the names in sorted order, each followed by its value, both prefixed with
+// their length as a uvarint, in unpadded URL-safe base64.
+func encodeXattrs(xattrs map[string][]byte) string {
+	names := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf []byte
+	for _, name := range names {
+		buf = binary.AppendUvarint(buf, uint64(len(name)))
+		buf = append(buf, name...)
+		buf = binary.AppendUvarint(buf, uint64(len(xattrs[name])))
+		buf = append(buf, xattrs[name]...)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// decodeXattrs decodes the result of encodeXattrs.
+func decodeXattrs(s string) (map[string][]byte, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	next := func() ([]byte, error) {
+		n, size := binary.Uvarint(buf)
+		if size <= 0 || n > uint64(len(buf)-size) {
+			return nil, fmt.Errorf("truncated extended attributes")
+		}
+		field := buf[size : size+int(n)]
+		buf = buf[size+int(n):]
+		return field, nil
+	}
+	xattrs := make(map[string][]byte)
+	for len(buf) > 0 {
+		name, err := next()
+		if err != nil {
+			return nil, err
+		}
+		value, err := next()
+		if err != nil {
+			return nil, err
+		}
+		xattrs[string(name)] = value
+	}
+	return xattrs, nil
+}
+
+// captureXattrs returns the extended attributes of the file or directory
+// at path if the store records them, and nil otherwise.
+func (b *Backup) captureXattrs(path string) map[string][]byte {
+	if b == nil || b.StoreConfig == nil || !b.StoreConfig.Xattrs {
+		return nil
+	}
+	xattrs, err := readXattrs(path)
+	if err != nil && !errors.Is(err, errXattrsUnsupported) {
+		b.warnf("cannot read extended attributes of %s: %v", path, err)
+	}
+	return b.limitXattrs(path, xattrs)
+}
+
+// maxXattrsSize limits the names and values of the extended attributes
+// recorded for an entry, which are kept in its listing line.
+const maxXattrsSize = 1 << 20
+
+// limitXattrs drops the attributes of path that do not fit in
+// maxXattrsSize, in the order of their names, with a warning.
+func (b *Backup) limitXattrs(path string, xattrs map[string][]byte) map[string][]byte {
+	names := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	size := 0
+	for _, name := range names {
+		n := len(name) + len(xattrs[name])
+		if size+n > maxXattrsSize {
+			b.warnf("extended attribute %s of %s is not recorded: the attributes of an entry are limited to 1 MiB", name, path)
+			delete(xattrs, name)
+			continue
+		}
+		size += n
+	}
+	return xattrs
+}
+
+// restoreXattrs sets the recorded extended attributes on dest. Attributes
+// that cannot be set, such as security attributes without privileges, are
+// reported as warnings; where extended attributes are not supported they
+// are dropped.
+func (e *BaseBackupEntry) restoreXattrs(dest string) {
+	if len(e.attrs.Xattrs) == 0 {
+		return
+	}
+	if err := writeXattrs(dest, e.attrs.Xattrs); err != nil && !errors.Is(err, errXattrsUnsupported) {
+		e.b.warnf("cannot restore extended attributes of %s: %v", dest, err)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin
+
+package internal
+
+// readXattrs is not supported on this platform: extended attributes are
+// not recorded.
+func readXattrs(path string) (map[string][]byte, error) {
+	return nil, errXattrsUnsupported
+}
+
+// writeXattrs is not supported on this platform: recorded extended
+// attributes are not restored.
+func writeXattrs(path string, xattrs map[string][]byte) error {
+	return errXattrsUnsupported
+}
@@ -0,0 +1,73 @@
+//go:build linux || darwin
+
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// readXattrs returns the extended attributes of the file or directory at
+// path, or nil if it has none.
+func readXattrs(path string) (map[string][]byte, error) {
+	names, err := xattrCall(func(buf []byte) (int, error) { return unix.Listxattr(path, buf) })
+	if err != nil {
+		return nil, err
+	}
+	var xattrs map[string][]byte
+	for _, name := range bytes.Split(names, []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		value, err := xattrCall(func(buf []byte) (int, error) { return unix.Getxattr(path, string(name), buf) })
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if xattrs == nil {
+			xattrs = make(map[string][]byte)
+		}
+		xattrs[string(name)] = value
+	}
+	return xattrs, nil
+}
+
+// xattrCall calls f with a buffer large enough for its result, retrying if
+// the result grew between the size query and the call.
+func xattrCall(f func(buf []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := f(nil)
+		if err == nil && size > 0 {
+			buf := make([]byte, size)
+			size, err = f(buf)
+			if errors.Is(err, unix.ERANGE) {
+				continue
+			}
+			if err == nil {
+				return buf[:size], nil
+			}
+		}
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil, errXattrsUnsupported
+		}
+		return nil, err
+	}
+}
+
+// writeXattrs sets the extended attributes on the file or directory at
+// path. It tries all attributes and returns the first error.
+func writeXattrs(path string, xattrs map[string][]byte) error {
+	var first error
+	for name, value := range xattrs {
+		err := unix.Setxattr(path, name, value, 0)
+		if errors.Is(err, unix.ENOTSUP) {
+			return errXattrsUnsupported
+		}
+		if err != nil && first == nil {
+			first = fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return first
+}
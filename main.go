@@ -1,11 +1,22 @@
 package main
 
 import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"sort"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/djabi/backup/internal"
@@ -35,10 +46,32 @@ func main() {
 				Aliases: []string{"y"},
 				Usage:   "Automatically answer yes to prompts (e.g. store creation)",
 			},
+			&cli.BoolFlag{
+				Name:  "json",
+				Usage: "Emit machine-readable JSON output (list, status)",
+			},
+			&cli.BoolFlag{
+				Name:  "bytes",
+				Usage: "Print byte counts as plain integers instead of KiB/MiB/GiB",
+			},
+			&cli.StringFlag{
+				Name:  "project",
+				Usage: "Project to work on when running from a store (default: default_project in store.toml, or all projects)",
+			},
+			&cli.BoolFlag{
+				Name:    "quiet",
+				Aliases: []string{"q"},
+				Usage:   "Only print warnings and errors besides the command's output",
+			},
+			&cli.BoolFlag{
+				Name:  "verbose",
+				Usage: "Also print debug messages, such as every file archived",
+			},
 		},
 		Before: func(c *cli.Context) error {
+			rawBytes = c.Bool("bytes")
 			cmdName := c.Args().First()
-			if cmdName == "init" || cmdName == "init-store" || cmdName == "help" || cmdName == "h" || cmdName == "version" || c.Bool("version") {
+			if cmdName == "init" || cmdName == "init-store" || cmdName == "doctor" || cmdName == "config" || cmdName == "help" || cmdName == "h" || cmdName == "version" || c.Bool("version") {
 				return nil
 			}
 			var err error
@@ -49,6 +82,26 @@ func main() {
 			if err != nil {
 				return fmt.Errorf("error initializing backup: %w", err)
 			}
+			b.JSON = c.Bool("json")
+			level := slog.LevelInfo
+			switch {
+			case c.Bool("quiet") && c.Bool("verbose"):
+				return fmt.Errorf("--quiet and --verbose cannot be combined")
+			case c.Bool("quiet"):
+				level = slog.LevelWarn
+			case c.Bool("verbose"):
+				level = slog.LevelDebug
+			}
+			b.Logger = slog.New(internal.NewConsoleHandler(level))
+			if project := c.String("project"); project != "" {
+				if b.Top != "" {
+					return fmt.Errorf("--project only applies when running from a store; this source directory belongs to project %q", b.ProjectName)
+				}
+				if filepath.Base(project) != project {
+					return fmt.Errorf("invalid project name: %s", project)
+				}
+				b.ProjectName = project
+			}
 			return nil
 		},
 		Commands: []*cli.Command{
@@ -65,12 +118,46 @@ func main() {
 				Name:      "init-store",
 				Usage:     "Initialize a new backup store",
 				ArgsUsage: "[path]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "hash",
+						Usage: "Content hash algorithm (" + strings.Join(internal.HashAlgorithms(), ", ") + ")",
+						Value: internal.DefaultHashAlgorithm,
+					},
+					&cli.StringFlag{
+						Name:  "compression",
+						Usage: "Blob compression (" + strings.Join(internal.Compressions(), ", ") + ")",
+						Value: internal.DefaultCompression,
+					},
+					&cli.IntFlag{
+						Name:  "shard-width",
+						Usage: "Hash characters per data subdirectory (1-4)",
+						Value: internal.DefaultShardWidth,
+					},
+					&cli.IntFlag{
+						Name:  "shard-depth",
+						Usage: "Levels of data subdirectories (0-3, 0 for none)",
+						Value: internal.DefaultShardDepth,
+					},
+					&cli.BoolFlag{
+						Name:  "encrypt",
+						Usage: "Encrypt blobs with a passphrase (prompted, or read from " + internal.PassphraseEnv + ")",
+					},
+					&cli.BoolFlag{
+						Name:  "xattrs",
+						Usage: "Record extended attributes of files and directories (Linux, macOS)",
+					},
+					&cli.BoolFlag{
+						Name:  "owners",
+						Usage: "Record the numeric owner and group of files and directories (not on Windows)",
+					},
+				},
 				Action: func(c *cli.Context) error {
 					path := c.Args().First()
 					if path == "" {
 						path = "."
 					}
-					return runInitStore(path)
+					return runInitStore(path, c.String("hash"), c.String("compression"), c.Int("shard-width"), c.Int("shard-depth"), c.Bool("encrypt"), c.Bool("xattrs"), c.Bool("owners"))
 				},
 			},
 			{
@@ -110,39 +197,346 @@ func main() {
 						Name:  "show-ignored",
 						Usage: "Show files and directories that are ignored",
 					},
+					&cli.IntFlag{
+						Name:  "jobs",
+						Usage: "Number of files to hash and compress concurrently",
+						Value: runtime.NumCPU(),
+					},
+					&cli.BoolFlag{
+						Name:  "rehash-all",
+						Usage: "Hash every file again instead of trusting the hash cache",
+					},
+					&cli.BoolFlag{
+						Name:  "strict",
+						Usage: "Abort the backup on files that cannot be read instead of skipping them",
+					},
+					excludeFlag,
+					includeFlag,
+					messageFlag,
 				},
 				Action: func(c *cli.Context) error {
 					b.DryRun = c.Bool("dry-run")
+					b.Message = c.String("message")
 					b.ShowIgnored = c.Bool("show-ignored")
+					b.Jobs = c.Int("jobs")
+					b.Strict = c.Bool("strict")
+					if b.HashCache != nil && c.Bool("rehash-all") {
+						b.HashCache.RehashAll = true
+						b.ChunkCache.RehashAll = true
+					}
+					b.SetCommandLineIgnores(c.StringSlice("exclude"), c.StringSlice("include"))
+					if err := lockStore(b); err != nil {
+						return err
+					}
+					defer b.Unlock()
 					return runBackup(b)
 				},
 			},
+			{
+				Name:  "watch",
+				Usage: "Back up whenever changes in the source tree settle",
+				Flags: []cli.Flag{
+					&cli.DurationFlag{
+						Name:  "debounce",
+						Usage: "How long the tree must be quiet after a change before a backup",
+						Value: 30 * time.Second,
+					},
+					&cli.DurationFlag{
+						Name:  "min-interval",
+						Usage: "Minimum time between two backups",
+						Value: 5 * time.Minute,
+					},
+					&cli.IntFlag{
+						Name:  "jobs",
+						Usage: "Number of files to hash and compress concurrently",
+						Value: runtime.NumCPU(),
+					},
+					excludeFlag,
+					includeFlag,
+					messageFlag,
+				},
+				Action: func(c *cli.Context) error {
+					b.Message = c.String("message")
+					b.Jobs = c.Int("jobs")
+					b.SetCommandLineIgnores(c.StringSlice("exclude"), c.StringSlice("include"))
+					return runWatch(b, c.Duration("debounce"), c.Duration("min-interval"))
+				},
+			},
 			{
 				Name:    "list",
 				Aliases: []string{"snapshot", "snapshots"},
 				Usage:   "List backup snapshots",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "sizes",
+						Usage: "Show the total size and file count of each snapshot",
+					},
+					&cli.BoolFlag{
+						Name:  "stat",
+						Usage: "Show the blobs each snapshot added over the one before it",
+					},
+					&cli.StringFlag{
+						Name:  "project",
+						Usage: "Only list this project (default: current project, or all projects in headless mode)",
+					},
+					&cli.BoolFlag{
+						Name:  "reverse",
+						Usage: "List the newest snapshots first",
+					},
+					&cli.IntFlag{
+						Name:  "limit",
+						Usage: "Only list the newest N snapshots",
+					},
+					&cli.StringSliceFlag{
+						Name:  "tag",
+						Usage: "Only list snapshots with this tag (repeatable; any of them matches)",
+					},
+					&cli.BoolFlag{
+						Name:  "verify-heads",
+						Usage: "Report snapshot heads that are empty, unreadable or misnamed instead of listing snapshots",
+					},
+					&cli.BoolFlag{
+						Name:  "fix",
+						Usage: "With --verify-heads, remove the reported heads",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					project := c.String("project")
+					if project == "" {
+						project = b.ProjectName
+					} else if filepath.Base(project) != project {
+						return fmt.Errorf("invalid project name: %s", project)
+					}
+					if c.Bool("fix") && !c.Bool("verify-heads") {
+						return fmt.Errorf("--fix requires --verify-heads")
+					}
+					if c.Bool("verify-heads") {
+						return runVerifyHeads(b, project, c.Bool("fix"))
+					}
+					if c.Int("limit") < 0 {
+						return fmt.Errorf("--limit must not be negative")
+					}
+					return runSnapshots(b, project, c.StringSlice("tag"), c.Bool("sizes"), c.Bool("stat"), c.Bool("reverse"), c.Int("limit"))
+				},
+			},
+			{
+				Name:      "tag",
+				Usage:     "Add or remove tags of a snapshot",
+				ArgsUsage: "<snapshot> <tag...>",
+				Description: "Tags label snapshots, e.g. \"release\". They are stored in the snapshot's\n" +
+					"   metadata and select snapshots in list, remove and forget.",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "remove",
+						Usage: "Remove the tags instead of adding them",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.Args().Len() < 2 {
+						return fmt.Errorf("a snapshot and at least one tag are required")
+					}
+					if err := lockStore(b); err != nil {
+						return err
+					}
+					defer b.Unlock()
+					return runTag(b, c.Args().First(), c.Args().Tail(), c.Bool("remove"))
+				},
+			},
+			{
+				Name:  "log",
+				Usage: "Show snapshots with their message, author and host, newest first",
 				Action: func(c *cli.Context) error {
-					return runSnapshots(b)
+					return runLog(b)
 				},
 			},
 			{
 				Name:  "tree",
 				Usage: "List contents of a backup",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:    "long",
+						Aliases: []string{"l"},
+						Usage:   "Show the type, size and full hash of every entry in columns",
+					},
+				},
 				Action: func(c *cli.Context) error {
 					arg := c.Args().First()
-					return runTree(b, arg)
+					return runTree(b, arg, c.Bool("long"))
+				},
+			},
+			{
+				Name:      "diff",
+				Usage:     "Show differences between two snapshots",
+				ArgsUsage: "<snapshotA> <snapshotB>",
+				Action: func(c *cli.Context) error {
+					if c.Args().Len() != 2 {
+						return fmt.Errorf("two snapshot names required")
+					}
+					return runDiff(b, c.Args().Get(0), c.Args().Get(1))
+				},
+			},
+			{
+				Name:      "cat",
+				Usage:     "Write the content of a file in a snapshot to stdout",
+				ArgsUsage: "<snapshot> <path>",
+				Action: func(c *cli.Context) error {
+					if c.Args().Len() != 2 {
+						return fmt.Errorf("snapshot name and path required")
+					}
+					return runCat(b, c.Args().Get(0), c.Args().Get(1))
+				},
+			},
+			{
+				Name:      "find",
+				Usage:     "Find files and directories by name in snapshots",
+				ArgsUsage: "<pattern>",
+				Description: "Prints snapshot:path for every entry whose name matches the pattern (*, ?\n" +
+					"   and [...] as in shell globs). A pattern with a slash is matched against the\n" +
+					"   whole path. An unchanged entry is only listed for the newest snapshot.",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "latest",
+						Usage: "Only search the newest snapshot of each project",
+					},
+					&cli.StringFlag{
+						Name:  "project",
+						Usage: "Only search this project (default: current project, or all projects in headless mode)",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.Args().Len() != 1 {
+						return fmt.Errorf("pattern required")
+					}
+					project := c.String("project")
+					if project == "" {
+						project = b.ProjectName
+					}
+					return runFind(b, c.Args().First(), project, c.Bool("latest"))
+				},
+			},
+			{
+				Name:      "locate-hash",
+				Usage:     "List the snapshot paths referencing a blob",
+				ArgsUsage: "<hash>",
+				Description: "Prints snapshot:path for every entry with the given hash, and for every\n" +
+					"   chunked file with a chunk of that hash. Use it to find the files affected\n" +
+					"   by a blob reported by check.",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "project",
+						Usage: "Only search this project (default: current project, or all projects in headless mode)",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.Args().Len() != 1 {
+						return fmt.Errorf("hash required")
+					}
+					project := c.String("project")
+					if project == "" {
+						project = b.ProjectName
+					}
+					return runLocateHash(b, c.Args().First(), project)
+				},
+			},
+			{
+				Name:      "copy",
+				Usage:     "Copy a snapshot and the blobs it needs to another store",
+				ArgsUsage: "<snapshot>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "to",
+						Usage:    "Destination store",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Only show how many blobs would be copied",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.Args().Len() != 1 {
+						return fmt.Errorf("snapshot name required")
+					}
+					return runCopy(b, c.Args().First(), c.String("to"), c.Bool("dry-run"))
+				},
+			},
+			{
+				Name:      "export",
+				Usage:     "Write a snapshot to a tar archive",
+				ArgsUsage: "<snapshot> <file.tar|file.tar.gz|->",
+				Description: "Writes the files, directories and symlinks of a snapshot to a standard tar\n" +
+					"   archive. Names ending in .tar.gz or .tgz are gzip compressed; - writes to stdout.",
+				Action: func(c *cli.Context) error {
+					if c.Args().Len() != 2 {
+						return fmt.Errorf("snapshot name and output file required")
+					}
+					return runExport(b, c.Args().Get(0), c.Args().Get(1))
+				},
+			},
+			{
+				Name:      "import",
+				Usage:     "Create a snapshot from a tar archive",
+				ArgsUsage: "<file.tar|file.tar.gz|->",
+				Description: "Stores the files, directories and symlinks of a tar archive and writes a\n" +
+					"   snapshot head for them. Gzip compressed archives are detected; - reads from stdin.",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "project",
+						Usage: "Project to add the snapshot to (default: current project)",
+					},
+					messageFlag,
+				},
+				Action: func(c *cli.Context) error {
+					if c.Args().Len() != 1 {
+						return fmt.Errorf("archive file required")
+					}
+					project := c.String("project")
+					if project == "" {
+						project = b.ProjectName
+					}
+					if project == "" {
+						return fmt.Errorf("--project is required outside a source directory")
+					}
+					if err := lockStore(b); err != nil {
+						return err
+					}
+					defer b.Unlock()
+					return runImport(b, c.Args().Get(0), project, c.String("message"))
 				},
 			},
 			{
-				Name:  "status",
-				Usage: "Show status",
+				Name:      "mount",
+				Usage:     "Browse a snapshot through a read-only FUSE mount (Linux, macOS)",
+				ArgsUsage: "<snapshot> <mountpoint>",
+				Action: func(c *cli.Context) error {
+					if c.Args().Len() != 2 {
+						return fmt.Errorf("snapshot name and mount point required")
+					}
+					return runMount(b, c.Args().Get(0), c.Args().Get(1))
+				},
+			},
+			{
+				Name:      "status",
+				Usage:     "Show status",
+				ArgsUsage: "[snapshot]",
 				Flags: []cli.Flag{
 					&cli.BoolFlag{
 						Name: "show-ignored",
 					},
+					&cli.BoolFlag{
+						Name:    "short",
+						Aliases: []string{"s"},
+						Usage:   "Only print the changed entries, one status character and path per line",
+					},
+					excludeFlag,
+					includeFlag,
 				},
 				Action: func(c *cli.Context) error {
-					return b.Status(c.Bool("show-ignored"))
+					b.SetCommandLineIgnores(c.StringSlice("exclude"), c.StringSlice("include"))
+					if c.Args().Len() > 1 {
+						return fmt.Errorf("at most one snapshot can be given")
+					}
+					return b.Status(c.Args().First(), c.Bool("show-ignored"), c.Bool("short"))
 				},
 			},
 			{
@@ -153,22 +547,169 @@ func main() {
 						Name:  "deep",
 						Usage: "Verify content hashes (slow)",
 					},
+					&cli.BoolFlag{
+						Name:  "clean-partials",
+						Usage: "Remove leftover .partial files from interrupted backups",
+					},
+					&cli.BoolFlag{
+						Name:  "quarantine",
+						Usage: "Move corrupted and misfiled blobs to .backup/quarantine of the store",
+					},
+					&cli.BoolFlag{
+						Name:  "repair",
+						Usage: "Copy missing or corrupted blobs from the store given with --from",
+					},
+					&cli.StringFlag{
+						Name:  "from",
+						Usage: "Second store to repair blobs from",
+					},
+					&cli.StringFlag{
+						Name:  "sample",
+						Usage: "Verify the content hashes of a random percentage of the blobs, e.g. 10%",
+					},
+					&cli.Int64Flag{
+						Name:  "seed",
+						Usage: "Random seed for --sample, to check the same blobs again (default: random)",
+					},
+					&cli.IntFlag{
+						Name:  "jobs",
+						Usage: "Number of blobs to hash concurrently with --deep or --sample",
+						Value: runtime.NumCPU(),
+					},
+					&cli.BoolFlag{
+						Name:  "snapshots-only",
+						Usage: "Only check that every snapshot head is valid and its top directory is in the store (fast)",
+					},
 				},
 				Action: func(c *cli.Context) error {
 					deep := c.Bool("deep")
+					b.Jobs = c.Int("jobs")
+					if c.Bool("snapshots-only") {
+						for _, flag := range []string{"deep", "sample", "repair", "quarantine", "clean-partials"} {
+							if c.IsSet(flag) {
+								return fmt.Errorf("--snapshots-only cannot be combined with --%s", flag)
+							}
+						}
+						return runCheckHeads(b)
+					}
+					var sample float64
+					if c.IsSet("sample") {
+						if deep {
+							return fmt.Errorf("--sample cannot be combined with --deep")
+						}
+						var err error
+						if sample, err = internal.ParsePercent(c.String("sample")); err != nil {
+							return err
+						}
+					}
+					if c.Bool("repair") && c.String("from") == "" {
+						return fmt.Errorf("--repair requires --from <store>")
+					}
+					if c.Bool("repair") || c.Bool("clean-partials") || c.Bool("quarantine") {
+						// Partial files of a running backup must not be
+						// removed, nor blobs moved under it
+						if err := lockStore(b); err != nil {
+							return err
+						}
+						defer b.Unlock()
+					}
+					if c.Bool("repair") {
+						if err := runRepair(b, c.String("from"), deep); err != nil {
+							return err
+						}
+					}
+					if c.Bool("clean-partials") {
+						cleaned, err := b.Store.CleanupPartials()
+						if err != nil {
+							return fmt.Errorf("failed to cleanup partial files: %w", err)
+						}
+						fmt.Printf("Removed %d leftover partial files.\n", cleaned)
+					}
 					fmt.Printf("Checking store integrity (deep=%v)...\n", deep)
 					errs := b.Verify(deep)
+					if sample > 0 {
+						seed := time.Now().UnixNano()
+						if c.IsSet("seed") {
+							seed = c.Int64("seed")
+						}
+						checked, total, sampleErrs := b.VerifySample(sample, seed)
+						fmt.Printf("Verified content hashes of %d of %d blobs (sample %s, seed %d).\n", checked, total, c.String("sample"), seed)
+						errs = append(errs, sampleErrs...)
+					}
+					if c.Bool("quarantine") {
+						if err := runQuarantine(b, errs); err != nil {
+							return err
+						}
+					}
 					if len(errs) > 0 {
 						fmt.Println("Integrity check failed with errors:")
 						for _, e := range errs {
 							fmt.Printf(" - %v\n", e)
 						}
-						return fmt.Errorf("store integrity check failed")
+						return checkFailed(errs, "store integrity check failed")
 					}
 					fmt.Println("Store integrity check passed.")
 					return nil
 				},
 			},
+			{
+				Name:      "verify-snapshot",
+				Usage:     "Check the integrity of a single snapshot",
+				ArgsUsage: "<snapshot>",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "deep",
+						Usage: "Verify content hashes (slow)",
+					},
+					&cli.IntFlag{
+						Name:  "jobs",
+						Usage: "Number of blobs to hash concurrently with --deep",
+						Value: runtime.NumCPU(),
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.Args().Len() != 1 {
+						return fmt.Errorf("snapshot name required")
+					}
+					b.Jobs = c.Int("jobs")
+					return runVerifySnapshot(b, c.Args().First(), c.Bool("deep"))
+				},
+			},
+			{
+				Name:      "stats",
+				Usage:     "Show blob, size and sharing statistics of the store",
+				ArgsUsage: "[snapshot]",
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:  "top",
+						Value: 10,
+						Usage: "Number of most referenced blobs, or of extensions with --by-extension, to show; 0 shows all",
+					},
+					&cli.BoolFlag{
+						Name:  "by-extension",
+						Usage: "Show the number and size of the files of a snapshot (default: latest) by extension",
+					},
+					&cli.BoolFlag{
+						Name:  "all",
+						Usage: "With --by-extension, count the distinct files of all snapshots of the project",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.Int("top") < 0 {
+						return fmt.Errorf("--top must not be negative")
+					}
+					if c.Bool("by-extension") {
+						if c.Args().Len() > 1 {
+							return fmt.Errorf("at most one snapshot can be given")
+						}
+						return runExtensionStats(b, c.Args().First(), c.Bool("all"), c.Int("top"))
+					}
+					if c.Args().Present() || c.Bool("all") {
+						return fmt.Errorf("a snapshot and --all need --by-extension")
+					}
+					return runStats(b, c.Int("top"))
+				},
+			},
 			{
 				Name:  "prune",
 				Usage: "Remove unused blobs from the store",
@@ -177,68 +718,373 @@ func main() {
 						Name:  "dry-run",
 						Usage: "Do not delete files, only show what would be deleted",
 					},
+					&cli.StringFlag{
+						Name:  "blob",
+						Usage: "Remove only the blob with this hash, if no snapshot references it",
+					},
+					&cli.BoolFlag{
+						Name:  "force",
+						Usage: "With --blob, remove the blob even if snapshots reference it",
+					},
+					keepUnreferencedFlag,
 				},
 				Action: func(c *cli.Context) error {
 					dryRun := c.Bool("dry-run")
-					stats, err := b.Prune(dryRun)
+					b.DryRun = dryRun
+					keep, err := keepUnreferenced(c, b)
+					if err != nil {
+						return err
+					}
+					if err := lockStore(b); err != nil {
+						return err
+					}
+					defer b.Unlock()
+					if hash := c.String("blob"); hash != "" {
+						return runPruneBlob(b, hash, c.Bool("force"), dryRun)
+					}
+					stats, err := b.Prune(dryRun, keep)
 					if err != nil {
 						return fmt.Errorf("prune failed: %w", err)
 					}
 					if dryRun {
-						fmt.Printf("[dry-run] Found %d unreferenced blobs, would reclaim %d bytes\n", stats.BlobsRemoved, stats.BytesRemoved)
+						fmt.Printf("[dry-run] Found %d unreferenced blobs, would reclaim %s\n", stats.BlobsRemoved, formatBytes(stats.BytesRemoved))
+						if stats.BlobsKept > 0 {
+							fmt.Printf("[dry-run] Would keep %d unreferenced blobs (%s) until their grace period ends\n", stats.BlobsKept, formatBytes(stats.BytesKept))
+						}
 					} else {
-						fmt.Printf("Pruned %d unreferenced blobs, reclaimed %d bytes\n", stats.BlobsRemoved, stats.BytesRemoved)
+						printPruneStats(stats)
 					}
 					return nil
 				},
 			},
 			{
-				Name:      "remove",
-				Aliases:   []string{"rm", "forget", "delete"},
-				Usage:     "Remove one or more backup snapshots",
-				ArgsUsage: "<snapshot> [snapshot...]",
+				Name:      "rename-project",
+				Usage:     "Rename a project of the store",
+				ArgsUsage: "<old> <new>",
+				Description: "Moves the snapshots of a project to a new name. No blobs are copied. Run\n" +
+					"   from a source directory of the project, its config.toml is updated too.",
 				Flags: []cli.Flag{
 					&cli.BoolFlag{
 						Name:  "dry-run",
-						Usage: "Show what would be deleted without actually removing anything",
+						Usage: "Only check that the project can be renamed",
 					},
 				},
 				Action: func(c *cli.Context) error {
-					snapshots := c.Args().Slice()
-					if len(snapshots) == 0 {
-						return fmt.Errorf("at least one snapshot ID is required")
+					if c.Args().Len() != 2 {
+						return fmt.Errorf("old and new project names required")
 					}
 					b.DryRun = c.Bool("dry-run")
-					return runRemove(b, snapshots)
+					if err := lockStore(b); err != nil {
+						return err
+					}
+					defer b.Unlock()
+					return runRenameProject(b, c.Args().Get(0), c.Args().Get(1))
 				},
 			},
 			{
-				Name:  "prune-cache",
-				Usage: "Prune entries from the hash cache for missing files",
+				Name:      "remove",
+				Aliases:   []string{"rm", "delete"},
+				Usage:     "Remove one or more backup snapshots",
+				ArgsUsage: "[snapshot...]",
 				Flags: []cli.Flag{
 					&cli.BoolFlag{
 						Name:  "dry-run",
-						Usage: "Show what would be removed without actually removing anything",
+						Usage: "Show what would be deleted without actually removing anything",
+					},
+					&cli.StringFlag{
+						Name:  "older-than",
+						Usage: "Also remove snapshots older than this age (e.g. 12h, 30d, 2w, 6m, 1y)",
 					},
+					&cli.StringFlag{
+						Name:  "newer-than",
+						Usage: "Also remove snapshots newer than this age; with --older-than, those in between",
+					},
+					&cli.StringSliceFlag{
+						Name:  "tag",
+						Usage: "Also remove snapshots with this tag (repeatable); with --older-than/--newer-than, only those of that age",
+					},
+					&cli.StringFlag{
+						Name:  "project",
+						Usage: "Project of the snapshots selected by age or tag (default: current project, or all projects in headless mode)",
+					},
+					keepUnreferencedFlag,
 				},
 				Action: func(c *cli.Context) error {
-					if b.HashCache == nil {
-						return fmt.Errorf("prune-cache requires running from a source directory with hash-cache enabled")
+					snapshots := c.Args().Slice()
+					olderThan, newerThan := c.String("older-than"), c.String("newer-than")
+					if len(snapshots) == 0 && olderThan == "" && newerThan == "" && len(c.StringSlice("tag")) == 0 {
+						return fmt.Errorf("at least one snapshot ID or --older-than/--newer-than/--tag is required")
 					}
-					dryRun := c.Bool("dry-run")
-					return runPruneCache(b, dryRun)
-				},
-			},
-			{
-				Name:      "restore",
-				Usage:     "Restore from a backup snapshot",
+					now := time.Now()
+					var filter ageFilter
+					var err error
+					if olderThan != "" {
+						if filter.olderThan, err = internal.ParseAge(olderThan, now); err != nil {
+							return err
+						}
+					}
+					if newerThan != "" {
+						if filter.newerThan, err = internal.ParseAge(newerThan, now); err != nil {
+							return err
+						}
+					}
+					filter.tags = c.StringSlice("tag")
+					filter.project = c.String("project")
+					if filter.project == "" {
+						filter.project = b.ProjectName
+					}
+					keep, err := keepUnreferenced(c, b)
+					if err != nil {
+						return err
+					}
+					b.DryRun = c.Bool("dry-run")
+					if err := lockStore(b); err != nil {
+						return err
+					}
+					defer b.Unlock()
+					return runRemove(b, snapshots, filter, keep)
+				},
+			},
+			{
+				Name:  "forget",
+				Usage: "Remove snapshots according to a retention policy",
+				Description: "Keeps the newest snapshot of each of the last N days, ISO weeks and months\n" +
+					"   of every project and removes the rest, then prunes unreferenced blobs.",
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:  "keep-daily",
+						Usage: "Number of daily snapshots to keep",
+					},
+					&cli.IntFlag{
+						Name:  "keep-weekly",
+						Usage: "Number of weekly snapshots to keep",
+					},
+					&cli.IntFlag{
+						Name:  "keep-monthly",
+						Usage: "Number of monthly snapshots to keep",
+					},
+					&cli.StringSliceFlag{
+						Name:  "keep-tag",
+						Usage: "Keep snapshots with this tag regardless of age (repeatable)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "tag",
+						Usage: "Only apply the policy to snapshots with this tag (repeatable)",
+					},
+					&cli.StringFlag{
+						Name:  "project",
+						Usage: "Only apply the policy to this project (default: current project, or all projects in headless mode)",
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Show which snapshots would be kept and removed without removing anything",
+					},
+					keepUnreferencedFlag,
+				},
+				Action: func(c *cli.Context) error {
+					if c.Args().Present() {
+						// forget used to be an alias of remove; refuse the old
+						// usage instead of applying a policy to every snapshot.
+						return fmt.Errorf("forget takes no snapshot arguments; use 'backup remove %s' to remove snapshots by name", strings.Join(c.Args().Slice(), " "))
+					}
+					policy := internal.RetentionPolicy{
+						KeepDaily:   c.Int("keep-daily"),
+						KeepWeekly:  c.Int("keep-weekly"),
+						KeepMonthly: c.Int("keep-monthly"),
+						KeepTags:    c.StringSlice("keep-tag"),
+						Tags:        c.StringSlice("tag"),
+					}
+					project := c.String("project")
+					if project == "" {
+						project = b.ProjectName
+					}
+					keep, err := keepUnreferenced(c, b)
+					if err != nil {
+						return err
+					}
+					b.DryRun = c.Bool("dry-run")
+					if err := lockStore(b); err != nil {
+						return err
+					}
+					defer b.Unlock()
+					return runForget(b, policy, project, keep)
+				},
+			},
+			{
+				Name:  "prune-cache",
+				Usage: "Prune entries from the hash cache for missing files",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Show what would be removed without actually removing anything",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if b.HashCache == nil {
+						return fmt.Errorf("prune-cache requires running from a source directory with hash-cache enabled")
+					}
+					dryRun := c.Bool("dry-run")
+					return runPruneCache(b, dryRun)
+				},
+			},
+			{
+				Name:  "cache-info",
+				Usage: "Show the size and hit ratio of the hash cache",
+				Action: func(c *cli.Context) error {
+					if b.HashCache == nil {
+						return fmt.Errorf("cache-info requires running from a source directory with hash-cache enabled")
+					}
+					return runCacheInfo(b)
+				},
+			},
+			{
+				Name:  "doctor",
+				Usage: "Check the source config, the store and the caches for problems",
+				Action: func(c *cli.Context) error {
+					return runDoctor(c.String("root"), c.String("store"), c.Bool("json"))
+				},
+			},
+			{
+				Name:  "config",
+				Usage: "Show or change the settings of config.toml or store.toml",
+				Description: "Edits the config.toml of the source directory, or the store.toml when run from\n" +
+					"   a store or with --store. Values are checked before the file is written;\n" +
+					"   comments and other settings are kept.",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "path",
+						Usage: "Print the path of the config file",
+						Action: func(c *cli.Context) error {
+							return runConfig(c, func(f *internal.ConfigFile) error {
+								fmt.Println(f.Path)
+								return nil
+							})
+						},
+					},
+					{
+						Name:  "list",
+						Usage: "Print the settings set in the config file",
+						Action: func(c *cli.Context) error {
+							return runConfig(c, runConfigList)
+						},
+					},
+					{
+						Name:      "get",
+						Usage:     "Print the value of a setting",
+						ArgsUsage: "<key>",
+						Action: func(c *cli.Context) error {
+							if c.Args().Len() != 1 {
+								return fmt.Errorf("exactly one setting required")
+							}
+							return runConfig(c, func(f *internal.ConfigFile) error {
+								value, err := f.Get(c.Args().First())
+								if err != nil {
+									return err
+								}
+								if value != "" {
+									fmt.Println(value)
+								}
+								return nil
+							})
+						},
+					},
+					{
+						Name:      "set",
+						Usage:     "Change a setting; lists are given comma-separated",
+						ArgsUsage: "<key> <value>",
+						Action: func(c *cli.Context) error {
+							if c.Args().Len() != 2 {
+								return fmt.Errorf("a setting and a value are required")
+							}
+							return runConfig(c, func(f *internal.ConfigFile) error {
+								return runConfigSet(f, c.Args().Get(0), c.Args().Get(1))
+							})
+						},
+					},
+				},
+			},
+			{
+				Name:  "unlock",
+				Usage: "Remove the store lock left behind by an interrupted command",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "force",
+						Usage: "Remove the lock without asking, even if its owner may still run",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return runUnlock(b, c.Bool("force"))
+				},
+			},
+			{
+				Name:      "restore",
+				Usage:     "Restore from a backup snapshot",
 				ArgsUsage: "<snapshot> [path] [destination]",
 				Description: "Restore a snapshot or a path within a snapshot.\n" +
 					"   If running from source directory, destination defaults to current directory.\n" +
 					"   Arguments:\n" +
 					"     <snapshot>     Timestamp or project/timestamp of the backup.\n" +
 					"     [path]         (Optional) Path of file/dir inside the backup to restore.\n" +
-					"     [destination]  (Optional) Destination path to restore to.",
+					"     [destination]  (Optional) Destination path to restore to.\n" +
+					"   With two arguments the second one is the path from a source directory\n" +
+					"   and the destination from a store. --path and --dest name them explicitly;\n" +
+					"   a remaining argument is then the other one.\n" +
+					"   With --to-stdout the path is written to stdout as a tar stream, e.g. to\n" +
+					"   pipe it into tar -x -C <dir>.",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "preserve-times",
+						Usage: "Restore recorded modification times of files and directories",
+					},
+					&cli.BoolFlag{
+						Name:  "preserve-perms",
+						Usage: "Restore recorded permissions of files and directories",
+					},
+					&cli.BoolFlag{
+						Name:  "preserve-owner",
+						Usage: "Restore recorded owners and groups of files and directories (needs root)",
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "List the paths that would be restored without writing anything",
+					},
+					&cli.BoolFlag{
+						Name:  "force",
+						Usage: "Overwrite existing files and symlinks at the destination",
+					},
+					&cli.StringSliceFlag{
+						Name:  "exclude",
+						Usage: "Skip paths matching `PATTERN` (.gitignore syntax, repeatable)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "include",
+						Usage: "Only restore paths matching `PATTERN` (.gitignore syntax, repeatable)",
+					},
+					&cli.IntFlag{
+						Name:  "strip-components",
+						Usage: "Drop `N` leading components from the restored paths, like tar",
+					},
+					&cli.StringFlag{
+						Name:  "path",
+						Usage: "Restore `PATH` inside the snapshot instead of the whole snapshot",
+					},
+					&cli.StringFlag{
+						Name:  "dest",
+						Usage: "Restore to `DIR` (default: the current directory from a source directory)",
+					},
+					&cli.BoolFlag{
+						Name:  "to-stdout",
+						Usage: "Write a tar stream of the path to stdout instead of restoring it to disk",
+					},
+					&cli.BoolFlag{
+						Name:  "verify",
+						Usage: "Read every restored file back and check it against the hashes in the store",
+					},
+					&cli.BoolFlag{
+						Name:  "continue-on-error",
+						Usage: "Restore everything possible when paths fail, and list the failures at the end",
+					},
+				},
 				Action: func(c *cli.Context) error {
 					args := c.Args()
 					if args.Len() < 1 {
@@ -246,65 +1092,40 @@ func main() {
 					}
 					snapshotName := args.Get(0)
 
-					// Parse optional args
-					var pathInside, dest string
-
-					if args.Len() == 1 {
-						// restore <snapshot> -> restore root to context default or error
-						pathInside = ""
-						dest = ""
-					} else if args.Len() == 2 {
-						// restore <snapshot> <dest> OR restore <snapshot> <path> ?
-						// Ambiguous. Usually implicit destination implies the LAST arg is missing.
-						// If we want to support "restore <snapshot> <path>", we need to know where to restore it.
-						// Strategy:
-						// If 2 args: assume <snapshot> <dest> (restoring root to dest)
-						// OR <snapshot> <path_inside> (restoring path to default dest)?
-						// Let's look at user request: "restore to provide a destination... one doesn't need to provide destination directory".
-						// If user types `restore <snap> <arg>`, is <arg> the source path or destination?
-						// CLI convention: `cp <src> <dest>`.
-						// If we treat `restore <snap>` as "cp <snap> .", then `restore <snap> <foo>` is "cp <snap>/foo ." or "cp <snap> foo"?
-						// Standard `tar -xf archive path` extracts path to current dir.
-						// `tar -xf archive -C dest`.
-						// Let's assume positional args: <snapshot> [path_inside_snapshot] [destination_on_disk].
-						// If 1 arg: <snapshot> -> restore root to default.
-						// If 2 args: <snapshot> <path_inside> -> restore path to default.
-						// If 3 args: <snapshot> <path_inside> <dest>.
-						// BUT user said "require restore to provide a destination".
-						// So if strictly headless: `restore <snap> <dest>` (restoring root).
-						// Maybe we need flags or heuristic.
-						// Heuristic:
-						// 1. If b.Top is set (source context), default dest is CWD.
-						//    Then args are likely <snapshot> [path].
-						// 2. If b.Top is NOT set (headless), dest is required.
-						//    Then args: <snapshot> <dest> (restoring root) OR <snapshot> <path> <dest>.
-						//    This is ambiguous if 2 args.
-
-						// Let's stick to simple flexible parsing?
-						// Let's assume the user meant:
-						// If in source dir: `restore <snap>` (restore all), `restore <snap> <file>` (restore file).
-						// If NOT in source dir: `restore <snap> <dest>` (restore all to dest), `restore <snap> <file> <dest>` (restore file to dest).
-
-						if b.Top != "" {
-							// Source context
-							pathInside = args.Get(1)
-							dest = "" // triggers default logic
-						} else {
-							// Headless context
-							// Support restoring root only? Or detecting if arg 1 looks like a path in backup?
-							// Safest: assume 2nd arg is destination if only 2 args and no context?
-							// Or assume 2nd arg is path inside, and we need 3rd arg for dest?
-							// User prompt: "when... run from inside a <store> directory, it understands that and requires restore to privide a destination"
-							// So `restore <snap>` fails. `restore <snap> <dest>` works.
-							dest = args.Get(1)
-							pathInside = ""
+					// Only a restore to disk from a store needs a
+					// destination; a tar stream takes none
+					pathInside, dest, err := restoreArgs(c, b.Top == "" && !c.Bool("to-stdout"))
+					if err != nil {
+						return err
+					}
+
+					if c.Bool("to-stdout") {
+						if dest != "" {
+							return fmt.Errorf("--to-stdout takes no destination")
+						}
+						for _, name := range []string{"dry-run", "force", "exclude", "include", "strip-components", "verify", "continue-on-error"} {
+							if c.IsSet(name) {
+								return fmt.Errorf("--%s cannot be combined with --to-stdout", name)
+							}
 						}
-					} else if args.Len() >= 3 {
-						pathInside = args.Get(1)
-						dest = args.Get(2)
+						return b.RestoreTar(snapshotName, pathInside, os.Stdout)
 					}
 
-					return runRestore(b, snapshotName, pathInside, dest)
+					opts := internal.RestoreOptions{
+						PreserveTimes:   c.Bool("preserve-times"),
+						PreservePerms:   c.Bool("preserve-perms"),
+						PreserveOwner:   c.Bool("preserve-owner"),
+						Force:           c.Bool("force"),
+						DryRun:          c.Bool("dry-run"),
+						Filter:          internal.NewRestoreFilter(c.StringSlice("exclude"), c.StringSlice("include")),
+						StripComponents: c.Int("strip-components"),
+						Verify:          c.Bool("verify"),
+						ContinueOnError: c.Bool("continue-on-error"),
+					}
+					if opts.StripComponents < 0 {
+						return fmt.Errorf("--strip-components must not be negative")
+					}
+					return runRestore(b, snapshotName, pathInside, dest, opts)
 				},
 			},
 		},
@@ -316,11 +1137,159 @@ func main() {
 	}
 }
 
-func runSnapshots(b *internal.Backup) error {
-	roots, err := b.BackupRoots()
+// Ad-hoc ignore patterns shared by create and status.
+var (
+	excludeFlag = &cli.StringSliceFlag{
+		Name:  "exclude",
+		Usage: "Ignore paths matching `PATTERN` (.gitignore syntax, repeatable)",
+	}
+	includeFlag = &cli.StringSliceFlag{
+		Name:  "include",
+		Usage: "Back up paths matching `PATTERN` even if an ignore file excludes them (repeatable)",
+	}
+)
+
+// messageFlag annotates the snapshots made by create and import.
+var messageFlag = &cli.StringFlag{
+	Name:    "message",
+	Aliases: []string{"m"},
+	Usage:   "Describe the snapshot; shown by log",
+}
+
+// keepUnreferencedFlag sets the grace period of the prunes of prune, remove
+// and forget.
+var keepUnreferencedFlag = &cli.IntFlag{
+	Name:  "keep-unreferenced-days",
+	Usage: "Only delete blobs that have been unreferenced for this many days, counted from the prune that first found them (default: keep_unreferenced_days of store.toml)",
+}
+
+// keepUnreferenced returns the grace period of --keep-unreferenced-days, or
+// of the store setting if the flag is not given.
+func keepUnreferenced(c *cli.Context, b *internal.Backup) (time.Duration, error) {
+	if !c.IsSet("keep-unreferenced-days") {
+		return b.KeepUnreferenced(), nil
+	}
+	days := c.Int("keep-unreferenced-days")
+	if days < 0 {
+		return 0, fmt.Errorf("--keep-unreferenced-days must not be negative")
+	}
+	return time.Duration(days) * 24 * time.Hour, nil
+}
+
+// printPruneStats reports the blobs a prune removed and kept.
+func printPruneStats(stats internal.PruneStats) {
+	fmt.Printf("Pruned %d unreferenced blobs, reclaimed %s\n", stats.BlobsRemoved, formatBytes(stats.BytesRemoved))
+	if stats.BlobsKept > 0 {
+		fmt.Printf("Kept %d unreferenced blobs (%s) until their grace period ends\n", stats.BlobsKept, formatBytes(stats.BytesKept))
+	}
+}
+
+// rawBytes is set by the global --bytes flag.
+var rawBytes bool
+
+// formatBytes formats a byte count for humans, or as a plain integer with
+// --bytes for scripts.
+func formatBytes(n int64) string {
+	if rawBytes {
+		return fmt.Sprintf("%d bytes", n)
+	}
+	return internal.HumanizeBytes(n)
+}
+
+// lockStore acquires the store lock for commands that modify the store.
+// Dry runs only read the store and do not take the lock.
+func lockStore(b *internal.Backup) error {
+	if b.DryRun {
+		return nil
+	}
+	return b.Lock()
+}
+
+// snapshotJSON is the JSON representation of a snapshot in `list --json`.
+type snapshotJSON struct {
+	Project   string `json:"project"`
+	Timestamp string `json:"timestamp"`
+	Hash      string `json:"hash"`
+	// Size is only set with --sizes.
+	Size *internal.SnapshotSize `json:"size,omitempty"`
+	// Growth is only set with --stat.
+	Growth *internal.BlobGrowth `json:"growth,omitempty"`
+	// Tags is only set by list; log reports them in Meta.
+	Tags []string `json:"tags,omitempty"`
+	// Meta is only set by log.
+	Meta *internal.SnapshotMeta `json:"meta,omitempty"`
+}
+
+func runSnapshots(b *internal.Backup, project string, tags []string, sizes, stat, reverse bool, limit int) error {
+	all, err := b.SnapshotsByAge(project, time.Time{}, time.Time{})
 	if err != nil {
 		return fmt.Errorf("failed to list backups: %w", err)
 	}
+	roots := internal.FilterTagged(all, tags)
+	found := len(roots)
+	if limit > 0 && len(roots) > limit {
+		roots = roots[len(roots)-limit:]
+	}
+
+	// Growth is computed in time order, where each snapshot is compared
+	// with the one walked just before
+	growth := make(map[*internal.BackupRoot]internal.BlobGrowth)
+	growthErrs := make(map[*internal.BackupRoot]error)
+	if stat {
+		counter := b.NewGrowthCounter(all)
+		for _, root := range roots {
+			if g, err := counter.Growth(root); err != nil {
+				growthErrs[root] = err
+			} else {
+				growth[root] = g
+			}
+		}
+	}
+	if reverse {
+		slices.Reverse(roots)
+	}
+
+	var sizer *internal.SnapshotSizer
+	if sizes {
+		sizer, err = b.NewSnapshotSizer()
+		if err != nil {
+			return fmt.Errorf("failed to load size cache: %w", err)
+		}
+		defer func() {
+			if err := sizer.Save(); err != nil {
+				b.Log().Warn(fmt.Sprintf("Failed to save size cache: %v", err))
+			}
+		}()
+	}
+
+	if b.JSON {
+		snapshots := make([]snapshotJSON, 0, len(roots))
+		for _, root := range roots {
+			h, err := root.Hash()
+			if err != nil {
+				b.Log().Warn(fmt.Sprintf("%s: %v", root, err))
+				continue
+			}
+			s := snapshotJSON{Project: root.Project(), Timestamp: root.Timestamp(), Hash: h, Tags: root.Tags()}
+			if sizer != nil {
+				size, err := sizer.Size(root)
+				if err != nil {
+					b.Log().Warn(fmt.Sprintf("%s: %v", root, err))
+				} else {
+					s.Size = &size
+				}
+			}
+			if stat {
+				if g, ok := growth[root]; ok {
+					s.Growth = &g
+				} else {
+					b.Log().Warn(fmt.Sprintf("%s: %v", root, growthErrs[root]))
+				}
+			}
+			snapshots = append(snapshots, s)
+		}
+		return internal.PrintJSON(snapshots)
+	}
 
 	for _, root := range roots {
 		h, err := root.Hash()
@@ -328,13 +1297,158 @@ func runSnapshots(b *internal.Backup) error {
 			fmt.Printf("%s <error: %v>\n", root, err)
 			continue
 		}
-		fmt.Printf("%s %s\n", root, h)
+		line := fmt.Sprintf("%s %s", root, h)
+		if sizer != nil {
+			size, err := sizer.Size(root)
+			if err != nil {
+				fmt.Printf("%s <error: %v>\n", line, err)
+				continue
+			}
+			line += fmt.Sprintf(" %s, %d files", formatBytes(size.Bytes), size.Files)
+		}
+		if stat {
+			g, ok := growth[root]
+			if !ok {
+				fmt.Printf("%s <error: %v>\n", line, growthErrs[root])
+				continue
+			}
+			if sizer != nil {
+				line += ","
+			}
+			line += fmt.Sprintf(" %d new blobs, %s added", g.NewBlobs, formatBytes(g.Bytes))
+		}
+		if tags := root.Tags(); len(tags) > 0 {
+			line += " [" + strings.Join(tags, ", ") + "]"
+		}
+		fmt.Println(line)
+	}
+	if len(roots) < found {
+		fmt.Printf("%d of %d snapshots shown\n", len(roots), found)
+	} else {
+		fmt.Printf("%d snapshots found\n", found)
 	}
-	fmt.Printf("%d snapshots found\n", len(roots))
 	return nil
 }
 
-func runTree(b *internal.Backup, rootName string) error {
+// headJSON is the JSON representation of an invalid snapshot head in
+// `list --verify-heads --json`.
+type headJSON struct {
+	Ref     string `json:"ref"`
+	Error   string `json:"error"`
+	Removed bool   `json:"removed"`
+}
+
+func runVerifyHeads(b *internal.Backup, project string, fix bool) error {
+	if fix {
+		if err := lockStore(b); err != nil {
+			return err
+		}
+		defer b.Unlock()
+	}
+	all, err := b.InvalidHeads()
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot heads: %w", err)
+	}
+	var invalid []internal.InvalidHead
+	for _, h := range all {
+		if project == "" || strings.HasPrefix(h.Ref, project+"/") {
+			invalid = append(invalid, h)
+		}
+	}
+
+	heads := make([]headJSON, 0, len(invalid))
+	unreadable := 0
+	for _, h := range invalid {
+		head := headJSON{Ref: h.Ref, Error: h.Err.Error()}
+		if !h.Damaged {
+			// A head that could not be read may be valid; it is never
+			// removed
+			unreadable++
+		} else if fix {
+			if err := b.RemoveHead(h.Ref); err != nil {
+				return fmt.Errorf("failed to remove %s: %w", h.Ref, err)
+			}
+			head.Removed = true
+		}
+		heads = append(heads, head)
+	}
+	if b.JSON {
+		if err := internal.PrintJSON(heads); err != nil {
+			return err
+		}
+	} else {
+		for _, h := range heads {
+			if h.Removed {
+				fmt.Printf("Removed %s (%s)\n", h.Ref, h.Error)
+			} else {
+				fmt.Printf("%s: %s\n", h.Ref, h.Error)
+			}
+		}
+		if len(heads) == 0 {
+			fmt.Println("All snapshot heads are valid.")
+		}
+	}
+	if len(heads) > 0 && !fix {
+		return fmt.Errorf("%d invalid snapshot heads; remove them with --fix", len(heads))
+	}
+	if unreadable > 0 {
+		return fmt.Errorf("%d snapshot heads could not be read and were not removed", unreadable)
+	}
+	return nil
+}
+
+func runLog(b *internal.Backup) error {
+	roots, err := b.BackupRoots()
+	if err != nil {
+		return fmt.Errorf("failed to list backups: %w", err)
+	}
+
+	if b.JSON {
+		snapshots := make([]snapshotJSON, 0, len(roots))
+		for i := len(roots) - 1; i >= 0; i-- {
+			root := roots[i]
+			h, err := root.Hash()
+			if err != nil {
+				b.Log().Warn(fmt.Sprintf("%s: %v", root, err))
+				continue
+			}
+			snapshots = append(snapshots, snapshotJSON{Project: root.Project(), Timestamp: root.Timestamp(), Hash: h, Meta: root.Meta})
+		}
+		return internal.PrintJSON(snapshots)
+	}
+
+	for i := len(roots) - 1; i >= 0; i-- {
+		root := roots[i]
+		h, err := root.Hash()
+		if err != nil {
+			fmt.Printf("snapshot %s <error: %v>\n\n", root, err)
+			continue
+		}
+		fmt.Printf("snapshot %s %s\n", root, h)
+		if root.Meta == nil {
+			fmt.Printf("Date:   %s\n\n", root.Time.Format(time.RFC1123))
+			continue
+		}
+		if root.Meta.User != "" || root.Meta.Hostname != "" {
+			fmt.Printf("Author: %s@%s\n", root.Meta.User, root.Meta.Hostname)
+		}
+		if root.Meta.Time.IsZero() {
+			fmt.Printf("Date:   %s\n", root.Time.Format(time.RFC1123))
+		} else {
+			fmt.Printf("Date:   %s\n", root.Meta.Time.Local().Format(time.RFC1123))
+		}
+		if len(root.Meta.Tags) > 0 {
+			fmt.Printf("Tags:   %s\n", strings.Join(root.Meta.Tags, ", "))
+		}
+		if root.Meta.Message != "" {
+			fmt.Printf("\n    %s\n", strings.ReplaceAll(root.Meta.Message, "\n", "\n    "))
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+func runTree(b *internal.Backup, rootName string, long bool) error {
 	var root *internal.BackupRoot
 	var err error
 
@@ -370,10 +1484,21 @@ func runTree(b *internal.Backup, rootName string) error {
 	// Let's implement recursive tree printer.
 
 	fmt.Printf("Listing content for backup %s\n", root)
-	return printTree(top, "")
+	return printTree(top, "", long)
+}
+
+// shortHash abbreviates a hash for display. Hashes of damaged trees may be
+// shorter than the abbreviation and are returned as they are.
+func shortHash(hash string) string {
+	if len(hash) > 7 {
+		return hash[:7]
+	}
+	return hash
 }
 
-func printTree(dir *internal.BackupDirectory, prefix string) error {
+// printTree prints the entries below dir, indented by prefix. long prints
+// a type, size and full hash column before each name.
+func printTree(dir *internal.BackupDirectory, prefix string, long bool) error {
 	entries, err := dir.Entries()
 	if err != nil {
 		return err
@@ -391,17 +1516,516 @@ func printTree(dir *internal.BackupDirectory, prefix string) error {
 		// D or F ?
 		// We can check type assertions
 		if d, ok := entry.(*internal.BackupDirectory); ok {
-			fmt.Printf("%s%s/ (%s)\n", prefix, name, d.Hash()[:7]) // Short hash
-			if err := printTree(d, prefix+"  "); err != nil {
+			if long {
+				fmt.Printf("dir  %10s  %s  %s%s/\n", "-", d.Hash(), prefix, name)
+			} else {
+				fmt.Printf("%s%s/ (%s)\n", prefix, name, shortHash(d.Hash()))
+			}
+			if err := printTree(d, prefix+"  ", long); err != nil {
 				return err
 			}
 		} else if f, ok := entry.(*internal.BackupFile); ok {
-			fmt.Printf("%s%s (%s)\n", prefix, name, f.Hash()[:7])
+			if !long {
+				fmt.Printf("%s%s (%s)\n", prefix, name, shortHash(f.Hash()))
+				continue
+			}
+			size, err := f.Size()
+			if err != nil {
+				return err
+			}
+			fmt.Printf("file %10s  %s  %s%s\n", formatBytes(size), f.Hash(), prefix, name)
+		} else if l, ok := entry.(*internal.BackupLink); ok {
+			target, err := l.Target()
+			if err != nil {
+				return err
+			}
+			if long {
+				fmt.Printf("link %10s  %s  %s%s -> %s\n", "-", l.Hash(), prefix, name, target)
+			} else {
+				fmt.Printf("%s%s -> %s (%s)\n", prefix, name, target, shortHash(l.Hash()))
+			}
+		}
+	}
+	return nil
+}
+
+func runDiff(b *internal.Backup, fromName, toName string) error {
+	from, err := b.FindBackupRoot(fromName)
+	if err != nil {
+		return fmt.Errorf("backup root not found: %s", fromName)
+	}
+	to, err := b.FindBackupRoot(toName)
+	if err != nil {
+		return fmt.Errorf("backup root not found: %s", toName)
+	}
+
+	diffs, err := from.Diff(to)
+	if err != nil {
+		return err
+	}
+	for _, d := range diffs {
+		fmt.Printf("%s %s\n", d.Type, d.Path)
+	}
+	if len(diffs) == 0 {
+		fmt.Println("No differences.")
+	}
+	return nil
+}
+
+func runCat(b *internal.Backup, snapshotName, path string) error {
+	root, err := b.FindBackupRoot(snapshotName)
+	if err != nil {
+		return fmt.Errorf("snapshot not found: %s", snapshotName)
+	}
+	entry, err := root.Locate(path)
+	if err != nil {
+		return fmt.Errorf("failed to locate path '%s' in snapshot: %w", path, err)
+	}
+	switch e := entry.(type) {
+	case nil:
+		return fmt.Errorf("path '%s' not found in snapshot %s", path, snapshotName)
+	case *internal.BackupDirectory:
+		return fmt.Errorf("'%s' is a directory", path)
+	case *internal.BackupLink:
+		return fmt.Errorf("'%s' is a symlink", path)
+	case *internal.BackupFile:
+		return e.WriteContent(os.Stdout)
+	default:
+		return fmt.Errorf("'%s' is not a file", path)
+	}
+}
+
+// runExtensionStats prints the files of the snapshot, the latest snapshot,
+// or with all, all snapshots, by extension. Beyond the top extensions, the
+// rest is summed up as one line.
+func runExtensionStats(b *internal.Backup, snapshot string, all bool, top int) error {
+	var roots []*internal.BackupRoot
+	switch {
+	case all && snapshot != "":
+		return fmt.Errorf("give a snapshot or --all, not both")
+	case all:
+		var err error
+		if roots, err = b.BackupRoots(); err != nil {
+			return err
+		}
+	case snapshot != "":
+		root, err := b.FindBackupRoot(snapshot)
+		if err != nil {
+			return fmt.Errorf("snapshot not found: %s", snapshot)
+		}
+		roots = append(roots, root)
+	default:
+		root, err := b.LatestBackupRoot()
+		if err != nil {
+			return err
+		}
+		if root != nil {
+			roots = append(roots, root)
+		}
+	}
+	if len(roots) == 0 {
+		return fmt.Errorf("no snapshots found")
+	}
+
+	stats, err := b.StatsByExtension(roots)
+	if err != nil {
+		return fmt.Errorf("failed to compute statistics by extension: %w", err)
+	}
+	if b.JSON {
+		return internal.PrintJSON(stats)
+	}
+
+	var total internal.ExtensionStats
+	for _, s := range stats {
+		total.Files += s.Files
+		total.Bytes += s.Bytes
+	}
+	if len(roots) == 1 {
+		fmt.Printf("Files of %s by extension:\n", roots[0])
+	} else {
+		fmt.Printf("Distinct files of %d snapshots by extension:\n", len(roots))
+	}
+	share := func(bytes int64) string {
+		if total.Bytes == 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%.1f%%", float64(bytes)*100/float64(total.Bytes))
+	}
+	fmt.Printf("  %-16s %8s %12s %7s\n", "Extension", "Files", "Size", "Share")
+	var other internal.ExtensionStats
+	for i, s := range stats {
+		if top > 0 && i >= top {
+			other.Files += s.Files
+			other.Bytes += s.Bytes
+			continue
+		}
+		ext := s.Extension
+		if ext == "" {
+			ext = "(none)"
+		}
+		fmt.Printf("  %-16s %8d %12s %7s\n", ext, s.Files, formatBytes(s.Bytes), share(s.Bytes))
+	}
+	if other.Files > 0 {
+		fmt.Printf("  %-16s %8d %12s %7s\n", fmt.Sprintf("(%d others)", len(stats)-top), other.Files, formatBytes(other.Bytes), share(other.Bytes))
+	}
+	fmt.Printf("  %-16s %8d %12s\n", "Total", total.Files, formatBytes(total.Bytes))
+	return nil
+}
+
+func runStats(b *internal.Backup, top int) error {
+	stats, err := b.StoreStats(top)
+	if err != nil {
+		return fmt.Errorf("failed to compute store statistics: %w", err)
+	}
+	if b.JSON {
+		return internal.PrintJSON(stats)
+	}
+
+	fmt.Printf("Store: %s\n", b.StoreName())
+	fmt.Printf("  Blobs:        %d (%s on disk)\n", stats.Blobs, formatBytes(stats.Bytes))
+	fmt.Printf("  Reachable:    %d, %d shared by several snapshots\n", stats.Reachable, stats.Shared)
+	fmt.Printf("  Unreferenced: %d\n", stats.Unreferenced)
+
+	projects := make([]string, 0, len(stats.Snapshots))
+	for p := range stats.Snapshots {
+		projects = append(projects, p)
+	}
+	sort.Strings(projects)
+	fmt.Println("Snapshots:")
+	for _, p := range projects {
+		name := p
+		if name == "" {
+			name = "(no project)"
+		}
+		fmt.Printf("  %-20s %d\n", name, stats.Snapshots[p])
+	}
+
+	if len(stats.MostShared) > 0 {
+		fmt.Println("Most referenced blobs:")
+		for _, r := range stats.MostShared {
+			fmt.Printf("  %s  %d snapshots\n", r.Hash, r.Refs)
+		}
+	}
+	return nil
+}
+
+// Exit codes of check and verify-snapshot; other failures exit with 1.
+const (
+	exitIntegrityFailure = 2 // Missing or corrupted blobs, or other damage
+	exitUnreferencedOnly = 3 // Unreferenced blobs, but nothing damaged
+)
+
+// checkFailed returns the error ending a failed check, with an exit code
+// that tells damage apart from unreferenced blobs.
+func checkFailed(errs []error, msg string) error {
+	for _, e := range errs {
+		var unreferenced *internal.UnreferencedBlobError
+		if !errors.As(e, &unreferenced) {
+			return cli.Exit(msg, exitIntegrityFailure)
+		}
+	}
+	return cli.Exit(msg+" (only unreferenced blobs, remove them with prune)", exitUnreferencedOnly)
+}
+
+func runVerifySnapshot(b *internal.Backup, snapshotName string, deep bool) error {
+	root, err := b.FindBackupRoot(snapshotName)
+	if err != nil {
+		return fmt.Errorf("snapshot not found: %s", snapshotName)
+	}
+	fmt.Printf("Checking snapshot %s (deep=%v)...\n", root, deep)
+	errs := b.VerifySnapshot(root, deep)
+	if len(errs) > 0 {
+		fmt.Println("Integrity check failed with errors:")
+		for _, e := range errs {
+			fmt.Printf(" - %v\n", e)
+		}
+		return checkFailed(errs, "snapshot integrity check failed")
+	}
+	fmt.Println("Snapshot integrity check passed.")
+	return nil
+}
+
+// runCheckHeads runs check --snapshots-only.
+func runCheckHeads(b *internal.Backup) error {
+	fmt.Println("Checking snapshot heads...")
+	checked, errs := b.VerifyHeads()
+	if len(errs) > 0 {
+		fmt.Println("Snapshot check failed with errors:")
+		for _, e := range errs {
+			fmt.Printf(" - %v\n", e)
+		}
+		return checkFailed(errs, "snapshot check failed")
+	}
+	fmt.Printf("Snapshot check passed (%d snapshots).\n", checked)
+	return nil
+}
+
+func runRepair(b *internal.Backup, fromDir string, deep bool) error {
+	from, err := internal.OpenStore(fromDir)
+	if err != nil {
+		return err
+	}
+	from.Logger = b.Logger
+	fmt.Printf("Repairing blobs from %s (deep=%v)...\n", from.StoreName(), deep)
+	result, err := b.Repair(from, deep)
+	if err != nil {
+		return fmt.Errorf("repair failed: %w", err)
+	}
+	fmt.Printf("Healed %d blobs.\n", len(result.Healed))
+	if len(result.Unrecoverable) > 0 {
+		fmt.Printf("%d blobs could not be recovered:\n", len(result.Unrecoverable))
+		for _, h := range result.Unrecoverable {
+			fmt.Printf(" - %s\n", h)
+		}
+	}
+	return nil
+}
+
+func runCopy(b *internal.Backup, snapshotName, toDir string, dryRun bool) error {
+	root, err := b.FindBackupRoot(snapshotName)
+	if err != nil {
+		return fmt.Errorf("snapshot not found: %s", snapshotName)
+	}
+	dest, err := internal.OpenStore(toDir)
+	if err != nil {
+		return err
+	}
+	dest.Logger = b.Logger
+	if dest.StoreRoot == b.StoreRoot {
+		return fmt.Errorf("source and destination are the same store")
+	}
+	if !dryRun {
+		// A prune in the destination must not remove copied blobs before
+		// the head referencing them is written
+		if err := dest.Lock(); err != nil {
+			return err
+		}
+		defer dest.Unlock()
+	}
+
+	result, err := b.CopySnapshot(root, dest, dryRun)
+	if err != nil {
+		return fmt.Errorf("copy failed: %w", err)
+	}
+	if dryRun {
+		fmt.Printf("[dry-run] Would copy %d of %d blobs (%s) to %s\n", result.Copied, result.Blobs, formatBytes(result.Bytes), dest.StoreName())
+		return nil
+	}
+	fmt.Printf("Copied snapshot %s to %s: %d of %d blobs (%s) copied, the rest already present.\n", root, dest.StoreName(), result.Copied, result.Blobs, formatBytes(result.Bytes))
+	return nil
+}
+
+func runFind(b *internal.Backup, pattern, project string, latest bool) error {
+	roots, err := b.SnapshotsByAge(project, time.Time{}, time.Time{})
+	if err != nil {
+		return fmt.Errorf("failed to list backups: %w", err)
+	}
+	if latest {
+		roots = internal.LatestRoots(roots)
+	}
+	// Newest first, so that unchanged entries are listed for their newest snapshot
+	sort.SliceStable(roots, func(i, j int) bool { return roots[i].Time.After(roots[j].Time) })
+
+	matches, err := b.Find(pattern, roots)
+	if err != nil {
+		return fmt.Errorf("find failed: %w", err)
+	}
+	if b.JSON {
+		out := make([]findJSON, 0, len(matches))
+		for _, m := range matches {
+			out = append(out, findJSON{Project: m.Root.Project(), Timestamp: m.Root.Timestamp(), Path: m.Path, Hash: m.Hash, Dir: m.Dir})
+		}
+		return internal.PrintJSON(out)
+	}
+	for _, m := range matches {
+		name := m.Path
+		if m.Dir {
+			name += "/"
+		}
+		fmt.Printf("%s:%s\n", m.Root, name)
+	}
+	return nil
+}
+
+// findJSON is the JSON representation of a find match.
+type findJSON struct {
+	Project   string `json:"project"`
+	Timestamp string `json:"timestamp"`
+	Path      string `json:"path"`
+	Hash      string `json:"hash"`
+	Dir       bool   `json:"dir,omitempty"`
+}
+
+func runLocateHash(b *internal.Backup, hash, project string) error {
+	if !b.Store.ValidHash(hash) {
+		return fmt.Errorf("invalid hash: %s", hash)
+	}
+	roots, err := b.SnapshotsByAge(project, time.Time{}, time.Time{})
+	if err != nil {
+		return fmt.Errorf("failed to list backups: %w", err)
+	}
+	sort.SliceStable(roots, func(i, j int) bool { return roots[i].Time.After(roots[j].Time) })
+
+	matches, unreadable, err := b.LocateHash(hash, roots)
+	if err != nil {
+		return fmt.Errorf("locate-hash failed: %w", err)
+	}
+	for _, h := range unreadable {
+		b.Log().Warn(fmt.Sprintf("Cannot read blob %s, the entries below it were not searched", h))
+	}
+	if b.JSON {
+		out := make([]findJSON, 0, len(matches))
+		for _, m := range matches {
+			out = append(out, findJSON{Project: m.Root.Project(), Timestamp: m.Root.Timestamp(), Path: m.Path, Hash: m.Hash, Dir: m.Dir})
+		}
+		return internal.PrintJSON(out)
+	}
+	if len(matches) == 0 {
+		fmt.Printf("No snapshot references %s.\n", hash)
+		return nil
+	}
+	for _, m := range matches {
+		name := m.Path
+		if m.Dir {
+			name += "/"
+		}
+		fmt.Printf("%s:%s\n", m.Root, name)
+	}
+	return nil
+}
+
+func runExport(b *internal.Backup, snapshotName, file string) (err error) {
+	if file, err = internal.ExpandPath(file); err != nil {
+		return err
+	}
+	root, err := b.FindBackupRoot(snapshotName)
+	if err != nil {
+		return fmt.Errorf("snapshot not found: %s", snapshotName)
+	}
+	top, err := root.TopDirectory()
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stdout
+	if file != "-" {
+		f, err := os.Create(file)
+		if err != nil {
+			return err
 		}
+		defer func() {
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(file)
+			}
+		}()
+		out = f
+	}
+	if strings.HasSuffix(file, ".tar.gz") || strings.HasSuffix(file, ".tgz") {
+		gw := gzip.NewWriter(out)
+		defer func() {
+			if cerr := gw.Close(); err == nil {
+				err = cerr
+			}
+		}()
+		out = gw
+	}
+
+	if err := b.ExportTar(top, out, root.Time); err != nil {
+		return fmt.Errorf("export failed: %w", err)
+	}
+	if file != "-" {
+		fmt.Printf("Exported snapshot %s to %s\n", root, file)
 	}
 	return nil
 }
 
+func runImport(b *internal.Backup, file, project, message string) error {
+	file, err := internal.ExpandPath(file)
+	if err != nil {
+		return err
+	}
+	var in io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	br := bufio.NewReader(in)
+	in = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		in = gr
+	}
+
+	b.Stats = internal.BackupStats{}
+	h, err := b.ImportTar(in)
+	if err != nil {
+		return fmt.Errorf("import failed: %w", err)
+	}
+
+	timestamp, err := b.WriteSnapshotHead(project, time.Now(), h)
+	if err != nil {
+		return fmt.Errorf("failed to write backup head: %w", err)
+	}
+	if err := b.WriteSnapshotMeta(path.Join(project, timestamp), internal.NewSnapshotMeta(message)); err != nil {
+		b.Log().Warn(fmt.Sprintf("Failed to write snapshot metadata: %v", err))
+	}
+	fmt.Printf("Imported %s. Head: %s (Project: %s)\n", file, timestamp, project)
+
+	fmt.Println("\nImport Summary:")
+	fmt.Printf("  Files:       %d total, %d archived\n", b.Stats.FilesTotal, b.Stats.FilesArchived)
+	fmt.Printf("  Directories: %d total, %d archived\n", b.Stats.DirsTotal, b.Stats.DirsArchived)
+	fmt.Printf("  Bytes:       %s archived\n", formatBytes(b.Stats.BytesArchived))
+	fmt.Printf("  Dedup:       %d files / %s already present\n", b.Stats.FilesDeduplicated, formatBytes(b.Stats.BytesDeduplicated))
+	return nil
+}
+
+func runMount(b *internal.Backup, snapshotName, mountpoint string) error {
+	mountpoint, err := internal.ExpandPath(mountpoint)
+	if err != nil {
+		return err
+	}
+	root, err := b.FindBackupRoot(snapshotName)
+	if err != nil {
+		return fmt.Errorf("snapshot not found: %s", snapshotName)
+	}
+	top, err := root.TopDirectory()
+	if err != nil {
+		return err
+	}
+	m, err := internal.MountSnapshot(top, mountpoint)
+	if err != nil {
+		return fmt.Errorf("failed to mount snapshot: %w", err)
+	}
+	fmt.Printf("Mounted snapshot %s at %s (press Ctrl-C to unmount)\n", root, mountpoint)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		// Unmounting fails while the mount is busy; a later signal retries
+		for range signals {
+			if err := m.Unmount(); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to unmount %s: %v\n", mountpoint, err)
+				continue
+			}
+			return
+		}
+	}()
+	m.Wait()
+	signal.Stop(signals)
+	return nil
+}
+
 func runBackup(b *internal.Backup) error {
 	if b.Top == "" {
 		msg := "Run 'create' from a source directory. Current directory is not initialized."
@@ -414,179 +2038,251 @@ func runBackup(b *internal.Backup) error {
 	// Ensure READMEs exist (auto-fix for existing setups)
 	if err := ensureSourceReadme(b.BackupConfigDir); err != nil {
 		// Non-fatal warning
-		fmt.Fprintf(os.Stderr, "Warning: Failed to create source README: %v\n", err)
+		b.Log().Warn(fmt.Sprintf("Failed to create source README: %v", err))
 	}
-	if b.StoreRoot != "" {
+	if b.StoreRoot != "" && b.StoreURL == "" {
 		if err := ensureStoreReadme(b.StoreRoot); err != nil {
-			fmt.Fprintf(os.Stderr, "Warning: Failed to create store README: %v\n", err)
+			b.Log().Warn(fmt.Sprintf("Failed to create store README: %v", err))
 		}
 	}
 
-	fmt.Println("Starting backup...")
+	b.Log().Info("Starting backup...")
 	if b.DryRun {
-		fmt.Println("Running in dry-run mode")
+		b.Log().Info("Running in dry-run mode")
 	}
 
 	// Cleanup leftover partial files from previous runs
 	if cleaned, err := b.Store.CleanupPartials(); err != nil {
-		fmt.Fprintf(os.Stderr, "Warning: Failed to cleanup partial files: %v\n", err)
+		b.Log().Warn(fmt.Sprintf("Failed to cleanup partial files: %v", err))
 	} else if cleaned > 0 {
-		fmt.Printf("Cleaned up %d leftover partial files from previous runs.\n", cleaned)
+		b.Log().Info(fmt.Sprintf("Cleaned up %d leftover partial files from previous runs.", cleaned))
 	}
 
-	// Reset stats
-	b.Stats = internal.BackupStats{}
+	if started, ok := b.InterruptedBackup(); ok && !b.DryRun {
+		b.Log().Info(fmt.Sprintf("Resuming the interrupted backup started at %s; content it saved is reused.", started.Local().Format(time.RFC1123)))
+	}
 
-	top := internal.NewDirectoryEntry(b, b.Top, nil)
+	if b.Config != nil && b.Config.PreBackup != "" {
+		if b.DryRun {
+			fmt.Printf("[dry-run] Would run pre_backup hook: %s\n", b.Config.PreBackup)
+		} else if err := b.RunHook("pre_backup", b.Config.PreBackup); err != nil {
+			return fmt.Errorf("backup aborted: %w", err)
+		}
+	}
 
-	if err := top.Save(); err != nil {
+	root, stats, err := b.CreateSnapshot()
+	if err != nil {
+		runPostBackupHook(b, nil)
 		return fmt.Errorf("backup failed: %w", err)
 	}
 
 	if b.DryRun {
 		fmt.Println("[dry-run] Would write backup head")
 		fmt.Println("[dry-run] Would save hash cache")
-	} else {
-		// Write backup head
-		h, err := top.Hash()
-		if err != nil {
-			return fmt.Errorf("failed to calculate top hash: %w", err)
+		fmt.Println()
+		if err := b.PrintTreeChanges(); err != nil {
+			return fmt.Errorf("comparing with the latest backup failed: %w", err)
 		}
-
-		var headDir string
+	} else {
+		msg := fmt.Sprintf("Backup completed successfully. Head: %s", root.Timestamp())
 		if b.ProjectName != "" {
-			headDir = filepath.Join(b.StoreSnapshots, b.ProjectName)
-		} else {
-			headDir = b.StoreSnapshots
+			msg += fmt.Sprintf(" (Project: %s)", b.ProjectName)
 		}
+		fmt.Println(msg)
+	}
 
-		if err := os.MkdirAll(headDir, 0755); err != nil {
-			return fmt.Errorf("failed to create snapshot dir %s: %w", headDir, err)
+	fmt.Println("\nBackup Summary:")
+	fmt.Printf("  Files:       %d total, %d archived, %d ignored\n", stats.FilesTotal, stats.FilesArchived, stats.FilesIgnored)
+	fmt.Printf("  Directories: %d total, %d archived, %d ignored\n", stats.DirsTotal, stats.DirsArchived, stats.DirsIgnored)
+	fmt.Printf("  Bytes:       %s archived\n", formatBytes(stats.BytesArchived))
+	fmt.Printf("  Dedup:       %d files / %s already present\n", stats.FilesDeduplicated, formatBytes(stats.BytesDeduplicated))
+	if b.HashCache != nil {
+		fmt.Printf("  Hash cache:  %s\n", formatCacheStats(b.HashCache.Stats()))
+	}
+	if len(b.Failed) > 0 {
+		fmt.Printf("  Failed:      %d files could not be read and were skipped\n", stats.FilesFailed)
+		sort.Slice(b.Failed, func(i, j int) bool { return b.Failed[i].Path < b.Failed[j].Path })
+		for _, f := range b.Failed {
+			rel, err := filepath.Rel(b.Top, f.Path)
+			if err != nil {
+				rel = f.Path
+			}
+			// The path is printed already
+			reason := f.Err
+			var pathErr *os.PathError
+			if errors.As(reason, &pathErr) {
+				reason = pathErr.Err
+			}
+			fmt.Printf("    %s: %v\n", rel, reason)
 		}
+	}
+
+	runPostBackupHook(b, root)
+	return nil
+}
+
+// runPostBackupHook runs the post_backup hook of b after a backup that made
+// the snapshot root, or that failed if root is nil. The hook learns which
+// from BACKUP_STATUS and BACKUP_SNAPSHOT. A failing hook is reported but
+// does not fail the backup, which is complete by then.
+func runPostBackupHook(b *internal.Backup, root *internal.BackupRoot) {
+	if b.Config == nil || b.Config.PostBackup == "" {
+		return
+	}
+	if b.DryRun {
+		fmt.Printf("[dry-run] Would run post_backup hook: %s\n", b.Config.PostBackup)
+		return
+	}
+	env := []string{"BACKUP_STATUS=failed", "BACKUP_PROJECT=" + b.ProjectName}
+	if root != nil {
+		env = []string{"BACKUP_STATUS=success", "BACKUP_PROJECT=" + b.ProjectName, "BACKUP_SNAPSHOT=" + root.Timestamp()}
+	}
+	if err := b.RunHook("post_backup", b.Config.PostBackup, env...); err != nil {
+		b.Log().Warn(err.Error())
+	}
+}
 
-		// Format: yyMMdd-HHmmss
-		var timestamp string
-		var headFile string
-		for {
-			timestamp = time.Now().Format("060102-150405")
-			headFile = filepath.Join(headDir, timestamp)
-			if _, err := os.Stat(headFile); os.IsNotExist(err) {
-				break
+func runWatch(b *internal.Backup, debounce, minInterval time.Duration) error {
+	if b.Top == "" {
+		return fmt.Errorf("Run 'watch' from a source directory. Current directory is not initialized.")
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	fmt.Printf("Watching %s (debounce %s, minimum interval %s, press Ctrl-C to stop)\n", b.Top, debounce, minInterval)
+	pending := false
+	return b.Watch(ctx, internal.WatchOptions{
+		Debounce:    debounce,
+		MinInterval: minInterval,
+		OnChange: func(path string) {
+			if !pending {
+				fmt.Printf("Change detected: %s\n", path)
+				pending = true
 			}
-			// Collision, wait enabling unique timestamp (1s resolution)
-			time.Sleep(100 * time.Millisecond)
-		}
+		},
+		OnSnapshot: func(root *internal.BackupRoot, err error) {
+			pending = false
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Backup failed: %v\n", err)
+				return
+			}
+			fmt.Printf("%s Backup %s: %d files archived, %s, %s\n", time.Now().Format(time.TimeOnly), root.Timestamp(),
+				b.Stats.FilesArchived, formatBytes(b.Stats.BytesArchived), formatCacheStats(b.HashCache.Stats()))
+		},
+	})
+}
 
-		if err := os.WriteFile(headFile, []byte(h+"\n"), 0644); err != nil {
-			return fmt.Errorf("failed to write backup head: %w", err)
+func runRestore(b *internal.Backup, snapshotName, pathInside, dest string, opts internal.RestoreOptions) error {
+	err := b.Restore(snapshotName, pathInside, dest, opts)
+	var conflict *internal.RestoreConflictError
+	if errors.As(err, &conflict) {
+		fmt.Println("The following paths already exist:")
+		for _, p := range conflict.Paths {
+			fmt.Printf("  %s\n", p)
 		}
-
-		// Prune cache for missing files before saving
-		if b.HashCache != nil {
-			pruned := b.HashCache.Prune()
-			if pruned > 0 {
-				if b.Stats.FilesArchived > 0 { // Just verbose logging if needed, or silent?
-					// Standard output for backup usually summarizes file ops.
-					// Maybe just log if we want to be chatty, but "Pruned x entries" might be noisy.
-					// Let's keep it silent unless it's a dedicated command, as requested,
-					// "No point of keeping thouse" implies automatic cleanup.
-				}
-			}
+	}
+	var failed *internal.RestoreFailedError
+	if errors.As(err, &failed) {
+		fmt.Println("The following paths could not be restored:")
+		for _, f := range failed.Failures {
+			fmt.Printf("  %s: %v\n", f.Path, f.Err)
 		}
+	}
+	return err
+}
 
-		// Save cache
-		if err := b.HashCache.MaybeSaveCache(); err != nil {
-			fmt.Fprintf(os.Stderr, "Warning: Failed to save hash cache: %v\n", err)
+// restoreArgs returns the path inside the snapshot and the destination of
+// restore from --path, --dest and the arguments after the snapshot. Without
+// flags, two arguments are "<path> <dest>", and a single argument is the
+// destination if needDest is set, as from a store where there is no default
+// destination, and the path otherwise. With one of the flags, a remaining
+// argument is the other one. The destination is expanded with internal.ExpandPath.
+func restoreArgs(c *cli.Context, needDest bool) (pathInside, dest string, err error) {
+	rest := c.Args().Tail()
+	pathInside, dest = c.String("path"), c.String("dest")
+	switch {
+	case c.IsSet("path") && c.IsSet("dest"):
+		if len(rest) > 0 {
+			return "", "", fmt.Errorf("unexpected arguments with --path and --dest: %s", strings.Join(rest, " "))
 		}
-
-		msg := fmt.Sprintf("Backup completed successfully. Head: %s", timestamp)
-		if b.ProjectName != "" {
-			msg += fmt.Sprintf(" (Project: %s)", b.ProjectName)
+	case c.IsSet("path") || c.IsSet("dest"):
+		if len(rest) > 1 {
+			return "", "", fmt.Errorf("too many arguments: %s", strings.Join(rest, " "))
 		}
-		fmt.Println(msg)
+		if len(rest) == 1 && c.IsSet("path") {
+			dest = rest[0]
+		} else if len(rest) == 1 {
+			pathInside = rest[0]
+		}
+	case len(rest) == 1 && needDest:
+		dest = rest[0]
+	case len(rest) == 1:
+		pathInside = rest[0]
+	case len(rest) == 2:
+		pathInside, dest = rest[0], rest[1]
+	case len(rest) > 2:
+		return "", "", fmt.Errorf("too many arguments: %s", strings.Join(rest, " "))
 	}
-
-	fmt.Println("\nBackup Summary:")
-	fmt.Printf("  Files:       %d total, %d archived, %d ignored\n", b.Stats.FilesTotal, b.Stats.FilesArchived, b.Stats.FilesIgnored)
-	fmt.Printf("  Directories: %d total, %d archived, %d ignored\n", b.Stats.DirsTotal, b.Stats.DirsArchived, b.Stats.DirsIgnored)
-	fmt.Printf("  Bytes:       %d archived\n", b.Stats.BytesArchived)
-
-	return nil
+	if dest, err = internal.ExpandPath(dest); err != nil {
+		return "", "", err
+	}
+	return pathInside, dest, nil
 }
 
-func runRestore(b *internal.Backup, snapshotName, pathInside, dest string) error {
-	// 1. Locate backup root
-	var root *internal.BackupRoot
-	var err error
+// ageFilter selects snapshots of a project by age and tags for remove. Zero
+// times and no tags do not restrict; without any of them nothing is
+// selected.
+type ageFilter struct {
+	project              string
+	olderThan, newerThan time.Time
+	tags                 []string
+}
 
-	root, err = b.FindBackupRoot(snapshotName)
+func runTag(b *internal.Backup, name string, tags []string, remove bool) error {
+	root, err := b.FindBackupRoot(name)
 	if err != nil {
-		return fmt.Errorf("snapshot not found: %s", snapshotName)
+		return fmt.Errorf("snapshot not found: %w", err)
 	}
-
-	// 2. Locate entry to restore
-	// Resolve pathInside if in source context and it's relative
-	resolvedPathInside := pathInside
-	if b.Top != "" && pathInside != "" && !filepath.IsAbs(pathInside) {
-		// If pathInside is "sub/file.txt" and we are in "sub", user might mean "sub/sub/file.txt" (standard)
-		// OR "sub/file.txt" relative to root?
-		// Standard unix tools (tar, git) use path relative to CWD if implied.
-		// git checkout file.txt -> file.txt in CWD.
-		// so if CWD is "sub", looking for "sub/file.txt" (relative to root).
-		// We need to convert CWD-relative path to Root-relative path to find it in snapshot.
-
-		relCwd, err := filepath.Rel(b.Top, b.CurrentWorkingDir)
-		if err == nil && relCwd != "." {
-			resolvedPathInside = filepath.Join(relCwd, pathInside)
-		}
+	var result []string
+	if remove {
+		result, err = b.TagSnapshot(root, nil, tags)
+	} else {
+		result, err = b.TagSnapshot(root, tags, nil)
 	}
-
-	entry, err := root.Locate(resolvedPathInside)
 	if err != nil {
-		return fmt.Errorf("failed to locate path '%s' (resolved: '%s') in snapshot: %w", pathInside, resolvedPathInside, err)
+		return err
 	}
-	if entry == nil {
-		// Try original path logic?
-		// If user typed "sub/file.txt" from "sub" but meant root? Rare.
-		// Fallback? No, strict is better.
-		return fmt.Errorf("path '%s' not found in snapshot %s", resolvedPathInside, snapshotName)
+	if len(result) == 0 {
+		fmt.Printf("%s has no tags\n", root)
+	} else {
+		fmt.Printf("%s tags: %s\n", root, strings.Join(result, ", "))
 	}
+	return nil
+}
 
-	// 3. Determine destination
-	if dest == "" {
-		if b.Top != "" {
-			// Context: Source directory
-			if pathInside == "" {
-				dest = "." // restore root to current dir (or root? CWD is safer default)
-			} else {
-				// restoring a file/dir, default to ./<name>
-				dest = entry.Name()
-				// Use base name of what user typed?
-				// If user typed "file.txt", we restore to "file.txt" (in CWD).
-				// dest is relative to CWD.
-				// entry.Name() is just the name.
-				// So if we are in CWD and write "file.txt", it goes to CWD/file.txt. Correct.
-			}
-		} else {
-			return fmt.Errorf("destination required when not running from source directory")
-		}
+func runRenameProject(b *internal.Backup, oldName, newName string) error {
+	source := b.Top != "" && b.ProjectName == oldName
+	if err := b.RenameProject(oldName, newName, b.DryRun); err != nil {
+		return fmt.Errorf("rename failed: %w", err)
 	}
-
-	fmt.Printf("Restoring %s from %s to %s...\n", pathInside, snapshotName, dest)
 	if b.DryRun {
-		fmt.Println("[dry-run] Would restore content")
+		fmt.Printf("[dry-run] Would rename project %s to %s\n", oldName, newName)
+		if source {
+			fmt.Printf("[dry-run] Would update the project name in %s\n", filepath.Join(b.BackupConfigDir, "config.toml"))
+		}
 		return nil
 	}
-
-	if err := entry.Restore(dest); err != nil {
-		return fmt.Errorf("restore failed: %w", err)
+	fmt.Printf("Renamed project %s to %s.\n", oldName, newName)
+	if source {
+		fmt.Printf("Updated the project name in %s.\n", filepath.Join(b.BackupConfigDir, "config.toml"))
 	}
-
-	fmt.Println("Restore complete.")
+	fmt.Printf("Other source directories of %s must set name = %q in their .backup/config.toml.\n", oldName, newName)
 	return nil
 }
 
-func runRemove(b *internal.Backup, snapshots []string) error {
+func runRemove(b *internal.Backup, snapshots []string, filter ageFilter, keep time.Duration) error {
+	var roots []*internal.BackupRoot
+	selected := make(map[string]bool)
 	for _, name := range snapshots {
 		// Verify existence
 		root, err := b.FindBackupRoot(name)
@@ -594,14 +2290,38 @@ func runRemove(b *internal.Backup, snapshots []string) error {
 			fmt.Printf("Error: Snapshot '%s' not found or invalid: %v\n", name, err)
 			continue
 		}
+		if !selected[root.BackupHead] {
+			selected[root.BackupHead] = true
+			roots = append(roots, root)
+		}
+	}
+	if !filter.olderThan.IsZero() || !filter.newerThan.IsZero() || len(filter.tags) > 0 {
+		matches, err := b.SnapshotsByAge(filter.project, filter.olderThan, filter.newerThan)
+		if err != nil {
+			return fmt.Errorf("failed to list backups: %w", err)
+		}
+		matches = internal.FilterTagged(matches, filter.tags)
+		if len(matches) == 0 && len(filter.tags) > 0 {
+			fmt.Println("No snapshots match the tag filter.")
+		} else if len(matches) == 0 {
+			fmt.Println("No snapshots match the age filter.")
+		}
+		for _, root := range matches {
+			if !selected[root.BackupHead] {
+				selected[root.BackupHead] = true
+				roots = append(roots, root)
+			}
+		}
+	}
 
+	for _, root := range roots {
 		if b.DryRun {
 			fmt.Printf("[dry-run] Would remove snapshot %s\n", root)
 			continue
 		}
 
 		fmt.Printf("Removing snapshot %s...\n", root)
-		if err := os.Remove(root.BackupHead); err != nil {
+		if err := root.Remove(); err != nil {
 			fmt.Printf("Error: Failed to remove snapshot file %s: %v\n", root.BackupHead, err)
 			continue
 		}
@@ -621,12 +2341,80 @@ func runRemove(b *internal.Backup, snapshots []string) error {
 	fmt.Println("Removal complete. Running prune to cleanup unreferenced data blobs...")
 
 	// Auto-prune (no dry-run)
-	stats, err := b.Prune(false)
+	stats, err := b.Prune(false, keep)
+	if err != nil {
+		return fmt.Errorf("prune failed: %w", err)
+	}
+	printPruneStats(stats)
+
+	return nil
+}
+
+func runForget(b *internal.Backup, policy internal.RetentionPolicy, project string, keep time.Duration) error {
+	decisions, err := b.Forget(policy, project, b.DryRun)
+	if err != nil {
+		return err
+	}
+
+	removed := 0
+	for _, d := range decisions {
+		if d.Keep {
+			fmt.Printf("keep    %s (%s)\n", d.Root, strings.Join(d.Reasons, ", "))
+			continue
+		}
+		removed++
+		if b.DryRun {
+			fmt.Printf("[dry-run] Would remove %s\n", d.Root)
+		} else {
+			fmt.Printf("remove  %s\n", d.Root)
+		}
+	}
+
+	if b.DryRun {
+		fmt.Printf("[dry-run] Would remove %d of %d snapshots\n", removed, len(decisions))
+		return nil
+	}
+	if removed == 0 {
+		fmt.Println("No snapshots to remove.")
+		return nil
+	}
+
+	fmt.Printf("Removed %d of %d snapshots. Running prune to cleanup unreferenced data blobs...\n", removed, len(decisions))
+	stats, err := b.Prune(false, keep)
 	if err != nil {
 		return fmt.Errorf("prune failed: %w", err)
 	}
-	fmt.Printf("Pruned %d unreferenced blobs, reclaimed %d bytes\n", stats.BlobsRemoved, stats.BytesRemoved)
+	printPruneStats(stats)
+	return nil
+}
 
+func runPruneBlob(b *internal.Backup, hash string, force, dryRun bool) error {
+	result, err := b.PruneBlob(hash, force, dryRun)
+	for _, h := range result.Unreadable {
+		b.Log().Warn(fmt.Sprintf("Cannot read blob %s, the entries below it were not searched", h))
+	}
+	if len(result.References) > 0 {
+		if err == nil {
+			fmt.Fprintf(os.Stderr, "WARNING: %s is referenced by the entries below. They cannot be restored while the blob is missing:\n", hash)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s is referenced by:\n", hash)
+		}
+		for _, m := range result.References {
+			name := m.Path
+			if m.Dir {
+				name += "/"
+			}
+			fmt.Fprintf(os.Stderr, "  %s:%s\n", m.Root, name)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("prune failed: %w", err)
+	}
+	if dryRun {
+		fmt.Printf("[dry-run] Would remove blob %s, reclaiming %s\n", hash, formatBytes(result.Bytes))
+	} else {
+		fmt.Printf("Removed blob %s, reclaimed %s\n", hash, formatBytes(result.Bytes))
+	}
 	return nil
 }
 
@@ -648,15 +2436,213 @@ func runPruneCache(b *internal.Backup, dryRun bool) error {
 			}
 		}
 	}
+	if b.ChunkCache != nil {
+		if count := b.ChunkCache.Prune(); count > 0 && !dryRun {
+			if err := b.ChunkCache.MaybeSaveCache(); err != nil {
+				return fmt.Errorf("failed to save chunk cache: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// cacheInfoJSON is the JSON representation of `cache-info --json`.
+type cacheInfoJSON struct {
+	Path       string                  `json:"path"`
+	Bytes      int64                   `json:"bytes"`
+	Entries    int                     `json:"entries"`
+	Stale      int                     `json:"stale"`
+	LastBackup internal.HashCacheStats `json:"lastBackup"`
+}
+
+func runCacheInfo(b *internal.Backup) error {
+	hc := b.HashCache
+	info := cacheInfoJSON{Path: hc.Path(), Entries: hc.Len(), Stale: hc.Stale(), LastBackup: hc.LastStats()}
+	if fi, err := os.Stat(hc.Path()); err == nil {
+		info.Bytes = fi.Size()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if b.JSON {
+		return internal.PrintJSON(info)
+	}
+
+	fmt.Printf("Hash cache: %s\n", info.Path)
+	fmt.Printf("  Entries:     %d (%s on disk)\n", info.Entries, formatBytes(info.Bytes))
+	fmt.Printf("  Stale:       %d (files changed since they were hashed)\n", info.Stale)
+	fmt.Printf("  Last backup: %s\n", formatCacheStats(info.LastBackup))
+	return nil
+}
+
+// runConfig runs fn on the config file found from the global --root and
+// --store flags.
+func runConfig(c *cli.Context, fn func(*internal.ConfigFile) error) error {
+	f, err := internal.FindConfigFile(c.String("root"), c.String("store"))
+	if err != nil {
+		return err
+	}
+	return fn(f)
+}
+
+func runConfigList(f *internal.ConfigFile) error {
+	keys, err := f.Keys()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("# %s\n", f.Path)
+	for _, key := range keys {
+		value, err := f.Get(key)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s = %s\n", key, strings.ReplaceAll(value, "\n", ", "))
+	}
+	return nil
+}
+
+func runConfigSet(f *internal.ConfigFile, key, value string) error {
+	if err := f.Set(key, value); err != nil {
+		return err
+	}
+	fmt.Printf("Set %s = %s in %s\n", key, value, f.Path)
+	if key == "name" && !f.Store {
+		fmt.Println("Existing snapshots stay under the old name; use rename-project to move them.")
+	}
+	return nil
+}
+
+func runQuarantine(b *internal.Backup, errs []error) error {
+	moved, err := b.QuarantineBlobs(errs)
+	for _, p := range moved {
+		fmt.Printf("Quarantined %s\n", p)
+	}
+	if err != nil {
+		return err
+	}
+	if len(moved) > 0 {
+		fmt.Printf("Moved %d blobs to quarantine; restore them from another copy with check --repair --from <store>.\n", len(moved))
+	}
+	return nil
+}
+
+func runDoctor(root, store string, jsonOut bool) error {
+	findings := internal.Doctor(root, store)
+	failed := 0
+	for _, f := range findings {
+		if f.Failed() {
+			failed++
+		}
+	}
+	if jsonOut {
+		if err := internal.PrintJSON(findings); err != nil {
+			return err
+		}
+	} else {
+		for _, f := range findings {
+			switch {
+			case f.Problem == "":
+				fmt.Printf("  ok    %s\n", f.Check)
+			case f.Warning:
+				fmt.Printf("  warn  %s: %s\n", f.Check, f.Problem)
+			default:
+				fmt.Printf("  FAIL  %s: %s\n", f.Check, f.Problem)
+			}
+			if f.Hint != "" {
+				fmt.Printf("        -> %s\n", f.Hint)
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("doctor found %d problems", failed)
+	}
+	if !jsonOut {
+		fmt.Println("No problems found.")
+	}
+	return nil
+}
+
+func runUnlock(b *internal.Backup, force bool) error {
+	owner, err := b.LockOwner()
+	if err != nil {
+		return err
+	}
+	if owner == nil {
+		fmt.Println("Store is not locked.")
+		return nil
+	}
+	if !owner.Stale() {
+		if owner.Local() {
+			b.Log().Warn(fmt.Sprintf("the store is locked by %s, which is still running.", owner))
+		} else {
+			b.Log().Warn(fmt.Sprintf("the store is locked by %s; processes of other hosts cannot be checked.", owner))
+		}
+		if !force {
+			fmt.Print("Breaking the lock of a running backup can corrupt the store. Remove the lock? [y/N] ")
+			var response string
+			fmt.Scanln(&response)
+			if response != "y" && response != "Y" && response != "yes" {
+				return fmt.Errorf("lock not removed")
+			}
+		}
+	}
+	if err := b.BreakLock(); err != nil {
+		return err
+	}
+	fmt.Printf("Removed the store lock held by %s.\n", owner)
 	return nil
 }
 
-func runInitStore(path string) error {
+// formatCacheStats describes the lookups of a backup in the hash cache.
+func formatCacheStats(s internal.HashCacheStats) string {
+	if s.Hits+s.Misses == 0 {
+		return "no lookups"
+	}
+	msg := fmt.Sprintf("%d hits, %d misses (%.1f%% hit ratio), %s hashed", s.Hits, s.Misses, 100*s.HitRatio(), formatBytes(s.BytesHashed))
+	if s.Touched > 0 {
+		msg += fmt.Sprintf(", %d touched but unchanged", s.Touched)
+	}
+	if s.Changed > 0 {
+		msg += fmt.Sprintf(", %d changed without a new modification time", s.Changed)
+	}
+	return msg
+}
+
+func runInitStore(path, hashName, compression string, shardWidth, shardDepth int, encrypt, xattrs, owners bool) error {
+	if internal.IsStoreURL(path) {
+		return fmt.Errorf("init-store needs a local path; initialize a store on its server and use its URL")
+	}
+	path, err := internal.ExpandPath(path)
+	if err != nil {
+		return err
+	}
 	absPath, err := filepath.Abs(path)
 	if err != nil {
 		return err
 	}
 
+	if _, err := internal.LookupHashFunc(hashName); err != nil {
+		return err
+	}
+	if _, err := internal.LookupCodec(compression); err != nil {
+		return err
+	}
+	shards := internal.StoreConfig{ShardWidth: shardWidth, ShardDepth: &shardDepth}
+	if _, _, err := shards.Shards(); err != nil {
+		return err
+	}
+	encryption := ""
+	if encrypt {
+		passphrase, err := internal.ReadNewPassphrase()
+		if err != nil {
+			return err
+		}
+		salt, check, err := internal.NewEncryptionConfig(passphrase)
+		if err != nil {
+			return err
+		}
+		encryption = fmt.Sprintf("encryption = \"%s\"\nencryption_salt = \"%s\"\nencryption_check = \"%s\"\n", internal.EncryptionAESGCM, salt, check)
+	}
+
 	if err := os.MkdirAll(absPath, 0755); err != nil {
 		return fmt.Errorf("failed to create directory %s: %w", absPath, err)
 	}
@@ -671,7 +2657,27 @@ func runInitStore(path string) error {
 	}
 
 	storeToml := filepath.Join(backupDir, "store.toml")
-	if err := os.WriteFile(storeToml, []byte("store = \".\"\n"), 0644); err != nil {
+	content := "store = \".\"\n"
+	if hashName != "" && hashName != internal.DefaultHashAlgorithm {
+		content += fmt.Sprintf("hash = \"%s\"\n", strings.ToLower(hashName))
+	}
+	if compression != "" && compression != internal.DefaultCompression {
+		content += fmt.Sprintf("compression = \"%s\"\n", strings.ToLower(compression))
+	}
+	if shardWidth != internal.DefaultShardWidth {
+		content += fmt.Sprintf("shard_width = %d\n", shardWidth)
+	}
+	if shardDepth != internal.DefaultShardDepth {
+		content += fmt.Sprintf("shard_depth = %d\n", shardDepth)
+	}
+	if xattrs {
+		content += "xattrs = true\n"
+	}
+	if owners {
+		content += "owners = true\n"
+	}
+	content += encryption
+	if err := os.WriteFile(storeToml, []byte(content), 0644); err != nil {
 		return fmt.Errorf("failed to write store.toml: %w", err)
 	}
 
@@ -687,6 +2693,10 @@ func runInitStore(path string) error {
 }
 
 func runInit(path, store, project string) error {
+	path, err := internal.ExpandPath(path)
+	if err != nil {
+		return err
+	}
 	absPath, err := filepath.Abs(path)
 	if err != nil {
 		return err
@@ -713,17 +2723,69 @@ func runInit(path, store, project string) error {
 		}
 	}
 
+	if internal.IsStoreURL(store) {
+		// Stores at URLs are created on their server; only check that it is one
+		if _, err := internal.OpenStore(store); err != nil {
+			return err
+		}
+	} else if err := checkInitStore(absPath, store); err != nil {
+		return err
+	} else if !filepath.IsAbs(store) && !strings.HasPrefix(store, "~") {
+		// The config resolves relative stores against the source directory
+		// rather than the directory init runs in
+		absStore, err := filepath.Abs(store)
+		if err != nil {
+			return err
+		}
+		if store, err = filepath.Rel(absPath, absStore); err != nil {
+			return err
+		}
+	}
+
+	if project == "" {
+		project = filepath.Base(absPath)
+		fmt.Printf("Enter project name [%s]: ", project)
+		var input string
+		fmt.Scanln(&input)
+		if input != "" {
+			project = input
+		}
+	}
+
+	if err := os.MkdirAll(backupDir, 0755); err != nil {
+		return err
+	}
+
+	configToml := filepath.Join(backupDir, "config.toml")
+	content := fmt.Sprintf("store = \"%s\"\nname = \"%s\"\n", filepath.ToSlash(store), project)
+	if err := os.WriteFile(configToml, []byte(content), 0644); err != nil {
+		return fmt.Errorf("failed to write config.toml: %w", err)
+	}
+
+	fmt.Printf("Initialized backup source at %s (project: %s)\n", absPath, project)
+	if err := ensureSourceReadme(backupDir); err != nil {
+		fmt.Printf("Warning: Failed to create README: %v\n", err)
+	}
+	return nil
+}
+
+// checkInitStore checks that the local store of a new source directory at
+// absPath exists, offering to create it, and does not overlap the source.
+func checkInitStore(absPath, store string) error {
 	// 1. Expand and Abs store path
 	expandedStore, err := internal.ExpandPath(store)
 	if err != nil {
 		return fmt.Errorf("invalid store path: %w", err)
 	}
-	absStore, err := filepath.Abs(expandedStore)
+	absStore, err := internal.CanonicalPath(expandedStore)
 	if err != nil {
 		return fmt.Errorf("failed to get absolute path for store: %w", err)
 	}
 
-	// 2. Overlap Check
+	// 2. Overlap Check, also through symlinks
+	if absPath, err = internal.CanonicalPath(absPath); err != nil {
+		return err
+	}
 	relToStore, err1 := filepath.Rel(absStore, absPath)
 	relToSource, err2 := filepath.Rel(absPath, absStore)
 	if (err1 == nil && !strings.HasPrefix(relToStore, "..") && relToStore != "..") ||
@@ -737,7 +2799,7 @@ func runInit(path, store, project string) error {
 		var response string
 		fmt.Scanln(&response)
 		if response == "y" || response == "Y" || response == "yes" {
-			if err := runInitStore(absStore); err != nil {
+			if err := runInitStore(absStore, internal.DefaultHashAlgorithm, internal.DefaultCompression, internal.DefaultShardWidth, internal.DefaultShardDepth, false, false, false); err != nil {
 				return fmt.Errorf("failed to initialize store: %w", err)
 			}
 		} else {
@@ -750,31 +2812,6 @@ func runInit(path, store, project string) error {
 	if _, err := os.Stat(storeToml); os.IsNotExist(err) {
 		return fmt.Errorf("directory %s is not a valid backup store (missing .backup/store.toml)", absStore)
 	}
-
-	if project == "" {
-		project = filepath.Base(absPath)
-		fmt.Printf("Enter project name [%s]: ", project)
-		var input string
-		fmt.Scanln(&input)
-		if input != "" {
-			project = input
-		}
-	}
-
-	if err := os.MkdirAll(backupDir, 0755); err != nil {
-		return err
-	}
-
-	configToml := filepath.Join(backupDir, "config.toml")
-	content := fmt.Sprintf("store = \"%s\"\nname = \"%s\"\n", filepath.ToSlash(store), project)
-	if err := os.WriteFile(configToml, []byte(content), 0644); err != nil {
-		return fmt.Errorf("failed to write config.toml: %w", err)
-	}
-
-	fmt.Printf("Initialized backup source at %s (project: %s)\n", absPath, project)
-	if err := ensureSourceReadme(backupDir); err != nil {
-		fmt.Printf("Warning: Failed to create README: %v\n", err)
-	}
 	return nil
 }
 
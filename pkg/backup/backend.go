@@ -0,0 +1,42 @@
+// Package backup is the public interface of the backup tool for programs
+// embedding it: to make backups without the command line (see NewBackup
+// and Backup.CreateSnapshot) and to keep stores at URLs of further schemes
+// (see RegisterBackend).
+package backup
+
+import (
+	"github.com/djabi/backup/internal"
+)
+
+// Backend opens the parts of stores kept at URLs of one scheme. A store at
+// a URL has the layout of a local store: blobs in data/, snapshot heads in
+// snapshots/, and its configuration, lock and record of unreferenced blobs
+// in .backup/.
+type Backend = internal.Backend
+
+// Blobstore holds the blobs of a store. Store.BlobName gives the name of a
+// blob in the store's layout.
+type Blobstore = internal.Blobstore
+
+// RefStore holds the snapshot heads and their metadata sidecars.
+type RefStore = internal.RefStore
+
+// StateFiles holds the files of a store's .backup directory shared by all
+// hosts using the store.
+type StateFiles = internal.StateFiles
+
+// Store describes the layout and encoding of a store's blobs.
+type Store = internal.Store
+
+// RegisterBackend makes backend available for store URLs of scheme, as
+// given to --store, the store setting of config.toml, and the data and
+// snapshots settings of store.toml. It is meant to be called from init
+// functions and panics if the scheme is registered twice.
+func RegisterBackend(scheme string, backend Backend) {
+	internal.RegisterBackend(scheme, backend)
+}
+
+// Backends returns the registered URL schemes.
+func Backends() []string {
+	return internal.Backends()
+}
@@ -0,0 +1,43 @@
+package backup
+
+import (
+	"errors"
+	"net/url"
+	"slices"
+	"testing"
+)
+
+// offlineBackend is a backend whose stores are never reachable.
+type offlineBackend struct{}
+
+var errOffline = errors.New("offline")
+
+func (offlineBackend) OpenBlobstore(s *Store, u *url.URL) (Blobstore, error) {
+	return nil, errOffline
+}
+
+func (offlineBackend) OpenRefStore(u *url.URL) (RefStore, error) {
+	return nil, errOffline
+}
+
+func (offlineBackend) OpenStateFiles(u *url.URL) (StateFiles, error) {
+	return nil, errOffline
+}
+
+func (offlineBackend) ReadFile(u *url.URL) ([]byte, error) {
+	return nil, errOffline
+}
+
+func TestRegisterBackend(t *testing.T) {
+	RegisterBackend("Offline", offlineBackend{})
+	if schemes := Backends(); !slices.Contains(schemes, "offline") || !slices.Contains(schemes, "file") {
+		t.Errorf("Expected the offline and file schemes, got %v", schemes)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected registering a scheme twice to panic")
+		}
+	}()
+	RegisterBackend("offline", offlineBackend{})
+}
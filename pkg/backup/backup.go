@@ -0,0 +1,42 @@
+package backup
+
+import (
+	"log/slog"
+
+	"github.com/djabi/backup/internal"
+)
+
+// Backup is a source directory, the project it is backed up as and the
+// store it is backed up to, with the settings of the backups.
+type Backup = internal.Backup
+
+// BackupRoot is a snapshot of a project.
+type BackupRoot = internal.BackupRoot
+
+// BackupStats counts the work done by a backup.
+type BackupStats = internal.BackupStats
+
+// FailedFile is a file left out of a backup because it could not be read.
+type FailedFile = internal.FailedFile
+
+// NewBackup opens the source directory containing startDir, as the
+// command line does when run there, with the store of its config.toml or
+// storeDir if that is not empty. A store without store.toml gets one if
+// assumeYes is set; otherwise the user is asked when stdin is a terminal,
+// and the store is refused when it is not.
+//
+// Backups are then made with CreateSnapshot, which saves the new content,
+// writes the snapshot head and saves the hash cache, as the create command
+// does.
+func NewBackup(startDir, storeDir string, assumeYes bool) (*Backup, error) {
+	return internal.NewBackup(startDir, storeDir, assumeYes)
+}
+
+// ConsoleHandler is the slog handler of the command line.
+type ConsoleHandler = internal.ConsoleHandler
+
+// NewConsoleHandler returns a ConsoleHandler printing messages of at least
+// level, for Backup.Logger.
+func NewConsoleHandler(level slog.Leveler) *ConsoleHandler {
+	return internal.NewConsoleHandler(level)
+}
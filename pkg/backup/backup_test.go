@@ -0,0 +1,49 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateSnapshot(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	storeDir := t.TempDir()
+	if _, err := NewBackup(t.TempDir(), storeDir, true); err != nil {
+		t.Fatal(err)
+	}
+
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, ".backup"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	config := "store = \"" + filepath.ToSlash(storeDir) + "\"\nname = \"embedded\"\n"
+	if err := os.WriteFile(filepath.Join(src, ".backup", "config.toml"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewBackup(src, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Unlock()
+	root, stats, err := b.CreateSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root == nil || root.Project() != "embedded" {
+		t.Fatalf("Expected a snapshot of project embedded, got %v", root)
+	}
+	if stats.FilesArchived != 1 {
+		t.Errorf("Expected 1 archived file, got %+v", stats)
+	}
+	if _, err := os.Stat(filepath.Join(storeDir, "snapshots", "embedded", root.Timestamp())); err != nil {
+		t.Errorf("Expected the snapshot head in the store: %v", err)
+	}
+}